@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/urfave/cli"
 )
 
@@ -11,6 +13,26 @@ type config struct {
 	JenkinsUser     string
 	JenkinsToken    string
 	JenkinsAddress  string
+	Provider        string
+	DockerHost      string
+	DockerLogPath   string
+	ArtifactPath    string
+	CachePath       string
+	//total size of caches in bytes, 0 means no limit
+	CacheMaxSize    int64
+	CacheMaxAge     time.Duration
+	SimStepDuration time.Duration
+	StoreType       string
+	StorePath       string
+	CollectInterval time.Duration
+	//activities running at the same time, 0 means no limit
+	MaxConcurrentRuns int
+	//size of a workspace archive uploaded by a step in bytes, 0 means no limit
+	MaxUploadSize int64
+	//master keys for secrets at rest
+	EncryptionKey     string
+	EncryptionKeyFile string
+	EncryptionOldKeys []string
 }
 
 var Config config
@@ -22,4 +44,20 @@ func Parse(context *cli.Context) {
 	Config.CattleUrl = context.String("cattle_url")
 	Config.CattleAccessKey = context.String("cattle_access_key")
 	Config.CattleSecretKey = context.String("cattle_secret_key")
+	Config.Provider = context.String("provider")
+	Config.DockerHost = context.String("docker_host")
+	Config.DockerLogPath = context.String("docker_log_path")
+	Config.ArtifactPath = context.String("artifact_path")
+	Config.CachePath = context.String("cache_path")
+	Config.CacheMaxSize = context.Int64("cache_max_size") * 1024 * 1024
+	Config.CacheMaxAge = context.Duration("cache_max_age")
+	Config.MaxUploadSize = context.Int64("max_upload_size") * 1024 * 1024
+	Config.SimStepDuration = context.Duration("sim_step_duration")
+	Config.StoreType = context.String("store")
+	Config.StorePath = context.String("store_path")
+	Config.CollectInterval = context.Duration("collect_interval")
+	Config.MaxConcurrentRuns = context.Int("max_concurrent_runs")
+	Config.EncryptionKey = context.String("encryption_key")
+	Config.EncryptionKeyFile = context.String("encryption_key_file")
+	Config.EncryptionOldKeys = context.StringSlice("encryption_old_key")
 }
@@ -0,0 +1,252 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//encrypted values are formatted as 'enc:v1:<key id>:<wrapped data key>:<ciphertext>'
+const prefix = "enc:v1:"
+
+var ErrKeyNotFound = errors.New("master key to decrypt the value is not found")
+var ErrMalformed = errors.New("malformed encrypted value")
+
+//masterKey wraps the per value data keys
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+type keyring struct {
+	primary *masterKey
+	keys    map[string]*masterKey
+}
+
+var ring *keyring
+
+//Init sets the master keys. The primary key is given directly or by the first line of key file,
+//the other lines of key file and oldKeys are former keys kept for decryption during rotation.
+//Encryption is disabled without a primary key
+func Init(key string, keyFile string, oldKeys []string) error {
+	if key == "" && keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return errors.Wrap(err, "fail to read encryption key file")
+		}
+		lines := []string{}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) > 0 {
+			key = lines[0]
+			oldKeys = append(oldKeys, lines[1:]...)
+		}
+	}
+	if key == "" {
+		ring = nil
+		return nil
+	}
+	r := &keyring{keys: map[string]*masterKey{}}
+	for _, k := range append([]string{key}, oldKeys...) {
+		if k == "" {
+			continue
+		}
+		mk, err := newMasterKey(k)
+		if err != nil {
+			return err
+		}
+		if r.primary == nil {
+			r.primary = mk
+		}
+		r.keys[mk.id] = mk
+	}
+	ring = r
+	return nil
+}
+
+//Enabled tells whether a master key is set
+func Enabled() bool {
+	return ring != nil
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+//Encrypt encrypts the value with a new data key wrapped by the primary master key.
+//Empty or encrypted values are returned as is, so are all values if encryption is disabled
+func Encrypt(value string) (string, error) {
+	if ring == nil || value == "" || IsEncrypted(value) {
+		return value, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataAEAD, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(ring.primary.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return format(ring.primary.id, wrapped, ciphertext), nil
+}
+
+//Decrypt returns the plain text of an encrypted value, values not encrypted are returned as is
+func Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	keyId, wrapped, ciphertext, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := unwrap(keyId, wrapped)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(dataAEAD, ciphertext)
+	if err != nil {
+		return "", errors.Wrap(err, "fail to decrypt value")
+	}
+	return string(plain), nil
+}
+
+//NeedsRotation tells whether the value is in plain text or wrapped by a former master key
+func NeedsRotation(value string) bool {
+	if ring == nil || value == "" {
+		return false
+	}
+	if !IsEncrypted(value) {
+		return true
+	}
+	keyId, _, _, err := parse(value)
+	return err == nil && keyId != ring.primary.id
+}
+
+//Rotate encrypts a plain value, or rewraps the data key of an encrypted value with the primary master key
+func Rotate(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return Encrypt(value)
+	}
+	if ring == nil {
+		return "", ErrKeyNotFound
+	}
+	keyId, wrapped, ciphertext, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+	if keyId == ring.primary.id {
+		return value, nil
+	}
+	dataKey, err := unwrap(keyId, wrapped)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err = seal(ring.primary.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return format(ring.primary.id, wrapped, ciphertext), nil
+}
+
+//newMasterKey uses a base64 encoded 32 bytes key directly, other strings are hashed to a key
+func newMasterKey(key string) (*masterKey, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != 32 {
+		sum := sha256.Sum256([]byte(key))
+		b = sum[:]
+	}
+	aead, err := newAEAD(b)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return &masterKey{
+		id:   hex.EncodeToString(sum[:])[:8],
+		aead: aead,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func unwrap(keyId string, wrapped []byte) ([]byte, error) {
+	if ring == nil {
+		return nil, ErrKeyNotFound
+	}
+	mk, ok := ring.keys[keyId]
+	if !ok {
+		return nil, errors.Wrapf(ErrKeyNotFound, "key id '%s'", keyId)
+	}
+	dataKey, err := open(mk.aead, wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to unwrap data key")
+	}
+	return dataKey, nil
+}
+
+//seal returns nonce followed by the ciphertext
+func seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+func format(keyId string, wrapped []byte, ciphertext []byte) string {
+	return fmt.Sprintf("%s%s:%s:%s", prefix, keyId,
+		base64.RawURLEncoding.EncodeToString(wrapped),
+		base64.RawURLEncoding.EncodeToString(ciphertext))
+}
+
+func parse(value string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, ErrMalformed
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrMalformed
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, ErrMalformed
+	}
+	return parts[0], wrapped, ciphertext, nil
+}
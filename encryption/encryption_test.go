@@ -0,0 +1,157 @@
+package encryption_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/encryption"
+)
+
+func initKeys(t *testing.T, key string) {
+	if err := encryption.Init(key, "", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		//plain tells whether the value is kept as is
+		plain bool
+	}{
+		{name: "passphrase key", key: "passphrase", value: "ghp_token"},
+		{name: "base64 key", key: "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", value: "client-secret ñ"},
+		{name: "empty value", key: "passphrase", value: "", plain: true},
+		{name: "disabled", key: "", value: "ghp_token", plain: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initKeys(t, tt.key)
+			encrypted, err := encryption.Encrypt(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.plain != (encrypted == tt.value) || tt.plain == encryption.IsEncrypted(encrypted) {
+				t.Fatalf("got %q of value %q", encrypted, tt.value)
+			}
+			if again, _ := encryption.Encrypt(encrypted); again != encrypted {
+				t.Errorf("encrypted value is encrypted twice")
+			}
+			decrypted, err := encryption.Decrypt(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decrypted != tt.value {
+				t.Errorf("got %q, expect %q", decrypted, tt.value)
+			}
+		})
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	initKeys(t, "passphrase")
+	encrypted, err := encryption.Encrypt("ghp_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//change a character of the ciphertext, the last one may only hold padding bits
+	i := len(encrypted) - 8
+	flipped := "A"
+	if encrypted[i:i+1] == "A" {
+		flipped = "B"
+	}
+	tests := []struct {
+		name  string
+		value string
+		key   string
+		err   error
+	}{
+		{name: "malformed", value: "enc:v1:abc", key: "passphrase", err: encryption.ErrMalformed},
+		{name: "tampered", value: encrypted[:i] + flipped + encrypted[i+1:], key: "passphrase"},
+		{name: "unknown key", value: encrypted, key: "other", err: encryption.ErrKeyNotFound},
+		{name: "disabled", value: encrypted, key: "", err: encryption.ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initKeys(t, tt.key)
+			_, err := encryption.Decrypt(tt.value)
+			if err == nil {
+				t.Fatal("decrypted an invalid value")
+			}
+			if tt.err != nil && errors.Cause(err) != tt.err {
+				t.Errorf("got error %v, expect %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	initKeys(t, "old")
+	old, err := encryption.Encrypt("ghp_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the new primary key keeps the old one for decryption
+	dir, err := ioutil.TempDir("", "pipeline-encryption-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keyFile, []byte("new\n\n old \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := encryption.Init("", keyFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		value  string
+		rotate bool
+	}{
+		{name: "plain value", value: "ghp_token", rotate: true},
+		{name: "former key", value: old, rotate: true},
+		{name: "empty value", value: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if encryption.NeedsRotation(tt.value) != tt.rotate {
+				t.Fatalf("got needs rotation %v, expect %v", !tt.rotate, tt.rotate)
+			}
+			rotated, err := encryption.Rotate(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encryption.NeedsRotation(rotated) {
+				t.Errorf("value needs rotation after rotate")
+			}
+			if tt.value == old && strings.Split(rotated, ":")[3] == strings.Split(old, ":")[3] {
+				t.Errorf("data key is not rewrapped")
+			}
+			if again, _ := encryption.Rotate(rotated); again != rotated {
+				t.Errorf("rotated value is rotated twice")
+			}
+			if tt.value == "" {
+				return
+			}
+			//the rotated value no longer needs the former key
+			initKeys(t, "new")
+			defer encryption.Init("", keyFile, nil)
+			decrypted, err := encryption.Decrypt(rotated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decrypted != "ghp_token" {
+				t.Errorf("got %q, expect ghp_token", decrypted)
+			}
+		})
+	}
+	encryption.Init("", "", nil)
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/rancher/pipeline/config"
+	"github.com/rancher/pipeline/encryption"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/provider/docker"
 	"github.com/rancher/pipeline/provider/jenkins"
+	"github.com/rancher/pipeline/provider/sim"
 	"github.com/rancher/pipeline/server"
+	"github.com/rancher/pipeline/server/service"
+	"github.com/rancher/pipeline/store"
 	"github.com/urfave/cli"
 )
 
@@ -54,6 +62,98 @@ func main() {
 			EnvVar: "CATTLE_SECRET_KEY",
 			Value:  "",
 		},
+		cli.StringFlag{
+			Name:   "store",
+			Usage:  "storage backend of pipeline data, 'rancher' or 'local'",
+			EnvVar: "PIPELINE_STORE",
+			Value:  "rancher",
+		},
+		cli.StringFlag{
+			Name:   "store_path",
+			Usage:  "data directory of the local storage backend",
+			EnvVar: "PIPELINE_STORE_PATH",
+			Value:  "/var/lib/pipeline",
+		},
+		cli.StringFlag{
+			Name:   "provider",
+			Usage:  "provider to run pipelines, 'jenkins', 'docker' or 'sim' to simulate steps",
+			EnvVar: "PIPELINE_PROVIDER",
+			Value:  "jenkins",
+		},
+		cli.StringFlag{
+			Name:   "docker_host",
+			Usage:  "docker engine address of the docker provider",
+			EnvVar: "DOCKER_HOST",
+			Value:  "unix:///var/run/docker.sock",
+		},
+		cli.StringFlag{
+			Name:   "docker_log_path",
+			Usage:  "directory of step logs of the docker provider",
+			EnvVar: "PIPELINE_DOCKER_LOG_PATH",
+			Value:  "/var/lib/pipeline/logs",
+		},
+		cli.StringFlag{
+			Name:   "artifact_path",
+			Usage:  "directory to keep artifacts collected from step workspaces",
+			EnvVar: "PIPELINE_ARTIFACT_PATH",
+			Value:  "/var/lib/pipeline/artifacts",
+		},
+		cli.StringFlag{
+			Name:   "cache_path",
+			Usage:  "directory to keep build caches of pipelines",
+			EnvVar: "PIPELINE_CACHE_PATH",
+			Value:  "/var/lib/pipeline/caches",
+		},
+		cli.Int64Flag{
+			Name:   "cache_max_size",
+			Usage:  "total size of build caches in MB, least recently used caches are evicted beyond it, 0 for no limit",
+			EnvVar: "PIPELINE_CACHE_MAX_SIZE",
+			Value:  10240,
+		},
+		cli.DurationFlag{
+			Name:   "cache_max_age",
+			Usage:  "build caches not used for the duration are evicted, 0 for no limit",
+			EnvVar: "PIPELINE_CACHE_MAX_AGE",
+			Value:  7 * 24 * time.Hour,
+		},
+		cli.Int64Flag{
+			Name:   "max_upload_size",
+			Usage:  "size of artifacts, test reports or caches uploaded by a step in MB, 0 for no limit",
+			EnvVar: "PIPELINE_MAX_UPLOAD_SIZE",
+			Value:  2048,
+		},
+		cli.DurationFlag{
+			Name:   "sim_step_duration",
+			Usage:  "duration of unscripted steps of the sim provider",
+			EnvVar: "PIPELINE_SIM_STEP_DURATION",
+			Value:  2 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:   "collect_interval",
+			Usage:  "interval to remove activities expired by retention policies and evict build caches, 0 to disable",
+			EnvVar: "PIPELINE_COLLECT_INTERVAL",
+			Value:  time.Hour,
+		},
+		cli.IntFlag{
+			Name:   "max_concurrent_runs",
+			Usage:  "activities of all pipelines running at the same time, excess runs are queued, 0 for no limit",
+			EnvVar: "PIPELINE_MAX_CONCURRENT_RUNS",
+		},
+		cli.StringFlag{
+			Name:   "encryption_key",
+			Usage:  "master key to encrypt secrets at rest",
+			EnvVar: "PIPELINE_ENCRYPTION_KEY",
+		},
+		cli.StringFlag{
+			Name:   "encryption_key_file",
+			Usage:  "file of master keys, the first line is the primary key and the others are former keys",
+			EnvVar: "PIPELINE_ENCRYPTION_KEY_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:   "encryption_old_key",
+			Usage:  "former master key to decrypt secrets during key rotation",
+			EnvVar: "PIPELINE_ENCRYPTION_OLD_KEYS",
+		},
 		cli.BoolFlag{
 			Name:   "debug",
 			Usage:  "enable debug mode",
@@ -68,8 +168,32 @@ func checkAndRun(c *cli.Context) (rtnerr error) {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 	config.Parse(c)
-	jenkins.InitJenkins()
-	provider := jenkins.JenkinsProvider{}
+	dataStore, err := store.New(config.Config.StoreType, config.Config.StorePath)
+	if err != nil {
+		return err
+	}
+	service.InitStore(dataStore)
+	if err := service.InitArtifacts(config.Config.ArtifactPath); err != nil {
+		return err
+	}
+	if err := service.InitCaches(config.Config.CachePath, config.Config.CacheMaxSize, config.Config.CacheMaxAge); err != nil {
+		return err
+	}
+	if err := encryption.Init(config.Config.EncryptionKey, config.Config.EncryptionKeyFile, config.Config.EncryptionOldKeys); err != nil {
+		return err
+	}
+	if encryption.Enabled() {
+		//encrypt existing secrets and rewrap those of former keys
+		go func() {
+			if _, err := service.ReencryptSecrets(); err != nil {
+				logrus.Errorf("fail to reencrypt secrets: %v", err)
+			}
+		}()
+	}
+	provider, err := newProvider()
+	if err != nil {
+		return err
+	}
 	errChan := make(chan bool)
 	go server.ListenAndServe(provider, errChan)
 
@@ -77,3 +201,16 @@ func checkAndRun(c *cli.Context) (rtnerr error) {
 	logrus.Info("Going down")
 	return nil
 }
+
+func newProvider() (model.PipelineProvider, error) {
+	switch config.Config.Provider {
+	case "jenkins":
+		return jenkins.NewJenkinsProvider(jenkins.InitJenkins()), nil
+	case "docker":
+		return docker.NewDockerProvider(config.Config.DockerHost, config.Config.DockerLogPath)
+	case "sim":
+		return sim.NewSimProvider(config.Config.SimStepDuration), nil
+	default:
+		return nil, fmt.Errorf("unknown provider '%s'", config.Config.Provider)
+	}
+}
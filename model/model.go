@@ -1,6 +1,7 @@
 package model
 
 import (
+	"io"
 	"net/http"
 
 	"github.com/pkg/errors"
@@ -26,6 +27,8 @@ const (
 	ActivityStepFail     = "Fail"
 	ActivityStepSkip     = "Skipped"
 	ActivityStepAbort    = "Abort"
+	//failed but allowed to fail
+	ActivityStepFailedAllowed = "FailedAllowed"
 
 	ActivityStageWaiting  = "Waiting"
 	ActivityStagePending  = "Pending"
@@ -35,7 +38,10 @@ const (
 	ActivityStageDenied   = "Denied"
 	ActivityStageSkip     = "Skipped"
 	ActivityStageAbort    = "Abort"
+	//a step failed but the failure is allowed
+	ActivityStageFailedAllowed = "FailedAllowed"
 
+	ActivityQueued   = "Queued"
 	ActivityWaiting  = "Waiting"
 	ActivityPending  = "Pending"
 	ActivityBuilding = "Building"
@@ -43,6 +49,15 @@ const (
 	ActivityFail     = "Fail"
 	ActivityDenied   = "Denied"
 	ActivityAbort    = "Abort"
+	//stopped by a newer run of the same branch
+	ActivitySuperseded = "Superseded"
+	//completed with failures allowed
+	ActivitySuccessWithWarnings = "SuccessWithWarnings"
+
+	TestCasePassed  = "passed"
+	TestCaseFailed  = "failed"
+	TestCaseError   = "error"
+	TestCaseSkipped = "skipped"
 )
 
 var ErrPipelineNotFound = errors.New("Pipeline Not found")
@@ -55,31 +70,36 @@ var PreservedEnvs = [...]string{"CICD_GIT_COMMIT", "CICD_GIT_BRANCH",
 
 type PipelineSetting struct {
 	client.Resource
-	Status string `json:"status,omitempty" yaml:"status,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty" yaml:"-"`
+	Status          string `json:"status,omitempty" yaml:"status,omitempty"`
+	//default retention policy of pipelines
+	Retention *RetentionPolicy `json:"retention,omitempty" yaml:"retention,omitempty"`
 }
 
 type SCMSetting struct {
 	client.Resource
-	IsAuth       bool   `json:"isAuth" yaml:"isAuth"`
-	Status       string `json:"status,omitempty" yaml:"status,omitempty"`
-	ScmType      string `json:"scmType,omitempty" yaml:"scmType,omitempty"`
-	HostName     string `json:"hostName,omitempty" yaml:"hostName,omitempty"`
-	Scheme       string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
-	HomePage     string `json:"homepage,omitempty" yaml:"homepage,omitempty"`
-	ClientID     string `json:"clientID,omitempty" yaml:"clientID,omitempty"`
-	ClientSecret string `json:"clientSecret,omitempty" yaml:"clientSecret,omitempty"`
-	RedirectURL  string `json:"redirectURL,omitempty" yaml:"redirectURL,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty" yaml:"-"`
+	IsAuth          bool   `json:"isAuth" yaml:"isAuth"`
+	Status          string `json:"status,omitempty" yaml:"status,omitempty"`
+	ScmType         string `json:"scmType,omitempty" yaml:"scmType,omitempty"`
+	HostName        string `json:"hostName,omitempty" yaml:"hostName,omitempty"`
+	Scheme          string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	HomePage        string `json:"homepage,omitempty" yaml:"homepage,omitempty"`
+	ClientID        string `json:"clientID,omitempty" yaml:"clientID,omitempty"`
+	ClientSecret    string `json:"clientSecret,omitempty" yaml:"clientSecret,omitempty"`
+	RedirectURL     string `json:"redirectURL,omitempty" yaml:"redirectURL,omitempty"`
 }
 
 type Pipeline struct {
 	client.Resource
+	ResourceVersion string `json:"resourceVersion,omitempty" yaml:"-"`
 	PipelineContent
 }
 
 type PipelineContent struct {
 	Name            string `json:"name,omitempty" yaml:"name,omitempty"`
 	IsActivate      bool   `json:"isActivate" yaml:"isActivate"`
-	VersionSequence string `json:"-" yaml:"-"`
+	VersionSequence string `json:"versionSequence,omitempty" yaml:"-"`
 	Status          string `json:"status,omitempty" yaml:"status,omitempty"`
 	RunCount        int    `json:"runCount" yaml:"runCount,omitempty"`
 	LastRunId       string `json:"lastRunId,omitempty" yaml:"lastRunId,omitempty"`
@@ -101,6 +121,69 @@ type PipelineContent struct {
 	CronTrigger   CronTrigger `json:"cronTrigger,omitempty" yaml:"cronTrigger,omitempty"`
 	Stages        []*Stage    `json:"stages,omitempty" yaml:"stages,omitempty"`
 	KeepWorkspace bool        `json:"keepWorkspace,omitempty" yaml:"keepWorkspace,omitempty"`
+	//overrides the global retention policy
+	Retention *RetentionPolicy `json:"retention,omitempty" yaml:"retention,omitempty"`
+	//labels required on the worker node to run
+	NodeLabels []string `json:"nodeLabels,omitempty" yaml:"nodeLabels,omitempty"`
+	//runs exceeding the limit are queued, 0 means no limit
+	MaxConcurrentRuns int `json:"maxConcurrentRuns,omitempty" yaml:"maxConcurrentRuns,omitempty"`
+	//stop older runs of the branch when a webhook triggers a new one
+	CancelSuperseded bool `json:"cancelSuperseded,omitempty" yaml:"cancelSuperseded,omitempty"`
+	//stages always run after the main stages whatever their outcome, for cleanup and notification
+	Finally []*Stage `json:"finally,omitempty" yaml:"finally,omitempty"`
+	//cache of task steps not declaring their own
+	Cache *StepCache `json:"cache,omitempty" yaml:"cache,omitempty"`
+}
+
+//AllStages gets the main stages followed by the finally stages
+func (p *PipelineContent) AllStages() []*Stage {
+	return append(append([]*Stage{}, p.Stages...), p.Finally...)
+}
+
+//RetentionPolicy decides which completed activities are removed by the collector.
+//Zero values mean no limit
+type RetentionPolicy struct {
+	//keep the latest N activities
+	KeepLast int `json:"keepLast,omitempty" yaml:"keepLast,omitempty"`
+	//keep activities started within D days
+	KeepDays int `json:"keepDays,omitempty" yaml:"keepDays,omitempty"`
+	//always keep the last successful activity
+	KeepLastSuccess bool `json:"keepLastSuccess,omitempty" yaml:"keepLastSuccess,omitempty"`
+}
+
+//PipelineRevision is a saved definition of a pipeline
+type PipelineRevision struct {
+	client.Resource
+	PipelineId string `json:"pipelineId,omitempty"`
+	Revision   string `json:"revision,omitempty"`
+	Author     string `json:"author,omitempty"`
+	Created    int64  `json:"created,omitempty"`
+	//reason of the revision, e.g. rollback
+	Message  string          `json:"message,omitempty"`
+	Pipeline PipelineContent `json:"pipeline,omitempty"`
+}
+
+//PipelineDiff is the structured difference between two revisions
+type PipelineDiff struct {
+	client.Resource
+	PipelineId string       `json:"pipelineId,omitempty"`
+	From       string       `json:"from,omitempty"`
+	To         string       `json:"to,omitempty"`
+	Changes    []DiffChange `json:"changes"`
+}
+
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+//DiffChange is a changed field, path is like 'stages[1].steps[0].image'
+type DiffChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
 }
 
 type CronTrigger struct {
@@ -117,6 +200,12 @@ type Stage struct {
 	Conditions *PipelineConditions `json:"conditions,omitempty" yaml:"conditions,omitempty"`
 	Approvers  []string            `json:"approvers,omitempty" yaml:"approvers,omitempty"`
 	Steps      []*Step             `json:"steps,omitempty" yaml:"steps,omitempty"`
+	//labels required on the worker node, stages share the node of the activity
+	NodeLabels []string `json:"nodeLabels,omitempty" yaml:"nodeLabels,omitempty"`
+	//a failed step stops the stage but the activity goes on
+	AllowFailure bool `json:"allowFailure,omitempty" yaml:"allowFailure,omitempty"`
+	//names of stages to wait for, the stage waits for the one before it if not set
+	Needs []string `json:"needs,omitempty" yaml:"needs,omitempty"`
 }
 
 type Step struct {
@@ -124,6 +213,10 @@ type Step struct {
 	Type string `json:"type,omitempty" yaml:"type,omitempty"`
 	//Step timeout in minutes
 	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	//re-run the step on failure
+	Retry *StepRetry `json:"retry,omitempty" yaml:"retry,omitempty"`
+	//failure of the step does not fail the stage
+	AllowFailure bool `json:"allowFailure,omitempty" yaml:"allowFailure,omitempty"`
 	//Condition  string             `json:"condition,omitempty" yaml:"condition,omitempty"`
 	Conditions *PipelineConditions `json:"conditions,omitempty" yaml:"conditions,omitempty"`
 	//---SCM step
@@ -147,6 +240,17 @@ type Step struct {
 	Args        string       `json:"args,omitempty" yaml:"args,omitempty"`
 	Env         []string     `json:"env,omitempty" yaml:"env,omitempty"`
 	Services    []*CIService `json:"services,omitempty" yaml:"services,omitempty"`
+	//files to keep after the step, globs relative to the workspace
+	Artifacts []string `json:"artifacts,omitempty" yaml:"artifacts,omitempty"`
+	//JUnit XML reports written by the step, globs relative to the workspace
+	TestReports []string `json:"testReports,omitempty" yaml:"testReports,omitempty"`
+	//workspace paths restored before the step and saved after it succeeds
+	Cache *StepCache `json:"cache,omitempty" yaml:"cache,omitempty"`
+	//run the task step once for each combination of axis values
+	Matrix *StepMatrix `json:"matrix,omitempty" yaml:"matrix,omitempty"`
+	//set on steps expanded from a matrix step in an activity
+	MatrixStep   int               `json:"matrixStep,omitempty" yaml:"-"`
+	MatrixValues map[string]string `json:"matrixValues,omitempty" yaml:"-"`
 
 	//---upgradeService step
 	ImageTag        string            `json:"imageTag,omitempty" yaml:"imageTag,omitempty"`
@@ -172,13 +276,45 @@ type Step struct {
 	Answers    string            `json:"answerString,omitempty" yaml:"answerString,omitempty"`
 }
 
+//StepRetry re-runs a failed step on the same node and workspace before the step fails
+type StepRetry struct {
+	//max times to retry
+	Count int `json:"count,omitempty" yaml:"count,omitempty"`
+	//seconds to wait before the first retry
+	Delay int `json:"delay,omitempty" yaml:"delay,omitempty"`
+	//multiplier of the delay for each further retry, 1 if not set
+	Backoff float64 `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+}
+
+//StepMatrix expands a task step into steps running in parallel, each gets
+//the values of a combination as env vars
+type StepMatrix struct {
+	//env var names and their values to combine
+	Axes map[string][]string `json:"axes,omitempty" yaml:"axes,omitempty"`
+	//max steps of the matrix to run at the same time, no limit if not set
+	MaxParallel int `json:"maxParallel,omitempty" yaml:"maxParallel,omitempty"`
+	//fail the activity on the first failed step instead of running through the matrix
+	FailFast bool `json:"failFast,omitempty" yaml:"failFast,omitempty"`
+}
+
+//StepCache keeps workspace paths across activities of the pipeline
+type StepCache struct {
+	//key template, ${VAR} is replaced by env vars and {{ checksum "file" }} by sha256 of the workspace file
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+	//paths or globs relative to the workspace
+	Paths []string `json:"paths,omitempty" yaml:"paths,omitempty"`
+}
+
 type PipelineConditions struct {
 	All []string `json:"all,omitempty" yaml:"all,omitempty"`
 	Any []string `json:"any,omitempty" yaml:"any,omitempty"`
+	//condition expression like 'CICD_GIT_BRANCH == "master" && changed("src/**")', it has to hold along with all or any
+	Expression string `json:"expression,omitempty" yaml:"expression,omitempty"`
 }
 
 type Activity struct {
 	client.Resource
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
 	Id              string            `json:"id,omitempty"`
 	Pipeline        Pipeline          `json:"pipelineSource,omitempty"`
 	PipelineName    string            `json:"pipelineName,omitempty"`
@@ -191,9 +327,82 @@ type Activity struct {
 	StartTS         int64             `json:"start_ts,omitempty"`
 	StopTS          int64             `json:"stop_ts,omitempty"`
 	NodeName        string            `json:"nodename,omitempty"`
+	NodeReason      string            `json:"nodeReason,omitempty"`
+	SupersededBy    string            `json:"supersededBy,omitempty"`
+	ResumeFrom      *ResumePoint      `json:"resumeFrom,omitempty"`
+	MainStatus      string            `json:"mainStatus,omitempty"`
+	FinallyStatus   string            `json:"finallyStatus,omitempty"`
 	ActivityStages  []*ActivityStage  `json:"activity_stages,omitempty"`
 	EnvVars         map[string]string `json:"envVars,omitempty"`
 	TriggerType     string            `json:"triggerType,omitempty"`
+	Artifacts       []*Artifact       `json:"artifacts,omitempty"`
+	//files changed by the commit as reported by the SCM step, nil if unknown
+	ChangedFiles []string `json:"changedFiles"`
+}
+
+//Artifact is a file collected from the workspace after a step, kept by the server
+type Artifact struct {
+	client.Resource
+	//path relative to the workspace
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum,omitempty"`
+	StageOrdinal int    `json:"stageOrdinal"`
+	StepOrdinal  int    `json:"stepOrdinal"`
+	Created      int64  `json:"created,omitempty"`
+}
+
+//Cache is an archive of workspace paths saved for a pipeline
+type Cache struct {
+	client.Resource
+	PipelineId string `json:"pipelineId"`
+	Key        string `json:"key"`
+	Size       int64  `json:"size"`
+	LastUsed   int64  `json:"lastUsed,omitempty"`
+}
+
+//Secret is a named value kept encrypted, steps reference it in env as ${secret:name}.
+//It belongs to the pipeline, or to the environment if no pipeline is set
+type Secret struct {
+	client.Resource
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	Id              string `json:"id,omitempty"`
+	Name            string `json:"name"`
+	PipelineId      string `json:"pipelineId,omitempty"`
+	//set on create and update, never returned
+	Value   string `json:"value,omitempty"`
+	Created int64  `json:"created,omitempty"`
+	Updated int64  `json:"updated,omitempty"`
+}
+
+//ResumePoint is the step to resume an activity from, it is set while
+//former steps run again to restore the workspace and services
+type ResumePoint struct {
+	StageOrdinal int `json:"stageOrdinal"`
+	StepOrdinal  int `json:"stepOrdinal"`
+}
+
+//ActivitySummary is the compact form of activity without the pipeline definition
+type ActivitySummary struct {
+	client.Resource
+	Id              string           `json:"id,omitempty"`
+	PipelineId      string           `json:"pipelineId,omitempty"`
+	PipelineName    string           `json:"pipelineName,omitempty"`
+	PipelineVersion string           `json:"pipelineVersion,omitempty"`
+	RunSequence     int              `json:"runSequence,omitempty"`
+	CommitInfo      string           `json:"commitInfo,omitempty"`
+	Branch          string           `json:"branch,omitempty"`
+	Status          string           `json:"status,omitempty"`
+	FailMessage     string           `json:"failMessage,omitempty"`
+	PendingStage    int              `json:"pendingStage,omitempty"`
+	StartTS         int64            `json:"start_ts,omitempty"`
+	StopTS          int64            `json:"stop_ts,omitempty"`
+	NodeName        string           `json:"nodename,omitempty"`
+	NodeReason      string           `json:"nodeReason,omitempty"`
+	SupersededBy    string           `json:"supersededBy,omitempty"`
+	FinallyStatus   string           `json:"finallyStatus,omitempty"`
+	ActivityStages  []*ActivityStage `json:"activity_stages,omitempty"`
+	TriggerType     string           `json:"triggerType,omitempty"`
 }
 
 type ActivityStage struct {
@@ -206,6 +415,8 @@ type ActivityStage struct {
 	Duration      int64           `json:"duration,omitempty"`
 	Status        string          `json:"status,omitempty"`
 	RawOutput     string          `json:"rawOutput,omitempty"`
+	Finally       bool            `json:"finally,omitempty"`
+	Needs         []string        `json:"needs,omitempty"`
 }
 
 type ActivityStep struct {
@@ -214,6 +425,60 @@ type ActivityStep struct {
 	Status   string `json:"status,omitempty"`
 	StartTS  int64  `json:"start_ts,omitempty"`
 	Duration int64  `json:"duration,omitempty"`
+	//failed attempts before the current one
+	Attempts []*StepAttempt `json:"attempts,omitempty"`
+	//ordinal from 1 of the matrix step in the stage definition it expands from,
+	//steps of a matrix are grouped under it
+	MatrixStep   int               `json:"matrixStep,omitempty"`
+	MatrixValues map[string]string `json:"matrixValues,omitempty"`
+	//counts of test reports collected after the step
+	Tests *TestSummary `json:"tests,omitempty"`
+	//values the step wrote to its output file
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+//TestSummary counts test cases of the reports of a step
+type TestSummary struct {
+	Total    int `json:"total"`
+	Failures int `json:"failures"`
+	Errors   int `json:"errors"`
+	Skipped  int `json:"skipped"`
+	//sum of test case durations in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+//TestReport keeps test cases parsed from reports of a step
+type TestReport struct {
+	client.Resource
+	ActivityId   string      `json:"activityId"`
+	StageOrdinal int         `json:"stageOrdinal"`
+	StepOrdinal  int         `json:"stepOrdinal"`
+	Summary      TestSummary `json:"summary"`
+	Cases        []*TestCase `json:"cases"`
+}
+
+//TestCase is the result of a test case in a report
+type TestCase struct {
+	client.Resource
+	StageOrdinal int    `json:"stageOrdinal"`
+	StepOrdinal  int    `json:"stepOrdinal"`
+	File         string `json:"file,omitempty"`
+	Suite        string `json:"suite,omitempty"`
+	ClassName    string `json:"className,omitempty"`
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	Duration     int64  `json:"duration"`
+	Message      string `json:"message,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+}
+
+//StepAttempt is a failed run of a retried step
+type StepAttempt struct {
+	Attempt  int    `json:"attempt,omitempty"`
+	Status   string `json:"status,omitempty"`
+	StartTS  int64  `json:"start_ts,omitempty"`
+	Duration int64  `json:"duration,omitempty"`
+	Log      string `json:"log,omitempty"`
 }
 
 type CIService struct {
@@ -225,7 +490,8 @@ type CIService struct {
 }
 
 func (activity *Activity) CanApprove(userId string) bool {
-	if activity.Status == ActivityPending && len(activity.Pipeline.Stages) > activity.PendingStage {
+	if len(activity.ActivityStages) > activity.PendingStage &&
+		activity.ActivityStages[activity.PendingStage].Status == ActivityStagePending {
 		approvers := activity.Pipeline.Stages[activity.PendingStage].Approvers
 		if len(approvers) == 0 {
 			//no approver limit
@@ -243,17 +509,35 @@ func (activity *Activity) CanApprove(userId string) bool {
 type PipelineProvider interface {
 	RunPipeline(*Pipeline, string) (*Activity, error)
 	RerunActivity(*Activity) error
+	ResumeActivity(*Activity, int, int) error
 	RunStage(*Activity, int) error
 	RunStep(*Activity, int, int) error
 	StopActivity(*Activity) error
 	SyncActivity(*Activity) error
 	GetStepLog(*Activity, int, int, map[string]interface{}) (string, error)
 	OnActivityCompelte(*Activity)
+	OnDeleteActivity(*Activity) error
 	OnCreateAccount(*GitAccount) error
 	OnDeleteAccount(*GitAccount) error
 	Reset() error
 }
 
+//StepEventListener handles step transitions reported by providers
+type StepEventListener interface {
+	OnStepStart(activityId string, stageOrdinal int, stepOrdinal int) error
+	//outputs are KEY=VALUE lines the step wrote to its output file,
+	//changedFiles are files changed by the commit reported by the SCM step, nil if unknown
+	OnStepFinish(activityId string, stageOrdinal int, stepOrdinal int, status string, commit string, outputs string, changedFiles []string) error
+	//archive is a tar stream of files in the workspace, leading path components are stripped
+	OnStepArtifacts(activityId string, stageOrdinal int, stepOrdinal int, archive io.Reader, strip int) error
+	OnStepTestReports(activityId string, stageOrdinal int, stepOrdinal int, archive io.Reader, strip int) error
+}
+
+//StepEventEmitter is implemented by providers reporting step transitions in process
+type StepEventEmitter interface {
+	SetStepEventListener(StepEventListener)
+}
+
 //scm stands for Source Code Manager
 type SCManager interface {
 	GetType() string
@@ -268,6 +552,7 @@ type SCManager interface {
 
 type GitAccount struct {
 	client.Resource
+	ResourceVersion string `json:"resourceVersion,omitempty"`
 	//private or shared across environment
 	Private       bool   `json:"private,omitempty"`
 	AccountType   string `json:"accountType,omitempty"`
@@ -1,7 +1,10 @@
 package model
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
@@ -14,6 +17,12 @@ func NewSchema() *client.Schemas {
 	schemas.AddType("schema", client.Schema{})
 	pipelineSchema(schemas.AddType("pipeline", Pipeline{}))
 	acitvitySchema(schemas.AddType("activity", Activity{}))
+	revisionSchema(schemas.AddType("pipelineRevision", PipelineRevision{}))
+	schemas.AddType("pipelineDiff", PipelineDiff{})
+	schemas.AddType("artifact", Artifact{})
+	schemas.AddType("cache", Cache{})
+	schemas.AddType("testCase", TestCase{})
+	secretSchema(schemas.AddType("secret", Secret{}))
 	pipelineSettingSchema(schemas.AddType("setting", PipelineSetting{}))
 	scmSettingSchema(schemas.AddType("scmSetting", SCMSetting{}))
 	accountSchema(schemas.AddType("gitaccount", GitAccount{}))
@@ -70,10 +79,17 @@ func pipelineSchema(pipeline *client.Schema) {
 		"export": client.Action{
 			Output: "pipeline",
 		},
+		"rollback": client.Action{
+			Output: "pipeline",
+		},
 	}
 
 	pipeline.CollectionMethods = []string{http.MethodGet, http.MethodPost}
-	pipeline.IncludeableLinks = []string{"activities"}
+	pipeline.IncludeableLinks = []string{"activities", "revisions"}
+}
+
+func revisionSchema(revision *client.Schema) {
+	revision.CollectionMethods = []string{http.MethodGet}
 }
 
 func acitvitySchema(activity *client.Schema) {
@@ -84,6 +100,12 @@ func acitvitySchema(activity *client.Schema) {
 		"rerun": client.Action{
 			Output: "activity",
 		},
+		"resume": client.Action{
+			Output: "activity",
+		},
+		"rerunFrom": client.Action{
+			Output: "activity",
+		},
 		"update": client.Action{
 			Output: "activity",
 		},
@@ -108,6 +130,7 @@ func pipelineSettingSchema(setting *client.Schema) {
 		"update": client.Action{
 			Output: "setting",
 		},
+		"reencrypt": client.Action{},
 	}
 }
 
@@ -132,6 +155,18 @@ func accountSchema(account *client.Schema) {
 	}
 }
 
+func secretSchema(secret *client.Schema) {
+	secret.CollectionMethods = []string{http.MethodGet, http.MethodPost}
+	secret.ResourceActions = map[string]client.Action{
+		"update": client.Action{
+			Output: "secret",
+		},
+		"remove": client.Action{
+			Output: "secret",
+		},
+	}
+}
+
 func repositorySchema(repository *client.Schema) {
 	repository.CollectionMethods = []string{http.MethodGet, http.MethodPost}
 	repository.PluralName = "gitrepositories"
@@ -158,13 +193,90 @@ func ToPipelineResource(apiContext *api.ApiContext, pipeline *Pipeline) *Pipelin
 	pipeline.Actions["activate"] = apiContext.UrlBuilder.ReferenceLink(pipeline.Resource) + "?action=activate"
 	pipeline.Actions["deactivate"] = apiContext.UrlBuilder.ReferenceLink(pipeline.Resource) + "?action=deactivate"
 	pipeline.Actions["export"] = apiContext.UrlBuilder.ReferenceLink(pipeline.Resource) + "?action=export"
+	pipeline.Actions["rollback"] = apiContext.UrlBuilder.ReferenceLink(pipeline.Resource) + "?action=rollback"
 
 	pipeline.Links["activities"] = apiContext.UrlBuilder.Link(pipeline.Resource, "activities")
 	pipeline.Links["exportConfig"] = apiContext.UrlBuilder.Link(pipeline.Resource, "exportConfig")
+	pipeline.Links["revisions"] = apiContext.UrlBuilder.Link(pipeline.Resource, "revisions")
+	pipeline.Links["diff"] = apiContext.UrlBuilder.Link(pipeline.Resource, "diff")
+	pipeline.Links["caches"] = apiContext.UrlBuilder.Link(pipeline.Resource, "caches")
+	pipeline.Links["secrets"] = apiContext.UrlBuilder.Link(pipeline.Resource, "secrets")
 	FilterPipeline(pipeline)
 	return pipeline
 }
 
+func ToPipelineRevisionResource(apiContext *api.ApiContext, revision *PipelineRevision) *PipelineRevision {
+	revision.Resource = client.Resource{
+		Id:      revision.Revision,
+		Type:    "pipelineRevision",
+		Actions: map[string]string{},
+		Links:   map[string]string{},
+	}
+	pipelineLink := apiContext.UrlBuilder.ReferenceByIdLink("pipeline", revision.PipelineId)
+	revision.Links["self"] = pipelineLink + "/revisions/" + revision.Revision
+	revision.Links["pipeline"] = pipelineLink
+	revision.Actions["rollback"] = pipelineLink + "?action=rollback&revision=" + revision.Revision
+	for _, stage := range revision.Pipeline.AllStages() {
+		for _, step := range stage.Steps {
+			step.Secretkey = ""
+		}
+	}
+	return revision
+}
+
+func ToPipelineDiffResource(apiContext *api.ApiContext, diff *PipelineDiff) *PipelineDiff {
+	diff.Resource = client.Resource{
+		Type:  "pipelineDiff",
+		Links: map[string]string{},
+	}
+	diff.Links["self"] = apiContext.UrlBuilder.Current()
+	return diff
+}
+
+//ToArtifactResource sets the link to download the artifact of the activity
+func ToArtifactResource(apiContext *api.ApiContext, activityId string, artifact *Artifact) *Artifact {
+	artifact.Resource = client.Resource{
+		Id:    artifact.Name,
+		Type:  "artifact",
+		Links: map[string]string{},
+	}
+	segments := strings.Split(artifact.Name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	activityLink := apiContext.UrlBuilder.ReferenceByIdLink("activity", activityId)
+	artifact.Links["self"] = activityLink + "/artifacts/" + strings.Join(segments, "/")
+	artifact.Links["download"] = artifact.Links["self"]
+	artifact.Links["activity"] = activityLink
+	return artifact
+}
+
+//ToCacheResource sets the link to purge the cache of the pipeline
+func ToCacheResource(apiContext *api.ApiContext, cache *Cache) *Cache {
+	cache.Resource = client.Resource{
+		Id:    cache.Key,
+		Type:  "cache",
+		Links: map[string]string{},
+	}
+	pipelineLink := apiContext.UrlBuilder.ReferenceByIdLink("pipeline", cache.PipelineId)
+	cache.Links["self"] = pipelineLink + "/caches/" + url.PathEscape(cache.Key)
+	cache.Links["pipeline"] = pipelineLink
+	return cache
+}
+
+//ToTestCaseResource sets links to the activity and the test cases of its step
+func ToTestCaseResource(apiContext *api.ApiContext, activityId string, index int, testCase *TestCase) *TestCase {
+	testCase.Resource = client.Resource{
+		Id:    fmt.Sprintf("%d-%d-%d", testCase.StageOrdinal, testCase.StepOrdinal, index),
+		Type:  "testCase",
+		Links: map[string]string{},
+	}
+	activityLink := apiContext.UrlBuilder.ReferenceByIdLink("activity", activityId)
+	testCase.Links["self"] = fmt.Sprintf("%s/tests?stageOrdinal=%d&stepOrdinal=%d", activityLink, testCase.StageOrdinal, testCase.StepOrdinal)
+	testCase.Links["activity"] = activityLink
+	return testCase
+}
+
 func ToActivityResource(apiContext *api.ApiContext, a *Activity) *Activity {
 	a.Resource = client.Resource{
 		Id:      a.Id,
@@ -175,18 +287,55 @@ func ToActivityResource(apiContext *api.ApiContext, a *Activity) *Activity {
 	a.Actions["update"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=update"
 	a.Actions["remove"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=remove"
 	//TODO if a.Iscomplete()
-	if a.Status != ActivityWaiting &&
+	if a.Status == ActivityQueued {
+		a.Actions["cancel"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=cancel"
+	} else if a.Status != ActivityWaiting &&
 		a.Status != ActivityBuilding &&
 		a.Status != ActivityPending {
 		a.Actions["rerun"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=rerun"
+		a.Actions["rerunFrom"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=rerunFrom"
+		if a.Status != ActivitySuccess {
+			a.Actions["resume"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=resume"
+		}
 	} else {
 		a.Actions["stop"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=stop"
 	}
 
+	a.Links["artifacts"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "/artifacts"
+	a.Links["tests"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "/tests"
+	if a.SupersededBy != "" {
+		a.Links["supersededBy"] = apiContext.UrlBuilder.ReferenceLink(client.Resource{Id: a.SupersededBy, Type: "activity"})
+	}
+
 	FilterActivity(a)
 	return a
 }
 
+//ToActivitySummary converts a resource of activity to its compact form
+func ToActivitySummary(a *Activity, branch string) *ActivitySummary {
+	return &ActivitySummary{
+		Resource:        a.Resource,
+		Id:              a.Id,
+		PipelineId:      a.Pipeline.Id,
+		PipelineName:    a.Pipeline.Name,
+		PipelineVersion: a.PipelineVersion,
+		RunSequence:     a.RunSequence,
+		CommitInfo:      a.CommitInfo,
+		Branch:          branch,
+		Status:          a.Status,
+		FailMessage:     a.FailMessage,
+		PendingStage:    a.PendingStage,
+		StartTS:         a.StartTS,
+		StopTS:          a.StopTS,
+		NodeName:        a.NodeName,
+		NodeReason:      a.NodeReason,
+		SupersededBy:    a.SupersededBy,
+		FinallyStatus:   a.FinallyStatus,
+		ActivityStages:  a.ActivityStages,
+		TriggerType:     a.TriggerType,
+	}
+}
+
 func ToAccountResource(apiContext *api.ApiContext, account *GitAccount) *GitAccount {
 	account.Resource = client.Resource{
 		Id:      account.Id,
@@ -206,6 +355,23 @@ func ToAccountResource(apiContext *api.ApiContext, account *GitAccount) *GitAcco
 	return account
 }
 
+//ToSecretResource sets actions of the secret, its value is not returned
+func ToSecretResource(apiContext *api.ApiContext, secret *Secret) *Secret {
+	secret.Resource = client.Resource{
+		Id:      secret.Id,
+		Type:    "secret",
+		Actions: map[string]string{},
+		Links:   map[string]string{},
+	}
+	secret.Actions["update"] = apiContext.UrlBuilder.ReferenceLink(secret.Resource) + "?action=update"
+	secret.Actions["remove"] = apiContext.UrlBuilder.ReferenceLink(secret.Resource) + "?action=remove"
+	if secret.PipelineId != "" {
+		secret.Links["pipeline"] = apiContext.UrlBuilder.ReferenceByIdLink("pipeline", secret.PipelineId)
+	}
+	FilterSecret(secret)
+	return secret
+}
+
 func ToRepositoryResource(apiContext *api.ApiContext, repository *GitRepository) *GitRepository {
 	repository.Resource = client.Resource{
 		Id:      repository.Id,
@@ -225,6 +391,7 @@ func ToPipelineSettingResource(apiContext *api.ApiContext, setting *PipelineSett
 	setting.Actions["update"] = apiContext.UrlBuilder.Current() + "?action=update" //apiContext.UrlBuilder.ReferenceLink(setting.Resource) + "?action=update"
 	setting.Actions["oauth"] = apiContext.UrlBuilder.Current() + "?action=oauth"
 	setting.Actions["reset"] = apiContext.UrlBuilder.Current() + "?action=reset"
+	setting.Actions["reencrypt"] = apiContext.UrlBuilder.Current() + "?action=reencrypt"
 
 	setting.Links["scmsettings"] = apiContext.UrlBuilder.Current() + "/scmsettings"
 	return setting
@@ -245,7 +412,7 @@ func ToSCMSettingResource(apiContext *api.ApiContext, setting *SCMSetting) *SCMS
 
 func FilterPipeline(pipeline *Pipeline) {
 	pipeline.WebHookToken = ""
-	for _, stage := range pipeline.Stages {
+	for _, stage := range pipeline.AllStages() {
 		for _, step := range stage.Steps {
 			step.Secretkey = ""
 		}
@@ -265,3 +432,7 @@ func FilterAccount(account *GitAccount) {
 func FilterSCMSetting(setting *SCMSetting) {
 	setting.ClientSecret = ""
 }
+
+func FilterSecret(secret *Secret) {
+	secret.Value = ""
+}
@@ -0,0 +1,394 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const apiVersion = "v1.24"
+
+var ErrContainerNotFound = errors.New("container not found")
+
+//dockerClient talks to the Docker Engine API of a unix socket or tcp endpoint
+type dockerClient struct {
+	client *http.Client
+	base   string
+}
+
+type containerConfig struct {
+	Image        string            `json:"Image"`
+	Entrypoint   []string          `json:"Entrypoint,omitempty"`
+	Cmd          []string          `json:"Cmd,omitempty"`
+	Env          []string          `json:"Env,omitempty"`
+	WorkingDir   string            `json:"WorkingDir,omitempty"`
+	Labels       map[string]string `json:"Labels,omitempty"`
+	OpenStdin    bool              `json:"OpenStdin"`
+	AttachStdout bool              `json:"AttachStdout"`
+	AttachStderr bool              `json:"AttachStderr"`
+	HostConfig   hostConfig        `json:"HostConfig"`
+}
+
+type hostConfig struct {
+	Binds []string `json:"Binds,omitempty"`
+	Links []string `json:"Links,omitempty"`
+}
+
+type containerState struct {
+	Running  bool   `json:"Running"`
+	ExitCode int    `json:"ExitCode"`
+	Error    string `json:"Error"`
+}
+
+type containerInfo struct {
+	Id    string         `json:"Id"`
+	State containerState `json:"State"`
+}
+
+type containerSummary struct {
+	Id     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	State  string            `json:"State"`
+}
+
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid docker host '%s'", host)
+	}
+	transport := &http.Transport{}
+	base := ""
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		base = "http://docker"
+	case "tcp", "http":
+		base = "http://" + u.Host
+	case "https":
+		base = "https://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker host '%s'", host)
+	}
+	return &dockerClient{
+		client: &http.Client{Transport: transport},
+		base:   base + "/" + apiVersion,
+	}, nil
+}
+
+func (c *dockerClient) do(ctx context.Context, method string, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	contentType := "application/json"
+	if r, ok := body.(io.Reader); ok {
+		//raw body such as a tar archive
+		reader = r
+		contentType = "application/x-tar"
+	} else if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/containers/") && path != "/containers/create" {
+		resp.Body.Close()
+		return nil, ErrContainerNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("docker %s %s got status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+//Ping checks the docker engine is reachable
+func (c *dockerClient) Ping() error {
+	resp, err := c.do(nil, http.MethodGet, "/_ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//Hostname gets the name of the docker host
+func (c *dockerClient) Hostname() (string, error) {
+	resp, err := c.do(nil, http.MethodGet, "/info", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	info := struct {
+		Name string `json:"Name"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	return info.Name, nil
+}
+
+//PullImage pulls the image, progress messages are written to out
+func (c *dockerClient) PullImage(ctx context.Context, image string, out io.Writer) error {
+	query := url.Values{}
+	query.Set("fromImage", image)
+	if !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") && !strings.Contains(image, "@") {
+		query.Set("tag", "latest")
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/images/create", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		msg := struct {
+			Status string `json:"status"`
+			Id     string `json:"id"`
+			Error  string `json:"error"`
+		}{}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		//skip layer progress
+		if msg.Id == "" || strings.HasPrefix(msg.Status, "Pull") {
+			fmt.Fprintln(out, strings.TrimSpace(msg.Id+" "+msg.Status))
+		}
+	}
+}
+
+func (c *dockerClient) ImageExists(image string) bool {
+	resp, err := c.do(nil, http.MethodGet, "/images/"+image+"/json", nil, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func (c *dockerClient) CreateContainer(name string, config *containerConfig) (string, error) {
+	query := url.Values{}
+	query.Set("name", name)
+	resp, err := c.do(nil, http.MethodPost, "/containers/create", query, config)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	created := struct {
+		Id string `json:"Id"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", err
+	}
+	return created.Id, nil
+}
+
+func (c *dockerClient) StartContainer(id string) error {
+	resp, err := c.do(nil, http.MethodPost, "/containers/"+id+"/start", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//WaitContainer blocks until the container stops and returns its exit code
+func (c *dockerClient) WaitContainer(ctx context.Context, id string) (int, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/containers/"+id+"/wait", nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	result := struct {
+		StatusCode int `json:"StatusCode"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return -1, err
+	}
+	return result.StatusCode, nil
+}
+
+func (c *dockerClient) InspectContainer(id string) (*containerInfo, error) {
+	resp, err := c.do(nil, http.MethodGet, "/containers/"+id+"/json", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	info := &containerInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+//FollowLogs writes container output to out line by line until the container stops
+func (c *dockerClient) FollowLogs(ctx context.Context, id string, out func(line string)) error {
+	query := url.Values{}
+	query.Set("follow", "1")
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	resp, err := c.do(ctx, http.MethodGet, "/containers/"+id+"/logs", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(demuxStream(resp.Body, pw))
+	}()
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		out(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+//demuxStream strips the 8 bytes stream headers of multiplexed stdout and stderr
+func demuxStream(r io.Reader, w io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if _, err := io.CopyN(w, r, int64(size)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *dockerClient) StopContainer(id string, timeout time.Duration) error {
+	query := url.Values{}
+	query.Set("t", fmt.Sprintf("%d", int(timeout.Seconds())))
+	resp, err := c.do(nil, http.MethodPost, "/containers/"+id+"/stop", query, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *dockerClient) RemoveContainer(id string) error {
+	query := url.Values{}
+	query.Set("force", "1")
+	query.Set("v", "1")
+	resp, err := c.do(nil, http.MethodDelete, "/containers/"+id, query, nil)
+	if err == ErrContainerNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//ArchivePath gets a tar stream of the path in the container, the container may be stopped
+func (c *dockerClient) ArchivePath(id string, path string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("path", path)
+	resp, err := c.do(nil, http.MethodGet, "/containers/"+id+"/archive", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+//PutArchive extracts the tar archive, gzipped or not, to the path in the container
+func (c *dockerClient) PutArchive(id string, path string, archive io.Reader) error {
+	query := url.Values{}
+	query.Set("path", path)
+	resp, err := c.do(nil, http.MethodPut, "/containers/"+id+"/archive", query, archive)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//ListContainers lists all containers having the label
+func (c *dockerClient) ListContainers(label string) ([]containerSummary, error) {
+	filters, err := json.Marshal(map[string][]string{"label": []string{label}})
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("all", "1")
+	query.Set("filters", string(filters))
+	resp, err := c.do(nil, http.MethodGet, "/containers/json", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	containers := []containerSummary{}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func (c *dockerClient) CreateVolume(name string, labels map[string]string) error {
+	body := map[string]interface{}{
+		"Name":   name,
+		"Labels": labels,
+	}
+	resp, err := c.do(nil, http.MethodPost, "/volumes/create", nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *dockerClient) RemoveVolume(name string) error {
+	resp, err := c.do(nil, http.MethodDelete, "/volumes/"+name, nil, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "status 404") {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,910 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/git"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+const (
+	//callback endpoint of step events, the same ones jenkins jobs notify
+	eventEndpoint = "http://127.0.0.1:60080/v1/events/"
+	workspaceDir  = "/workspace"
+	gitImage      = "alpine/git"
+	dockerImage   = "docker:stable"
+	activityLabel = "activityid"
+	commitMarker  = "R_CICD_GIT_COMMIT="
+	//git credentials are copied to the SCM container only, out of its env and the workspace
+	gitCredentialsFile = "/tmp/.r_cicd_git_credentials"
+	//max size of the output file of a step to read
+	maxOutputSize = 1 << 20
+	notifyRetries = 10
+	//node labels are not checked, all steps run on the docker host
+	nodeReason = "the docker host is the only node of the provider"
+)
+
+//DockerProvider runs pipeline steps as containers of the local docker engine
+//without a jenkins master. A docker volume of each activity is shared by its
+//steps as the workspace.
+type DockerProvider struct {
+	client     *dockerClient
+	dockerHost string
+	logPath    string
+	nodeName   string
+
+	lock    sync.Mutex
+	aborted map[string]bool
+}
+
+func NewDockerProvider(dockerHost string, logPath string) (*DockerProvider, error) {
+	client, err := newDockerClient(dockerHost)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(); err != nil {
+		return nil, errors.Wrapf(err, "fail to connect docker engine '%s'", dockerHost)
+	}
+	nodeName, err := client.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(logPath, 0755); err != nil {
+		return nil, err
+	}
+	return &DockerProvider{
+		client:     client,
+		dockerHost: dockerHost,
+		logPath:    logPath,
+		nodeName:   nodeName,
+		aborted:    map[string]bool{},
+	}, nil
+}
+
+func (d *DockerProvider) RunPipeline(p *model.Pipeline, triggerType string) (*model.Activity, error) {
+	if len(p.Stages) == 0 {
+		return nil, errors.New("no stage in pipeline definition to run!")
+	}
+	activity := service.NewActivity(p, d.nodeName)
+	activity.NodeReason = nodeReason
+	activity.TriggerType = triggerType
+	service.InitActivityEnvvars(activity)
+
+	if err := d.prepareWorkspace(activity); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("running stage:%v", p.Stages[0])
+	if err := d.RunStage(activity, 0); err != nil {
+		return nil, err
+	}
+
+	logrus.Debugf("creating activity:%v", activity)
+	if err := service.CreateActivity(activity); err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+//RerunActivity runs an existing activity in a clean workspace
+func (d *DockerProvider) RerunActivity(a *model.Activity) error {
+	d.setAborted(a.Id, false)
+	d.cleanContainers(a.Id)
+	if err := d.client.RemoveVolume(workspaceName(a.Id)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path.Join(d.logPath, a.Id)); err != nil {
+		return err
+	}
+	a.NodeName = d.nodeName
+	a.NodeReason = nodeReason
+	a.RunSequence = a.Pipeline.RunCount + 1
+	a.StartTS = time.Now().UnixNano() / int64(time.Millisecond)
+	service.InitActivityEnvvars(a)
+	if err := d.prepareWorkspace(a); err != nil {
+		return err
+	}
+	return d.RunStage(a, 0)
+}
+
+//ResumeActivity runs a completed activity again from the step, the workspace is
+//cloned again if it was removed on completion
+func (d *DockerProvider) ResumeActivity(a *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	d.setAborted(a.Id, false)
+	d.cleanContainers(a.Id)
+	restore := !a.Pipeline.KeepWorkspace
+	if restore {
+		if err := d.client.RemoveVolume(workspaceName(a.Id)); err != nil {
+			return err
+		}
+	}
+	if err := d.prepareWorkspace(a); err != nil {
+		return err
+	}
+	return service.ResumeFrom(d, a, stageOrdinal, stepOrdinal, restore)
+}
+
+func (d *DockerProvider) RunStage(activity *model.Activity, ordinal int) error {
+	if service.IsFinallyStage(activity, ordinal) {
+		//finally stages still run after the activity is stopped
+		d.setAborted(activity.Id, false)
+	}
+	return service.RunStage(d, activity, ordinal)
+}
+
+//RunStep starts the step container in background, step transitions are
+//notified through the event endpoints as jenkins jobs do
+func (d *DockerProvider) RunStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	if skipped, err := service.SkipStep(d, activity, stageOrdinal, stepOrdinal); skipped || err != nil {
+		return err
+	}
+	step := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal]
+	logrus.Debugf("Run step:%s,%d,%d", activity.Pipeline.Name, stageOrdinal, stepOrdinal)
+	services := service.GetServices(activity, stageOrdinal, stepOrdinal)
+	go d.execStep(activity.Id, activity.StartTS, stageOrdinal, stepOrdinal, step, services)
+	return nil
+}
+
+func (d *DockerProvider) execStep(activityId string, startTS int64, stageOrdinal int, stepOrdinal int, step *model.Step, services []*model.CIService) {
+	logFile := stepLogPath(d.logPath, activityId, stageOrdinal, stepOrdinal)
+	stepOut, err := newStepLog(logFile, startTS)
+	if err != nil {
+		logrus.Errorf("fail to create log of step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activityId, err)
+		return
+	}
+	if err := d.notify("stepstart", activityId, stageOrdinal, stepOrdinal, url.Values{}); err != nil {
+		logrus.Errorf("fail to start step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activityId, err)
+		stepOut.Finish("ABORTED")
+		return
+	}
+	//get latest env vars set by former steps
+	activity, err := service.GetActivity(activityId)
+	if err != nil {
+		logrus.Errorf("fail to get activity '%s': %v", activityId, err)
+		stepOut.Finish("ABORTED")
+		return
+	}
+
+	ctx := context.Background()
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(step.Timeout)*time.Minute)
+		defer cancel()
+	}
+	form := url.Values{}
+	result := "SUCCESS"
+	if err := d.runStepContainer(ctx, activity, stageOrdinal, stepOrdinal, step, services, stepOut, form); err != nil {
+		stepOut.Printf("ERROR: %v", err)
+		result = "FAILURE"
+	}
+	if d.isAborted(activityId) {
+		stepOut.Finish("ABORTED")
+		return
+	}
+	stepOut.Finish(result)
+	form.Set("status", result)
+	if err := d.notify("stepfinish", activityId, stageOrdinal, stepOrdinal, form); err != nil {
+		logrus.Errorf("fail to finish step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activityId, err)
+	}
+}
+
+//runStepContainer runs the container of the step and waits for its completion
+func (d *DockerProvider) runStepContainer(ctx context.Context, activity *model.Activity, stageOrdinal int, stepOrdinal int, step *model.Step, services []*model.CIService, stepOut *stepLog, form url.Values) error {
+	config := &containerConfig{
+		WorkingDir:   workspaceDir,
+		Env:          activityEnv(activity),
+		Labels:       map[string]string{activityLabel: activity.Id},
+		AttachStdout: true,
+		AttachStderr: true,
+		HostConfig: hostConfig{
+			Binds: []string{workspaceName(activity.Id) + ":" + workspaceDir},
+		},
+	}
+	containerName := stepContainerName(activity.Id, stageOrdinal, stepOrdinal)
+	var gitCredentials string
+	switch step.Type {
+	case model.StepTypeSCM:
+		var err error
+		if gitCredentials, err = d.scmConfig(activity, step, config); err != nil {
+			return err
+		}
+		stepOut.Printf("Cloning the remote Git repository %s", step.Repository)
+	case model.StepTypeTask:
+		if err := taskConfig(activity, step, services, config); err != nil {
+			return err
+		}
+		if step.IsService {
+			containerName = activity.Id + step.Alias
+		} else {
+			config.Env = append(config.Env, service.EnvOutputFile+"="+outputFile(stageOrdinal, stepOrdinal))
+		}
+	case model.StepTypeBuild:
+		d.buildConfig(step, config)
+	default:
+		return fmt.Errorf("step type '%s' is not supported by the docker provider", step.Type)
+	}
+
+	if !d.client.ImageExists(config.Image) {
+		stepOut.Printf("Pulling image %s", config.Image)
+		if err := d.client.PullImage(ctx, config.Image, stepOut); err != nil {
+			return errors.Wrapf(err, "fail to pull image '%s'", config.Image)
+		}
+	}
+	if err := d.client.RemoveContainer(containerName); err != nil {
+		return err
+	}
+	id, err := d.client.CreateContainer(containerName, config)
+	if err != nil {
+		return err
+	}
+	if gitCredentials != "" {
+		archive := fileArchive(path.Base(gitCredentialsFile), []byte(gitCredentials), 0600)
+		if err := d.client.PutArchive(id, path.Dir(gitCredentialsFile), archive); err != nil {
+			d.client.RemoveContainer(id)
+			return err
+		}
+	}
+	if step.Type == model.StepTypeTask && !step.IsService {
+		//clear outputs of a former run in the workspace
+		if err := d.client.PutArchive(id, workspaceDir, emptyFileArchive(service.StepOutputFile(stageOrdinal, stepOrdinal))); err != nil {
+			d.client.RemoveContainer(id)
+			return err
+		}
+	}
+	cacheKey := ""
+	if service.GetStepCache(activity, stageOrdinal, stepOrdinal) != nil {
+		if cacheKey, err = d.restoreCache(activity, stageOrdinal, stepOrdinal, id, stepOut); err != nil {
+			stepOut.Printf("WARNING: fail to restore cache: %v", err)
+		}
+	}
+	if err := d.client.StartContainer(id); err != nil {
+		d.client.RemoveContainer(id)
+		return err
+	}
+	if step.Type == model.StepTypeTask && step.IsService {
+		return d.checkService(id, step, stepOut)
+	}
+	defer d.client.RemoveContainer(id)
+
+	logDone := make(chan struct{})
+	go func() {
+		defer close(logDone)
+		err := d.client.FollowLogs(context.Background(), id, func(line string) {
+			if strings.HasPrefix(line, commitMarker) {
+				form.Set("GIT_COMMIT", strings.TrimPrefix(line, commitMarker))
+				return
+			}
+			stepOut.Println(line)
+		})
+		if err != nil {
+			logrus.Debugf("follow logs of container '%s' got: %v", id, err)
+		}
+	}()
+	exitCode, err := d.client.WaitContainer(ctx, id)
+	if ctx.Err() == context.DeadlineExceeded {
+		d.client.StopContainer(id, 10*time.Second)
+		<-logDone
+		return fmt.Errorf("step timed out after %d minutes", step.Timeout)
+	}
+	<-logDone
+	if err == nil && step.Type == model.StepTypeTask {
+		outputs, _, err := d.readFile(id, outputFile(stageOrdinal, stepOrdinal))
+		if err != nil {
+			stepOut.Printf("WARNING: fail to read outputs: %v", err)
+		}
+		form.Set("OUTPUTS", outputs)
+	}
+	if err == nil && exitCode == 0 && step.Type == model.StepTypeSCM {
+		changes, ok, err := d.readFile(id, path.Join(workspaceDir, service.ChangedFilesFile))
+		if err != nil {
+			stepOut.Printf("WARNING: fail to read changed files: %v", err)
+		} else if ok {
+			form.Set("CHANGED_FILES", changes)
+		}
+	}
+	if err == nil && step.Type == model.StepTypeTask && len(step.Artifacts) > 0 {
+		if err := d.uploadWorkspace("artifacts", activity.Id, stageOrdinal, stepOrdinal, id, step.Artifacts); err != nil {
+			stepOut.Printf("WARNING: fail to collect artifacts: %v", err)
+		}
+	}
+	if err == nil && step.Type == model.StepTypeTask && len(step.TestReports) > 0 {
+		if err := d.uploadWorkspace("testreports", activity.Id, stageOrdinal, stepOrdinal, id, step.TestReports); err != nil {
+			stepOut.Printf("WARNING: fail to collect test reports: %v", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("step exited with code %d", exitCode)
+	}
+	if cacheKey != "" {
+		if err := d.saveCache(activity, stageOrdinal, stepOrdinal, id, cacheKey, stepOut); err != nil {
+			stepOut.Printf("WARNING: fail to save cache: %v", err)
+		}
+	}
+	return nil
+}
+
+//changedFilesScript lists files changed by the commit, no file is written if it has no parent
+const changedFilesScript = "git diff --name-only HEAD~1 HEAD > " + service.ChangedFilesFile + " 2>/dev/null || rm -f " + service.ChangedFilesFile + "\n"
+
+//scmConfig clones the repository to the workspace and prints the commit.
+//It returns the content of the git credentials file to copy to the container
+func (d *DockerProvider) scmConfig(activity *model.Activity, step *model.Step, config *containerConfig) (string, error) {
+	token, err := service.GetUserToken(step.GitUser)
+	if err != nil {
+		return "", errors.Wrapf(err, "fail to get credential of git user '%s'", step.GitUser)
+	}
+	authUrl, err := git.GetAuthRepoUrl(step.Repository, step.GitUser, token)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid repository url '%s'", step.Repository)
+	}
+	credentials := u.Scheme + "://" + u.User.String() + "@" + u.Host + "\n"
+	checkout := ""
+	if activity.CommitInfo != "" && activity.CommitInfo != "null" {
+		//rerun the commit of the activity
+		checkout = "git checkout -q " + quoteShell(activity.CommitInfo) + "\n"
+	}
+	script := "set -e\n" +
+		"trap 'rm -f " + gitCredentialsFile + "' EXIT\n" +
+		"git -c credential.helper='store --file=" + gitCredentialsFile + "' clone -q --branch \"$R_CICD_GIT_BRANCH\" \"$R_CICD_GIT_URL\" .\n" +
+		"rm -f " + gitCredentialsFile + "\n" +
+		checkout +
+		"git log -1 --oneline\n" +
+		"echo \"" + commitMarker + "$(git rev-parse HEAD)\"\n" +
+		changedFilesScript
+	config.Image = gitImage
+	config.Entrypoint = []string{"/bin/sh", "-c"}
+	config.Cmd = []string{script}
+	config.Env = append(config.Env, "R_CICD_GIT_URL="+step.Repository, "R_CICD_GIT_BRANCH="+step.Branch)
+	return credentials, nil
+}
+
+//taskConfig runs the image of the step, secrets referenced in its env are only set on the container
+func taskConfig(activity *model.Activity, step *model.Step, services []*model.CIService, config *containerConfig) error {
+	config.Image = step.Image
+	for _, para := range step.Env {
+		env, err := service.ResolveStepEnv(activity, para)
+		if err != nil {
+			return err
+		}
+		config.Env = append(config.Env, env)
+	}
+	if step.ShellScript != "" {
+		config.Entrypoint = []string{"/bin/sh", "-c"}
+		config.Cmd = []string{"set -xe\n" + step.ShellScript}
+	} else {
+		if step.Entrypoint != "" {
+			config.Entrypoint = strings.Fields(step.Entrypoint)
+		}
+		if step.Args != "" {
+			config.Cmd = strings.Fields(service.SubstituteVar(activity, step.Args))
+		}
+	}
+	if step.IsService {
+		//keep stdin open so that a shell image keeps running
+		config.OpenStdin = true
+	}
+	for _, svc := range services {
+		config.HostConfig.Links = append(config.HostConfig.Links, svc.ContainerName+":"+svc.Name)
+	}
+	return nil
+}
+
+//buildConfig builds and pushes the image with docker cli against the same engine
+func (d *DockerProvider) buildConfig(step *model.Step, config *containerConfig) {
+	buf := "set -xe\n"
+	if step.Dockerfile == "" {
+		buildPath := "."
+		if step.BuildPath != "" {
+			buildPath = step.BuildPath
+		}
+		dockerfilePath := "Dockerfile"
+		if step.DockerfilePath != "" {
+			dockerfilePath = step.DockerfilePath
+		}
+		buf += fmt.Sprintf("docker build --tag %s -f %s %s\n", quoteShell(step.TargetImage), quoteShell(dockerfilePath), quoteShell(buildPath))
+	} else {
+		buf += "echo " + quoteShell(step.Dockerfile) + ">.r_cicd_Dockerfile\n"
+		buf += fmt.Sprintf("docker build --tag %s -f .r_cicd_Dockerfile .\n", quoteShell(step.TargetImage))
+	}
+	if step.PushFlag {
+		buf += fmt.Sprintf("docker push %s\n", quoteShell(step.TargetImage))
+	}
+	config.Image = dockerImage
+	config.Entrypoint = []string{"/bin/sh", "-c"}
+	config.Cmd = []string{buf}
+	if strings.HasPrefix(d.dockerHost, "unix://") {
+		socket := strings.TrimPrefix(d.dockerHost, "unix://")
+		config.HostConfig.Binds = append(config.HostConfig.Binds, socket+":/var/run/docker.sock")
+	} else {
+		config.Env = append(config.Env, "DOCKER_HOST="+d.dockerHost)
+	}
+}
+
+//checkService expects the service container keeps running
+func (d *DockerProvider) checkService(id string, step *model.Step, stepOut *stepLog) error {
+	stepOut.Printf("run a service container with alias %s.", step.Alias)
+	time.Sleep(3 * time.Second)
+	info, err := d.client.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+	if info.State.Running {
+		return nil
+	}
+	d.client.FollowLogs(context.Background(), id, stepOut.Println)
+	return fmt.Errorf("service container \"%s\" is stopped.\ncheck above logs or the task step config.\nA running container is expected when using \"as a service\" option.", step.Alias)
+}
+
+//notify posts step event to the pipeline server, retrying until the activity is saved
+func (d *DockerProvider) notify(event string, activityId string, stageOrdinal int, stepOrdinal int, form url.Values) error {
+	query := url.Values{}
+	query.Set("id", activityId)
+	query.Set("stageOrdinal", strconv.Itoa(stageOrdinal))
+	query.Set("stepOrdinal", strconv.Itoa(stepOrdinal))
+	if status := form.Get("status"); status != "" {
+		query.Set("status", status)
+	}
+	token, err := service.StepToken(activityId, stageOrdinal, stepOrdinal)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < notifyRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, eventEndpoint+event+"?"+query.Encode(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(service.StepTokenHeader, token)
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("got status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return err
+}
+
+//uploadWorkspace posts files in the workspace of the exited step container matching artifact or
+//test report globs of the step to the event endpoint of the pipeline server
+func (d *DockerProvider) uploadWorkspace(event string, activityId string, stageOrdinal int, stepOrdinal int, containerId string, globs []string) error {
+	archive := d.archiveGlobs(containerId, globs)
+	defer archive.Close()
+	query := url.Values{}
+	query.Set("id", activityId)
+	query.Set("stageOrdinal", strconv.Itoa(stageOrdinal))
+	query.Set("stepOrdinal", strconv.Itoa(stepOrdinal))
+	token, err := service.StepToken(activityId, stageOrdinal, stepOrdinal)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, eventEndpoint+event+"?"+query.Encode(), archive)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Header.Set(service.StepTokenHeader, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+//restoreCache extracts the cache of the step into the workspace of the created container.
+//It gets the resolved key to save the cache after the step
+func (d *DockerProvider) restoreCache(activity *model.Activity, stageOrdinal int, stepOrdinal int, containerId string, stepOut *stepLog) (string, error) {
+	key, err := service.CacheKey(activity, stageOrdinal, stepOrdinal, func(file string) (string, error) {
+		return d.fileChecksum(containerId, path.Join(workspaceDir, file))
+	})
+	if err != nil {
+		return "", err
+	}
+	cache, f, err := service.OpenCache(activity.Pipeline.Id, key)
+	if err == service.ErrCacheNotFound {
+		stepOut.Printf("No cache for key %s", key)
+		return key, nil
+	} else if err != nil {
+		return key, err
+	}
+	defer f.Close()
+	if err := d.client.PutArchive(containerId, workspaceDir, f); err != nil {
+		return key, err
+	}
+	stepOut.Printf("Restored cache %s, %d bytes", key, cache.Size)
+	return key, nil
+}
+
+//saveCache saves cache paths in the workspace of the exited step container
+//unless the key is saved already
+func (d *DockerProvider) saveCache(activity *model.Activity, stageOrdinal int, stepOrdinal int, containerId string, key string, stepOut *stepLog) error {
+	if service.CacheExists(activity.Pipeline.Id, key) {
+		return nil
+	}
+	archive := d.archiveGlobs(containerId, service.GetStepCache(activity, stageOrdinal, stepOrdinal).Paths)
+	defer archive.Close()
+	if err := service.SaveCache(activity, stageOrdinal, stepOrdinal, key, archive, 0); err != nil {
+		return err
+	}
+	if service.CacheExists(activity.Pipeline.Id, key) {
+		stepOut.Printf("Saved cache %s", key)
+	}
+	return nil
+}
+
+//archiveGlobs gets a tar stream of files in the workspace of the container matching the globs, named
+//relative to the workspace. Only the directory before the first wildcard of each glob is archived
+func (d *DockerProvider) archiveGlobs(containerId string, globs []string) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(d.writeGlobs(containerId, globs, w))
+	}()
+	return r
+}
+
+func (d *DockerProvider) writeGlobs(containerId string, globs []string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, dir := range globDirs(globs) {
+		archive, err := d.client.ArchivePath(containerId, path.Join(workspaceDir, dir))
+		if err == ErrContainerNotFound {
+			//nothing matches
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = filterArchive(archive, tw, path.Dir(path.Join(workspaceDir, dir)), globs)
+		archive.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+//filterArchive copies entries of the archive of a path under base matching the globs
+func filterArchive(archive io.Reader, tw *tar.Writer, base string, globs []string) error {
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(path.Join(base, hdr.Name), workspaceDir+"/")
+		if path.IsAbs(name) || !service.MatchArtifact(globs, name) {
+			continue
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+//globDirs gets the directories in the workspace before the first wildcard of the globs,
+//without those in another one of them
+func globDirs(globs []string) []string {
+	dirs := []string{}
+	for _, glob := range globs {
+		dir := path.Clean(strings.TrimPrefix(glob, "./"))
+		if i := strings.IndexAny(dir, "*?"); i >= 0 {
+			dir = path.Dir(dir[:i] + "x")
+		}
+		if dir == "." {
+			dir = ""
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	result := []string{}
+Dirs:
+	for _, dir := range dirs {
+		for _, kept := range result {
+			if kept == "" || dir == kept || strings.HasPrefix(dir, kept+"/") {
+				continue Dirs
+			}
+		}
+		result = append(result, dir)
+	}
+	return result
+}
+
+//readFile gets the content of the file in the container and whether it exists
+func (d *DockerProvider) readFile(containerId string, file string) (string, bool, error) {
+	archive, err := d.client.ArchivePath(containerId, file)
+	if err == ErrContainerNotFound {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	defer archive.Close()
+	tr := tar.NewReader(archive)
+	if _, err := tr.Next(); err == io.EOF {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(tr, maxOutputSize))
+	return string(data), err == nil, err
+}
+
+//fileChecksum gets the sha256 of the file in the container, empty if it does not exist
+func (d *DockerProvider) fileChecksum(containerId string, file string) (string, error) {
+	archive, err := d.client.ArchivePath(containerId, file)
+	if err == ErrContainerNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+	tr := tar.NewReader(archive)
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return "", fmt.Errorf("'%s' is not a regular file", file)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, tr); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (d *DockerProvider) StopActivity(a *model.Activity) error {
+	logrus.Debugf("stopping activity, current status: %s", a.Status)
+	d.setAborted(a.Id, true)
+	d.cleanContainers(a.Id)
+	a.Status = model.ActivityAbort
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	a.StopTS = now
+	for _, stage := range a.ActivityStages {
+		//stages run concurrently by needs
+		if stage.Status != model.ActivityStageBuilding {
+			continue
+		}
+		for _, step := range stage.ActivitySteps {
+			if step.Status == model.ActivityStepBuilding {
+				step.Status = model.ActivityStepAbort
+				step.Duration = now - step.StartTS
+			}
+		}
+		logrus.Debugf("aborting stage, current status: %s", stage.Status)
+		stage.Status = model.ActivityStageAbort
+		stage.Duration = now - stage.StartTS
+	}
+	return nil
+}
+
+//SyncActivity checks step containers of a running activity after restart,
+//steps whose containers are still running or missing cannot be tracked and fail
+func (d *DockerProvider) SyncActivity(activity *model.Activity) error {
+	for i, actiStage := range activity.ActivityStages {
+		for j, actiStep := range actiStage.ActivitySteps {
+			if actiStep.Status != model.ActivityStepBuilding {
+				continue
+			}
+			step := activity.Pipeline.Stages[i].Steps[j]
+			if step.Type == model.StepTypeTask && step.IsService {
+				continue
+			}
+			info, err := d.client.InspectContainer(stepContainerName(activity.Id, i, j))
+			if err != nil && err != ErrContainerNotFound {
+				return err
+			}
+			if err == nil {
+				d.client.RemoveContainer(info.Id)
+			}
+			if err == nil && !info.State.Running && info.State.ExitCode == 0 {
+				service.SuccessStep(activity, i, j)
+				service.Triggernext(activity, i, j, d)
+				continue
+			}
+			service.FailStep(activity, i, j)
+			activity.FailMessage = fmt.Sprintf("step %d of '%s' stage is interrupted", j+1, actiStage.Name)
+			if !service.RunFinally(d, activity) {
+				d.OnActivityCompelte(activity)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (d *DockerProvider) GetStepLog(activity *model.Activity, stageOrdinal int, stepOrdinal int, paras map[string]interface{}) (string, error) {
+	if stageOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) || stepOrdinal < 0 || stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
+		return "", errors.New("ordinal out of range")
+	}
+	prevLog := ""
+	logText := &prevLog
+	if val, ok := paras["prevLog"]; ok {
+		logText = val.(*string)
+	}
+	return readStepLog(stepLogPath(d.logPath, activity.Id, stageOrdinal, stepOrdinal), logText)
+}
+
+//OnActivityCompelte helps clean up
+func (d *DockerProvider) OnActivityCompelte(activity *model.Activity) {
+	service.NotifyQueue()
+	d.cleanContainers(activity.Id)
+	logrus.Infof("activity '%s' complete", activity.Id)
+	if !activity.Pipeline.KeepWorkspace {
+		if err := d.client.RemoveVolume(workspaceName(activity.Id)); err != nil {
+			logrus.Errorf("error cleanning up workspace of activity '%s': %v", activity.Id, err)
+		}
+	}
+}
+
+//OnDeleteActivity removes containers, the workspace and logs of a removed activity
+func (d *DockerProvider) OnDeleteActivity(activity *model.Activity) error {
+	d.setAborted(activity.Id, false)
+	d.cleanContainers(activity.Id)
+	if err := d.client.RemoveVolume(workspaceName(activity.Id)); err != nil {
+		return errors.Wrapf(err, "fail to remove workspace of activity '%s'", activity.Id)
+	}
+	return os.RemoveAll(path.Join(d.logPath, activity.Id))
+}
+
+//OnCreateAccount does nothing as git credentials are read when cloning
+func (d *DockerProvider) OnCreateAccount(account *model.GitAccount) error {
+	return nil
+}
+
+func (d *DockerProvider) OnDeleteAccount(account *model.GitAccount) error {
+	if account == nil {
+		return errors.New("nil account")
+	}
+	return nil
+}
+
+func (d *DockerProvider) Reset() error {
+	containers, err := d.client.ListContainers(activityLabel)
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		if err := d.client.RemoveContainer(c.Id); err != nil {
+			return err
+		}
+	}
+	files, err := ioutil.ReadDir(d.logPath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.RemoveAll(path.Join(d.logPath, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//cleanContainers removes step and service containers of the activity
+func (d *DockerProvider) cleanContainers(activityId string) {
+	containers, err := d.client.ListContainers(activityLabel + "=" + activityId)
+	if err != nil {
+		logrus.Errorf("error listing containers of activity '%s': %v", activityId, err)
+		return
+	}
+	for _, c := range containers {
+		if err := d.client.RemoveContainer(c.Id); err != nil {
+			logrus.Errorf("error removing container '%s': %v", c.Id, err)
+		}
+	}
+}
+
+func (d *DockerProvider) prepareWorkspace(activity *model.Activity) error {
+	if err := d.client.CreateVolume(workspaceName(activity.Id), map[string]string{activityLabel: activity.Id}); err != nil {
+		return errors.Wrapf(err, "fail to create workspace of activity '%s'", activity.Id)
+	}
+	return nil
+}
+
+func (d *DockerProvider) setAborted(activityId string, aborted bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if aborted {
+		d.aborted[activityId] = true
+	} else {
+		delete(d.aborted, activityId)
+	}
+}
+
+func (d *DockerProvider) isAborted(activityId string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.aborted[activityId]
+}
+
+//activityEnv converts env vars of the activity to container env
+func activityEnv(activity *model.Activity) []string {
+	env := []string{}
+	for k, v := range activity.EnvVars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+func outputFile(stageOrdinal int, stepOrdinal int) string {
+	return path.Join(workspaceDir, service.StepOutputFile(stageOrdinal, stepOrdinal))
+}
+
+//emptyFileArchive gets a tar stream of an empty file
+func emptyFileArchive(name string) io.Reader {
+	return fileArchive(name, nil, 0666)
+}
+
+//fileArchive gets a tar stream of a file with the content
+func fileArchive(name string, content []byte, mode int64) io.Reader {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: mode, Size: int64(len(content)), ModTime: time.Now()})
+	tw.Write(content)
+	tw.Close()
+	return buf
+}
+
+func workspaceName(activityId string) string {
+	return "pipeline-" + activityId
+}
+
+func stepContainerName(activityId string, stageOrdinal int, stepOrdinal int) string {
+	return strings.Join([]string{activityId, strconv.Itoa(stageOrdinal), strconv.Itoa(stepOrdinal)}, "_")
+}
+
+//quoteShell quotes the text with double quotes so variable substitution works
+func quoteShell(text string) string {
+	escaped := strings.Replace(text, "\\", "\\\\", -1)
+	escaped = strings.Replace(escaped, "\"", "\\\"", -1)
+	return "\"" + escaped + "\""
+}
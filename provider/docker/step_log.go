@@ -0,0 +1,83 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//stepLog writes step output in the timestamped format of jenkins console,
+//each line is prefixed with the duration since the activity started
+type stepLog struct {
+	lock    sync.Mutex
+	file    *os.File
+	startTS int64
+}
+
+func stepLogPath(logPath string, activityId string, stageOrdinal int, stepOrdinal int) string {
+	return path.Join(logPath, activityId, strconv.Itoa(stageOrdinal)+"_"+strconv.Itoa(stepOrdinal)+".log")
+}
+
+func newStepLog(file string, startTS int64) (*stepLog, error) {
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &stepLog{file: f, startTS: startTS}, nil
+}
+
+func (l *stepLog) Println(line string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	elapsed := time.Now().UnixNano()/int64(time.Millisecond) - l.startTS
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	fmt.Fprintf(l.file, "%s  %s\n", time.Duration(elapsed)*time.Millisecond, line)
+}
+
+func (l *stepLog) Printf(format string, a ...interface{}) {
+	l.Println(fmt.Sprintf(format, a...))
+}
+
+func (l *stepLog) Write(p []byte) (int, error) {
+	l.Println(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+//Finish writes the closing line the log readers wait for
+func (l *stepLog) Finish(result string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	fmt.Fprintf(l.file, "  Finished: %s\n", result)
+	l.file.Close()
+}
+
+//readStepLog returns the log appended after prevLog
+func readStepLog(file string, prevLog *string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	text := string(data)
+	if !strings.HasPrefix(text, *prevLog) {
+		//the log is rewritten by a retried step
+		*prevLog = ""
+	}
+	if len(text) <= len(*prevLog) {
+		return "", nil
+	}
+	appended := text[len(*prevLog):]
+	*prevLog = text
+	return appended, nil
+}
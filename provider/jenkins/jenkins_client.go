@@ -21,25 +21,59 @@ var (
 	ErrUpdateJobFail    = errors.New("Update Job fail")
 	ErrStopJobFail      = errors.New("Stop Job fail")
 	ErrDeleteBuildFail  = errors.New("Delete Build fail")
+	ErrDeleteJobFail    = errors.New("Delete Job fail")
 	ErrBuildJobFail     = errors.New("Build Job fail")
 	ErrGetBuildInfoFail = errors.New("Get Build Info fail")
 	ErrGetJobInfoFail   = errors.New("Get Job Info fail")
 )
 
-func InitJenkins() {
-	var jenkinsServerAddress, user, token string
-	jenkinsServerAddress = config.Config.JenkinsAddress
-	user = config.Config.JenkinsUser
-	token = config.Config.JenkinsToken
+//JenkinsClient operates jobs, builds and credentials of a jenkins master
+type JenkinsClient interface {
+	GetCSRF() error
+	CreateJob(jobname string, content []byte) error
+	UpdateJob(jobname string, content []byte) error
+	DeleteJob(jobname string) error
+	BuildJob(jobname string, params map[string]string) (string, error)
+	DeleteBuild(jobname string) error
+	StopJob(jobname string) error
+	CancelQueueItem(id int) error
+	GetJobInfo(jobname string) (*JenkinsJobInfo, error)
+	GetBuildInfo(jobname string) (*JenkinsBuildInfo, error)
+	GetBuildRawOutput(jobname string, startLine int) (string, error)
+	ExecScript(script string) (string, error)
+	GetActiveNodesName() ([]string, error)
+	GetNodes() ([]JenkinsNode, error)
+	CreateCredential(content []byte) error
+	DeleteCredential(id string) error
+}
+
+//jenkinsHTTPClient calls the REST API of a jenkins master
+type jenkinsHTTPClient struct {
+	conf jenkinsConfig
+}
+
+//NewJenkinsClient creates a client of the jenkins master at the address
+func NewJenkinsClient(address string, user string, token string) JenkinsClient {
+	conf := jenkinsConfig{}
+	jenkinsConfLock.RLock()
+	for k, v := range JenkinsConfig {
+		conf[k] = v
+	}
+	jenkinsConfLock.RUnlock()
+	conf[JenkinsServerAddress] = address
+	conf[JenkinsUser] = user
+	conf[JenkinsToken] = token
+	return &jenkinsHTTPClient{conf: conf}
+}
 
-	JenkinsConfig.Set(JenkinsServerAddress, jenkinsServerAddress)
-	JenkinsConfig.Set(JenkinsUser, user)
-	JenkinsConfig.Set(JenkinsToken, token)
+//InitJenkins connects to the jenkins master of the configuration
+func InitJenkins() JenkinsClient {
+	client := NewJenkinsClient(config.Config.JenkinsAddress, config.Config.JenkinsUser, config.Config.JenkinsToken)
 	logrus.Info("Connectting to Jenkins...")
 
 	RetryTime := 10
 	for i := 0; i < RetryTime; i++ {
-		if err := GetCSRF(); err != nil {
+		if err := client.GetCSRF(); err != nil {
 			logrus.Errorf("Error Connecting to Jenkins err:%s\n", err.Error())
 			if i < RetryTime-1 {
 				logrus.Infoln("Retry in 10s...")
@@ -51,13 +85,14 @@ func InitJenkins() {
 	}
 
 	logrus.Info("Connected to Jenkins")
+	return client
 }
 
-func GetCSRF() error {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	getCrumbURI, _ := JenkinsConfig.Get(GetCrumbURI)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
+func (c *jenkinsHTTPClient) GetCSRF() error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	getCrumbURI, _ := c.conf.Get(GetCrumbURI)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
 	getCrumbURL, err := url.Parse(sah + getCrumbURI)
 	if err != nil {
 		logrus.Error(err)
@@ -82,20 +117,20 @@ func GetCSRF() error {
 		}
 		return errors.New("error get crumbs from jenkins")
 	}
-	JenkinsConfig.Set(JenkinsCrumbHeader, Crumbs[0])
-	JenkinsConfig.Set(JenkinsCrumb, Crumbs[1])
+	c.conf.Set(JenkinsCrumbHeader, Crumbs[0])
+	c.conf.Set(JenkinsCrumb, Crumbs[1])
 	return nil
 }
 
 //DeleteBuild deletes the last build of a job
-func DeleteBuild(jobname string) error {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	deleteBuildURI, _ := JenkinsConfig.Get(DeleteBuildURI)
+func (c *jenkinsHTTPClient) DeleteBuild(jobname string) error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	deleteBuildURI, _ := c.conf.Get(DeleteBuildURI)
 	deleteBuildURI = fmt.Sprintf(deleteBuildURI, jobname)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 
 	var targetURL *url.URL
 	var err error
@@ -126,13 +161,49 @@ func DeleteBuild(jobname string) error {
 
 }
 
-func ExecScript(script string) (string, error) {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	scriptURI, _ := JenkinsConfig.Get(ScriptURI)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+//DeleteJob deletes a job with all its builds, deleting a nonexistent job is not an error
+func (c *jenkinsHTTPClient) DeleteJob(jobname string) error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	deleteJobURI, _ := c.conf.Get(DeleteJobURI)
+	deleteJobURI = fmt.Sprintf(deleteJobURI, jobname)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
+
+	targetURL, err := url.Parse(sah + deleteJobURI)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	req, _ := http.NewRequest(http.MethodPost, targetURL.String(), nil)
+
+	req.Header.Add(CrumbHeader, Crumb)
+	req.SetBasicAuth(user, token)
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		logrus.Infof("delete job fail,response code is :%v", resp.StatusCode)
+		return ErrDeleteJobFail
+	}
+	return nil
+}
+
+func (c *jenkinsHTTPClient) ExecScript(script string) (string, error) {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	scriptURI, _ := c.conf.Get(ScriptURI)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 
 	var targetURL *url.URL
 	var err error
@@ -163,8 +234,8 @@ func ExecScript(script string) (string, error) {
 }
 
 //GetActiveNodesName gets all available jenkins slaves name and the master
-func GetActiveNodesName() ([]string, error) {
-	nlist, err := ExecScript(GetActiveNodesScript)
+func (c *jenkinsHTTPClient) GetActiveNodesName() ([]string, error) {
+	nlist, err := c.ExecScript(GetActiveNodesScript)
 	nlist = strings.TrimLeft(nlist, "\n")
 	nlist = strings.TrimRight(nlist, "\n")
 	logrus.Debugf("exec result:%v", nlist)
@@ -176,13 +247,53 @@ func GetActiveNodesName() ([]string, error) {
 	return r, nil
 }
 
-func CreateJob(jobname string, content []byte) error {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	createJobURI, _ := JenkinsConfig.Get(CreateJobURI)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+//GetNodes gets labels and executors usage of all jenkins slaves
+func (c *jenkinsHTTPClient) GetNodes() ([]JenkinsNode, error) {
+	res, err := c.ExecScript(GetNodesScript)
+	if err != nil {
+		logrus.Errorf("get nodes fail,%v", err)
+		return nil, err
+	}
+	return parseNodes(res)
+}
+
+//parseNodes parses the output of GetNodesScript
+func parseNodes(text string) ([]JenkinsNode, error) {
+	nodes := []JenkinsNode{}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("invalid node info '%s'", line)
+		}
+		busy, err := strconv.Atoi(strings.TrimSpace(fields[3]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid busy executors of node '%s'", fields[0])
+		}
+		executors, err := strconv.Atoi(strings.TrimSpace(fields[4]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid executors of node '%s'", fields[0])
+		}
+		nodes = append(nodes, JenkinsNode{
+			Name:          fields[0],
+			Online:        strings.TrimSpace(fields[1]) == "true",
+			Labels:        strings.Fields(fields[2]),
+			BusyExecutors: busy,
+			Executors:     executors,
+		})
+	}
+	return nodes, nil
+}
+
+func (c *jenkinsHTTPClient) CreateJob(jobname string, content []byte) error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	createJobURI, _ := c.conf.Get(CreateJobURI)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 	//url part
 	createJobURL, err := url.Parse(sah + createJobURI)
 	if err != nil {
@@ -214,14 +325,14 @@ func CreateJob(jobname string, content []byte) error {
 	return nil
 }
 
-func UpdateJob(jobname string, content []byte) error {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	updateJobURI, _ := JenkinsConfig.Get(UpdateJobURI)
+func (c *jenkinsHTTPClient) UpdateJob(jobname string, content []byte) error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	updateJobURI, _ := c.conf.Get(UpdateJobURI)
 	updateJobURI = fmt.Sprintf(updateJobURI, jobname)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 	//url part
 	updateJobURL, err := url.Parse(sah + updateJobURI)
 	if err != nil {
@@ -249,16 +360,16 @@ func UpdateJob(jobname string, content []byte) error {
 	return nil
 }
 
-func BuildJob(jobname string, params map[string]string) (string, error) {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	buildURI, _ := JenkinsConfig.Get(JenkinsJobBuildURI)
+func (c *jenkinsHTTPClient) BuildJob(jobname string, params map[string]string) (string, error) {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	buildURI, _ := c.conf.Get(JenkinsJobBuildURI)
 	buildURI = fmt.Sprintf(buildURI, jobname)
-	buildWithParamsURI, _ := JenkinsConfig.Get(JenkinsJobBuildWithParamsURI)
+	buildWithParamsURI, _ := c.conf.Get(JenkinsJobBuildWithParamsURI)
 	buildWithParamsURI = fmt.Sprintf(buildWithParamsURI, jobname)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 
 	withParams := false
 	if len(params) > 0 {
@@ -294,14 +405,14 @@ func BuildJob(jobname string, params map[string]string) (string, error) {
 	return "", nil
 }
 
-func GetBuildInfo(jobname string) (*JenkinsBuildInfo, error) {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	buildInfoURI, _ := JenkinsConfig.Get(JenkinsBuildInfoURI)
+func (c *jenkinsHTTPClient) GetBuildInfo(jobname string) (*JenkinsBuildInfo, error) {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	buildInfoURI, _ := c.conf.Get(JenkinsBuildInfoURI)
 	buildInfoURI = fmt.Sprintf(buildInfoURI, jobname)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 
 	var targetURL *url.URL
 	var err error
@@ -336,14 +447,14 @@ func GetBuildInfo(jobname string) (*JenkinsBuildInfo, error) {
 
 }
 
-func GetJobInfo(jobname string) (*JenkinsJobInfo, error) {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	jobInfoURI, _ := JenkinsConfig.Get(JenkinsJobInfoURI)
+func (c *jenkinsHTTPClient) GetJobInfo(jobname string) (*JenkinsJobInfo, error) {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	jobInfoURI, _ := c.conf.Get(JenkinsJobInfoURI)
 	jobInfoURI = fmt.Sprintf(jobInfoURI, jobname)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 
 	var targetURL *url.URL
 	var err error
@@ -378,17 +489,17 @@ func GetJobInfo(jobname string) (*JenkinsJobInfo, error) {
 
 }
 
-func GetBuildRawOutput(jobname string, startLine int) (string, error) {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	buildRawOutputURI, _ := JenkinsConfig.Get(JenkinsBuildLogURI)
+func (c *jenkinsHTTPClient) GetBuildRawOutput(jobname string, startLine int) (string, error) {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	buildRawOutputURI, _ := c.conf.Get(JenkinsBuildLogURI)
 	buildRawOutputURI = fmt.Sprintf(buildRawOutputURI, jobname)
 	if startLine > 0 {
 		buildRawOutputURI += "&startLine=" + strconv.Itoa(startLine)
 	}
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 
 	var targetURL *url.URL
 	var err error
@@ -418,14 +529,14 @@ func GetBuildRawOutput(jobname string, startLine int) (string, error) {
 
 }
 
-func StopJob(jobname string) error {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	stopJobURI, _ := JenkinsConfig.Get(StopJobURI)
+func (c *jenkinsHTTPClient) StopJob(jobname string) error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	stopJobURI, _ := c.conf.Get(StopJobURI)
 	stopJobURI = fmt.Sprintf(stopJobURI, jobname)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 
 	targetURL, err := url.Parse(sah + stopJobURI)
 
@@ -451,14 +562,14 @@ func StopJob(jobname string) error {
 	return nil
 }
 
-func CancelQueueItem(id int) error {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	cancelQueueItemURI, _ := JenkinsConfig.Get(CancelQueueItemURI)
+func (c *jenkinsHTTPClient) CancelQueueItem(id int) error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	cancelQueueItemURI, _ := c.conf.Get(CancelQueueItemURI)
 	cancelQueueItemURI = fmt.Sprintf(cancelQueueItemURI, id)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 
 	targetURL, err := url.Parse(sah + cancelQueueItemURI)
 
@@ -489,13 +600,13 @@ func CancelQueueItem(id int) error {
 	return nil
 }
 
-func CreateCredential(content []byte) error {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	setCredURI, _ := JenkinsConfig.Get(JenkinsSetCredURI)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+func (c *jenkinsHTTPClient) CreateCredential(content []byte) error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	setCredURI, _ := c.conf.Get(JenkinsSetCredURI)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 	setCredURL, err := url.Parse(sah + setCredURI)
 	if err != nil {
 		logrus.Error(err)
@@ -522,14 +633,14 @@ func CreateCredential(content []byte) error {
 	return nil
 }
 
-func DeleteCredential(id string) error {
-	sah, _ := JenkinsConfig.Get(JenkinsServerAddress)
-	delCredURI, _ := JenkinsConfig.Get(JenkinsDeleteCredURI)
+func (c *jenkinsHTTPClient) DeleteCredential(id string) error {
+	sah, _ := c.conf.Get(JenkinsServerAddress)
+	delCredURI, _ := c.conf.Get(JenkinsDeleteCredURI)
 	delCredURI = fmt.Sprintf(delCredURI, id)
-	user, _ := JenkinsConfig.Get(JenkinsUser)
-	token, _ := JenkinsConfig.Get(JenkinsToken)
-	CrumbHeader, _ := JenkinsConfig.Get(JenkinsCrumbHeader)
-	Crumb, _ := JenkinsConfig.Get(JenkinsCrumb)
+	user, _ := c.conf.Get(JenkinsUser)
+	token, _ := c.conf.Get(JenkinsToken)
+	CrumbHeader, _ := c.conf.Get(JenkinsCrumbHeader)
+	Crumb, _ := c.conf.Get(JenkinsCrumb)
 	delCredURL, err := url.Parse(sah + delCredURI)
 	if err != nil {
 		logrus.Error(err)
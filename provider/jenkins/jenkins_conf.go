@@ -16,6 +16,7 @@ const StopJobURI = "StopjobURI"
 const CancelQueueItemURI = "CancelQueueItemURI"
 const ScriptURI = "ScriptURI"
 const DeleteBuildURI = "DeleteBuildURI"
+const DeleteJobURI = "DeleteJobURI"
 const GetCrumbURI = "GetCrumbURI"
 const JenkinsCrumbHeader = "JenkinsCrumbHeader"
 const JenkinsCrumb = "JenkinsCrumb"
@@ -51,6 +52,7 @@ var JenkinsConfig = jenkinsConfig{
 	StopJobURI:                   "/job/%s/lastBuild/stop",
 	CancelQueueItemURI:           "/queue/cancelItem?id=%d",
 	DeleteBuildURI:               "/job/%s/lastBuild/doDelete",
+	DeleteJobURI:                 "/job/%s/doDelete",
 	GetCrumbURI:                  "/crumbIssuer/api/xml?xpath=concat(//crumbRequestField,\":\",//crumb)",
 	JenkinsJobBuildURI:           "/job/%s/build",
 	JenkinsJobBuildWithParamsURI: "/job/%s/buildWithParameters",
@@ -83,6 +85,13 @@ const GetActiveNodesScript = `for (slave in hudson.model.Hudson.instance.slaves)
   }
 }
 `
+
+//GetNodesScript prints name, online, labels, busy executors and executors of slaves separated by tabs
+const GetNodesScript = `for (slave in hudson.model.Hudson.instance.slaves) {
+  def computer = slave.getComputer();
+  println slave.name + "\t" + !computer.isOffline() + "\t" + slave.getLabelString() + "\t" + computer.countBusy() + "\t" + computer.getNumExecutors();
+}
+`
 const upgradeStackScript = `
 set +x
 TEMPDIR=$(mktemp -d .r_cicd_stacks.XXXX) && cd $TEMPDIR
@@ -192,8 +201,16 @@ cihelper --envurl $R_UPGRADESTACK_ENDPOINT --accesskey $R_UPGRADESTACK_ACCESSKEY
 rm -r ../$TEMPDIR
 `
 
+//stepFinishScript posts the result of the step with the token header of the step
 const stepFinishScript = `def result = manager.build.result
-def command =  ["sh","-c","curl -s -d '' 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
+def command =  ["sh","-c","curl -s -d '' -H '%v' 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
+manager.listener.logger.println command.execute().text`
+
+//stepOutputFinishScript posts outputs the task step wrote to its output file along with its result
+const stepOutputFinishScript = `def result = manager.build.result
+def file = manager.build.workspace.child("%s")
+def OUTPUTS = file.exists() ? java.net.URLEncoder.encode(file.readToString(), "UTF-8") : ""
+def command =  ["sh","-c","curl -s -d 'OUTPUTS=${OUTPUTS}' -H '%v' 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
 manager.listener.logger.println command.execute().text`
 
 const stepSCMFinishScript = `def result = manager.build.result
@@ -201,7 +218,28 @@ def env = manager.build.environment
 def GIT_COMMIT = env.get("GIT_COMMIT")
 def GIT_URL = env.get("GIT_URL")
 def GIT_BRANCH = env.get("GIT_BRANCH")
-def command =  ["sh","-c","curl -s -d 'GIT_URL=${GIT_URL}&GIT_BRANCH=${GIT_BRANCH}&GIT_COMMIT=${GIT_COMMIT}' 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
+def changes = manager.build.workspace.child("%s")
+def CHANGED_FILES = changes.exists() ? "&CHANGED_FILES=" + java.net.URLEncoder.encode(changes.readToString(), "UTF-8") : ""
+def command =  ["sh","-c","curl -s -d 'GIT_URL=${GIT_URL}&GIT_BRANCH=${GIT_BRANCH}&GIT_COMMIT=${GIT_COMMIT}${CHANGED_FILES}' -H '%v' 'pipeline-server:60080/v1/events/stepfinish?id=%v&status=${result}&stageOrdinal=%v&stepOrdinal=%v'"]
 manager.listener.logger.println command.execute().text`
 
-const stepStartScript = "curl -s -d '' 'pipeline-server:60080/v1/events/stepstart?id=%v&stageOrdinal=%v&stepOrdinal=%v'"
+//stepStartScript notifies the start of the step with the token header of the step
+const stepStartScript = "curl -s -d '' -H '%v' 'pipeline-server:60080/v1/events/stepstart?id=%v&stageOrdinal=%v&stepOrdinal=%v'"
+
+//stepCacheRestoreScript resolves the cache key and extracts the cache into the workspace if it is saved,
+//requests carry the token header of the step
+const stepCacheRestoreScript = "R_CICD_CACHE_KEY=$(%s)\n" +
+	"curl -sf -H \"%s\" \"pipeline-server:60080/v1/events/cache?%s&key=${R_CICD_CACHE_KEY}\" | tar xzf - 2>/dev/null && echo \"restored cache ${R_CICD_CACHE_KEY}\" || echo \"no cache for key ${R_CICD_CACHE_KEY}\"\n"
+
+//stepCacheSaveScript uploads cache paths in the workspace after the step succeeds, unless the key is saved
+const stepCacheSaveScript = "\nif ! curl -sf -I -H \"%[3]s\" \"pipeline-server:60080/v1/events/cache?%[1]s&key=${R_CICD_CACHE_KEY}\" >/dev/null; then " +
+	"tar czf - $(ls -d %[2]s 2>/dev/null) 2>/dev/null | curl -s -H \"Content-Type: application/gzip\" -H \"%[3]s\" --data-binary @- \"pipeline-server:60080/v1/events/cache?%[1]s&key=${R_CICD_CACHE_KEY}\"; fi\n"
+
+//stepSecretEnvScript gets the env var of the step referencing secrets from the server with the token header of the step
+const stepSecretEnvScript = "%[1]s=$(curl -sf -H \"%[5]s\" \"pipeline-server:60080/v1/events/secretenv?name=%[1]s&id=%[2]s&stageOrdinal=%[3]d&stepOrdinal=%[4]d\") || { echo \"fail to get env %[1]s referencing secrets\"; exit 1; }\nexport %[1]s\n"
+
+//stepUploadScript uploads files matching globs in the workspace to the event endpoint with the token header of the step
+const stepUploadScript = "tar czf - $(ls -d %s 2>/dev/null) 2>/dev/null | curl -s -H \"Content-Type: application/gzip\" -H \"%s\" --data-binary @- \"pipeline-server:60080/v1/events/%s?id=%v&stageOrdinal=%v&stepOrdinal=%v\""
+
+//stepExitScript runs the commands when the step exits, whatever its result
+const stepExitScript = "trap '%s' EXIT\n"
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,31 +17,37 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/encryption"
 	"github.com/rancher/pipeline/model"
 	"github.com/rancher/pipeline/server/service"
 	"github.com/rancher/pipeline/util"
-	"github.com/sluu99/uuid"
 )
 
 type JenkinsProvider struct {
+	client JenkinsClient
+}
+
+func NewJenkinsProvider(client JenkinsClient) JenkinsProvider {
+	return JenkinsProvider{client: client}
 }
 
 func (j JenkinsProvider) RunPipeline(p *model.Pipeline, triggerType string) (*model.Activity, error) {
 
-	activity, err := ToActivity(p)
+	activity, err := j.ToActivity(p)
 	if err != nil {
 		return nil, err
 	}
 	activity.TriggerType = triggerType
-	initActivityEnvvars(activity)
+	service.InitActivityEnvvars(activity)
 
 	if len(p.Stages) == 0 {
 		return nil, errors.New("no stage in pipeline definition to run!")
 	}
-	for i := 0; i < len(p.Stages); i++ {
-		logrus.Debugf("creating stage:%v", p.Stages[i])
+	//stages of the activity include finally stages
+	for i := 0; i < len(activity.Pipeline.Stages); i++ {
+		logrus.Debugf("creating stage:%v", activity.Pipeline.Stages[i])
 		if err := j.CreateStage(activity, i); err != nil {
-			logrus.Error(errors.Wrapf(err, "stage <%s> fail", p.Stages[i].Name))
+			logrus.Error(errors.Wrapf(err, "stage <%s> fail", activity.Pipeline.Stages[i].Name))
 			return nil, err
 		}
 	}
@@ -62,7 +69,7 @@ func (j JenkinsProvider) RunPipeline(p *model.Pipeline, triggerType string) (*mo
 func (j JenkinsProvider) RerunActivity(a *model.Activity) error {
 
 	jobName := getJobName(a, 0, 0)
-	_, err := GetJobInfo(jobName)
+	_, err := j.client.GetJobInfo(jobName)
 	if err != nil {
 		//job records are missing in jenkins, regenerate them
 		for i := 0; i < len(a.Pipeline.Stages); i++ {
@@ -73,16 +80,17 @@ func (j JenkinsProvider) RerunActivity(a *model.Activity) error {
 		}
 	} else {
 		//clean previous build
-		if err := DeleteFormerBuild(a); err != nil {
+		if err := j.DeleteFormerBuild(a); err != nil {
 			return err
 		}
 	}
 	//find an available node to run
-	nodeName, err := getNodeNameToRun()
+	nodeName, reason, err := j.selectNode(service.NodeLabels(&a.Pipeline), "")
 	if err != nil {
 		return err
 	}
 	a.NodeName = nodeName
+	a.NodeReason = reason
 	err = j.UpdateJobConf(a)
 	if err != nil {
 		logrus.Errorf("fail to update job config before rerun: %v", err)
@@ -91,18 +99,45 @@ func (j JenkinsProvider) RerunActivity(a *model.Activity) error {
 	logrus.Infof("rerunpipeline,get nodeName:%v", nodeName)
 	a.RunSequence = a.Pipeline.RunCount + 1
 	a.StartTS = time.Now().UnixNano() / int64(time.Millisecond)
-	initActivityEnvvars(a)
+	service.InitActivityEnvvars(a)
 	err = j.RunStage(a, 0)
 	return err
 }
 
+//ResumeActivity runs a completed activity again from the step. The workspace is restored
+//if it was cleaned up or the node of the activity is offline
+func (j JenkinsProvider) ResumeActivity(a *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	jobName := getJobName(a, 0, 0)
+	if _, err := j.client.GetJobInfo(jobName); err != nil {
+		//job records are missing in jenkins, regenerate them
+		for i := 0; i < len(a.Pipeline.Stages); i++ {
+			if err := j.CreateStage(a, i); err != nil {
+				logrus.Error(errors.Wrapf(err, "recreate stage <%s> fail", a.Pipeline.Stages[i].Name))
+				return err
+			}
+		}
+	}
+	nodeName := a.NodeName
+	if err := j.ensureNodeOnline(a); err != nil {
+		return err
+	}
+	//checkout the commit of the activity to restore
+	if err := j.UpdateJobConf(a); err != nil {
+		return err
+	}
+	restore := !a.Pipeline.KeepWorkspace || a.NodeName != nodeName
+	logrus.Infof("resume activity '%s' on node '%s', restore workspace: %v", a.Id, a.NodeName, restore)
+	return service.ResumeFrom(j, a, stageOrdinal, stepOrdinal, restore)
+}
+
 func (j JenkinsProvider) StopActivity(a *model.Activity) error {
 	logrus.Debugf("stopping activity, current status: %s", a.Status)
 	a.Status = model.ActivityAbort
 	now := time.Now().UnixNano() / int64(time.Millisecond)
 	a.StopTS = now
 	for stageOrdinal, stage := range a.ActivityStages {
-		if stage.Status == model.ActivityStageSuccess || stage.Status == model.ActivityStageSkip {
+		//stages run concurrently by needs
+		if stage.Status != model.ActivityStageBuilding {
 			continue
 		} else {
 			for stepOrdinal := 0; stepOrdinal < len(stage.ActivitySteps); stepOrdinal++ {
@@ -114,7 +149,6 @@ func (j JenkinsProvider) StopActivity(a *model.Activity) error {
 			logrus.Debugf("aborting stage, current status: %s", stage.Status)
 			stage.Status = model.ActivityStageAbort
 			stage.Duration = now - stage.StartTS
-			break
 		}
 
 	}
@@ -123,7 +157,7 @@ func (j JenkinsProvider) StopActivity(a *model.Activity) error {
 
 func (j JenkinsProvider) StopStep(a *model.Activity, stageOrdinal int, stepOrdinal int) error {
 	jobname := getJobName(a, stageOrdinal, stepOrdinal)
-	info, err := GetJobInfo(jobname)
+	info, err := j.client.GetJobInfo(jobname)
 	if err != nil {
 		return err
 	}
@@ -139,16 +173,16 @@ func (j JenkinsProvider) StopStep(a *model.Activity, stageOrdinal int, stepOrdin
 		if !ok {
 			return fmt.Errorf("type assertion fail for queueId")
 		}
-		if err := CancelQueueItem(int(queueId)); err != nil {
+		if err := j.client.CancelQueueItem(int(queueId)); err != nil {
 			return fmt.Errorf("cancel queueitem error:%v", err)
 		}
 	} else {
-		buildInfo, err := GetBuildInfo(jobname)
+		buildInfo, err := j.client.GetBuildInfo(jobname)
 		if err != nil {
 			return err
 		}
 		if buildInfo.Building {
-			if err := StopJob(jobname); err != nil {
+			if err := j.client.StopJob(jobname); err != nil {
 				return err
 			}
 			step.Status = model.ActivityStepAbort
@@ -163,39 +197,119 @@ func (j JenkinsProvider) CreateStage(activity *model.Activity, ordinal int) erro
 	logrus.Info("create jenkins job from stage")
 	stage := activity.ActivityStages[ordinal]
 	for i, _ := range stage.ActivitySteps {
-		conf := j.generateStepJenkinsProject(activity, ordinal, i)
+		conf, err := j.generateStepJenkinsProject(activity, ordinal, i)
+		if err != nil {
+			return err
+		}
 		jobName := getJobName(activity, ordinal, i)
 		bconf, _ := xml.MarshalIndent(conf, "  ", "    ")
-		if err := CreateJob(jobName, bconf); err != nil {
+		if err := j.client.CreateJob(jobName, bconf); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-//getNodeNameToRun gets a random node name to run
-func getNodeNameToRun() (string, error) {
-	nodes, err := GetActiveNodesName()
+//selectNode picks a node to run the activity requiring the labels, the excluded node is not picked.
+//Returns the node name and the reason to pick it
+func (j JenkinsProvider) selectNode(labels []string, exclude string) (string, string, error) {
+	nodes, err := j.client.GetNodes()
 	if err != nil {
-		return "", errors.Wrapf(err, "fail to find an active node to work")
+		return "", "", errors.Wrapf(err, "fail to find an active node to work")
+	}
+	return pickNode(nodes, labels, exclude)
+}
+
+//pickNode picks the online node having all the labels with the fewest busy executors,
+//then the most idle executors. Ties are broken randomly to spread activities
+func pickNode(nodes []JenkinsNode, labels []string, exclude string) (string, string, error) {
+	online := 0
+	candidates := []JenkinsNode{}
+	for _, node := range nodes {
+		if !node.Online || node.Name == exclude {
+			continue
+		}
+		online++
+		if hasLabels(node, labels) {
+			candidates = append(candidates, node)
+		}
+	}
+	if online == 0 {
+		return "", "", errors.New("no active worker node available, please add at least one slave node or check if it is ready")
 	}
-	if len(nodes) == 0 {
-		return "", errors.New("no active worker node available, please add at least one slave node or check if it is ready")
+	if len(candidates) == 0 {
+		return "", "", fmt.Errorf("none of %d active worker nodes has labels %v", online, labels)
 	}
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	index := r.Intn(len(nodes))
-	logrus.Debugf("pick %s to work", nodes[index])
-	return nodes[index], nil
+	perm := r.Perm(len(candidates))
+	best := candidates[perm[0]]
+	for _, i := range perm[1:] {
+		node := candidates[i]
+		if node.BusyExecutors < best.BusyExecutors ||
+			(node.BusyExecutors == best.BusyExecutors && node.Executors-node.BusyExecutors > best.Executors-best.BusyExecutors) {
+			best = node
+		}
+	}
+	matching := fmt.Sprintf("%d active nodes", len(candidates))
+	if len(labels) > 0 {
+		matching = fmt.Sprintf("%d of %d active nodes having labels %v", len(candidates), online, labels)
+	}
+	reason := fmt.Sprintf("least loaded of %s, %d of %d executors busy", matching, best.BusyExecutors, best.Executors)
+	logrus.Debugf("pick %s to work, %s", best.Name, reason)
+	return best.Name, reason, nil
+}
+
+func hasLabels(node JenkinsNode, labels []string) bool {
+	for _, label := range labels {
+		found := false
+		for _, l := range node.Labels {
+			if l == label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//ensureNodeOnline picks another node if the node of the activity goes offline before the activity starts
+func (j JenkinsProvider) ensureNodeOnline(activity *model.Activity) error {
+	nodes, err := j.client.GetNodes()
+	if err != nil {
+		logrus.Warningf("fail to check node '%s' of activity '%s': %v", activity.NodeName, activity.Id, err)
+		return nil
+	}
+	for _, node := range nodes {
+		if node.Name == activity.NodeName && node.Online {
+			return nil
+		}
+	}
+	offline := activity.NodeName
+	nodeName, reason, err := pickNode(nodes, service.NodeLabels(&activity.Pipeline), offline)
+	if err != nil {
+		return errors.Wrapf(err, "node '%s' is offline", offline)
+	}
+	logrus.Infof("node '%s' of activity '%s' is offline, fall back to node '%s'", offline, activity.Id, nodeName)
+	activity.NodeName = nodeName
+	activity.NodeReason = fmt.Sprintf("fall back from offline node '%s', %s", offline, reason)
+	if activity.EnvVars != nil {
+		activity.EnvVars["CICD_NODE_NAME"] = nodeName
+	}
+	return j.UpdateJobConf(activity)
 }
 
 //DeleteFormerBuild delete last build info of a completed activity
-func DeleteFormerBuild(activity *model.Activity) error {
+func (j JenkinsProvider) DeleteFormerBuild(activity *model.Activity) error {
 	for stageOrdinal, stage := range activity.ActivityStages {
 		for stepOrdinal, step := range stage.ActivitySteps {
 			jobName := getJobName(activity, stageOrdinal, stepOrdinal)
-			if step.Status == model.ActivityStepSuccess || step.Status == model.ActivityStepFail {
+			if step.Status == model.ActivityStepSuccess || step.Status == model.ActivityStepFail ||
+				step.Status == model.ActivityStepFailedAllowed {
 				logrus.Infof("deleting:%v", jobName)
-				if err := DeleteBuild(jobName); err != nil {
+				if err := j.client.DeleteBuild(jobName); err != nil {
 					return err
 				}
 			}
@@ -210,14 +324,17 @@ func DeleteFormerBuild(activity *model.Activity) error {
 func (j JenkinsProvider) UpdateJobConf(activity *model.Activity) error {
 	for stageNum := 0; stageNum < len(activity.ActivityStages); stageNum++ {
 		for stepNum := 0; stepNum < len(activity.ActivityStages[stageNum].ActivitySteps); stepNum++ {
-			conf := j.generateStepJenkinsProject(activity, stageNum, stepNum)
+			conf, err := j.generateStepJenkinsProject(activity, stageNum, stepNum)
+			if err != nil {
+				return err
+			}
 			if stageNum == 0 && stepNum == 0 && activity.CommitInfo != "" && activity.CommitInfo != "null" {
 				conf.Scm.GitBranch = activity.CommitInfo
 			}
 			jobName := getJobName(activity, stageNum, stepNum)
 			bconf, _ := xml.MarshalIndent(conf, "  ", "    ")
 			logrus.Debugf("updating jenkins job:%s", jobName)
-			if err := UpdateJob(jobName, bconf); err != nil {
+			if err := j.client.UpdateJob(jobName, bconf); err != nil {
 				logrus.Errorf("updatejob error:%v", err)
 				return err
 			}
@@ -226,155 +343,33 @@ func (j JenkinsProvider) UpdateJobConf(activity *model.Activity) error {
 	return nil
 }
 
-func EvaluateConditions(activity *model.Activity, condition *model.PipelineConditions) (bool, error) {
-	if condition == nil || (len(condition.All) == 0 && len(condition.Any) == 0) {
-		return false, fmt.Errorf("Nil condition")
-	}
-	if len(condition.All) > 0 {
-		for _, c := range condition.All {
-			resCond, err := EvaluateCondition(activity, c)
-			if err != nil {
-				return false, err
-			}
-			if !resCond {
-				return false, nil
-			}
-		}
-		return true, nil
-	}
-
-	for _, c := range condition.Any {
-		resCond, err := EvaluateCondition(activity, c)
-		if err != nil {
-			return false, err
-		}
-		if resCond {
-			return true, nil
-		}
-	}
-	return false, nil
-}
-
-//valid format:     xxx=xxx; xxx!=xxx
-func EvaluateCondition(activity *model.Activity, condition string) (bool, error) {
-	m := util.GetParams(`(?P<Key>.*?)!=(?P<Value>.*)`, condition)
-	if m["Key"] != "" && m["Value"] != "" {
-		key := SubstituteVar(activity, m["Key"])
-		val := SubstituteVar(activity, m["Value"])
-		envVal := activity.EnvVars[key]
-		if envVal != val {
-			return true, nil
-		}
-		return false, nil
-	}
-
-	m = util.GetParams(`(?P<Key>.*?)=(?P<Value>.*)`, condition)
-	if m["Key"] != "" && m["Value"] != "" {
-		key := SubstituteVar(activity, m["Key"])
-		val := SubstituteVar(activity, m["Value"])
-		envVal := activity.EnvVars[key]
-		if envVal == val {
-			return true, nil
-		}
-		return false, nil
-	}
-	return false, fmt.Errorf("cannot parse condition:%s", condition)
+func (j JenkinsProvider) RunStage(activity *model.Activity, ordinal int) error {
+	return service.RunStage(j, activity, ordinal)
 }
 
-func (j JenkinsProvider) RunStage(activity *model.Activity, ordinal int) error {
-	if len(activity.ActivityStages) <= ordinal {
-		return fmt.Errorf("error run stage,stage index out of range")
-	}
-	stage := activity.Pipeline.Stages[ordinal]
-	logrus.Infof("run stage:%s", stage.Name)
-	logrus.Debugf("paras:%v,%v,%v,%v", activity.Pipeline, activity, len(activity.Pipeline.Stages), ordinal)
-	condFlag := true
-	curTime := time.Now().UnixNano() / int64(time.Millisecond)
-	var err error
-	if service.HasStageCondition(stage) {
-		condFlag, err = EvaluateConditions(activity, stage.Conditions)
-		if err != nil {
-			logrus.Errorf("Evaluate condition '%v' got error:%v", stage.Conditions, err)
-			return err
-		}
-	}
-	if !condFlag {
-		activity.ActivityStages[ordinal].Status = model.ActivityStageSkip
-		if ordinal == len(activity.ActivityStages)-1 {
-			//skip last stage and success activity
-			activity.Status = model.ActivitySuccess
-			activity.StopTS = curTime
-			j.OnActivityCompelte(activity)
-		} else {
-			//skip the stage then run next one.
-			err = j.RunStage(activity, ordinal+1)
-		}
+func (j JenkinsProvider) RunStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	if skipped, err := service.SkipStep(j, activity, stageOrdinal, stepOrdinal); skipped || err != nil {
 		return err
 	}
-
-	activity.ActivityStages[ordinal].StartTS = curTime
-	//Trigger all step jobs in the stage.
-	if stage.Parallel {
-		for i := 0; i < len(stage.Steps); i++ {
-			if err := j.RunStep(activity, ordinal, i); err != nil {
-				logrus.Errorf("run step error:%v", err)
-				return err
-			}
-		}
-	} else {
-		//Trigger first to run sequentially
-		if err := j.RunStep(activity, ordinal, 0); err != nil {
-			logrus.Errorf("run step error:%v", err)
+	if !service.IsActivityStarted(activity) {
+		if err := j.ensureNodeOnline(activity); err != nil {
 			return err
 		}
 	}
-
-	return nil
-}
-
-func (j JenkinsProvider) RunStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
-	if len(activity.ActivityStages) <= stageOrdinal ||
-		len(activity.ActivityStages[stageOrdinal].ActivitySteps) <= stepOrdinal ||
-		stageOrdinal < 0 || stepOrdinal < 0 {
-		return fmt.Errorf("error run stage,stage index out of range")
-	}
-	stage := activity.Pipeline.Stages[stageOrdinal]
-	step := stage.Steps[stepOrdinal]
-	condFlag := true
-	var err error
-	if service.HasStepCondition(step) {
-		condFlag, err = EvaluateConditions(activity, step.Conditions)
+	logrus.Debugf("Run step:%s,%d,%d", activity.Pipeline.Name, stageOrdinal, stepOrdinal)
+	jobName := getJobName(activity, stageOrdinal, stepOrdinal)
+	if service.IsFinallyStage(activity, stageOrdinal) || len(service.OutputEnvVars(activity)) > 0 {
+		//job of a finally step gets the outcome of main stages, jobs of later steps get outputs of former steps
+		conf, err := j.generateStepJenkinsProject(activity, stageOrdinal, stepOrdinal)
 		if err != nil {
-			logrus.Errorf("Evaluate condition '%v' got error:%v", step.Conditions, err)
 			return err
 		}
-	}
-	if !condFlag {
-		activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Status = model.ActivityStepSkip
-		actiStage := activity.ActivityStages[stageOrdinal]
-		curTime := time.Now().UnixNano() / int64(time.Millisecond)
-		if service.IsStageSuccess(actiStage) {
-			//if skipped and stage success
-			actiStage.Status = model.ActivityStageSuccess
-			actiStage.Duration = curTime - actiStage.StartTS
-			if stageOrdinal == len(activity.ActivityStages)-1 {
-				//last stage success and success activity
-				activity.Status = model.ActivitySuccess
-				activity.StopTS = curTime
-				j.OnActivityCompelte(activity)
-			} else {
-				//success the stage then run next one.
-				err = j.RunStage(activity, stageOrdinal+1)
-			}
-		} else if !stage.Parallel {
-			//sequential, skipped current step then run next step
-			err = j.RunStep(activity, stageOrdinal, stepOrdinal+1)
+		bconf, _ := xml.MarshalIndent(conf, "  ", "    ")
+		if err := j.client.UpdateJob(jobName, bconf); err != nil {
+			return err
 		}
-		return err
 	}
-	logrus.Debugf("Run step:%s,%d,%d", activity.Pipeline.Name, stageOrdinal, stepOrdinal)
-	jobName := getJobName(activity, stageOrdinal, stepOrdinal)
-	if _, err := BuildJob(jobName, map[string]string{}); err != nil {
+	if _, err := j.client.BuildJob(jobName, map[string]string{}); err != nil {
 		logrus.Errorf("run %s error:%v", jobName, err)
 		return err
 	}
@@ -382,22 +377,52 @@ func (j JenkinsProvider) RunStep(activity *model.Activity, stageOrdinal int, ste
 	return nil
 }
 
-func (j JenkinsProvider) generateStepJenkinsProject(activity *model.Activity, stageOrdinal int, stepOrdinal int) *JenkinsProject {
+func (j JenkinsProvider) generateStepJenkinsProject(activity *model.Activity, stageOrdinal int, stepOrdinal int) (*JenkinsProject, error) {
 	logrus.Info("generating jenkins project config")
 	activityId := activity.Id
+	//callbacks of the step carry its token
+	token, err := service.StepToken(activityId, stageOrdinal, stepOrdinal)
+	if err != nil {
+		return nil, err
+	}
+	tokenHeader := service.StepTokenHeader + ": " + token
 	workspaceName := path.Join("${JENKINS_HOME}", "workspace", activityId)
 	stage := activity.Pipeline.Stages[stageOrdinal]
 	step := stage.Steps[stepOrdinal]
 
 	step.Services = service.GetServices(activity, stageOrdinal, stepOrdinal)
 	taskShells := []JenkinsTaskShell{}
-	taskShells = append(taskShells, JenkinsTaskShell{Command: commandBuilder(activity, step)})
+	command := commandBuilder(activity, step, stageOrdinal, stepOrdinal, tokenHeader)
+	if cache := service.GetStepCache(activity, stageOrdinal, stepOrdinal); cache != nil {
+		query := fmt.Sprintf("id=%s&stageOrdinal=%d&stepOrdinal=%d", url.QueryEscape(activityId), stageOrdinal, stepOrdinal)
+		//cache paths are validated not to need quoting
+		command = fmt.Sprintf(stepCacheRestoreScript, cacheKeyScript(cache, step), tokenHeader, query) + command +
+			fmt.Sprintf(stepCacheSaveScript, query, strings.Join(cache.Paths, " "), tokenHeader)
+	}
+	if step.Type == model.StepTypeTask {
+		//artifact and test report globs are validated not to need quoting
+		uploads := []string{}
+		if len(step.Artifacts) > 0 {
+			uploads = append(uploads, fmt.Sprintf(stepUploadScript, strings.Join(step.Artifacts, " "), tokenHeader, "artifacts", url.QueryEscape(activityId), stageOrdinal, stepOrdinal))
+		}
+		if len(step.TestReports) > 0 {
+			uploads = append(uploads, fmt.Sprintf(stepUploadScript, strings.Join(step.TestReports, " "), tokenHeader, "testreports", url.QueryEscape(activityId), stageOrdinal, stepOrdinal))
+		}
+		if len(uploads) > 0 {
+			command = fmt.Sprintf(stepExitScript, strings.Join(uploads, "; ")) + command
+		}
+	}
+	taskShells = append(taskShells, JenkinsTaskShell{Command: command})
 	commandBuilders := JenkinsBuilder{TaskShells: taskShells}
 
 	scm := JenkinsSCM{Class: "hudson.scm.NullSCM"}
 
 	postBuildSctipt := stepFinishScript
-	if step.Type == model.StepTypeSCM {
+	scriptArgs := []interface{}{tokenHeader, url.QueryEscape(activity.Id), stageOrdinal, stepOrdinal}
+	if step.Type == model.StepTypeTask && !step.IsService {
+		postBuildSctipt = stepOutputFinishScript
+		scriptArgs = append([]interface{}{service.StepOutputFile(stageOrdinal, stepOrdinal)}, scriptArgs...)
+	} else if step.Type == model.StepTypeSCM {
 		scm = JenkinsSCM{
 			Class:           "hudson.plugins.git.GitSCM",
 			Plugin:          "git@3.3.1",
@@ -407,11 +432,12 @@ func (j JenkinsProvider) generateStepJenkinsProject(activity *model.Activity, st
 			GitBranch:       step.Branch,
 		}
 		postBuildSctipt = stepSCMFinishScript
+		scriptArgs = append([]interface{}{service.ChangedFilesFile}, scriptArgs...)
 	}
 	preSCMStep := PreSCMBuildStepsWrapper{
 		Plugin:      "preSCMbuildstep@0.3",
 		FailOnError: false,
-		Command:     fmt.Sprintf(stepStartScript, url.QueryEscape(activityId), stageOrdinal, stepOrdinal),
+		Command:     fmt.Sprintf(stepStartScript, tokenHeader, url.QueryEscape(activityId), stageOrdinal, stepOrdinal),
 	}
 
 	//Step timeout settings, at least 3 minutes
@@ -448,12 +474,12 @@ func (j JenkinsProvider) generateStepJenkinsProject(activity *model.Activity, st
 		GroovyScript: GroovyScript{
 			Plugin:  "script-security@1.30",
 			Sandbox: false,
-			Script:  fmt.Sprintf(postBuildSctipt, url.QueryEscape(activity.Id), stageOrdinal, stepOrdinal),
+			Script:  fmt.Sprintf(postBuildSctipt, scriptArgs...),
 		},
 	}
 	v.Publishers = pbt
 
-	return v
+	return v, nil
 
 }
 
@@ -462,18 +488,48 @@ func (j JenkinsProvider) Reset() error {
 	return nil
 }
 
-func commandBuilder(activity *model.Activity, step *model.Step) string {
+func commandBuilder(activity *model.Activity, step *model.Step, stageOrdinal int, stepOrdinal int, tokenHeader string) string {
 	stringBuilder := new(bytes.Buffer)
 	stringBuilder.WriteString("set +x \n")
 	switch step.Type {
 	case model.StepTypeTask:
 
+		//outputs of former steps are written by steps, so they are exported as shell variables in single quotes
+		//and env of the step refers to them instead of having the values substituted
+		outputs := service.OutputEnvVars(activity)
+		outputNames := []string{}
+		for k := range outputs {
+			outputNames = append(outputNames, k)
+		}
+		sort.Strings(outputNames)
+		for _, k := range outputNames {
+			stringBuilder.WriteString(fmt.Sprintf("export %s=%s\n", k, QuoteShellLiteral(outputs[k])))
+		}
 		envVars := ""
+		secretVars := ""
 		if len(step.Env) > 0 {
 			for _, para := range step.Env {
+				if service.HasSecretRef(para) {
+					//got from the server when the step runs, not kept in the job config or the workspace
+					name := strings.SplitN(para, "=", 2)[0]
+					secretVars += fmt.Sprintf(stepSecretEnvScript, name, url.QueryEscape(activity.Id), stageOrdinal, stepOrdinal, tokenHeader)
+					envVars += fmt.Sprintf("-e %s ", name)
+					continue
+				}
 				envVars += fmt.Sprintf("-e %s ", QuoteShell(para))
 			}
 		}
+		if status, ok := activity.EnvVars["CICD_ACTIVITY_STATUS"]; ok {
+			envVars += fmt.Sprintf("-e %s ", QuoteShell("CICD_ACTIVITY_STATUS="+status))
+		}
+		for _, k := range outputNames {
+			envVars += fmt.Sprintf("-e %s ", k)
+		}
+		if !step.IsService {
+			outputFile := service.StepOutputFile(stageOrdinal, stepOrdinal)
+			envVars += fmt.Sprintf("-e \"%s=${PWD}/%s\" ", service.EnvOutputFile, outputFile)
+			stringBuilder.WriteString(fmt.Sprintf("rm -f %s\n", outputFile))
+		}
 
 		entrypointPara := ""
 		argsPara := ""
@@ -517,6 +573,7 @@ func commandBuilder(activity *model.Activity, step *model.Step) string {
 
 		}
 
+		stringBuilder.WriteString(secretVars)
 		volumeInfo := "--volumes-from ${HOSTNAME} -w ${PWD}"
 		//volumeInfo := "-v /var/jenkins_home/workspace:/var/jenkins_home/workspace -w ${PWD}"
 		stringBuilder.WriteString("docker run --rm")
@@ -592,6 +649,8 @@ func commandBuilder(activity *model.Activity, step *model.Step) string {
 			stringBuilder.WriteString(fmt.Sprintf("%s=%s\n", splits[0], QuoteShell(splits[1])))
 		}
 		stringBuilder.WriteString("\nR_CICD_EOF\n")
+		//files changed by the commit, for conditions of next stages
+		stringBuilder.WriteString(fmt.Sprintf("git diff --name-only HEAD~1 HEAD > %[1]s 2>/dev/null || rm -f %[1]s\n", service.ChangedFilesFile))
 
 	case model.StepTypeUpgradeService:
 		stringBuilder.WriteString(". ${PWD}/.r_cicd.env\n")
@@ -703,21 +762,22 @@ func commandBuilder(activity *model.Activity, step *model.Step) string {
 
 func (j JenkinsProvider) SyncActivity(activity *model.Activity) error {
 	for i, actiStage := range activity.ActivityStages {
-		for j, actiStep := range actiStage.ActivitySteps {
-			if actiStep.Status == model.ActivityStepFail || actiStep.Status == model.ActivityStepSuccess {
+		for stepOrdinal, actiStep := range actiStage.ActivitySteps {
+			if actiStep.Status == model.ActivityStepFail || actiStep.Status == model.ActivityStepSuccess ||
+				actiStep.Status == model.ActivityStepFailedAllowed {
 				continue
 			}
-			jobName := getJobName(activity, i, j)
-			jobInfo, err := GetJobInfo(jobName)
+			jobName := getJobName(activity, i, stepOrdinal)
+			jobInfo, err := j.client.GetJobInfo(jobName)
 			if err != nil {
 				//cannot get jobinfo
 				logrus.Debugf("got job info:%v,err:%v", jobInfo, err)
 				return err
 			}
 
-			buildInfo, err := GetBuildInfo(jobName)
+			buildInfo, err := j.client.GetBuildInfo(jobName)
 			if err != nil {
-				if actiStage.NeedApproval && j == 0 {
+				if actiStage.NeedApproval && stepOrdinal == 0 {
 					//Pending
 					actiStage.Status = model.ActivityStagePending
 					activity.Status = model.ActivityPending
@@ -730,11 +790,15 @@ func (j JenkinsProvider) SyncActivity(activity *model.Activity) error {
 					actiStep.StartTS = buildInfo.Timestamp
 					actiStep.Duration = buildInfo.Duration
 					actiStep.Status = model.ActivityStepSuccess
-					if j == len(actiStage.ActivitySteps)-1 {
+					if stepOrdinal == len(actiStage.ActivitySteps)-1 {
 						//Stage Success
 						actiStage.Status = model.ActivityStageSuccess
 						actiStage.Duration = buildInfo.Timestamp + buildInfo.Duration - actiStage.StartTS
 					}
+				} else if buildInfo.Result == "FAILURE" && service.IsFailureAllowed(activity, i, stepOrdinal) {
+					actiStep.StartTS = buildInfo.Timestamp
+					actiStep.Duration = buildInfo.Duration
+					actiStep.Status = model.ActivityStepFailedAllowed
 				} else if buildInfo.Result == "FAILURE" {
 					actiStep.StartTS = buildInfo.Timestamp
 					actiStep.Duration = buildInfo.Duration
@@ -776,7 +840,7 @@ func (j JenkinsProvider) SyncActivityStale(activity *model.Activity) (bool, erro
 			continue
 		}
 
-		jobInfo, err := GetJobInfo(jobName)
+		jobInfo, err := j.client.GetJobInfo(jobName)
 		if err != nil {
 			//cannot get jobinfo
 			logrus.Infof("got job info:%v,err:%v", jobInfo, err)
@@ -789,7 +853,7 @@ func (j JenkinsProvider) SyncActivityStale(activity *model.Activity) (bool, erro
 				return nil
 			}
 		*/
-		buildInfo, err := GetBuildInfo(jobName)
+		buildInfo, err := j.client.GetBuildInfo(jobName)
 		//logrus.Infof("got build info:%v, err:%v", buildInfo, err)
 		if err != nil {
 			//cannot get build info
@@ -808,7 +872,7 @@ func (j JenkinsProvider) SyncActivityStale(activity *model.Activity) (bool, erro
 
 		//logrus.Info("get buildinfo result:%v,actiStagestatus:%v", buildInfo.Result, actiStage.Status)
 		if err == nil {
-			rawOutput, err := GetBuildRawOutput(jobName, 0)
+			rawOutput, err := j.client.GetBuildRawOutput(jobName, 0)
 			if err != nil {
 				logrus.Infof("got rawOutput:%v,err:%v", rawOutput, err)
 			}
@@ -848,11 +912,13 @@ func (j JenkinsProvider) SyncActivityStale(activity *model.Activity) (bool, erro
 
 //OnActivityCompelte helps clean up
 func (j JenkinsProvider) OnActivityCompelte(activity *model.Activity) {
+	//capacity is freed for queued activities
+	service.NotifyQueue()
 	//clean related container by label
 	command := fmt.Sprintf("docker ps --filter label=activityid=%s -q | xargs docker rm -f", activity.Id)
 	cleanServiceScript := fmt.Sprintf(ScriptSkel, activity.NodeName, strings.Replace(command, "\"", "\\\"", -1))
 	logrus.Debugf("cleanservicescript is: %v", cleanServiceScript)
-	res, err := ExecScript(cleanServiceScript)
+	res, err := j.client.ExecScript(cleanServiceScript)
 	logrus.Debugf("clean services result:%v,%v", res, err)
 	if err != nil {
 		logrus.Errorf("error cleanning up on worker node: %v, got result '%s'", err, res)
@@ -862,7 +928,7 @@ func (j JenkinsProvider) OnActivityCompelte(activity *model.Activity) {
 	if !activity.Pipeline.KeepWorkspace {
 		command = "rm -rf ${System.getenv('JENKINS_HOME')}/workspace/" + activity.Id
 		cleanWorkspaceScript := fmt.Sprintf(ScriptSkel, activity.NodeName, strings.Replace(command, "\"", "\\\"", -1))
-		res, err = ExecScript(cleanWorkspaceScript)
+		res, err = j.client.ExecScript(cleanWorkspaceScript)
 		if err != nil {
 			logrus.Errorf("error cleanning up on worker node: %v, got result '%s'", err, res)
 		}
@@ -871,17 +937,44 @@ func (j JenkinsProvider) OnActivityCompelte(activity *model.Activity) {
 
 }
 
+//OnDeleteActivity removes jenkins jobs and the workspace of a removed activity
+func (j JenkinsProvider) OnDeleteActivity(activity *model.Activity) error {
+	for stageOrdinal, stage := range activity.ActivityStages {
+		for stepOrdinal := range stage.ActivitySteps {
+			jobName := getJobName(activity, stageOrdinal, stepOrdinal)
+			if err := j.client.DeleteJob(jobName); err != nil {
+				return errors.Wrapf(err, "fail to delete job '%s'", jobName)
+			}
+		}
+	}
+	if activity.NodeName == "" || activity.Id == "" {
+		return nil
+	}
+	command := "rm -rf ${System.getenv('JENKINS_HOME')}/workspace/" + activity.Id
+	cleanWorkspaceScript := fmt.Sprintf(ScriptSkel, activity.NodeName, strings.Replace(command, "\"", "\\\"", -1))
+	res, err := j.client.ExecScript(cleanWorkspaceScript)
+	if err != nil {
+		return errors.Wrapf(err, "fail to clean workspace on node '%s', got result '%s'", activity.NodeName, res)
+	}
+	logrus.Debugf("clean workspace result:%v", res)
+	return nil
+}
+
 func (j JenkinsProvider) OnCreateAccount(account *model.GitAccount) error {
 	jenkinsCred := &JenkinsCredential{}
 	jenkinsCred.Class = "com.cloudbees.plugins.credentials.impl.UsernamePasswordCredentialsImpl"
 	jenkinsCred.Scope = "GLOBAL"
 	jenkinsCred.Id = account.Id
+	token, err := encryption.Decrypt(account.AccessToken)
+	if err != nil {
+		return err
+	}
 	if account.AccountType == "github" {
 		jenkinsCred.Username = account.Login
-		jenkinsCred.Password = account.AccessToken
+		jenkinsCred.Password = token
 	} else if account.AccountType == "gitlab" {
 		jenkinsCred.Username = "oauth2"
-		jenkinsCred.Password = account.AccessToken
+		jenkinsCred.Password = token
 	} else {
 		return errors.New("unknown scmtype")
 	}
@@ -894,7 +987,7 @@ func (j JenkinsProvider) OnCreateAccount(account *model.GitAccount) error {
 	buff := bytes.NewBufferString("json=")
 	buff.Write(b)
 	fmt.Print(string(buff.Bytes()))
-	if err := CreateCredential(buff.Bytes()); err != nil {
+	if err := j.client.CreateCredential(buff.Bytes()); err != nil {
 		return err
 	}
 	return nil
@@ -904,7 +997,7 @@ func (j JenkinsProvider) OnDeleteAccount(account *model.GitAccount) error {
 	if account == nil {
 		return errors.New("nil account")
 	}
-	return DeleteCredential(account.Id)
+	return j.client.DeleteCredential(account.Id)
 }
 
 func (j JenkinsProvider) GetStepLog(activity *model.Activity, stageOrdinal int, stepOrdinal int, paras map[string]interface{}) (string, error) {
@@ -918,7 +1011,7 @@ func (j JenkinsProvider) GetStepLog(activity *model.Activity, stageOrdinal int,
 	}
 	startLine := len(strings.Split(*logText, "\n"))
 
-	rawOutput, err := GetBuildRawOutput(jobName, startLine)
+	rawOutput, err := j.client.GetBuildRawOutput(jobName, startLine)
 	if err != nil {
 		return "", err
 	}
@@ -985,7 +1078,7 @@ func parseSteps(actiStage *model.ActivityStage, rawOutput string) bool {
 	for i, step := range actiStage.ActivitySteps {
 		finishStepNum := len(outputs) - 1
 		prevStatus := step.Status
-		logrus.Debug("getting step %v", i)
+		logrus.Debugf("getting step %v", i)
 		if i < finishStepNum-1 {
 			//passed steps
 			step.Status = model.ActivityStepSuccess
@@ -1049,78 +1142,48 @@ func parseStepTime(step *model.ActivityStep, log string, activityStartTS int64)
 }
 
 //ToActivity init an activity from pipeline def
-func ToActivity(p *model.Pipeline) (*model.Activity, error) {
+func (j JenkinsProvider) ToActivity(p *model.Pipeline) (*model.Activity, error) {
 
 	//Find a jenkins slave on which to run
-	nodeName, err := getNodeNameToRun()
+	nodeName, reason, err := j.selectNode(service.NodeLabels(p), "")
 	if err != nil {
 		return &model.Activity{}, err
 	}
-	activity := &model.Activity{
-		Id:          uuid.Rand().Hex(),
-		Pipeline:    *p,
-		RunSequence: p.RunCount + 1,
-		Status:      model.ActivityWaiting,
-		StartTS:     time.Now().UnixNano() / int64(time.Millisecond),
-		NodeName:    nodeName,
-	}
-	for _, stage := range p.Stages {
-		activity.ActivityStages = append(activity.ActivityStages, ToActivityStage(stage))
-	}
-
+	activity := service.NewActivity(p, nodeName)
+	activity.NodeReason = reason
 	return activity, nil
 }
 
-func initActivityEnvvars(activity *model.Activity) {
-	p := activity.Pipeline
-	vars := map[string]string{}
-	vars["CICD_PIPELINE_NAME"] = p.Name
-	vars["CICD_PIPELINE_ID"] = p.Id
-	vars["CICD_NODE_NAME"] = activity.NodeName
-	vars["CICD_ACTIVITY_ID"] = activity.Id
-	vars["CICD_ACTIVITY_SEQUENCE"] = strconv.Itoa(activity.RunSequence)
-	vars["CICD_GIT_URL"] = p.Stages[0].Steps[0].Repository
-	vars["CICD_GIT_BRANCH"] = p.Stages[0].Steps[0].Branch
-	vars["CICD_GIT_COMMIT"] = activity.CommitInfo
-	vars["CICD_TRIGGER_TYPE"] = activity.TriggerType
-	//user defined env vars
-	for _, envvar := range activity.Pipeline.Parameters {
-		splits := strings.SplitN(envvar, "=", 2)
-		if len(splits) != 2 {
-			continue
-		}
-		vars[splits[0]] = splits[1]
-	}
-	activity.EnvVars = vars
-}
-
-func ToActivityStage(stage *model.Stage) *model.ActivityStage {
-	actiStage := model.ActivityStage{
-		Name:          stage.Name,
-		NeedApproval:  stage.NeedApprove,
-		Status:        "Waiting",
-		ActivitySteps: []*model.ActivityStep{},
-	}
-	for _, step := range stage.Steps {
-		actiStep := &model.ActivityStep{
-			Name:   step.Name,
-			Status: model.ActivityStepWaiting,
+//cacheKeyScript gets the shell command printing the cache key of the step. Env vars are expanded by
+//the shell at run time and characters not allowed in keys become '_' as the server does
+func cacheKeyScript(cache *model.StepCache, step *model.Step) string {
+	script := ". ${PWD}/.r_cicd.env;"
+	for _, para := range step.Env {
+		if kv := strings.SplitN(para, "=", 2); len(kv) == 2 {
+			script += fmt.Sprintf("%s=%s;", kv[0], QuoteShell(kv[1]))
 		}
-		actiStage.ActivitySteps = append(actiStage.ActivitySteps, actiStep)
 	}
-	return &actiStage
-
+	//the key template and checksum files are validated not to need quoting
+	key := service.ExpandCacheChecksums(cache.Key, func(file string) string {
+		return "$(sha256sum " + file + " 2>/dev/null | cut -c1-64)"
+	})
+	return script + fmt.Sprintf("printf '%%s' \"%s\" | tr -c 'a-zA-Z0-9._-' '_'", key)
 }
 
 func QuoteShell(script string) string {
 	//Use double quotes so variable substitution works
 
 	escaped := strings.Replace(script, "\\", "\\\\", -1)
-	escaped = strings.Replace(script, "\"", "\\\"", -1)
+	escaped = strings.Replace(escaped, "\"", "\\\"", -1)
 	escaped = "\"" + escaped + "\""
 	return escaped
 }
 
+//QuoteShellLiteral quotes the value in single quotes so the shell takes it as is
+func QuoteShellLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "'\\''", -1) + "'"
+}
+
 func EscapeShell(activity *model.Activity, script string) string {
 	escaped := strings.Replace(script, "\\", "\\\\", -1)
 	escaped = strings.Replace(escaped, "$", "\\$", -1)
@@ -1134,17 +1197,6 @@ func EscapeShell(activity *model.Activity, script string) string {
 	return escaped
 }
 
-//merely substitute envvars without escaping shell
-func SubstituteVar(activity *model.Activity, text string) string {
-	for k, v := range activity.EnvVars {
-		text = strings.Replace(text, "$"+k+" ", v, -1)
-		text = strings.Replace(text, "$"+k+"\n", v, -1)
-		text = strings.Replace(text, "${"+k+"}", v, -1)
-
-	}
-	return text
-}
-
 func templateURLPath(path string) (string, string, string, string, bool) {
 	pathSplit := strings.Split(path, ":")
 	switch len(pathSplit) {
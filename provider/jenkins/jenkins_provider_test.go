@@ -0,0 +1,366 @@
+package jenkins_test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/provider/jenkins"
+	"github.com/rancher/pipeline/provider/jenkins/jenkinsfake"
+	"github.com/rancher/pipeline/server/service"
+	"github.com/rancher/pipeline/store"
+)
+
+//tests run the jenkins provider against the fake jenkins master with a local store
+var (
+	fake     *jenkinsfake.Server
+	client   jenkins.JenkinsClient
+	provider jenkins.JenkinsProvider
+	counter  int32
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetLevel(logrus.WarnLevel)
+	dir, err := ioutil.TempDir("", "pipeline-jenkins-test")
+	if err != nil {
+		panic(err)
+	}
+	st, err := store.New(store.StoreTypeLocal, dir)
+	if err != nil {
+		panic(err)
+	}
+	service.InitStore(st)
+	fake = jenkinsfake.NewServer("admin", "token")
+	client = jenkins.NewJenkinsClient(fake.URL, fake.User, fake.Token)
+	if err := client.GetCSRF(); err != nil {
+		panic(err)
+	}
+	provider = jenkins.NewJenkinsProvider(client)
+	code := m.Run()
+	fake.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+//runPipeline runs a pipeline of an SCM stage and the stages on the fake master
+func runPipeline(t *testing.T, stages ...*model.Stage) *model.Activity {
+	p := &model.Pipeline{}
+	p.Id = "p" + strconv.Itoa(int(atomic.AddInt32(&counter, 1)))
+	p.Name = p.Id
+	p.Stages = append([]*model.Stage{{Name: "scm", Steps: []*model.Step{{
+		Name:       "clone",
+		Type:       model.StepTypeSCM,
+		Repository: "https://example.com/repo.git",
+		Branch:     "master",
+		GitUser:    "gituser",
+	}}}}, stages...)
+	if err := service.CreatePipeline(p, "tester"); err != nil {
+		t.Fatalf("create pipeline: %v", err)
+	}
+	a, err := provider.RunPipeline(p, model.TriggerTypeManual)
+	if err != nil {
+		t.Fatalf("run pipeline: %v", err)
+	}
+	return a
+}
+
+func jobName(a *model.Activity, stageOrdinal int, stepOrdinal int) string {
+	return strings.Join([]string{a.Pipeline.Name, a.Id, a.ActivityStages[stageOrdinal].Name, strconv.Itoa(stepOrdinal)}, "_")
+}
+
+func jobConfig(t *testing.T, name string) *jenkins.JenkinsProject {
+	job := fake.Job(name)
+	if job == nil {
+		t.Fatalf("job '%s' is not created", name)
+	}
+	conf := &jenkins.JenkinsProject{}
+	if err := xml.Unmarshal(job.Config, conf); err != nil {
+		t.Fatalf("invalid config of job '%s': %v", name, err)
+	}
+	return conf
+}
+
+func TestJobConfig(t *testing.T) {
+	fake.SetNodeInfo([]jenkins.JenkinsNode{
+		{Name: "master", Online: true, Executors: 2},
+		{Name: "gpu", Online: true, Executors: 2, Labels: []string{"gpu"}},
+	})
+	defer fake.SetNodes([]string{"master"})
+	a := runPipeline(t, &model.Stage{Name: "build", NodeLabels: []string{"gpu"}, Steps: []*model.Step{{
+		Name:      "make",
+		Type:      model.StepTypeTask,
+		Image:     "golang:1.8",
+		Args:      "make",
+		Env:       []string{"GOOS=linux"},
+		Timeout:   5,
+		Artifacts: []string{"dist/*"},
+	}}})
+	if a.NodeName != "gpu" {
+		t.Errorf("activity runs on node '%s', expect the labeled node 'gpu'", a.NodeName)
+	}
+
+	scm := jobConfig(t, jobName(a, 0, 0))
+	if scm.Scm.Class != "hudson.plugins.git.GitSCM" || scm.Scm.GitRepo != "https://example.com/repo.git" ||
+		scm.Scm.GitBranch != "master" || scm.Scm.GitCredentialId != "gituser" {
+		t.Errorf("unexpected scm of SCM job: %+v", scm.Scm)
+	}
+	if scm.AssignedNode != "gpu" || !strings.HasSuffix(scm.CustomWorkspace, "/workspace/"+a.Id) {
+		t.Errorf("SCM job runs on node '%s' in '%s'", scm.AssignedNode, scm.CustomWorkspace)
+	}
+	if !strings.Contains(scm.PreSCMBuildStepsWrapper.Command, "stepstart?id="+a.Id+"&stageOrdinal=0&stepOrdinal=0") {
+		t.Errorf("SCM job does not notify step start: %s", scm.PreSCMBuildStepsWrapper.Command)
+	}
+	if !strings.Contains(scm.Publishers.GroovyScript.Script, "stepOrdinal=0") {
+		t.Errorf("SCM job does not notify step finish: %s", scm.Publishers.GroovyScript.Script)
+	}
+	scmToken, err := service.StepToken(a.Id, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range []string{scm.PreSCMBuildStepsWrapper.Command, scm.Publishers.GroovyScript.Script} {
+		if !strings.Contains(script, service.StepTokenHeader+": "+scmToken) {
+			t.Errorf("step event of SCM job does not carry the token of the step: %s", script)
+		}
+	}
+	if job := fake.Job(jobName(a, 0, 0)); len(job.Builds) != 1 {
+		t.Errorf("SCM job has %d builds, expect 1", len(job.Builds))
+	}
+
+	task := jobConfig(t, jobName(a, 1, 0))
+	if task.Scm.Class != "hudson.scm.NullSCM" {
+		t.Errorf("task job has scm '%s'", task.Scm.Class)
+	}
+	if len(task.Builders.TaskShells) != 1 {
+		t.Fatalf("task job has %d shells, expect 1", len(task.Builders.TaskShells))
+	}
+	command := task.Builders.TaskShells[0].Command
+	for _, s := range []string{"golang:1.8", `-e "GOOS=linux"`, "make"} {
+		if !strings.Contains(command, s) {
+			t.Errorf("command of task job does not contain '%s': %s", s, command)
+		}
+	}
+	token, err := service.StepToken(a.Id, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(command, service.StepTokenHeader+": "+token) {
+		t.Errorf("artifacts upload of task job does not carry the token of the step: %s", command)
+	}
+	if task.TimeoutWrapper == nil || task.TimeoutWrapper.Strategy.TimeoutMinutes != 5 {
+		t.Errorf("task job has no timeout of 5 minutes: %+v", task.TimeoutWrapper)
+	}
+	if job := fake.Job(jobName(a, 1, 0)); len(job.Builds) != 0 {
+		t.Errorf("task job of the later stage has %d builds, expect none", len(job.Builds))
+	}
+}
+
+func TestGetStepLog(t *testing.T) {
+	const preamble = "00h00m00s000ms  Started by user admin\n" +
+		"00h00m00s001ms  Building remotely on master in workspace /var/jenkins_home/workspace/a\n" +
+		"00h00m00s002ms  [a] $ /bin/sh -xe /tmp/jenkins1.sh\n" +
+		"00h00m00s003ms  + curl -s -d '' pipeline-server:60080/v1/events/stepstart\n"
+	tests := []struct {
+		name         string
+		stageOrdinal int
+		console      []string
+		expect       string
+	}{
+		{
+			name:         "SCM step",
+			stageOrdinal: 0,
+			console: []string{preamble +
+				"00h00m00s100ms  Cloning the remote Git repository\n",
+				"00h00m00s200ms  Checking out Revision 0a1b2c\n"},
+			expect: "00h00m00s100ms  Cloning the remote Git repository\n" +
+				"00h00m00s200ms  Checking out Revision 0a1b2c\n",
+		},
+		{
+			name:         "task step",
+			stageOrdinal: 1,
+			console: []string{preamble +
+				"00h00m00s100ms  [a] $ /bin/sh -xe /tmp/jenkins2.sh\n" +
+				"00h00m00s101ms  + set +x\n" +
+				"00h00m00s102ms  building\n",
+				"00h00m00s200ms  done\n"},
+			expect: "00h00m00s102ms  building\n00h00m00s200ms  done\n",
+		},
+		{
+			name:         "no printed log",
+			stageOrdinal: 1,
+			console:      []string{preamble, "00h00m00s100ms  still starting\n"},
+			expect:       "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := runPipeline(t, &model.Stage{Name: "build", Steps: []*model.Step{{Name: "make", Type: model.StepTypeTask, Image: "busybox"}}})
+			name := jobName(a, tt.stageOrdinal, 0)
+			if tt.stageOrdinal > 0 {
+				if _, err := client.BuildJob(name, map[string]string{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			prevLog := ""
+			paras := map[string]interface{}{"prevLog": &prevLog}
+			log := ""
+			//the log is read incrementally while the console grows
+			for _, text := range tt.console {
+				if err := fake.AppendConsole(name, text); err != nil {
+					t.Fatal(err)
+				}
+				var err error
+				if log, err = provider.GetStepLog(a, tt.stageOrdinal, 0, paras); err != nil {
+					t.Fatalf("get step log: %v", err)
+				}
+			}
+			if log != tt.expect {
+				t.Errorf("got log %q, expect %q", log, tt.expect)
+			}
+		})
+	}
+}
+
+func TestSyncActivity(t *testing.T) {
+	tests := []struct {
+		name string
+		//result of the build of the task step, no build if empty
+		result       string
+		allowFailure bool
+		needApprove  bool
+		step         string
+		stage        string
+		activity     string
+	}{
+		{
+			name:     "success",
+			result:   "SUCCESS",
+			step:     model.ActivityStepSuccess,
+			stage:    model.ActivityStageSuccess,
+			activity: model.ActivityWaiting,
+		},
+		{
+			name:     "failure",
+			result:   "FAILURE",
+			step:     model.ActivityStepFail,
+			stage:    model.ActivityStageFail,
+			activity: model.ActivityFail,
+		},
+		{
+			name:         "allowed failure",
+			result:       "FAILURE",
+			allowFailure: true,
+			step:         model.ActivityStepFailedAllowed,
+			stage:        model.ActivityStageWaiting,
+			activity:     model.ActivityWaiting,
+		},
+		{
+			name:     "building",
+			result:   "building",
+			step:     model.ActivityStepBuilding,
+			stage:    model.ActivityStageBuilding,
+			activity: model.ActivityBuilding,
+		},
+		{
+			name:        "waiting for approval",
+			needApprove: true,
+			step:        model.ActivityStepWaiting,
+			stage:       model.ActivityStagePending,
+			activity:    model.ActivityPending,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := runPipeline(t, &model.Stage{Name: "build", NeedApprove: tt.needApprove, Steps: []*model.Step{
+				{Name: "make", Type: model.StepTypeTask, Image: "busybox", AllowFailure: tt.allowFailure},
+			}})
+			if err := fake.FinishBuild(jobName(a, 0, 0), "SUCCESS"); err != nil {
+				t.Fatal(err)
+			}
+			name := jobName(a, 1, 0)
+			if tt.result != "" {
+				if _, err := client.BuildJob(name, map[string]string{}); err != nil {
+					t.Fatal(err)
+				}
+				if tt.result != "building" {
+					if err := fake.FinishBuild(name, tt.result); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			a.Status = model.ActivityWaiting
+			if err := provider.SyncActivity(a); err != nil {
+				t.Fatalf("sync activity: %v", err)
+			}
+			if status := a.ActivityStages[0].Status; status != model.ActivityStageSuccess {
+				t.Errorf("got SCM stage status '%s', expect success", status)
+			}
+			stage := a.ActivityStages[1]
+			if stage.ActivitySteps[0].Status != tt.step || stage.Status != tt.stage || a.Status != tt.activity {
+				t.Errorf("got step '%s', stage '%s', activity '%s', expect '%s', '%s', '%s'",
+					stage.ActivitySteps[0].Status, stage.Status, a.Status, tt.step, tt.stage, tt.activity)
+			}
+			if tt.result != "" && stage.ActivitySteps[0].StartTS == 0 {
+				t.Errorf("start time of the step is not synced")
+			}
+		})
+	}
+}
+
+func TestOutputsQuoting(t *testing.T) {
+	a := runPipeline(t,
+		&model.Stage{Name: "build", Steps: []*model.Step{{Name: "make", Type: model.StepTypeTask, Image: "busybox"}}},
+		&model.Stage{Name: "deploy", Steps: []*model.Step{{Name: "ship", Type: model.StepTypeTask, Image: "busybox",
+			Env: []string{`VERSION=${CICD_OUTPUT_MAKE_VERSION}`, `PATH_DIR=C:\tmp`}}}},
+	)
+	service.SetStepOutputs(a, 1, 0, "VERSION=$(touch x)`touch y`'\"\n")
+	if err := provider.RunStep(a, 2, 0); err != nil {
+		t.Fatalf("run step: %v", err)
+	}
+	command := jobConfig(t, jobName(a, 2, 0)).Builders.TaskShells[0].Command
+
+	//run the command of the job with docker printing its args
+	dir, err := ioutil.TempDir("", "pipeline-jenkins-shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".r_cicd.env"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "docker() { printf '%s\\n' \"$@\" > args; env > env; }\n" + command
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("run command: %v: %s", err, out)
+	}
+	for _, f := range []string{"x", "y"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			t.Errorf("output value runs in the shell of the job")
+		}
+	}
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := ioutil.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := "$(touch x)`touch y`'\""
+	for _, s := range []string{"VERSION=" + value, `PATH_DIR=C:\tmp`, "CICD_OUTPUT_MAKE_VERSION"} {
+		if !strings.Contains(string(args), s+"\n") {
+			t.Errorf("docker args do not contain '%s': %s", s, args)
+		}
+	}
+	if !strings.Contains(string(env), "CICD_OUTPUT_MAKE_VERSION="+value+"\n") {
+		t.Errorf("output is not exported to docker")
+	}
+}
@@ -0,0 +1,461 @@
+//Package jenkinsfake provides a stateful fake jenkins master on an httptest server,
+//serving the part of the REST API that the jenkins provider uses.
+package jenkinsfake
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/pipeline/provider/jenkins"
+)
+
+const (
+	CrumbHeader = "Jenkins-Crumb"
+	Crumb       = "fakecrumb"
+	//executors of nodes set by names
+	defaultExecutors = 2
+)
+
+type Build struct {
+	Number    int64
+	Building  bool
+	Result    string
+	Timestamp int64
+	Duration  int64
+	Console   string
+	//commit of the git scm
+	SHA1 string
+}
+
+type Job struct {
+	Name    string
+	Config  []byte
+	InQueue bool
+	QueueId int
+	Builds  []*Build
+}
+
+//Server is a fake jenkins master
+type Server struct {
+	*httptest.Server
+	User  string
+	Token string
+
+	lock        sync.Mutex
+	jobs        map[string]*Job
+	nodes       []jenkins.JenkinsNode
+	credentials map[string][]byte
+	scripts     []string
+	nextQueueId int
+	//keep triggered builds in queue until StartBuild
+	queueBuilds bool
+}
+
+//NewServer starts a fake jenkins master with a 'master' node online
+func NewServer(user string, token string) *Server {
+	s := &Server{
+		User:        user,
+		Token:       token,
+		jobs:        map[string]*Job{},
+		nodes:       []jenkins.JenkinsNode{{Name: "master", Online: true, Executors: defaultExecutors}},
+		credentials: map[string][]byte{},
+		nextQueueId: 1,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+//Client creates a jenkins client of the fake master
+func (s *Server) Client() jenkins.JenkinsClient {
+	return jenkins.NewJenkinsClient(s.URL, s.User, s.Token)
+}
+
+//SetNodes sets names of online nodes without labels
+func (s *Server) SetNodes(names []string) {
+	nodes := []jenkins.JenkinsNode{}
+	for _, name := range names {
+		nodes = append(nodes, jenkins.JenkinsNode{Name: name, Online: true, Executors: defaultExecutors})
+	}
+	s.SetNodeInfo(nodes)
+}
+
+//SetNodeInfo sets nodes with labels and executors, builds of jobs assigned
+//to a node are added to its busy executors
+func (s *Server) SetNodeInfo(nodes []jenkins.JenkinsNode) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nodes = nodes
+}
+
+//SetQueueBuilds makes triggered builds wait in queue until StartBuild is called
+func (s *Server) SetQueueBuilds(queue bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queueBuilds = queue
+}
+
+//Job returns a copy of the job, nil if not found
+func (s *Server) Job(name string) *Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[name]
+	if !ok {
+		return nil
+	}
+	cp := *job
+	cp.Builds = nil
+	for _, b := range job.Builds {
+		bcp := *b
+		cp.Builds = append(cp.Builds, &bcp)
+	}
+	return &cp
+}
+
+//JobNames lists names of all jobs
+func (s *Server) JobNames() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := []string{}
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	return names
+}
+
+//Scripts returns scripts executed through the script console
+func (s *Server) Scripts() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.scripts...)
+}
+
+//Credential returns the posted content of a credential
+func (s *Server) Credential(id string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.credentials[id]
+	return c, ok
+}
+
+//StartBuild starts a queued build of the job
+func (s *Server) StartBuild(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[name]
+	if !ok {
+		return fmt.Errorf("job '%s' not found", name)
+	}
+	if !job.InQueue {
+		return fmt.Errorf("job '%s' is not in queue", name)
+	}
+	job.InQueue = false
+	s.startBuild(job)
+	return nil
+}
+
+//AppendConsole appends text to console output of the last build,
+//lines are expected in the elapsed time format of the timestamper plugin
+func (s *Server) AppendConsole(name string, text string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	build, err := s.lastBuild(name)
+	if err != nil {
+		return err
+	}
+	build.Console += text
+	return nil
+}
+
+//FinishBuild completes the last build of the job with result 'SUCCESS', 'FAILURE' or 'ABORTED'
+func (s *Server) FinishBuild(name string, result string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	build, err := s.lastBuild(name)
+	if err != nil {
+		return err
+	}
+	s.finishBuild(build, result)
+	return nil
+}
+
+//SetCommit sets the git commit of the last build
+func (s *Server) SetCommit(name string, sha1 string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	build, err := s.lastBuild(name)
+	if err != nil {
+		return err
+	}
+	build.SHA1 = sha1
+	return nil
+}
+
+func (s *Server) lastBuild(name string) (*Build, error) {
+	job, ok := s.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("job '%s' not found", name)
+	}
+	if len(job.Builds) == 0 {
+		return nil, fmt.Errorf("job '%s' has no build", name)
+	}
+	return job.Builds[len(job.Builds)-1], nil
+}
+
+func (s *Server) startBuild(job *Job) {
+	var number int64 = 1
+	if len(job.Builds) > 0 {
+		number = job.Builds[len(job.Builds)-1].Number + 1
+	}
+	job.Builds = append(job.Builds, &Build{
+		Number:    number,
+		Building:  true,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+func (s *Server) finishBuild(build *Build, result string) {
+	if !build.Building {
+		return
+	}
+	build.Building = false
+	build.Result = result
+	build.Duration = time.Now().UnixNano()/int64(time.Millisecond) - build.Timestamp
+	build.Console += "\n  Finished: " + result + "\n"
+}
+
+func (s *Server) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	user, token, ok := req.BasicAuth()
+	if !ok || user != s.User || token != s.Token {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path == "/crumbIssuer/api/xml" {
+		fmt.Fprintf(rw, "%s:%s", CrumbHeader, Crumb)
+		return
+	}
+	if req.Method == http.MethodPost && req.Header.Get(CrumbHeader) != Crumb {
+		http.Error(rw, "No valid crumb was included in the request", http.StatusForbidden)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	path := req.URL.Path
+	switch {
+	case path == "/createItem":
+		s.createItem(rw, req)
+	case path == "/scriptText":
+		s.scriptText(rw, req)
+	case path == "/queue/cancelItem":
+		s.cancelItem(rw, req)
+	case strings.HasPrefix(path, "/credentials/store/system/domain/_/"):
+		s.credential(rw, req)
+	case strings.HasPrefix(path, "/job/"):
+		splits := strings.SplitN(strings.TrimPrefix(path, "/job/"), "/", 2)
+		action := ""
+		if len(splits) == 2 {
+			action = splits[1]
+		}
+		s.job(rw, req, splits[0], action)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (s *Server) createItem(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(rw, "name is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.jobs[name]; ok {
+		http.Error(rw, fmt.Sprintf("A job already exists with the name '%s'", name), http.StatusBadRequest)
+		return
+	}
+	config, _ := ioutil.ReadAll(req.Body)
+	s.jobs[name] = &Job{Name: name, Config: config}
+}
+
+func (s *Server) scriptText(rw http.ResponseWriter, req *http.Request) {
+	script := req.FormValue("script")
+	switch script {
+	case jenkins.GetActiveNodesScript:
+		for _, node := range s.nodes {
+			if node.Online {
+				fmt.Fprintln(rw, node.Name)
+			}
+		}
+	case jenkins.GetNodesScript:
+		busy := s.busyExecutors()
+		for _, node := range s.nodes {
+			fmt.Fprintf(rw, "%s\t%t\t%s\t%d\t%d\n", node.Name, node.Online, strings.Join(node.Labels, " "), node.BusyExecutors+busy[node.Name], node.Executors)
+		}
+	default:
+		//other scripts are recorded and answer empty
+		s.scripts = append(s.scripts, script)
+	}
+}
+
+//busyExecutors counts running builds on each node
+func (s *Server) busyExecutors() map[string]int {
+	busy := map[string]int{}
+	for _, job := range s.jobs {
+		if len(job.Builds) == 0 || !job.Builds[len(job.Builds)-1].Building {
+			continue
+		}
+		conf := struct {
+			AssignedNode string `xml:"assignedNode"`
+		}{}
+		if err := xml.Unmarshal(job.Config, &conf); err == nil {
+			busy[conf.AssignedNode]++
+		}
+	}
+	return busy
+}
+
+func (s *Server) cancelItem(rw http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(req.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(rw, "invalid id", http.StatusBadRequest)
+		return
+	}
+	for _, job := range s.jobs {
+		if job.InQueue && job.QueueId == id {
+			job.InQueue = false
+			break
+		}
+	}
+	rw.Header().Set("Location", s.URL+"/queue/")
+	rw.WriteHeader(http.StatusFound)
+}
+
+func (s *Server) credential(rw http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/credentials/store/system/domain/_/")
+	if path == "createCredentials" {
+		content := []byte(req.FormValue("json"))
+		data := struct {
+			Credentials struct {
+				Id string `json:"id"`
+			} `json:"credentials"`
+		}{}
+		if err := json.Unmarshal(content, &data); err != nil || data.Credentials.Id == "" {
+			http.Error(rw, "invalid credential", http.StatusBadRequest)
+			return
+		}
+		s.credentials[data.Credentials.Id] = content
+		return
+	}
+	if strings.HasPrefix(path, "credential/") && strings.HasSuffix(path, "/doDelete") {
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "credential/"), "/doDelete")
+		if _, ok := s.credentials[id]; !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		delete(s.credentials, id)
+		return
+	}
+	http.NotFound(rw, req)
+}
+
+func (s *Server) job(rw http.ResponseWriter, req *http.Request, name string, action string) {
+	job, ok := s.jobs[name]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	switch {
+	case action == "config.xml" && req.Method == http.MethodPost:
+		job.Config, _ = ioutil.ReadAll(req.Body)
+	case action == "config.xml":
+		rw.Write(job.Config)
+	case action == "build" || action == "buildWithParameters":
+		if s.queueBuilds {
+			job.InQueue = true
+			job.QueueId = s.nextQueueId
+			s.nextQueueId++
+		} else {
+			s.startBuild(job)
+		}
+		rw.Header().Set("Location", fmt.Sprintf("%s/queue/item/%d/", s.URL, job.QueueId))
+		rw.WriteHeader(http.StatusCreated)
+	case action == "doDelete":
+		delete(s.jobs, name)
+	case action == "api/json":
+		json.NewEncoder(rw).Encode(jobInfo(job))
+	case strings.HasPrefix(action, "lastBuild"):
+		if len(job.Builds) == 0 {
+			http.NotFound(rw, req)
+			return
+		}
+		s.lastBuildAction(rw, req, job, strings.TrimPrefix(action, "lastBuild/"))
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (s *Server) lastBuildAction(rw http.ResponseWriter, req *http.Request, job *Job, action string) {
+	build := job.Builds[len(job.Builds)-1]
+	switch action {
+	case "api/json":
+		json.NewEncoder(rw).Encode(buildInfo(build))
+	case "timestamps/":
+		lines := strings.SplitAfter(build.Console, "\n")
+		start, _ := strconv.Atoi(req.URL.Query().Get("startLine"))
+		if start > len(lines) {
+			start = len(lines)
+		}
+		fmt.Fprint(rw, strings.Join(lines[start:], ""))
+	case "stop":
+		s.finishBuild(build, "ABORTED")
+	case "doDelete":
+		job.Builds = job.Builds[:len(job.Builds)-1]
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func jobInfo(job *Job) *jenkins.JenkinsJobInfo {
+	info := &jenkins.JenkinsJobInfo{
+		Name:      job.Name,
+		Buildable: true,
+		InQueue:   job.InQueue,
+	}
+	if job.InQueue {
+		info.QueueItem = map[string]interface{}{"id": job.QueueId}
+	}
+	info.NextBuildNumber = 1
+	if len(job.Builds) > 0 {
+		last := job.Builds[len(job.Builds)-1]
+		info.LastBuild.Number = last.Number
+		info.NextBuildNumber = last.Number + 1
+	}
+	return info
+}
+
+func buildInfo(build *Build) *jenkins.JenkinsBuildInfo {
+	info := &jenkins.JenkinsBuildInfo{
+		Building:  build.Building,
+		Result:    build.Result,
+		Number:    build.Number,
+		ID:        strconv.FormatInt(build.Number, 10),
+		Timestamp: build.Timestamp,
+		Duration:  build.Duration,
+	}
+	if build.SHA1 != "" {
+		b, _ := json.Marshal([]interface{}{
+			map[string]interface{}{
+				"lastBuiltRevision": map[string]interface{}{"SHA1": build.SHA1},
+			},
+		})
+		json.Unmarshal(b, &info.Actions)
+	}
+	return info
+}
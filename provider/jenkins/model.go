@@ -124,6 +124,15 @@ type ChangeSet struct {
 	Items []interface{}
 }
 
+//JenkinsNode is a slave node and its executors usage
+type JenkinsNode struct {
+	Name          string
+	Online        bool
+	Labels        []string
+	BusyExecutors int
+	Executors     int
+}
+
 type JenkinsJobInfo struct {
 	Class   string `json:"_class"`
 	Actions []struct {
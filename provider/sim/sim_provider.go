@@ -0,0 +1,454 @@
+package sim
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+const (
+	simNodeName   = "sim"
+	simNodeReason = "simulated runs have a single node"
+	//env vars of a step to script it in the pipeline definition
+	envDuration = "SIM_DURATION"
+	envExitCode = "SIM_EXIT_CODE"
+	envLog      = "SIM_LOG"
+
+	startRetries  = 10
+	retryInterval = 100 * time.Millisecond
+)
+
+//StepScript describes how a simulated step behaves
+type StepScript struct {
+	Duration time.Duration
+	ExitCode int
+	Log      []string
+	//commit reported by the SCM step
+	Commit string
+	//contents of files the step leaves in the workspace, by path
+	Files map[string]string
+	//values the step writes to its output file
+	Outputs map[string]string
+	//files changed by the commit reported by the SCM step, unknown if nil
+	ChangedFiles []string
+}
+
+//SimProvider runs steps as scripted fakes in memory. Step transitions go through
+//the same listener as the event callbacks of real providers, so orchestration
+//of approvals, conditions, parallel stages and reruns can be exercised without
+//jenkins or docker.
+type SimProvider struct {
+	stepDuration time.Duration
+
+	lock     sync.Mutex
+	listener model.StepEventListener
+	scripts  map[string]StepScript
+	logs     map[string]string
+	aborts   map[string]chan struct{}
+}
+
+//NewSimProvider creates a provider whose unscripted steps last stepDuration and succeed
+func NewSimProvider(stepDuration time.Duration) *SimProvider {
+	return &SimProvider{
+		stepDuration: stepDuration,
+		scripts:      map[string]StepScript{},
+		logs:         map[string]string{},
+		aborts:       map[string]chan struct{}{},
+	}
+}
+
+func (s *SimProvider) SetStepEventListener(listener model.StepEventListener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listener = listener
+}
+
+//SetScript scripts steps of the name in stages of the name
+func (s *SimProvider) SetScript(stageName string, stepName string, script StepScript) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scripts[scriptKey(stageName, stepName)] = script
+}
+
+func (s *SimProvider) RunPipeline(p *model.Pipeline, triggerType string) (*model.Activity, error) {
+	if len(p.Stages) == 0 {
+		return nil, errors.New("no stage in pipeline definition to run!")
+	}
+	activity := service.NewActivity(p, simNodeName)
+	activity.NodeReason = simNodeReason
+	activity.TriggerType = triggerType
+	service.InitActivityEnvvars(activity)
+	s.resetAbort(activity.Id)
+
+	if err := s.RunStage(activity, 0); err != nil {
+		return nil, err
+	}
+	if err := service.CreateActivity(activity); err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+func (s *SimProvider) RerunActivity(a *model.Activity) error {
+	s.resetAbort(a.Id)
+	s.deleteLogs(a.Id)
+	a.NodeName = simNodeName
+	a.NodeReason = simNodeReason
+	a.RunSequence = a.Pipeline.RunCount + 1
+	a.StartTS = time.Now().UnixNano() / int64(time.Millisecond)
+	service.InitActivityEnvvars(a)
+	return s.RunStage(a, 0)
+}
+
+//ResumeActivity runs a completed activity again from the step, there is no workspace to restore
+func (s *SimProvider) ResumeActivity(a *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	s.resetAbort(a.Id)
+	return service.ResumeFrom(s, a, stageOrdinal, stepOrdinal, false)
+}
+
+func (s *SimProvider) RunStage(activity *model.Activity, ordinal int) error {
+	return service.RunStage(s, activity, ordinal)
+}
+
+func (s *SimProvider) RunStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	if skipped, err := service.SkipStep(s, activity, stageOrdinal, stepOrdinal); skipped || err != nil {
+		return err
+	}
+	step := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal]
+	script, err := s.getScript(activity, stageOrdinal, stepOrdinal)
+	if err != nil {
+		return err
+	}
+	if step.Type == model.StepTypeSCM && script.Commit == "" {
+		script.Commit = fmt.Sprintf("%x", sha1.Sum([]byte(activity.Id)))
+	}
+	saveCache, err := simCache(activity, stageOrdinal, stepOrdinal, &script)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	abort := s.aborts[activity.Id]
+	//a retried step logs from scratch
+	delete(s.logs, logKey(activity.Id, stageOrdinal, stepOrdinal))
+	s.lock.Unlock()
+	logrus.Debugf("Run step:%s,%d,%d", activity.Pipeline.Name, stageOrdinal, stepOrdinal)
+	go s.execStep(activity.Id, activity.StartTS, stageOrdinal, stepOrdinal, script, abort, saveCache)
+	return nil
+}
+
+//simCache resolves the cache key of the step with checksums of script files and logs whether
+//the cache would be restored. It gets the function saving script files as the cache
+func simCache(activity *model.Activity, stageOrdinal int, stepOrdinal int, script *StepScript) (func() error, error) {
+	if service.GetStepCache(activity, stageOrdinal, stepOrdinal) == nil {
+		return nil, nil
+	}
+	key, err := service.CacheKey(activity, stageOrdinal, stepOrdinal, func(file string) (string, error) {
+		content, ok := script.Files[file]
+		if !ok {
+			return "", nil
+		}
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:]), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := "No cache for key " + key
+	if service.CacheExists(activity.Pipeline.Id, key) {
+		msg = "Restored cache " + key
+	}
+	script.Log = append([]string{msg}, script.Log...)
+	a := *activity
+	files := script.Files
+	return func() error {
+		return service.SaveCache(&a, stageOrdinal, stepOrdinal, key, workspaceArchive(files), 0)
+	}, nil
+}
+
+func (s *SimProvider) execStep(activityId string, startTS int64, stageOrdinal int, stepOrdinal int, script StepScript, abort chan struct{}, saveCache func() error) {
+	s.lock.Lock()
+	listener := s.listener
+	s.lock.Unlock()
+	if listener == nil {
+		logrus.Errorf("no listener of step events for activity '%s'", activityId)
+		return
+	}
+	key := logKey(activityId, stageOrdinal, stepOrdinal)
+	//the activity is saved after its first step is triggered
+	var err error
+	for i := 0; i < startRetries; i++ {
+		if err = listener.OnStepStart(activityId, stageOrdinal, stepOrdinal); err == nil {
+			break
+		}
+		time.Sleep(retryInterval)
+	}
+	if err != nil {
+		logrus.Errorf("fail to start step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activityId, err)
+		s.appendLog(key, startTS, "  Finished: ABORTED")
+		return
+	}
+	for _, line := range script.Log {
+		s.appendLog(key, startTS, line)
+	}
+	select {
+	case <-time.After(script.Duration):
+	case <-abort:
+		s.appendLog(key, 0, "  Finished: ABORTED")
+		return
+	}
+	status := "SUCCESS"
+	if script.ExitCode != 0 {
+		s.appendLog(key, startTS, fmt.Sprintf("Build step exited with code %d", script.ExitCode))
+		status = "FAILURE"
+	}
+	if status == "SUCCESS" && saveCache != nil {
+		if err := saveCache(); err != nil {
+			s.appendLog(key, startTS, fmt.Sprintf("WARNING: fail to save cache: %v", err))
+		}
+	}
+	if len(script.Files) > 0 {
+		if err := listener.OnStepArtifacts(activityId, stageOrdinal, stepOrdinal, workspaceArchive(script.Files), 0); err != nil {
+			s.appendLog(key, startTS, fmt.Sprintf("WARNING: fail to collect artifacts: %v", err))
+		}
+		if err := listener.OnStepTestReports(activityId, stageOrdinal, stepOrdinal, workspaceArchive(script.Files), 0); err != nil {
+			s.appendLog(key, startTS, fmt.Sprintf("WARNING: fail to collect test reports: %v", err))
+		}
+	}
+	s.appendLog(key, 0, "  Finished: "+status)
+	outputs := []string{}
+	for k, v := range script.Outputs {
+		outputs = append(outputs, k+"="+v)
+	}
+	sort.Strings(outputs)
+	if err := listener.OnStepFinish(activityId, stageOrdinal, stepOrdinal, status, script.Commit, strings.Join(outputs, "\n"), script.ChangedFiles); err != nil {
+		logrus.Errorf("fail to finish step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activityId, err)
+	}
+}
+
+//getScript finds the script set for the step, then the one in the step env
+func (s *SimProvider) getScript(activity *model.Activity, stageOrdinal int, stepOrdinal int) (StepScript, error) {
+	stage := activity.Pipeline.Stages[stageOrdinal]
+	step := stage.Steps[stepOrdinal]
+	s.lock.Lock()
+	script, ok := s.scripts[scriptKey(stage.Name, step.Name)]
+	s.lock.Unlock()
+	if ok {
+		return script, nil
+	}
+	script = StepScript{Duration: s.stepDuration, Log: defaultLog(step)}
+	for _, env := range step.Env {
+		env, err := service.ResolveStepEnv(activity, env)
+		if err != nil {
+			//the step fails like in a real provider
+			script.ExitCode = 1
+			script.Log = []string{"ERROR: " + err.Error()}
+			return script, nil
+		}
+		splits := strings.SplitN(env, "=", 2)
+		if len(splits) != 2 {
+			continue
+		}
+		switch splits[0] {
+		case envDuration:
+			d, err := time.ParseDuration(splits[1])
+			if err != nil {
+				return script, errors.Wrapf(err, "invalid %s of step '%s'", envDuration, step.Name)
+			}
+			script.Duration = d
+		case envExitCode:
+			code, err := strconv.Atoi(splits[1])
+			if err != nil {
+				return script, errors.Wrapf(err, "invalid %s of step '%s'", envExitCode, step.Name)
+			}
+			script.ExitCode = code
+		case envLog:
+			script.Log = strings.Split(splits[1], "\\n")
+		}
+	}
+	return script, nil
+}
+
+func defaultLog(step *model.Step) []string {
+	switch step.Type {
+	case model.StepTypeSCM:
+		return []string{"Cloning the remote Git repository " + step.Repository}
+	case model.StepTypeTask:
+		if step.ShellScript == "" {
+			return []string{strings.TrimSpace("+ " + step.Image + " " + step.Args)}
+		}
+		log := []string{}
+		for _, line := range strings.Split(step.ShellScript, "\n") {
+			if line != "" {
+				log = append(log, "+ "+line)
+			}
+		}
+		return log
+	case model.StepTypeBuild:
+		return []string{"+ docker build --tag " + step.TargetImage}
+	}
+	return []string{"run " + step.Type + " step"}
+}
+
+//appendLog writes a line of the jenkins console format, startTS 0 writes the line as is
+func (s *SimProvider) appendLog(key string, startTS int64, line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if startTS > 0 {
+		elapsed := time.Now().UnixNano()/int64(time.Millisecond) - startTS
+		line = (time.Duration(elapsed) * time.Millisecond).String() + "  " + line
+	}
+	s.logs[key] += line + "\n"
+}
+
+func (s *SimProvider) StopActivity(a *model.Activity) error {
+	s.lock.Lock()
+	if abort, ok := s.aborts[a.Id]; ok {
+		close(abort)
+		delete(s.aborts, a.Id)
+	}
+	s.lock.Unlock()
+	a.Status = model.ActivityAbort
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	a.StopTS = now
+	for _, stage := range a.ActivityStages {
+		//stages run concurrently by needs
+		if stage.Status != model.ActivityStageBuilding {
+			continue
+		}
+		for _, step := range stage.ActivitySteps {
+			if step.Status == model.ActivityStepBuilding {
+				step.Status = model.ActivityStepAbort
+				step.Duration = now - step.StartTS
+			}
+		}
+		stage.Status = model.ActivityStageAbort
+		stage.Duration = now - stage.StartTS
+	}
+	return nil
+}
+
+//SyncActivity fails building steps as simulated runs do not survive restarts
+func (s *SimProvider) SyncActivity(activity *model.Activity) error {
+	for i, actiStage := range activity.ActivityStages {
+		for j, actiStep := range actiStage.ActivitySteps {
+			if actiStep.Status == model.ActivityStepBuilding {
+				service.FailStep(activity, i, j)
+				activity.FailMessage = fmt.Sprintf("step %d of '%s' stage is interrupted", j+1, actiStage.Name)
+				if !service.RunFinally(s, activity) {
+					s.OnActivityCompelte(activity)
+				}
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SimProvider) GetStepLog(activity *model.Activity, stageOrdinal int, stepOrdinal int, paras map[string]interface{}) (string, error) {
+	if stageOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) || stepOrdinal < 0 || stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
+		return "", errors.New("ordinal out of range")
+	}
+	prevLog := ""
+	logText := &prevLog
+	if val, ok := paras["prevLog"]; ok {
+		logText = val.(*string)
+	}
+	s.lock.Lock()
+	text := s.logs[logKey(activity.Id, stageOrdinal, stepOrdinal)]
+	s.lock.Unlock()
+	if !strings.HasPrefix(text, *logText) {
+		//the log is rewritten by a retried step
+		*logText = ""
+	}
+	if len(text) <= len(*logText) {
+		return "", nil
+	}
+	appended := text[len(*logText):]
+	*logText = text
+	return appended, nil
+}
+
+func (s *SimProvider) OnActivityCompelte(activity *model.Activity) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.aborts, activity.Id)
+	logrus.Infof("activity '%s' complete", activity.Id)
+	service.NotifyQueue()
+}
+
+func (s *SimProvider) OnDeleteActivity(activity *model.Activity) error {
+	s.deleteLogs(activity.Id)
+	return nil
+}
+
+func (s *SimProvider) OnCreateAccount(account *model.GitAccount) error {
+	return nil
+}
+
+func (s *SimProvider) OnDeleteAccount(account *model.GitAccount) error {
+	if account == nil {
+		return errors.New("nil account")
+	}
+	return nil
+}
+
+func (s *SimProvider) Reset() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, abort := range s.aborts {
+		close(abort)
+	}
+	s.aborts = map[string]chan struct{}{}
+	s.logs = map[string]string{}
+	return nil
+}
+
+func (s *SimProvider) resetAbort(activityId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.aborts[activityId] = make(chan struct{})
+}
+
+func (s *SimProvider) deleteLogs(activityId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.logs {
+		if strings.HasPrefix(key, activityId+"_") {
+			delete(s.logs, key)
+		}
+	}
+}
+
+//workspaceArchive gets a tar stream of the files
+func workspaceArchive(files map[string]string) io.Reader {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	return buf
+}
+
+func scriptKey(stageName string, stepName string) string {
+	return stageName + "/" + stepName
+}
+
+func logKey(activityId string, stageOrdinal int, stepOrdinal int) string {
+	return strings.Join([]string{activityId, strconv.Itoa(stageOrdinal), strconv.Itoa(stepOrdinal)}, "_")
+}
@@ -417,7 +417,7 @@ func deleteGithubWebhook(user string, repo string, accesstoken string, id int) e
 	if resp.StatusCode > 399 {
 		return errors.New(string(respData))
 	}
-	logrus.Debugf("after delete,%v,%v", string(respData))
+	logrus.Debugf("after delete,%v", string(respData))
 	return err
 }
 
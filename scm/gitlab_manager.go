@@ -319,7 +319,7 @@ func (g GitlabManager) VerifyWebhookPayload(p *model.Pipeline, req *http.Request
 	payload := map[string]interface{}{}
 	logrus.Debugf("gitlab webhook got payload:\n%v", string(body))
 	if err := json.Unmarshal(body, &payload); err != nil {
-		logrus.Error("fail to parse github webhook payload,err:%v", err)
+		logrus.Errorf("fail to parse github webhook payload,err:%v", err)
 		return false
 	}
 	if payload["ref"] != "refs/heads/"+p.Stages[0].Steps[0].Branch {
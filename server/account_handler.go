@@ -178,8 +178,10 @@ func (s *Server) Oauth(rw http.ResponseWriter, req *http.Request) error {
 			return fmt.Errorf("auth not set")
 		}
 		clientID = setting.ClientID
-		clientSecret = setting.ClientSecret
 		redirectURL = setting.RedirectURL
+		if clientSecret, err = service.GetSCMClientSecret(setting); err != nil {
+			return err
+		}
 
 		SCManager, err := service.GetSCManager(scmType)
 		if err != nil {
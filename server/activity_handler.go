@@ -4,10 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
 	v1client "github.com/rancher/go-rancher/client"
 	"github.com/rancher/pipeline/model"
@@ -18,70 +26,135 @@ import (
 
 //List All Activities
 func (s *Server) ListActivities(rw http.ResponseWriter, req *http.Request) error {
+	q, err := parseActivityQuery(req)
+	if err != nil {
+		return err
+	}
+	return writeActivities(req, q)
+}
 
+//parseActivityQuery reads filters, sorting and pagination of activities from query parameters
+func parseActivityQuery(req *http.Request) (*service.ActivityQuery, error) {
+	v := req.URL.Query()
+	q := &service.ActivityQuery{
+		PipelineId:  v.Get("pipelineId"),
+		TriggerType: v.Get("triggerType"),
+		Branch:      v.Get("branch"),
+		Commit:      v.Get("commit"),
+		NodeName:    v.Get("nodeName"),
+		SortBy:      v.Get("sort"),
+		Order:       v.Get("order"),
+		Marker:      v.Get("marker"),
+	}
+	if status := v.Get("status"); status != "" {
+		q.Status = strings.Split(status, ",")
+	}
+	switch q.SortBy {
+	case "", service.SortByStartTime, service.SortByRunSequence, service.SortByStatus:
+	default:
+		return nil, fmt.Errorf("unsupported sort field '%s'", q.SortBy)
+	}
+	switch q.Order {
+	case "", service.SortOrderAsc, service.SortOrderDesc:
+	default:
+		return nil, fmt.Errorf("unsupported sort order '%s'", q.Order)
+	}
+	var err error
+	for name, field := range map[string]*int64{"since": &q.Since, "until": &q.Until} {
+		if value := v.Get(name); value != "" {
+			if *field, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s '%s', it should be a timestamp in milliseconds", name, value)
+			}
+		}
+	}
+	if limit := v.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			return nil, fmt.Errorf("invalid limit '%s'", limit)
+		}
+	}
+	return q, nil
+}
+
+//writeActivities writes a page of activities matching the query,
+//with 'projection=compact' the pipeline definition is omitted
+func writeActivities(req *http.Request, q *service.ActivityQuery) error {
 	apiContext := api.GetApiContext(req)
-	geObjList, err := service.PaginateGenericObjects("activity")
+	activities, next, total, err := service.QueryActivities(q)
 	if err != nil {
 		logrus.Errorf("fail to list activity,err:%v", err)
 		return err
 	}
-	var activities []*model.Activity
 	uid, err := util.GetCurrentUser(req.Cookies())
 	if err != nil || uid == "" {
 		logrus.Errorf("cannot get currentUser,%v,%v", uid, err)
 	}
 
-	for _, gobj := range geObjList {
-		b := []byte(gobj.ResourceData["data"].(string))
-		a := &model.Activity{}
-		json.Unmarshal(b, a)
+	for _, a := range activities {
 		model.ToActivityResource(apiContext, a)
 		if a.CanApprove(uid) {
 			//add approve action
 			a.Actions["approve"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=approve"
 			a.Actions["deny"] = apiContext.UrlBuilder.ReferenceLink(a.Resource) + "?action=deny"
 		}
-		activities = append(activities, a)
 	}
-
-	datalist := priorityPendingActivity(activities)
-	apiContext.Write(&v1client.GenericCollection{
+	compact := req.URL.Query().Get("projection") == "compact"
+	datalist := []interface{}{}
+	for _, a := range activities {
+		if compact {
+			datalist = append(datalist, model.ToActivitySummary(a, service.ActivityBranch(a)))
+		} else {
+			datalist = append(datalist, a)
+		}
+	}
+	collection := &v1client.GenericCollection{
 		Data: datalist,
-	})
-
+	}
+	total64 := int64(total)
+	collection.Pagination = &v1client.Pagination{
+		Marker: q.Marker,
+		Total:  &total64,
+	}
+	if q.Limit > 0 {
+		limit := int64(q.Limit)
+		collection.Pagination.Limit = &limit
+	}
+	if next != "" {
+		collection.Pagination.Partial = true
+		if u, err := url.Parse(apiContext.UrlBuilder.Current()); err == nil {
+			//next page keeps the filters of the query
+			params := req.URL.Query()
+			params.Set("marker", next)
+			u.RawQuery = params.Encode()
+			collection.Pagination.Next = u.String()
+		}
+	}
+	if q.SortBy != "" {
+		collection.Sort = &v1client.Sort{
+			Name:  q.SortBy,
+			Order: q.Order,
+		}
+	}
+	apiContext.Write(collection)
 	return nil
-
 }
 
 func (s *Server) CleanActivities(rw http.ResponseWriter, req *http.Request) error {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-	geObjList, err := service.PaginateGenericObjects("activity")
+	activities, err := service.ListActivities()
 	if err != nil {
 		logrus.Errorf("fail to list activity,err:%v", err)
 		return err
 	}
-	for _, gobj := range geObjList {
-		apiClient.GenericObject.Delete(&gobj)
+	for _, a := range activities {
+		service.DeleteActivity(a.Id)
 	}
 	return nil
 
 }
 
 func (s *Server) CleanPipelines(rw http.ResponseWriter, req *http.Request) error {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-	geObjList, err := service.PaginateGenericObjects("pipeline")
-	if err != nil {
-		logrus.Errorf("fail to list pipeline,err:%v", err)
-		return err
-	}
-	for _, gobj := range geObjList {
-		apiClient.GenericObject.Delete(&gobj)
+	pipelines := service.ListPipelines()
+	for _, p := range pipelines {
+		service.DeletePipeline(p.Id)
 	}
 	return nil
 }
@@ -95,6 +168,7 @@ func (s *Server) CreateActivity(rw http.ResponseWriter, req *http.Request) error
 	if err := json.Unmarshal(requestBytes, activity); err != nil {
 		return err
 	}
+	activity.ResourceVersion = requestVersion(req, activity.ResourceVersion)
 	//validate git account access
 	if !service.ValidAccountAccess(req, activity.Pipeline.Stages[0].Steps[0].GitUser) {
 		return fmt.Errorf("no access to '%s' git account", activity.Pipeline.Stages[0].Steps[0].GitUser)
@@ -142,6 +216,71 @@ func (s *Server) RerunActivity(rw http.ResponseWriter, req *http.Request) error
 	return nil
 }
 
+//ResumeActivity runs the completed activity again from its first step not succeeded
+func (s *Server) ResumeActivity(rw http.ResponseWriter, req *http.Request) error {
+	return s.resumeActivity(rw, req, func(r *model.Activity) error {
+		return service.ResumeActivity(s.Provider, r)
+	})
+}
+
+//RerunActivityFrom runs the completed activity again from the stage and step ordinal
+func (s *Server) RerunActivityFrom(rw http.ResponseWriter, req *http.Request) error {
+	input := struct {
+		StageOrdinal int `json:"stageOrdinal"`
+		StepOrdinal  int `json:"stepOrdinal"`
+	}{}
+	if data, err := ioutil.ReadAll(req.Body); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &input); err != nil {
+			return err
+		}
+	} else {
+		if input.StageOrdinal, err = strconv.Atoi(req.FormValue("stageOrdinal")); err != nil {
+			return fmt.Errorf("invalid stage ordinal to rerun from: %v", err)
+		}
+		if stepOrdinal := req.FormValue("stepOrdinal"); stepOrdinal != "" {
+			if input.StepOrdinal, err = strconv.Atoi(stepOrdinal); err != nil {
+				return fmt.Errorf("invalid step ordinal to rerun from: %v", err)
+			}
+		}
+	}
+	return s.resumeActivity(rw, req, func(r *model.Activity) error {
+		return service.RerunActivityFrom(s.Provider, r, input.StageOrdinal, input.StepOrdinal)
+	})
+}
+
+func (s *Server) resumeActivity(rw http.ResponseWriter, req *http.Request, resume func(*model.Activity) error) error {
+	id := mux.Vars(req)["id"]
+	apiContext := api.GetApiContext(req)
+
+	mutex := GlobalAgent.getActivityLock(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	r, err := service.GetActivity(id)
+	if err != nil {
+		logrus.Errorf("fail getting activity with id:%v", id)
+		return err
+	}
+	//validate git account access
+	if !service.ValidAccountAccess(req, r.Pipeline.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Pipeline.Stages[0].Steps[0].GitUser)
+	}
+
+	if err = resume(r); err != nil {
+		logrus.Errorf("resume activity error:%v", err)
+		return err
+	}
+	if err = service.UpdateActivity(r); err != nil {
+		logrus.Errorf("update activity error:%v", err)
+		return err
+	}
+	s.UpdateLastActivity(r)
+	broadcastResourceChange(*r)
+	model.ToActivityResource(apiContext, r)
+	apiContext.Write(r)
+	return nil
+}
+
 func (s *Server) ApproveActivity(rw http.ResponseWriter, req *http.Request) error {
 	id := mux.Vars(req)["id"]
 	apiContext := api.GetApiContext(req)
@@ -163,9 +302,6 @@ func (s *Server) ApproveActivity(rw http.ResponseWriter, req *http.Request) erro
 		logrus.Errorf("fail approve activity:%v", err)
 		return err
 	}
-	r.Status = model.ActivityWaiting
-	r.ActivityStages[r.PendingStage].Status = model.ActivityStageWaiting
-	r.PendingStage = 0
 	if err = service.UpdateActivity(r); err != nil {
 		logrus.Errorf("fail update activity:%v", err)
 		return err
@@ -200,6 +336,7 @@ func (s *Server) DenyActivity(rw http.ResponseWriter, req *http.Request) error {
 		logrus.Errorf("fail denyActivity:%v", err)
 		return err
 	}
+	service.RunFinally(s.Provider, r)
 	if err = service.UpdateActivity(r); err != nil {
 		logrus.Errorf("fail update activity:%v", err)
 		return err
@@ -235,19 +372,56 @@ func (s *Server) StopActivity(rw http.ResponseWriter, req *http.Request) error {
 		logrus.Errorf("fail stop activity:%v", err)
 		return err
 	}
+	service.RunFinally(s.Provider, r)
 	if err = service.UpdateActivity(r); err != nil {
 		logrus.Errorf("fail update activity:%v", err)
 		return err
 	}
 	broadcastResourceChange(*r)
 	s.UpdateLastActivity(r)
-	s.Provider.OnActivityCompelte(r)
+	if service.IsComplete(r) {
+		s.Provider.OnActivityCompelte(r)
+	}
 	model.ToActivityResource(apiContext, r)
 	apiContext.Write(r)
 	return nil
 
 }
 
+//CancelActivity removes a queued activity from the queue
+func (s *Server) CancelActivity(rw http.ResponseWriter, req *http.Request) error {
+	id := mux.Vars(req)["id"]
+	apiContext := api.GetApiContext(req)
+
+	mutex := GlobalAgent.getActivityLock(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	r, err := service.GetActivity(id)
+	if err != nil {
+		logrus.Errorf("fail getting activity with id:%v", id)
+		return err
+	}
+	//validate git account access
+	if !service.ValidAccountAccess(req, r.Pipeline.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Pipeline.Stages[0].Steps[0].GitUser)
+	}
+
+	if err = service.CancelQueuedActivity(r); err != nil {
+		logrus.Errorf("fail cancel activity:%v", err)
+		return err
+	}
+	if err = service.UpdateActivity(r); err != nil {
+		logrus.Errorf("fail update activity:%v", err)
+		return err
+	}
+	broadcastResourceChange(*r)
+	s.UpdateLastActivity(r)
+	model.ToActivityResource(apiContext, r)
+	apiContext.Write(r)
+	return nil
+}
+
 func (s *Server) DeleteActivity(rw http.ResponseWriter, req *http.Request) error {
 	id := mux.Vars(req)["id"]
 	r, err := service.GetActivity(id)
@@ -258,6 +432,11 @@ func (s *Server) DeleteActivity(rw http.ResponseWriter, req *http.Request) error
 	if !service.ValidAccountAccess(req, r.Pipeline.Stages[0].Steps[0].GitUser) {
 		return fmt.Errorf("no access to '%s' git account", r.Pipeline.Stages[0].Steps[0].GitUser)
 	}
+	if service.IsComplete(r) {
+		if err := s.Provider.OnDeleteActivity(r); err != nil {
+			logrus.Errorf("fail to clean up activity '%s': %v", id, err)
+		}
+	}
 	err = service.DeleteActivity(id)
 	if err != nil {
 		return err
@@ -269,12 +448,21 @@ func (s *Server) DeleteActivity(rw http.ResponseWriter, req *http.Request) error
 
 func (s *Server) UpdateActivity(rw http.ResponseWriter, req *http.Request) error {
 	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
 	requestBytes, err := ioutil.ReadAll(req.Body)
 	activity := &model.Activity{}
 
 	if err := json.Unmarshal(requestBytes, activity); err != nil {
 		return err
 	}
+	activity.Id = id
+	//step callbacks update the activity under the same lock,
+	//so they never fail on a version changed by this update
+	mutex := GlobalAgent.getActivityLock(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	activity.ResourceVersion = requestVersion(req, activity.ResourceVersion)
 	//validate git account access
 	if !service.ValidAccountAccess(req, activity.Pipeline.Stages[0].Steps[0].GitUser) {
 		return fmt.Errorf("no access to '%s' git account", activity.Pipeline.Stages[0].Steps[0].GitUser)
@@ -283,6 +471,7 @@ func (s *Server) UpdateActivity(rw http.ResponseWriter, req *http.Request) error
 	if err != nil {
 		return err
 	}
+	setETag(rw, activity.ResourceVersion)
 	model.ToActivityResource(apiContext, activity)
 	apiContext.Write(activity)
 	return nil
@@ -301,6 +490,7 @@ func (s *Server) GetActivity(rw http.ResponseWriter, req *http.Request) error {
 		return fmt.Errorf("no access to '%s' git account", a.Pipeline.Stages[0].Steps[0].GitUser)
 	}
 
+	setETag(rw, a.ResourceVersion)
 	model.ToActivityResource(apiContext, a)
 	uid, err := util.GetCurrentUser(req.Cookies())
 	if err != nil || uid == "" {
@@ -314,37 +504,151 @@ func (s *Server) GetActivity(rw http.ResponseWriter, req *http.Request) error {
 	return apiContext.WriteResource(a)
 }
 
-func priorityPendingActivity(activities []*model.Activity) []interface{} {
-	var actilist []interface{}
-	var pendinglist []interface{}
+//ListArtifacts lists files kept from the workspace of the activity
+func (s *Server) ListArtifacts(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	a, err := service.GetActivity(id)
+	if err != nil {
+		return err
+	}
+	//validate git account access
+	if !service.ValidAccountAccess(req, a.Pipeline.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", a.Pipeline.Stages[0].Steps[0].GitUser)
+	}
+	data := []interface{}{}
+	for _, artifact := range a.Artifacts {
+		data = append(data, model.ToArtifactResource(apiContext, a.Id, artifact))
+	}
+	apiContext.Write(&v1client.GenericCollection{
+		Data: data,
+	})
+	return nil
+}
+
+//DownloadArtifact serves the file of an artifact of the activity
+func (s *Server) DownloadArtifact(rw http.ResponseWriter, req *http.Request) error {
+	id := mux.Vars(req)["id"]
+	a, err := service.GetActivity(id)
+	if err != nil {
+		return err
+	}
+	//validate git account access
+	if !service.ValidAccountAccess(req, a.Pipeline.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", a.Pipeline.Stages[0].Steps[0].GitUser)
+	}
+	artifact, file, err := service.GetArtifact(a, mux.Vars(req)["name"])
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "fail to open artifact '%s'", artifact.Name)
+	}
+	defer f.Close()
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Add("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(artifact.Name)}))
+	setETag(rw, artifact.Checksum)
+	http.ServeContent(rw, req, path.Base(artifact.Name), time.Unix(0, artifact.Created*int64(time.Millisecond)), f)
+	return nil
+}
+
+//ListTests lists test cases of reports collected for steps of the activity,
+//they can be filtered by status, stageOrdinal and stepOrdinal
+func (s *Server) ListTests(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	a, err := service.GetActivity(id)
+	if err != nil {
+		return err
+	}
+	//validate git account access
+	if !service.ValidAccountAccess(req, a.Pipeline.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", a.Pipeline.Stages[0].Steps[0].GitUser)
+	}
+	cases, err := service.ListTestCases(a)
+	if err != nil {
+		return err
+	}
+	status := req.FormValue("status")
+	stageOrdinal := req.FormValue("stageOrdinal")
+	stepOrdinal := req.FormValue("stepOrdinal")
+	data := []interface{}{}
+	for i, c := range cases {
+		if (status != "" && c.Status != status) ||
+			(stageOrdinal != "" && stageOrdinal != strconv.Itoa(c.StageOrdinal)) ||
+			(stepOrdinal != "" && stepOrdinal != strconv.Itoa(c.StepOrdinal)) {
+			continue
+		}
+		data = append(data, model.ToTestCaseResource(apiContext, a.Id, i, c))
+	}
+	apiContext.Write(&v1client.GenericCollection{
+		Data: data,
+	})
+	return nil
+}
+
+//supersedeActivities stops older runs of the branch replaced by the activity
+func (s *Server) supersedeActivities(activity *model.Activity) {
+	activities, err := service.SupersededActivities(activity)
+	if err != nil {
+		logrus.Errorf("fail to get activities superseded by '%s': %v", activity.Id, err)
+		return
+	}
 	for _, a := range activities {
-		if a.Status == model.ActivityPending {
-			pendinglist = append(pendinglist, a)
-		} else {
-			actilist = append(actilist, a)
+		if err := s.supersedeActivity(a.Id, activity.Id); err != nil {
+			logrus.Errorf("fail to supersede activity '%s': %v", a.Id, err)
 		}
 	}
-	actilist = append(pendinglist, actilist...)
-	return actilist
+}
+
+func (s *Server) supersedeActivity(id string, newerId string) error {
+	mutex := GlobalAgent.getActivityLock(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	r, err := service.GetActivity(id)
+	if err != nil {
+		return err
+	}
+	queued := r.Status == model.ActivityQueued
+	if err = service.SupersedeActivity(s.Provider, r, newerId); err != nil {
+		return err
+	}
+	if !queued {
+		service.RunFinally(s.Provider, r)
+	}
+	if err = service.UpdateActivity(r); err != nil {
+		return err
+	}
+	logrus.Infof("activity '%s' is superseded by '%s'", id, newerId)
+	broadcastResourceChange(*r)
+	s.UpdateLastActivity(r)
+	if !queued && service.IsComplete(r) {
+		s.Provider.OnActivityCompelte(r)
+	}
+	return nil
 }
 
 //update last activity info in the pipeline on activity changes
 func (s *Server) UpdateLastActivity(activity *model.Activity) {
 	logrus.Debugf("begin UpdateLastActivity")
 	pId := activity.Pipeline.Id
-	p, err := service.GetPipelineById(pId)
-	if err != nil {
-		return
-	}
-	if activity.Id != p.LastRunId {
+	notLast := errors.New("not last activity")
+	p, err := service.ModifyPipeline(pId, func(p *model.Pipeline) error {
+		if activity.Id != p.LastRunId {
+			return notLast
+		}
+		p.LastRunStatus = activity.Status
+		p.CommitInfo = activity.CommitInfo
+		p.NextRunTime = service.GetNextRunTime(p)
+		return nil
+	})
+	if err == notLast {
 		return
-	}
-	p.LastRunStatus = activity.Status
-	p.CommitInfo = activity.CommitInfo
-	p.NextRunTime = service.GetNextRunTime(p)
-
-	if err := service.UpdatePipeline(p); err != nil {
+	} else if err != nil {
 		logrus.Errorf("fail update pipeline last run status,%v", err)
+		return
 	}
 	broadcastResourceChange(*p)
 }
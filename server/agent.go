@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/config"
 	"github.com/rancher/pipeline/git"
 	"github.com/rancher/pipeline/model"
 	"github.com/rancher/pipeline/scheduler"
@@ -77,6 +78,8 @@ func InitAgent(s *Server) {
 	logrus.Debugf("inited GlobalAgent:%v", GlobalAgent)
 	go GlobalAgent.handleWS()
 	go GlobalAgent.RunScheduler()
+	go GlobalAgent.RunCollector(config.Config.CollectInterval)
+	go GlobalAgent.RunQueue(queueInterval)
 
 }
 
@@ -238,10 +241,13 @@ func (a *Agent) registerCronRunner(cr *scheduler.CronRunner) {
 				}
 				if latestCommit == ppl.CommitInfo {
 					//update nextruntime and return
-					ppl.NextRunTime = service.GetNextRunTime(ppl)
-
-					if err := service.UpdatePipeline(ppl); err != nil {
+					ppl, err = service.ModifyPipeline(ppl.Id, func(p *model.Pipeline) error {
+						p.NextRunTime = service.GetNextRunTime(p)
+						return nil
+					})
+					if err != nil {
 						logrus.Errorf("update pipeline error,%v", err)
+						return
 					}
 					a.broadcast <- WSMsg{
 						Id:           uuid.Rand().Hex(),
@@ -260,7 +266,7 @@ func (a *Agent) registerCronRunner(cr *scheduler.CronRunner) {
 			}
 		})
 		if err != nil {
-			logrus.Error("cron addfunc error for pipeline %v:%v", pId, err)
+			logrus.Errorf("cron addfunc error for pipeline %v:%v", pId, err)
 			return
 		}
 		cr.Start()
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/server/service"
+)
+
+//RunCollector removes activities expired by retention policies and evicts build caches periodically
+func (a *Agent) RunCollector(interval time.Duration) {
+	if interval <= 0 {
+		logrus.Infof("activity collector is disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.collectActivities()
+		a.collectCaches()
+	}
+}
+
+func (a *Agent) collectCaches() {
+	evicted, err := service.EvictCaches()
+	if err != nil {
+		logrus.Errorf("fail to evict caches: %v", err)
+	}
+	if evicted > 0 {
+		logrus.Infof("evicted %d caches", evicted)
+	}
+}
+
+func (a *Agent) collectActivities() {
+	expired, err := service.ExpiredActivities()
+	if err != nil {
+		logrus.Errorf("fail to get expired activities: %v", err)
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+	logrus.Infof("collecting %d expired activities", len(expired))
+	for _, e := range expired {
+		if err := a.removeActivity(e.Id); err != nil {
+			logrus.Errorf("fail to remove activity '%s': %v", e.Id, err)
+		}
+	}
+}
+
+//removeActivity cleans up provider resources of a completed activity then deletes it.
+//The activity is kept if the clean up fails, so that it is retried next time
+func (a *Agent) removeActivity(id string) error {
+	mutex := a.getActivityLock(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	r, err := service.GetActivity(id)
+	if err != nil {
+		return err
+	}
+	if !service.IsComplete(r) {
+		return nil
+	}
+	if err := a.Server.Provider.OnDeleteActivity(r); err != nil {
+		return err
+	}
+	if err := service.DeleteActivity(id); err != nil {
+		return err
+	}
+	a.activityLocks.Delete(id)
+	r.Status = "removed"
+	broadcastResourceChange(*r)
+	return nil
+}
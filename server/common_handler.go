@@ -3,13 +3,17 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
+	"github.com/rancher/pipeline/config"
 	"github.com/rancher/pipeline/model"
 	"github.com/rancher/pipeline/server/service"
 	"github.com/rancher/pipeline/util"
@@ -56,10 +60,14 @@ func (s *Server) Webhook(rw http.ResponseWriter, req *http.Request) error {
 
 	logrus.Debugf("token validate pass")
 
-	if _, err = service.RunPipeline(s.Provider, id, model.TriggerTypeWebhook); err != nil {
+	activity, err := service.RunPipeline(s.Provider, id, model.TriggerTypeWebhook)
+	if err != nil {
 		rw.Write([]byte("run pipeline error!"))
 		return err
 	}
+	if pipeline.CancelSuperseded {
+		s.supersedeActivities(activity)
+	}
 	rw.Write([]byte("run pipeline success!"))
 	logrus.Infof("webhook trigger run for '%s' success", pipeline.Name)
 	return nil
@@ -98,17 +106,181 @@ func (s *Server) ListEnvVars(rw http.ResponseWriter, req *http.Request) error {
 }
 
 func (s *Server) StepStart(rw http.ResponseWriter, req *http.Request) error {
+	activity, stageOrdinal, stepOrdinal, err := stepCallback(req, service.CheckStepStartToken)
+	if err != nil {
+		return err
+	}
+	return s.OnStepStart(activity.Id, stageOrdinal, stepOrdinal)
+}
+
+func (s *Server) StepFinish(rw http.ResponseWriter, req *http.Request) error {
+	//outputs and changed files of the step are set to env vars of the activity, only the step posts them
+	activity, stageOrdinal, stepOrdinal, err := stepCallback(req, service.CheckStepToken)
+	if err != nil {
+		return err
+	}
+	status := req.URL.Query().Get("status")
+	commit := req.FormValue("GIT_COMMIT")
+	var changedFiles []string
+	if changes, ok := req.PostForm["CHANGED_FILES"]; ok {
+		changedFiles = []string{}
+		for _, c := range changes {
+			for _, file := range strings.Split(c, "\n") {
+				if file = strings.TrimSpace(file); file != "" {
+					changedFiles = append(changedFiles, file)
+				}
+			}
+		}
+	}
+	return s.OnStepFinish(activity.Id, stageOrdinal, stepOrdinal, status, commit, req.FormValue("OUTPUTS"), changedFiles)
+}
+
+//stepCallback gets the activity and ordinals of the step calling back the server,
+//the call is authenticated by the token of the step and the check of the step status
+func stepCallback(req *http.Request, check func(*model.Activity, int, int, string) error) (*model.Activity, int, int, error) {
 	v := req.URL.Query()
-	activityId := v.Get("id")
 	stageOrdinal, err := strconv.Atoi(v.Get("stageOrdinal"))
 	if err != nil {
-		return err
+		return nil, 0, 0, err
 	}
 	stepOrdinal, err := strconv.Atoi(v.Get("stepOrdinal"))
 	if err != nil {
+		return nil, 0, 0, err
+	}
+	activity, err := service.GetActivity(v.Get("id"))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if err := check(activity, stageOrdinal, stepOrdinal, req.Header.Get(service.StepTokenHeader)); err != nil {
+		logrus.Warningf("reject callback of step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activity.Id, err)
+		return nil, 0, 0, err
+	}
+	return activity, stageOrdinal, stepOrdinal, nil
+}
+
+//limitUpload caps the size of the request body uploaded by a step
+func limitUpload(rw http.ResponseWriter, req *http.Request) error {
+	if config.Config.MaxUploadSize <= 0 {
+		return nil
+	}
+	if req.ContentLength > config.Config.MaxUploadSize {
+		return errors.Wrapf(service.ErrUploadTooLarge, "%d bytes exceed %d bytes", req.ContentLength, config.Config.MaxUploadSize)
+	}
+	req.Body = http.MaxBytesReader(rw, req.Body, config.Config.MaxUploadSize)
+	return nil
+}
+
+//StepArtifacts receives a tar stream of workspace files after the step
+func (s *Server) StepArtifacts(rw http.ResponseWriter, req *http.Request) error {
+	defer req.Body.Close()
+	activity, stageOrdinal, stepOrdinal, err := stepCallback(req, service.CheckStepToken)
+	if err != nil {
+		return err
+	}
+	strip := 0
+	if v := req.URL.Query().Get("strip"); v != "" {
+		if strip, err = strconv.Atoi(v); err != nil {
+			return err
+		}
+	}
+	if err := limitUpload(rw, req); err != nil {
 		return err
 	}
+	return s.OnStepArtifacts(activity.Id, stageOrdinal, stepOrdinal, req.Body, strip)
+}
 
+//StepTestReports receives a tar stream of test report files in the workspace after the step
+func (s *Server) StepTestReports(rw http.ResponseWriter, req *http.Request) error {
+	defer req.Body.Close()
+	activity, stageOrdinal, stepOrdinal, err := stepCallback(req, service.CheckStepToken)
+	if err != nil {
+		return err
+	}
+	strip := 0
+	if v := req.URL.Query().Get("strip"); v != "" {
+		if strip, err = strconv.Atoi(v); err != nil {
+			return err
+		}
+	}
+	if err := limitUpload(rw, req); err != nil {
+		return err
+	}
+	return s.OnStepTestReports(activity.Id, stageOrdinal, stepOrdinal, req.Body, strip)
+}
+
+//StepCache serves the archive of the cache to restore before the step, the key resolves the key template of the step
+func (s *Server) StepCache(rw http.ResponseWriter, req *http.Request) error {
+	activity, stageOrdinal, stepOrdinal, err := stepCallback(req, service.CheckStepToken)
+	if err != nil {
+		return err
+	}
+	key := req.URL.Query().Get("key")
+	if err := service.CheckStepCacheKey(activity, stageOrdinal, stepOrdinal, key); err != nil {
+		return err
+	}
+	cache, f, err := service.OpenCache(activity.Pipeline.Id, key)
+	if err == service.ErrCacheNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	logrus.Debugf("restore cache '%s' for activity '%s'", cache.Key, activity.Id)
+	rw.Header().Set("Content-Type", "application/gzip")
+	http.ServeContent(rw, req, "", time.Time{}, f)
+	return nil
+}
+
+//StepSecretEnv gets the value of the env var of the running step referencing secrets,
+//jenkins jobs get it right before running the step container
+func (s *Server) StepSecretEnv(rw http.ResponseWriter, req *http.Request) error {
+	activity, stageOrdinal, stepOrdinal, err := stepCallback(req, service.CheckStepToken)
+	if err != nil {
+		return err
+	}
+	value, err := service.StepSecretEnv(activity, stageOrdinal, stepOrdinal, req.URL.Query().Get("name"))
+	if err == service.ErrSecretNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type", "text/plain")
+	_, err = rw.Write([]byte(value))
+	return err
+}
+
+//SaveStepCache receives a tar stream of cache paths in the workspace after the step succeeds
+func (s *Server) SaveStepCache(rw http.ResponseWriter, req *http.Request) error {
+	defer req.Body.Close()
+	activity, stageOrdinal, stepOrdinal, err := stepCallback(req, service.CheckStepToken)
+	if err != nil {
+		return err
+	}
+	v := req.URL.Query()
+	strip := 0
+	if v.Get("strip") != "" {
+		if strip, err = strconv.Atoi(v.Get("strip")); err != nil {
+			return err
+		}
+	}
+	key := v.Get("key")
+	if err := service.CheckStepCacheKey(activity, stageOrdinal, stepOrdinal, key); err != nil {
+		return err
+	}
+	if err := limitUpload(rw, req); err != nil {
+		return err
+	}
+	if err := service.SaveCache(activity, stageOrdinal, stepOrdinal, key, req.Body, strip); err != nil {
+		logrus.Errorf("fail to save cache '%s' of step %d-%d of activity '%s': %v", key, stageOrdinal, stepOrdinal, activity.Id, err)
+		return err
+	}
+	return nil
+}
+
+//OnStepStart marks the step as building
+func (s *Server) OnStepStart(activityId string, stageOrdinal int, stepOrdinal int) error {
 	mutex := GlobalAgent.getActivityLock(activityId)
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -121,6 +293,10 @@ func (s *Server) StepStart(rw http.ResponseWriter, req *http.Request) error {
 	if stageOrdinal < 0 || stepOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) || stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
 		return errors.New("step index invalid")
 	}
+	if service.IsMainEnded(activity, stageOrdinal) {
+		logrus.Debugf("ignore stepstart event of ended main stage in activity '%s'", activityId)
+		return nil
+	}
 	service.StartStep(activity, stageOrdinal, stepOrdinal)
 	if err = service.UpdateActivity(activity); err != nil {
 		return err
@@ -130,19 +306,8 @@ func (s *Server) StepStart(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
-func (s *Server) StepFinish(rw http.ResponseWriter, req *http.Request) error {
-	//get activityId,stageOrdinal,stepOrdinal from request
-	v := req.URL.Query()
-	activityId := v.Get("id")
-	status := v.Get("status")
-	stageOrdinal, err := strconv.Atoi(v.Get("stageOrdinal"))
-	if err != nil {
-		return err
-	}
-	stepOrdinal, err := strconv.Atoi(v.Get("stepOrdinal"))
-	if err != nil {
-		return err
-	}
+//OnStepFinish completes the step with status 'SUCCESS' or 'FAILURE' and triggers next steps
+func (s *Server) OnStepFinish(activityId string, stageOrdinal int, stepOrdinal int, status string, commit string, outputs string, changedFiles []string) error {
 	mutex := GlobalAgent.getActivityLock(activityId)
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -155,18 +320,54 @@ func (s *Server) StepFinish(rw http.ResponseWriter, req *http.Request) error {
 	if stageOrdinal < 0 || stepOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) || stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
 		return errors.New("step index invalid")
 	}
+	if service.IsMainEnded(activity, stageOrdinal) {
+		logrus.Debugf("ignore stepfinish event of ended main stage in activity '%s'", activityId)
+		return nil
+	}
+	if service.CheckStepRunning(activity, stageOrdinal, stepOrdinal) != nil {
+		logrus.Debugf("ignore stepfinish event of step %d-%d not running in activity '%s'", stageOrdinal, stepOrdinal, activityId)
+		return nil
+	}
+	if (status == "SUCCESS" || status == "FAILURE") && outputs != "" {
+		service.SetStepOutputs(activity, stageOrdinal, stepOrdinal, outputs)
+	}
+	if stageOrdinal == 0 && stepOrdinal == 0 && status == "SUCCESS" {
+		//conditions of next stages check changed files
+		activity.ChangedFiles = changedFiles
+	}
 	if status == "SUCCESS" {
-		service.SuccessStep(activity, stageOrdinal, stepOrdinal)
-		service.Triggernext(activity, stageOrdinal, stepOrdinal, s.Provider)
+		if service.IsRestoreStep(activity, stageOrdinal, stepOrdinal) {
+			service.RestoreStep(s.Provider, activity, stageOrdinal, stepOrdinal)
+		} else {
+			service.SuccessStep(activity, stageOrdinal, stepOrdinal)
+			service.Triggernext(activity, stageOrdinal, stepOrdinal, s.Provider)
+		}
 	} else if status == "FAILURE" {
-		service.FailStep(activity, stageOrdinal, stepOrdinal)
+		if delay, ok := service.RetryStep(s.Provider, activity, stageOrdinal, stepOrdinal); ok {
+			time.AfterFunc(delay, func() {
+				if err := s.retryStep(activityId, stageOrdinal, stepOrdinal); err != nil {
+					logrus.Errorf("fail to retry step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activityId, err)
+				}
+			})
+		} else if !service.IsRestoreStep(activity, stageOrdinal, stepOrdinal) &&
+			service.IsFailureAllowed(activity, stageOrdinal, stepOrdinal) {
+			service.FailStepAllowed(activity, stageOrdinal, stepOrdinal)
+			service.Triggernext(activity, stageOrdinal, stepOrdinal, s.Provider)
+		} else if !service.IsFailFast(activity, stageOrdinal, stepOrdinal) {
+			//other steps of the matrix run on
+			service.FailMatrixStep(activity, stageOrdinal, stepOrdinal)
+			service.Triggernext(activity, stageOrdinal, stepOrdinal, s.Provider)
+		} else {
+			service.FailStep(activity, stageOrdinal, stepOrdinal)
+		}
 	}
 
 	//update commitinfo for SCM step
 	if stageOrdinal == 0 && stepOrdinal == 0 {
-		activity.CommitInfo = req.FormValue("GIT_COMMIT")
+		activity.CommitInfo = commit
 		activity.EnvVars["CICD_GIT_COMMIT"] = activity.CommitInfo
 	}
+	service.RunFinally(s.Provider, activity)
 
 	if err = service.UpdateActivity(activity); err != nil {
 		return err
@@ -182,6 +383,115 @@ func (s *Server) StepFinish(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+//OnStepArtifacts keeps files of the archive matching artifacts of the step
+func (s *Server) OnStepArtifacts(activityId string, stageOrdinal int, stepOrdinal int, archive io.Reader, strip int) error {
+	mutex := GlobalAgent.getActivityLock(activityId)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logrus.Debugf("get artifacts event,paras:%v,%v,%v", activityId, stageOrdinal, stepOrdinal)
+	activity, err := service.GetActivity(activityId)
+	if err != nil {
+		return err
+	}
+	//artifacts of a finished step are not replaced
+	if err := service.CheckStepRunning(activity, stageOrdinal, stepOrdinal); err != nil {
+		return err
+	}
+	if err := service.SaveArtifacts(activity, stageOrdinal, stepOrdinal, archive, strip); err != nil {
+		logrus.Errorf("fail to save artifacts of step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activityId, err)
+		return err
+	}
+	if err = service.UpdateActivity(activity); err != nil {
+		return err
+	}
+	broadcastResourceChange(*activity)
+	return nil
+}
+
+//OnStepTestReports parses test reports of the archive matching test reports of the step
+func (s *Server) OnStepTestReports(activityId string, stageOrdinal int, stepOrdinal int, archive io.Reader, strip int) error {
+	mutex := GlobalAgent.getActivityLock(activityId)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logrus.Debugf("get test reports event,paras:%v,%v,%v", activityId, stageOrdinal, stepOrdinal)
+	activity, err := service.GetActivity(activityId)
+	if err != nil {
+		return err
+	}
+	//test reports of a finished step are not replaced
+	if err := service.CheckStepRunning(activity, stageOrdinal, stepOrdinal); err != nil {
+		return err
+	}
+	if err := service.SaveTestReports(activity, stageOrdinal, stepOrdinal, archive, strip); err != nil {
+		logrus.Errorf("fail to save test reports of step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activityId, err)
+		return err
+	}
+	if err = service.UpdateActivity(activity); err != nil {
+		return err
+	}
+	broadcastResourceChange(*activity)
+	return nil
+}
+
+//retryStep runs the failed step again, the step fails if it cannot be triggered
+func (s *Server) retryStep(activityId string, stageOrdinal int, stepOrdinal int) error {
+	mutex := GlobalAgent.getActivityLock(activityId)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	activity, err := service.GetActivity(activityId)
+	if err != nil {
+		return err
+	}
+	runErr := service.RunRetry(s.Provider, activity, stageOrdinal, stepOrdinal)
+	if runErr != nil {
+		if service.IsFailureAllowed(activity, stageOrdinal, stepOrdinal) {
+			service.FailStepAllowed(activity, stageOrdinal, stepOrdinal)
+			service.Triggernext(activity, stageOrdinal, stepOrdinal, s.Provider)
+		} else if !service.IsFailFast(activity, stageOrdinal, stepOrdinal) {
+			service.FailMatrixStep(activity, stageOrdinal, stepOrdinal)
+			service.Triggernext(activity, stageOrdinal, stepOrdinal, s.Provider)
+		} else {
+			service.FailStep(activity, stageOrdinal, stepOrdinal)
+		}
+		activity.FailMessage = fmt.Sprintf("fail to retry step: %v", runErr)
+		service.RunFinally(s.Provider, activity)
+	}
+	if err = service.UpdateActivity(activity); err != nil {
+		return err
+	}
+	broadcastResourceChange(*activity)
+	if service.IsComplete(activity) {
+		s.UpdateLastActivity(activity)
+		s.Provider.OnActivityCompelte(activity)
+	}
+	return runErr
+}
+
 func (s *Server) Reset(rw http.ResponseWriter, req *http.Request) error {
 	return service.Reset()
 }
+
+//Reencrypt encrypts stored secrets with the primary master key
+func (s *Server) Reencrypt(rw http.ResponseWriter, req *http.Request) error {
+	_, err := service.ReencryptSecrets()
+	return err
+}
+
+//requestVersion gets the resource version the client expects to update,
+//an If-Match header takes precedence over the version in request body
+func requestVersion(req *http.Request, bodyVersion string) string {
+	ifMatch := strings.TrimSpace(req.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return bodyVersion
+	}
+	return strings.Trim(strings.TrimPrefix(ifMatch, "W/"), "\"")
+}
+
+func setETag(rw http.ResponseWriter, version string) {
+	if version != "" {
+		rw.Header().Set("ETag", "\""+version+"\"")
+	}
+}
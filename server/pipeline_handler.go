@@ -6,16 +6,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
-	v2client "github.com/rancher/go-rancher/v2"
 	"github.com/rancher/pipeline/model"
 	"github.com/rancher/pipeline/server/service"
 	"github.com/rancher/pipeline/server/webhook"
+	"github.com/rancher/pipeline/store"
 	"github.com/rancher/pipeline/util"
 	"github.com/sluu99/uuid"
 	yaml "gopkg.in/yaml.v2"
@@ -43,6 +45,7 @@ func (s *Server) ListPipeline(rw http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return fmt.Errorf("fail to get pipeline: %v", err)
 	}
+	setETag(rw, r.ResourceVersion)
 	apiContext.Write(model.ToPipelineResource(apiContext, r))
 	return nil
 }
@@ -102,7 +105,11 @@ func (s *Server) CreatePipeline(rw http.ResponseWriter, req *http.Request) error
 		return err
 	}
 
-	if err = service.CreatePipeline(ppl); err != nil {
+	uid, err := util.GetCurrentUser(req.Cookies())
+	if err != nil || uid == "" {
+		logrus.Debugf("create pipeline unrecognized user")
+	}
+	if err = service.CreatePipeline(ppl, uid); err != nil {
 		return err
 	}
 
@@ -119,6 +126,7 @@ func (s *Server) UpdatePipeline(rw http.ResponseWriter, req *http.Request) error
 	if err := json.Unmarshal(data, ppl); err != nil {
 		return err
 	}
+	ppl.ResourceVersion = requestVersion(req, ppl.ResourceVersion)
 	if err := service.Validate(ppl); err != nil {
 		return err
 	}
@@ -141,10 +149,39 @@ func (s *Server) UpdatePipeline(rw http.ResponseWriter, req *http.Request) error
 	if err != nil {
 		return fmt.Errorf("fail to get pipeline: %v", err)
 	}
+	if ppl.ResourceVersion != "" && ppl.ResourceVersion != prevPipeline.ResourceVersion {
+		return errors.Wrapf(store.ErrConflict, "pipeline '%s'", id)
+	}
+	if err = updateWebhook(scManager, token, prevPipeline, ppl); err != nil {
+		return err
+	}
+
+	if err = service.UpdatePipelineEnvKey(ppl); err != nil {
+		return err
+	}
+
+	uid, err := util.GetCurrentUser(req.Cookies())
+	if err != nil || uid == "" {
+		logrus.Debugf("update pipeline unrecognized user")
+	}
+	if err = service.UpdatePipelineDefinition(ppl, uid, ""); err != nil {
+		return err
+	}
+
+	GlobalAgent.onPipelineChange(ppl)
+	setETag(rw, ppl.ResourceVersion)
+	apiContext.Write(model.ToPipelineResource(apiContext, ppl))
+	return nil
+}
+
+//updateWebhook creates or removes the webhook when the scm step of pipeline is changed
+func updateWebhook(scManager model.SCManager, token string, prevPipeline *model.Pipeline, ppl *model.Pipeline) error {
+	var err error
 	if prevPipeline.Stages[0].Steps[0].Webhook && !ppl.Stages[0].Steps[0].Webhook {
 		if err = scManager.DeleteWebhook(prevPipeline, token); err != nil {
 			logrus.Error(err)
 		}
+		ppl.WebHookId = 0
 	} else if !prevPipeline.Stages[0].Steps[0].Webhook && ppl.Stages[0].Steps[0].Webhook {
 		if err = scManager.CreateWebhook(ppl, token, webhook.CIWebhookEndpoint); err != nil {
 			logrus.Error(err)
@@ -161,17 +198,6 @@ func (s *Server) UpdatePipeline(rw http.ResponseWriter, req *http.Request) error
 			return err
 		}
 	}
-
-	if err = service.UpdatePipelineEnvKey(ppl); err != nil {
-		return err
-	}
-
-	if err = service.UpdatePipeline(ppl); err != nil {
-		return err
-	}
-
-	GlobalAgent.onPipelineChange(ppl)
-	apiContext.Write(model.ToPipelineResource(apiContext, ppl))
 	return nil
 }
 
@@ -214,8 +240,10 @@ func (s *Server) ActivatePipeline(rw http.ResponseWriter, req *http.Request) err
 	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
 		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
 	}
-	r.IsActivate = true
-	err = service.UpdatePipeline(r)
+	r, err = service.ModifyPipeline(id, func(p *model.Pipeline) error {
+		p.IsActivate = true
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -236,8 +264,10 @@ func (s *Server) DeActivatePipeline(rw http.ResponseWriter, req *http.Request) e
 	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
 		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
 	}
-	r.IsActivate = false
-	err = service.UpdatePipeline(r)
+	r, err = service.ModifyPipeline(id, func(p *model.Pipeline) error {
+		p.IsActivate = false
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -289,13 +319,27 @@ func (s *Server) RunPipeline(rw http.ResponseWriter, req *http.Request) error {
 }
 
 func (s *Server) ListActivitiesOfPipeline(rw http.ResponseWriter, req *http.Request) error {
-	apiContext := api.GetApiContext(req)
-	apiClient, err := util.GetRancherClient()
+	pId := mux.Vars(req)["id"]
+	r, err := service.GetPipelineById(pId)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
+	}
+	q, err := parseActivityQuery(req)
 	if err != nil {
 		return err
 	}
-	pId := mux.Vars(req)["id"]
-	r, err := service.GetPipelineById(pId)
+	q.PipelineId = pId
+	return writeActivities(req, q)
+}
+
+func (s *Server) ListPipelineRevisions(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	r, err := service.GetPipelineById(id)
 	if err != nil {
 		return fmt.Errorf("fail to get pipeline: %v", err)
 	}
@@ -303,32 +347,187 @@ func (s *Server) ListActivitiesOfPipeline(rw http.ResponseWriter, req *http.Requ
 	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
 		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
 	}
-	filters := make(map[string]interface{})
-	filters["kind"] = "activity"
-	goCollection, err := apiClient.GenericObject.List(&v2client.ListOpts{
-		Filters: filters,
+	revisions, err := service.ListPipelineRevisions(id)
+	if err != nil {
+		return err
+	}
+	var data []interface{}
+	for _, revision := range revisions {
+		data = append(data, model.ToPipelineRevisionResource(apiContext, revision))
+	}
+	apiContext.Write(&client.GenericCollection{
+		Data: data,
 	})
+	return nil
+}
 
+func (s *Server) GetPipelineRevision(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	r, err := service.GetPipelineById(id)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
+	}
+	revision, err := service.GetPipelineRevision(id, mux.Vars(req)["revision"])
 	if err != nil {
 		return err
 	}
-	var activities []interface{}
-	for _, gobj := range goCollection.Data {
-		b := []byte(gobj.ResourceData["data"].(string))
-		a := &model.Activity{}
-		json.Unmarshal(b, a)
-		if a.Pipeline.Id != pId {
-			continue
+	apiContext.Write(model.ToPipelineRevisionResource(apiContext, revision))
+	return nil
+}
+
+//DiffPipelineRevisions compares revision 'from' to revision 'to',
+//which default to the previous and the current revision
+func (s *Server) DiffPipelineRevisions(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	r, err := service.GetPipelineById(id)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
+	}
+	to := req.FormValue("to")
+	if to == "" {
+		to = r.VersionSequence
+	}
+	from := req.FormValue("from")
+	if from == "" {
+		seq, err := strconv.Atoi(to)
+		if err != nil || seq <= 1 {
+			return fmt.Errorf("no previous revision to compare with revision '%s'", to)
 		}
+		from = strconv.Itoa(seq - 1)
+	}
+	diff, err := service.DiffPipelineRevisions(id, from, to)
+	if err != nil {
+		return err
+	}
+	apiContext.Write(model.ToPipelineDiffResource(apiContext, diff))
+	return nil
+}
 
-		model.ToActivityResource(apiContext, a)
-		activities = append(activities, a)
+//RollbackPipeline restores the definition of an older revision as a new revision,
+//webhook and cron trigger are updated accordingly
+func (s *Server) RollbackPipeline(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	input := struct {
+		Revision string `json:"revision"`
+	}{}
+	if data, err := ioutil.ReadAll(req.Body); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &input); err != nil {
+			return err
+		}
+	}
+	if input.Revision == "" {
+		input.Revision = req.FormValue("revision")
+	}
+	if input.Revision == "" {
+		return fmt.Errorf("revision to rollback is required")
+	}
+	prevPipeline, err := service.GetPipelineById(id)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	revision, err := service.GetPipelineRevision(id, input.Revision)
+	if err != nil {
+		return err
+	}
+	ppl, err := service.GetPipelineById(id)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	if err := service.RestoreRevision(ppl, revision); err != nil {
+		return err
+	}
+	if err := service.Validate(ppl); err != nil {
+		return err
+	}
+	//valid git account access
+	for _, p := range []*model.Pipeline{prevPipeline, ppl} {
+		if !service.ValidAccountAccess(req, p.Stages[0].Steps[0].GitUser) {
+			return fmt.Errorf("no access to '%s' git account", p.Stages[0].Steps[0].GitUser)
+		}
+	}
+	gitUser := ppl.Stages[0].Steps[0].GitUser
+	token, err := service.GetUserToken(gitUser)
+	if err != nil {
+		logrus.Error(err)
+		return fmt.Errorf("no access to '%s' git account", gitUser)
+	}
+	scManager, err := service.GetSCManagerFromUserID(gitUser)
+	if err != nil {
+		return err
+	}
+	if err = updateWebhook(scManager, token, prevPipeline, ppl); err != nil {
+		return err
+	}
+	if err = service.UpdatePipelineEnvKey(ppl); err != nil {
+		return err
+	}
+	uid, err := util.GetCurrentUser(req.Cookies())
+	if err != nil || uid == "" {
+		logrus.Debugf("rollback pipeline unrecognized user")
+	}
+	message := fmt.Sprintf("rollback to revision %s", revision.Revision)
+	if err = service.UpdatePipelineDefinition(ppl, uid, message); err != nil {
+		return err
 	}
 
-	//v2client here generates error?
+	GlobalAgent.onPipelineChange(ppl)
+	setETag(rw, ppl.ResourceVersion)
+	apiContext.Write(model.ToPipelineResource(apiContext, ppl))
+	return nil
+}
+
+//ListCaches lists build caches of the pipeline, the latest used first
+func (s *Server) ListCaches(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	r, err := service.GetPipelineById(id)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
+	}
+	caches, err := service.ListCaches(id)
+	if err != nil {
+		return err
+	}
+	data := []interface{}{}
+	for _, cache := range caches {
+		data = append(data, model.ToCacheResource(apiContext, cache))
+	}
 	apiContext.Write(&client.GenericCollection{
-		Data: activities,
+		Data: data,
 	})
+	return nil
+}
 
+//PurgeCaches removes the build cache of the key, or all build caches of the pipeline
+func (s *Server) PurgeCaches(rw http.ResponseWriter, req *http.Request) error {
+	id := mux.Vars(req)["id"]
+	r, err := service.GetPipelineById(id)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
+	}
+	key := mux.Vars(req)["key"]
+	if err := service.PurgeCaches(id, key); err != nil {
+		return err
+	}
+	logrus.Infof("purged caches of pipeline '%s', key:'%s'", id, key)
 	return nil
 }
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/server/service"
+)
+
+//queueInterval is the period to check queued activities besides completion notifications,
+//in case an activity is saved complete after the notification
+const queueInterval = 10 * time.Second
+
+//RunQueue starts queued activities in order when capacity frees up
+func (a *Agent) RunQueue(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-service.QueueSignal():
+		case <-ticker.C:
+		}
+		a.startQueuedActivities()
+	}
+}
+
+func (a *Agent) startQueuedActivities() {
+	ids, err := service.QueuedActivityIds()
+	if err != nil {
+		logrus.Errorf("fail to get queued activities: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if err := a.startQueuedActivity(id); err != nil {
+			logrus.Errorf("fail to start queued activity '%s': %v", id, err)
+		}
+	}
+}
+
+func (a *Agent) startQueuedActivity(id string) error {
+	mutex := a.getActivityLock(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	r, err := service.GetActivity(id)
+	if err != nil {
+		return err
+	}
+	started, startErr := service.StartQueuedActivity(a.Server.Provider, r)
+	if !started {
+		return startErr
+	}
+	if err := service.UpdateActivity(r); err != nil {
+		return err
+	}
+	broadcastResourceChange(*r)
+	a.Server.UpdateLastActivity(r)
+	return startErr
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
 	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
 )
 
 //HandleError handle error from operation
@@ -17,6 +18,18 @@ func HandleError(s *client.Schemas, t func(http.ResponseWriter, *http.Request) e
 			logrus.Errorf("Got Error: %v", err)
 			rw.Header().Set("Content-Type", "application/json")
 			StatusCode := 500
+			if service.IsConflict(err) {
+				StatusCode = http.StatusConflict
+				if req.Header.Get("If-Match") != "" {
+					StatusCode = http.StatusPreconditionFailed
+				}
+			} else if service.IsBadRequest(err) {
+				StatusCode = http.StatusBadRequest
+			} else if service.IsForbidden(err) {
+				StatusCode = http.StatusForbidden
+			} else if service.IsTooLarge(err) {
+				StatusCode = http.StatusRequestEntityTooLarge
+			}
 			rw.WriteHeader(StatusCode)
 			e := model.Error{
 				Resource: client.Resource{
@@ -49,12 +62,23 @@ func NewRouter(s *Server) *mux.Router {
 	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/activities").Handler(f(schemas, s.ListActivitiesOfPipeline))
 	router.Methods(http.MethodDelete).Path("/v1/pipelines/{id}").Handler(f(schemas, s.DeletePipeline))
 	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/exportconfig").Handler(f(schemas, s.ExportPipeline))
+	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/revisions").Handler(f(schemas, s.ListPipelineRevisions))
+	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/revisions/{revision}").Handler(f(schemas, s.GetPipelineRevision))
+	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/diff").Handler(f(schemas, s.DiffPipelineRevisions))
+	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/caches").Handler(f(schemas, s.ListCaches))
+	router.Methods(http.MethodDelete).Path("/v1/pipelines/{id}/caches").Handler(f(schemas, s.PurgeCaches))
+	router.Methods(http.MethodDelete).Path("/v1/pipelines/{id}/caches/{key}").Handler(f(schemas, s.PurgeCaches))
+	router.Methods(http.MethodGet).Path("/v1/pipelines/{id}/secrets").Handler(f(schemas, s.ListPipelineSecrets))
+	router.Methods(http.MethodPost).Path("/v1/pipelines/{id}/secrets").Handler(f(schemas, s.CreateSecret))
 	//router.Methods(http.MethodDelete).Path("/v1/pipeline").Handler(f(schemas, s.CleanPipelines))
 
 	//activities
 	router.Methods(http.MethodGet).Path("/v1/activities").Handler(f(schemas, s.ListActivities))
 	router.Methods(http.MethodGet).Path("/v1/activities/{id}").Handler(f(schemas, s.GetActivity))
 	router.Methods(http.MethodDelete).Path("/v1/activities/{id}").Handler(f(schemas, s.DeleteActivity))
+	router.Methods(http.MethodGet).Path("/v1/activities/{id}/artifacts").Handler(f(schemas, s.ListArtifacts))
+	router.Methods(http.MethodGet).Path("/v1/activities/{id}/artifacts/{name:.+}").Handler(f(schemas, s.DownloadArtifact))
+	router.Methods(http.MethodGet).Path("/v1/activities/{id}/tests").Handler(f(schemas, s.ListTests))
 	//router.Methods(http.MethodDelete).Path("/v1/activity").Handler(f(schemas, s.CleanActivities))
 
 	//scm accounts
@@ -69,6 +93,12 @@ func NewRouter(s *Server) *mux.Router {
 
 	router.Methods(http.MethodGet).Path("/v1/envvars").Handler(f(schemas, s.ListEnvVars))
 
+	//secrets
+	router.Methods(http.MethodGet).Path("/v1/secrets").Handler(f(schemas, s.ListSecrets))
+	router.Methods(http.MethodPost).Path("/v1/secrets").Handler(f(schemas, s.CreateSecret))
+	router.Methods(http.MethodGet).Path("/v1/secrets/{id}").Handler(f(schemas, s.GetSecret))
+	router.Methods(http.MethodDelete).Path("/v1/secrets/{id}").Handler(f(schemas, s.DeleteSecret))
+
 	//websockets
 	router.Methods(http.MethodGet).Path("/v1/ws/log").Handler(f(schemas, s.ServeStepLog))
 	router.Methods(http.MethodGet).Path("/v1/ws/status").Handler(f(schemas, s.ServeStatusWS))
@@ -76,6 +106,11 @@ func NewRouter(s *Server) *mux.Router {
 	//callback path for jenkins events
 	router.Methods(http.MethodPost).Path("/v1/events/stepfinish").Handler(f(schemas, s.StepFinish))
 	router.Methods(http.MethodPost).Path("/v1/events/stepstart").Handler(f(schemas, s.StepStart))
+	router.Methods(http.MethodPost).Path("/v1/events/artifacts").Handler(f(schemas, s.StepArtifacts))
+	router.Methods(http.MethodPost).Path("/v1/events/testreports").Handler(f(schemas, s.StepTestReports))
+	router.Methods(http.MethodGet, http.MethodHead).Path("/v1/events/cache").Handler(f(schemas, s.StepCache))
+	router.Methods(http.MethodPost).Path("/v1/events/cache").Handler(f(schemas, s.SaveStepCache))
+	router.Methods(http.MethodGet).Path("/v1/events/secretenv").Handler(f(schemas, s.StepSecretEnv))
 
 	//webhook endpoint
 	router.Methods(http.MethodPost).Path("/v1/webhook").Handler(f(schemas, s.Webhook))
@@ -86,27 +121,32 @@ func NewRouter(s *Server) *mux.Router {
 		"deactivate": f(schemas, s.DeActivatePipeline),
 		"remove":     f(schemas, s.DeletePipeline),
 		"export":     f(schemas, s.ExportPipeline),
+		"rollback":   f(schemas, s.RollbackPipeline),
 	}
 	for name, actions := range pipelineActions {
 		router.Methods(http.MethodPost).Path("/v1/pipelines/{id}").Queries("action", name).Handler(actions)
 	}
 
 	activityActions := map[string]http.Handler{
-		"update":  f(schemas, s.UpdateActivity),
-		"remove":  f(schemas, s.DeleteActivity),
-		"approve": f(schemas, s.ApproveActivity),
-		"deny":    f(schemas, s.DenyActivity),
-		"rerun":   f(schemas, s.RerunActivity),
-		"stop":    f(schemas, s.StopActivity),
+		"update":    f(schemas, s.UpdateActivity),
+		"remove":    f(schemas, s.DeleteActivity),
+		"approve":   f(schemas, s.ApproveActivity),
+		"deny":      f(schemas, s.DenyActivity),
+		"rerun":     f(schemas, s.RerunActivity),
+		"resume":    f(schemas, s.ResumeActivity),
+		"rerunFrom": f(schemas, s.RerunActivityFrom),
+		"stop":      f(schemas, s.StopActivity),
+		"cancel":    f(schemas, s.CancelActivity),
 	}
 	for name, actions := range activityActions {
 		router.Methods(http.MethodPost).Path("/v1/activities/{id}").Queries("action", name).Handler(actions)
 	}
 
 	pipelineSettingActions := map[string]http.Handler{
-		"update": f(schemas, s.UpdatePipelineSetting),
-		"reset":  f(schemas, s.Reset),
-		"oauth":  f(schemas, s.Oauth),
+		"update":    f(schemas, s.UpdatePipelineSetting),
+		"reset":     f(schemas, s.Reset),
+		"oauth":     f(schemas, s.Oauth),
+		"reencrypt": f(schemas, s.Reencrypt),
 	}
 	for name, actions := range pipelineSettingActions {
 		router.Methods(http.MethodPost).Path("/v1/settings").Queries("action", name).Handler(actions)
@@ -120,6 +160,14 @@ func NewRouter(s *Server) *mux.Router {
 		router.Methods(http.MethodPost).Path("/v1/scmsettings/{id}").Queries("action", name).Handler(actions)
 	}
 
+	secretActions := map[string]http.Handler{
+		"update": f(schemas, s.UpdateSecret),
+		"remove": f(schemas, s.DeleteSecret),
+	}
+	for name, actions := range secretActions {
+		router.Methods(http.MethodPost).Path("/v1/secrets/{id}").Queries("action", name).Handler(actions)
+	}
+
 	accountActions := map[string]http.Handler{
 		"share":        f(schemas, s.ShareAccount),
 		"unshare":      f(schemas, s.UnshareAccount),
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/rancher/go-rancher/api"
+	"github.com/rancher/go-rancher/client"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+//ListSecrets lists secrets of the environment
+func (s *Server) ListSecrets(rw http.ResponseWriter, req *http.Request) error {
+	return writeSecrets(req, "")
+}
+
+//ListPipelineSecrets lists secrets of the pipeline
+func (s *Server) ListPipelineSecrets(rw http.ResponseWriter, req *http.Request) error {
+	id := mux.Vars(req)["id"]
+	if err := validSecretAccess(req, id); err != nil {
+		return err
+	}
+	return writeSecrets(req, id)
+}
+
+//validSecretAccess checks access to secrets of the pipeline by its git account,
+//secrets of the environment are not checked
+func validSecretAccess(req *http.Request, pipelineId string) error {
+	if pipelineId == "" {
+		return nil
+	}
+	r, err := service.GetPipelineById(pipelineId)
+	if err != nil {
+		return fmt.Errorf("fail to get pipeline: %v", err)
+	}
+	//valid git account access
+	if !service.ValidAccountAccess(req, r.Stages[0].Steps[0].GitUser) {
+		return fmt.Errorf("no access to '%s' git account", r.Stages[0].Steps[0].GitUser)
+	}
+	return nil
+}
+
+func writeSecrets(req *http.Request, pipelineId string) error {
+	apiContext := api.GetApiContext(req)
+	secrets, err := service.ListSecrets(pipelineId)
+	if err != nil {
+		return err
+	}
+	data := []interface{}{}
+	for _, secret := range secrets {
+		data = append(data, model.ToSecretResource(apiContext, secret))
+	}
+	apiContext.Write(&client.GenericCollection{
+		Data: data,
+	})
+	return nil
+}
+
+func (s *Server) GetSecret(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	secret, err := service.GetSecret(mux.Vars(req)["id"])
+	if err != nil {
+		return err
+	}
+	if err := validSecretAccess(req, secret.PipelineId); err != nil {
+		return err
+	}
+	return apiContext.WriteResource(model.ToSecretResource(apiContext, secret))
+}
+
+//CreateSecret creates a secret of the environment, or of the pipeline in the path or the request
+func (s *Server) CreateSecret(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	requestBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	secret := &model.Secret{}
+	if err := json.Unmarshal(requestBytes, secret); err != nil {
+		return err
+	}
+	if id := mux.Vars(req)["id"]; id != "" {
+		secret.PipelineId = id
+	}
+	if err := validSecretAccess(req, secret.PipelineId); err != nil {
+		return err
+	}
+	if err := service.CreateSecret(secret); err != nil {
+		return err
+	}
+	logrus.Infof("created secret '%s'", secret.Id)
+	return apiContext.WriteResource(model.ToSecretResource(apiContext, secret))
+}
+
+//UpdateSecret sets the value of the secret
+func (s *Server) UpdateSecret(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	requestBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	input := &model.Secret{}
+	if err := json.Unmarshal(requestBytes, input); err != nil {
+		return err
+	}
+	id := mux.Vars(req)["id"]
+	secret, err := service.GetSecret(id)
+	if err != nil {
+		return err
+	}
+	if err := validSecretAccess(req, secret.PipelineId); err != nil {
+		return err
+	}
+	if secret, err = service.UpdateSecret(id, input.Value); err != nil {
+		return err
+	}
+	logrus.Infof("updated secret '%s'", secret.Id)
+	return apiContext.WriteResource(model.ToSecretResource(apiContext, secret))
+}
+
+func (s *Server) DeleteSecret(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["id"]
+	secret, err := service.GetSecret(id)
+	if err != nil {
+		return err
+	}
+	if err := validSecretAccess(req, secret.PipelineId); err != nil {
+		return err
+	}
+	if secret, err = service.DeleteSecret(id); err != nil {
+		return err
+	}
+	logrus.Infof("deleted secret '%s'", secret.Id)
+	return apiContext.WriteResource(model.ToSecretResource(apiContext, secret))
+}
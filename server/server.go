@@ -23,6 +23,9 @@ func NewServer(provider model.PipelineProvider) *Server {
 	s := &Server{
 		Provider: provider,
 	}
+	if emitter, ok := provider.(model.StepEventEmitter); ok {
+		emitter.SetStepEventListener(s)
+	}
 	return s
 }
 
@@ -51,11 +54,9 @@ func Preset(provider model.PipelineProvider) {
 	//Sync status of running activities
 	for _, a := range activities {
 		//TODO !a.IsRunning
-		if a.Status == model.ActivityFail ||
-			a.Status == model.ActivitySuccess ||
-			a.Status == model.ActivityDenied ||
+		if service.IsComplete(a) ||
 			a.Status == model.ActivityPending ||
-			a.Status == model.ActivityAbort {
+			a.Status == model.ActivityQueued {
 			continue
 		}
 		if err := provider.SyncActivity(a); err != nil {
@@ -6,9 +6,10 @@ import (
 	"net/http"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/rancher/go-rancher/v2"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/encryption"
 	"github.com/rancher/pipeline/model"
-	"github.com/rancher/pipeline/util"
+	"github.com/rancher/pipeline/store"
 )
 
 const GIT_ACCOUNT_TYPE = "gitaccount"
@@ -24,6 +25,10 @@ func RefreshRepos(accountId string) ([]*model.GitRepository, error) {
 	if err != nil {
 		return nil, err
 	}
+	//scm manager uses the plain token
+	if account.AccessToken, err = GetUserToken(accountId); err != nil {
+		return nil, err
+	}
 	repos, err := manager.GetRepos(account)
 	if err != nil {
 		return nil, err
@@ -32,49 +37,28 @@ func RefreshRepos(accountId string) ([]*model.GitRepository, error) {
 }
 
 func GetAccount(id string) (*model.GitAccount, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return nil, err
-	}
-	filters := make(map[string]interface{})
-	filters["kind"] = GIT_ACCOUNT_TYPE
-	filters["key"] = id
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("Error %v filtering genericObjects by key", err)
-	}
-	if len(goCollection.Data) == 0 {
-		return nil, fmt.Errorf("cannot find account with id '%s'", id)
-	}
-	data := goCollection.Data[0]
 	account := &model.GitAccount{}
-	if err = json.Unmarshal([]byte(data.ResourceData["data"].(string)), &account); err != nil {
-		return nil, err
+	version, err := getResource(GIT_ACCOUNT_TYPE, id, account)
+	if err == store.ErrNotFound {
+		return nil, fmt.Errorf("cannot find account with id '%s'", id)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error %v getting account", err)
 	}
+	account.ResourceVersion = version
 	return account, nil
 }
 
 //listAccounts gets scm accounts accessible by the user
 func ListAccounts(uid string) ([]*model.GitAccount, error) {
-	apiClient, err := util.GetRancherClient()
+	objs, err := listResources(GIT_ACCOUNT_TYPE)
 	if err != nil {
-		return nil, err
-	}
-	filters := make(map[string]interface{})
-	filters["kind"] = GIT_ACCOUNT_TYPE
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("Error %v filtering genericObjects by key", err)
+		return nil, fmt.Errorf("Error %v listing accounts", err)
 	}
 	var accounts []*model.GitAccount
-	for _, gobj := range goCollection.Data {
-		b := []byte(gobj.ResourceData["data"].(string))
+	for _, obj := range objs {
 		a := &model.GitAccount{}
-		json.Unmarshal(b, a)
+		json.Unmarshal(obj.Data, a)
+		a.ResourceVersion = obj.Version
 		if uid == a.RancherUserID || !a.Private {
 			accounts = append(accounts, a)
 		}
@@ -114,68 +98,27 @@ func UnshareAccount(id string) (*model.GitAccount, error) {
 	return r, nil
 }
 
+//UpdateAccount saves the account, access token is encrypted in place
 func UpdateAccount(account *model.GitAccount) error {
-	b, err := json.Marshal(account)
-	if err != nil {
-		return err
-	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-
-	filters := make(map[string]interface{})
-	filters["key"] = account.Id
-	filters["kind"] = GIT_ACCOUNT_TYPE
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error querying account:%v", err)
+	if err := encryptAccount(account); err != nil {
 		return err
 	}
-	if len(goCollection.Data) == 0 {
+	version, err := updateResource(GIT_ACCOUNT_TYPE, account.Id, account.Id, account.ResourceVersion, account)
+	if err == store.ErrNotFound {
 		return fmt.Errorf("account '%s' not found", account.Id)
+	} else if err != nil {
+		return err
 	}
-	existing := goCollection.Data[0]
-	_, err = apiClient.GenericObject.Update(&existing, &client.GenericObject{
-		Name:         account.Id,
-		Key:          account.Id,
-		ResourceData: resourceData,
-		Kind:         GIT_ACCOUNT_TYPE,
-	})
-	return err
+	account.ResourceVersion = version
+	return nil
 }
 
 func RemoveAccount(id string) (*model.GitAccount, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return nil, err
-	}
-
-	filters := make(map[string]interface{})
-	filters["key"] = id
-	filters["kind"] = GIT_ACCOUNT_TYPE
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error querying account:%v", err)
-		return nil, err
-	}
-	if len(goCollection.Data) == 0 {
-		return nil, fmt.Errorf("account '%s' not found", id)
-	}
-	existing := goCollection.Data[0]
-
 	account := &model.GitAccount{}
-	if err = json.Unmarshal([]byte(existing.ResourceData["data"].(string)), account); err != nil {
-		return nil, err
-	}
-	if err = apiClient.GenericObject.Delete(&existing); err != nil {
+	if err := deleteResource(GIT_ACCOUNT_TYPE, id, account); err == store.ErrNotFound {
+		return nil, fmt.Errorf("account '%s' not found", id)
+	} else if err != nil {
+		logrus.Errorf("Error removing account:%v", err)
 		return nil, err
 	}
 
@@ -183,78 +126,46 @@ func RemoveAccount(id string) (*model.GitAccount, error) {
 }
 
 func CleanAccounts(scmType string) ([]*model.GitAccount, error) {
-
-	apiClient, err := util.GetRancherClient()
+	objs, err := listResources(GIT_ACCOUNT_TYPE)
 	if err != nil {
-		return nil, err
-	}
-	geObjList, err := PaginateGenericObjects(GIT_ACCOUNT_TYPE)
-	if err != nil {
-		logrus.Errorf("fail to list acciybt,err:%v", err)
+		logrus.Errorf("fail to list account,err:%v", err)
 		return nil, err
 	}
 	delAccounts := []*model.GitAccount{}
-	for _, gobj := range geObjList {
+	for _, obj := range objs {
 		account := &model.GitAccount{}
-		if err := json.Unmarshal([]byte(gobj.ResourceData["data"].(string)), account); err != nil {
+		if err := json.Unmarshal(obj.Data, account); err != nil {
 			logrus.Errorf("parse data got error:%v", err)
 			continue
 		}
 		if account.AccountType == scmType {
 			delAccounts = append(delAccounts, account)
-			apiClient.GenericObject.Delete(&gobj)
+			dataStore.Delete(GIT_ACCOUNT_TYPE, obj.Key)
 		}
 	}
 	return delAccounts, nil
 }
 
+//CreateAccount saves the account, access token is encrypted in place
 func CreateAccount(account *model.GitAccount) error {
-	b, err := json.Marshal(account)
-	if err != nil {
+	if err := encryptAccount(account); err != nil {
 		return err
 	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
-	apiClient, err := util.GetRancherClient()
+	version, err := createResource(GIT_ACCOUNT_TYPE, account.Id, account.Id, account)
 	if err != nil {
 		return err
 	}
-	_, err = apiClient.GenericObject.Create(&client.GenericObject{
-		Name:         account.Id,
-		Key:          account.Id,
-		ResourceData: resourceData,
-		Kind:         GIT_ACCOUNT_TYPE,
-	})
-	return err
+	account.ResourceVersion = version
+	return nil
 }
 
 func GetCacheRepoList(accountId string) ([]*model.GitRepository, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return nil, err
-	}
-	filters := make(map[string]interface{})
-	filters["kind"] = REPO_CACHE_TYPE
-	filters["key"] = accountId
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("Error %v filtering genericObjects by key", err)
-	}
-	if len(goCollection.Data) == 0 {
-		//no cache,refresh
-		repos, err := RefreshRepos(accountId)
-		if err != nil {
-			return nil, err
-		}
-		return repos, nil
-	}
 	repos := []*model.GitRepository{}
-	data := goCollection.Data[0]
-	if err = json.Unmarshal([]byte(data.ResourceData["data"].(string)), &repos); err != nil {
-		return nil, err
+	if _, err := getResource(REPO_CACHE_TYPE, accountId, &repos); err == store.ErrNotFound {
+		//no cache,refresh
+		return RefreshRepos(accountId)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error %v getting repo cache", err)
 	}
 	return repos, nil
 }
@@ -262,75 +173,34 @@ func GetCacheRepoList(accountId string) ([]*model.GitRepository, error) {
 func CreateOrUpdateCacheRepoList(accountId string, repos []*model.GitRepository) error {
 
 	logrus.Debugf("refreshing repos")
-	b, err := json.Marshal(repos)
-	if err != nil {
-		return err
-	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-
-	filters := make(map[string]interface{})
-	filters["key"] = accountId
-	filters["kind"] = REPO_CACHE_TYPE
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error querying account:%v", err)
-		return err
-	}
-	if len(goCollection.Data) == 0 {
+	_, err := updateResource(REPO_CACHE_TYPE, accountId, "", "", repos)
+	if err == store.ErrNotFound {
 		//not exist,create a repocache object
-		if _, err := apiClient.GenericObject.Create(&client.GenericObject{
-			Key:          accountId,
-			ResourceData: resourceData,
-			Kind:         REPO_CACHE_TYPE,
-		}); err != nil {
+		if _, err := createResource(REPO_CACHE_TYPE, accountId, "", repos); err != nil {
 			return fmt.Errorf("Save repo cache got error: %v", err)
 		}
 
 		logrus.Debugf("done refresh repos")
 		return nil
 	}
-	existing := goCollection.Data[0]
-	_, err = apiClient.GenericObject.Update(&existing, &client.GenericObject{
-		Key:          accountId,
-		ResourceData: resourceData,
-		Kind:         REPO_CACHE_TYPE,
-	})
 	return err
 }
 
 func CreateOrUpdateEnvKey(clientId string, token string) error {
 	id := "envKey:" + clientId
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-	filters := make(map[string]interface{})
-	filters["kind"] = GIT_ACCOUNT_TYPE
-	filters["key"] = id
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		return fmt.Errorf("Error %v filtering genericObjects by key", err)
-	}
 	account := &model.GitAccount{
 		AccountType: "envKey",
 		Login:       clientId,
 		AccessToken: token,
 	}
-	if len(goCollection.Data) == 0 {
+	account.Id = id
+	if _, err := dataStore.Get(GIT_ACCOUNT_TYPE, id); err == store.ErrNotFound {
 		//not exist, create new
 		if err := CreateAccount(account); err != nil {
 			return err
 		}
+	} else if err != nil {
+		return fmt.Errorf("Error %v getting env key", err)
 	} else {
 		//update
 		if err := UpdateAccount(account); err != nil {
@@ -354,7 +224,7 @@ func GetEnvToken(EnvId string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return account.AccessToken, nil
+	return encryption.Decrypt(account.AccessToken)
 }
 
 func GetUserToken(gitUser string) (string, error) {
@@ -362,5 +232,14 @@ func GetUserToken(gitUser string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return account.AccessToken, nil
+	return encryption.Decrypt(account.AccessToken)
+}
+
+func encryptAccount(account *model.GitAccount) error {
+	token, err := encryption.Encrypt(account.AccessToken)
+	if err != nil {
+		return errors.Wrapf(err, "fail to encrypt token of account '%s'", account.Id)
+	}
+	account.AccessToken = token
+	return nil
 }
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+)
+
+//activityEntry keeps the fields of an activity that queries filter and sort by
+type activityEntry struct {
+	Id          string
+	PipelineId  string
+	Status      string
+	TriggerType string
+	Branch      string
+	CommitInfo  string
+	NodeName    string
+	StartTS     int64
+	RunSequence int
+	//seq is the order of creation
+	seq int
+}
+
+//activityIndex indexes activities by pipeline so queries do not load every activity.
+//It is loaded from the store on first use and kept up to date by the writes of this process,
+//like the check-and-set of the store it is not shared by several server replicas
+type activityIndex struct {
+	lock    sync.Mutex
+	loaded  bool
+	nextSeq int
+	entries map[string]*activityEntry
+	//pipelines maps pipeline id to ids of its activities
+	pipelines map[string]map[string]bool
+}
+
+var activityIdx = &activityIndex{}
+
+func newActivityEntry(a *model.Activity) *activityEntry {
+	return &activityEntry{
+		Id:          a.Id,
+		PipelineId:  a.Pipeline.Id,
+		Status:      a.Status,
+		TriggerType: a.TriggerType,
+		Branch:      ActivityBranch(a),
+		CommitInfo:  a.CommitInfo,
+		NodeName:    a.NodeName,
+		StartTS:     a.StartTS,
+		RunSequence: a.RunSequence,
+	}
+}
+
+//load reads all activities once, the caller holds the write lock
+func (idx *activityIndex) load() error {
+	if idx.loaded {
+		return nil
+	}
+	all, err := ListActivities()
+	if err != nil {
+		return err
+	}
+	idx.entries = map[string]*activityEntry{}
+	idx.pipelines = map[string]map[string]bool{}
+	idx.nextSeq = 0
+	for _, a := range all {
+		idx.add(newActivityEntry(a))
+	}
+	idx.loaded = true
+	logrus.Debugf("indexed %d activities", len(all))
+	return nil
+}
+
+func (idx *activityIndex) add(e *activityEntry) {
+	if prev, ok := idx.entries[e.Id]; ok {
+		e.seq = prev.seq
+		if prev.PipelineId != e.PipelineId {
+			delete(idx.pipelines[prev.PipelineId], e.Id)
+		}
+	} else {
+		e.seq = idx.nextSeq
+		idx.nextSeq++
+	}
+	idx.entries[e.Id] = e
+	if idx.pipelines[e.PipelineId] == nil {
+		idx.pipelines[e.PipelineId] = map[string]bool{}
+	}
+	idx.pipelines[e.PipelineId][e.Id] = true
+}
+
+//preload loads the index if it is not loaded, so callers holding other locks do not scan the store
+func (idx *activityIndex) preload() error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.load()
+}
+
+//put indexes the created or updated activity
+func (idx *activityIndex) put(a *model.Activity) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if !idx.loaded {
+		//it is indexed on load
+		return
+	}
+	idx.add(newActivityEntry(a))
+}
+
+//remove drops the deleted activity
+func (idx *activityIndex) remove(id string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if e, ok := idx.entries[id]; ok {
+		delete(idx.pipelines[e.PipelineId], id)
+		if len(idx.pipelines[e.PipelineId]) == 0 {
+			delete(idx.pipelines, e.PipelineId)
+		}
+		delete(idx.entries, id)
+	}
+}
+
+//reset drops the index, it is loaded again on next query
+func (idx *activityIndex) reset() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.loaded = false
+	idx.entries = nil
+	idx.pipelines = nil
+}
+
+//find returns copies of the entries of the pipeline, or of all activities if the id is empty,
+//in the order of creation
+func (idx *activityIndex) find(pipelineId string) ([]*activityEntry, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+	result := []*activityEntry{}
+	if pipelineId == "" {
+		for _, e := range idx.entries {
+			c := *e
+			result = append(result, &c)
+		}
+	} else {
+		for id := range idx.pipelines[pipelineId] {
+			c := *idx.entries[id]
+			result = append(result, &c)
+		}
+	}
+	sortBySeq(result)
+	return result, nil
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+)
+
+const (
+	SortByStartTime   = "startTime"
+	SortByRunSequence = "runSequence"
+	SortByStatus      = "status"
+
+	SortOrderAsc  = "asc"
+	SortOrderDesc = "desc"
+)
+
+//ActivityQuery filters, sorts and paginates activities, empty fields are not filtered
+type ActivityQuery struct {
+	PipelineId  string
+	Status      []string
+	TriggerType string
+	Branch      string
+	//prefix of the commit id
+	Commit   string
+	NodeName string
+	//range of start time in milliseconds
+	Since int64
+	Until int64
+
+	//SortBy is empty to keep the order of creation, activities waiting for approval first
+	SortBy string
+	//Order defaults to desc
+	Order string
+	//Limit is the max number of activities in a page, 0 for no limit
+	Limit int
+	//Marker is the id of the last activity in previous page
+	Marker string
+}
+
+//ErrInvalidMarker is returned for a marker not in the matched activities
+var ErrInvalidMarker = errors.New("invalid marker, the activity is not found in the listing")
+
+//QueryActivities returns a page of activities matching the query,
+//with the marker of next page and the total number of matched activities.
+//Activities are matched and sorted in the index, only the page is loaded from the store
+func QueryActivities(q *ActivityQuery) ([]*model.Activity, string, int, error) {
+	entries, err := activityIdx.find(q.PipelineId)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	matched := []*activityEntry{}
+	for _, e := range entries {
+		if q.match(e) {
+			matched = append(matched, e)
+		}
+	}
+	q.sort(matched)
+	total := len(matched)
+
+	start := 0
+	if q.Marker != "" {
+		start = -1
+		for i, e := range matched {
+			if e.Id == q.Marker {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return nil, "", 0, ErrInvalidMarker
+		}
+	}
+	page := matched[start:]
+	next := ""
+	if q.Limit > 0 && len(page) > q.Limit {
+		page = page[:q.Limit]
+		next = page[len(page)-1].Id
+	}
+	result := []*model.Activity{}
+	for _, e := range page {
+		a, err := GetActivity(e.Id)
+		if err != nil {
+			//removed after it is matched
+			logrus.Debugf("skip activity '%s' in listing: %v", e.Id, err)
+			continue
+		}
+		result = append(result, a)
+	}
+	return result, next, total, nil
+}
+
+//ActivityBranch gets the git branch an activity runs on
+func ActivityBranch(a *model.Activity) string {
+	if branch := a.EnvVars["CICD_GIT_BRANCH"]; branch != "" {
+		return branch
+	}
+	if len(a.Pipeline.Stages) > 0 && len(a.Pipeline.Stages[0].Steps) > 0 {
+		return a.Pipeline.Stages[0].Steps[0].Branch
+	}
+	return ""
+}
+
+func (q *ActivityQuery) match(a *activityEntry) bool {
+	if q.PipelineId != "" && a.PipelineId != q.PipelineId {
+		return false
+	}
+	if len(q.Status) > 0 {
+		found := false
+		for _, status := range q.Status {
+			if strings.EqualFold(status, a.Status) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.TriggerType != "" && a.TriggerType != q.TriggerType {
+		return false
+	}
+	if q.Branch != "" && a.Branch != q.Branch {
+		return false
+	}
+	if q.Commit != "" && !strings.HasPrefix(a.CommitInfo, q.Commit) {
+		return false
+	}
+	if q.NodeName != "" && a.NodeName != q.NodeName {
+		return false
+	}
+	if q.Since > 0 && a.StartTS < q.Since {
+		return false
+	}
+	if q.Until > 0 && a.StartTS > q.Until {
+		return false
+	}
+	return true
+}
+
+func (q *ActivityQuery) sort(activities []*activityEntry) {
+	if q.SortBy == "" {
+		//activities waiting for approval go first
+		sort.SliceStable(activities, func(i, j int) bool {
+			return activities[i].Status == model.ActivityPending && activities[j].Status != model.ActivityPending
+		})
+		return
+	}
+	less := func(a, b *activityEntry) bool {
+		switch q.SortBy {
+		case SortByRunSequence:
+			if a.RunSequence != b.RunSequence {
+				return a.RunSequence < b.RunSequence
+			}
+		case SortByStatus:
+			if a.Status != b.Status {
+				return a.Status < b.Status
+			}
+		}
+		if a.StartTS != b.StartTS {
+			return a.StartTS < b.StartTS
+		}
+		//ids make a stable order for markers
+		return a.Id < b.Id
+	}
+	desc := q.Order != SortOrderAsc
+	sort.Slice(activities, func(i, j int) bool {
+		if desc {
+			return less(activities[j], activities[i])
+		}
+		return less(activities[i], activities[j])
+	})
+}
+
+//sortBySeq keeps the order of creation
+func sortBySeq(entries []*activityEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+}
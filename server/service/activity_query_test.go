@@ -0,0 +1,57 @@
+package service_test
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+func TestQueryActivitiesPendingFirst(t *testing.T) {
+	pipelineId := fmt.Sprintf("q%d", atomic.AddInt32(&counter, 1))
+	statuses := []string{model.ActivitySuccess, model.ActivityFail, model.ActivityPending, model.ActivitySuccess, model.ActivityPending}
+	ids := []string{}
+	for i, status := range statuses {
+		a := &model.Activity{Id: fmt.Sprintf("%s-a%d", pipelineId, i), Status: status, RunSequence: i + 1, StartTS: int64(i + 1)}
+		a.Pipeline.Id = pipelineId
+		if err := service.CreateActivity(a); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, a.Id)
+	}
+
+	//pages follow the marker with pending activities of every page first
+	got := []string{}
+	marker := ""
+	for page := 0; page < len(statuses); page++ {
+		activities, next, total, err := service.QueryActivities(&service.ActivityQuery{PipelineId: pipelineId, Limit: 2, Marker: marker})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != len(statuses) {
+			t.Errorf("got total %d, expect %d", total, len(statuses))
+		}
+		for _, a := range activities {
+			got = append(got, a.Id)
+		}
+		if next == "" {
+			break
+		}
+		marker = next
+	}
+	expect := []string{ids[2], ids[4], ids[0], ids[1], ids[3]}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("got activities %v, expect %v", got, expect)
+	}
+
+	activities, _, _, err := service.QueryActivities(&service.ActivityQuery{PipelineId: pipelineId, SortBy: service.SortByRunSequence, Order: service.SortOrderAsc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != len(ids) || activities[0].Id != ids[0] || activities[4].Id != ids[4] {
+		t.Errorf("pending activities are not sorted by the field")
+	}
+}
@@ -7,146 +7,81 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/pipeline/model"
-	"github.com/rancher/pipeline/util"
+	"github.com/rancher/pipeline/store"
 )
 
 func ListActivities() ([]*model.Activity, error) {
-	geObjList, err := PaginateGenericObjects("activity")
+	objs, err := listResources(ACTIVITY_TYPE)
 	if err != nil {
 		logrus.Errorf("fail to list activity, err:%v", err)
 		return nil, err
 	}
 	var activities []*model.Activity
-	for _, gobj := range geObjList {
-		b := []byte(gobj.ResourceData["data"].(string))
+	for _, obj := range objs {
 		a := &model.Activity{}
-		json.Unmarshal(b, a)
+		json.Unmarshal(obj.Data, a)
+		a.ResourceVersion = obj.Version
 		activities = append(activities, a)
 	}
 
 	return activities, nil
 }
 
-//Get Activity From GenericObjects By Id
+//Get Activity From store By Id
 func GetActivity(id string) (*model.Activity, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return nil, err
-	}
-	filters := make(map[string]interface{})
-	filters["key"] = id
-	filters["kind"] = "activity"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("Error %v filtering genericObjects by key", err)
-	}
-	if len(goCollection.Data) == 0 {
+	activity := &model.Activity{}
+	version, err := getResource(ACTIVITY_TYPE, id, activity)
+	if err == store.ErrNotFound {
 		return nil, fmt.Errorf("Requested activity not found")
+	} else if err != nil {
+		return nil, fmt.Errorf("Error %v getting activity", err)
 	}
-	data := goCollection.Data[0]
-	activity := &model.Activity{}
-	json.Unmarshal([]byte(data.ResourceData["data"].(string)), activity)
+	activity.ResourceVersion = version
 
 	return activity, nil
 }
 
 func CreateActivity(activity *model.Activity) error {
-	apiClient, err := util.GetRancherClient()
+	version, err := createResource(ACTIVITY_TYPE, activity.Id, activity.Id, activity)
 	if err != nil {
-		return err
-	}
-	//activity.Id = uuid.Rand().Hex()
-	b, err := json.Marshal(activity)
-	if err != nil {
-		return err
-	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
-
-	if _, err := apiClient.GenericObject.Create(&client.GenericObject{
-		Name:         activity.Id,
-		Key:          activity.Id,
-		ResourceData: resourceData,
-		Kind:         "activity",
-	}); err != nil {
 		return fmt.Errorf("Failed to save activity: %v", err)
 	}
+	activity.ResourceVersion = version
+	activityIdx.put(activity)
 	return nil
 }
 
+//UpdateActivity saves the activity, it fails with a conflict
+//if the activity is modified since its ResourceVersion
 func UpdateActivity(activity *model.Activity) error {
 	logrus.Debugf("updating activity %v.", activity.Id)
 	logrus.Debugf("activity stages:%v", activity.ActivityStages)
-	b, err := json.Marshal(activity)
-	if err != nil {
-		return err
-	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-
-	filters := make(map[string]interface{})
-	filters["key"] = activity.Id
-	filters["kind"] = "activity"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
-		return nil
-	}
-	if len(goCollection.Data) == 0 {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
+	version, err := updateResource(ACTIVITY_TYPE, activity.Id, activity.Id, activity.ResourceVersion, activity)
+	if err == store.ErrNotFound {
+		logrus.Errorf("activity '%s' not found to update", activity.Id)
 		return nil
-	}
-	existing := goCollection.Data[0]
-	_, err = apiClient.GenericObject.Update(&existing, &client.GenericObject{
-		Name:         activity.Id,
-		Key:          activity.Id,
-		ResourceData: resourceData,
-		Kind:         "activity",
-	})
-	if err != nil {
+	} else if err != nil {
 		return err
 	}
+	activity.ResourceVersion = version
+	activityIdx.put(activity)
 	return nil
 }
 
 func DeleteActivity(id string) error {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-
-	filters := make(map[string]interface{})
-	filters["key"] = id
-	filters["kind"] = "activity"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
-		return nil
-	}
-	if len(goCollection.Data) == 0 {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
+	activity := &model.Activity{}
+	err := deleteResource(ACTIVITY_TYPE, id, activity)
+	if err == store.ErrNotFound {
+		logrus.Errorf("activity '%s' not found to delete", id)
+		activityIdx.remove(id)
 		return nil
-	}
-	existing := goCollection.Data[0]
-	err = apiClient.GenericObject.Delete(&existing)
-	if err != nil {
+	} else if err != nil {
 		return err
 	}
-	return nil
+	activityIdx.remove(id)
+	dropTestReports(activity, func(int, int) bool { return true })
+	return DeleteArtifacts(id)
 }
 
 func RerunActivity(provider model.PipelineProvider, activity *model.Activity) error {
@@ -154,6 +89,9 @@ func RerunActivity(provider model.PipelineProvider, activity *model.Activity) er
 	if activity.Status == model.ActivityBuilding || activity.Status == model.ActivityWaiting {
 		return errors.New("not allow to rerun a running activity")
 	}
+	if activity.Status == model.ActivityQueued {
+		return errors.New("not allow to rerun a queued activity")
+	}
 	ResetActivityStatus(activity)
 
 	if err := provider.RerunActivity(activity); err != nil {
@@ -167,8 +105,16 @@ func RerunActivity(provider model.PipelineProvider, activity *model.Activity) er
 func ResetActivityStatus(activity *model.Activity) {
 	activity.Status = model.ActivityWaiting
 	activity.PendingStage = 0
+	activity.SupersededBy = ""
+	activity.ResumeFrom = nil
+	activity.MainStatus = ""
+	activity.FinallyStatus = ""
 	activity.StartTS = 0
 	activity.StopTS = 0
+	activity.ChangedFiles = nil
+	dropArtifacts(activity, func(int, int) bool { return true })
+	dropTestReports(activity, func(int, int) bool { return true })
+	dropOutputs(activity, func(int, int) bool { return true })
 	for _, stage := range activity.ActivityStages {
 		stage.Duration = 0
 		stage.StartTS = 0
@@ -177,6 +123,8 @@ func ResetActivityStatus(activity *model.Activity) {
 			step.Duration = 0
 			step.StartTS = 0
 			step.Status = model.ActivityStepWaiting
+			step.Message = ""
+			step.Attempts = nil
 		}
 	}
 }
@@ -186,9 +134,11 @@ func IsComplete(activity *model.Activity) bool {
 		return false
 	}
 	if activity.Status == model.ActivityAbort ||
+		activity.Status == model.ActivitySuperseded ||
 		activity.Status == model.ActivityDenied ||
 		activity.Status == model.ActivityFail ||
-		activity.Status == model.ActivitySuccess {
+		activity.Status == model.ActivitySuccess ||
+		activity.Status == model.ActivitySuccessWithWarnings {
 		return true
 	}
 	return false
@@ -198,25 +148,36 @@ func ApproveActivity(provider model.PipelineProvider, activity *model.Activity)
 	if activity == nil {
 		return errors.New("nil activity")
 	}
-	if activity.Status != model.ActivityPending {
+	if activity.PendingStage >= len(activity.ActivityStages) ||
+		activity.ActivityStages[activity.PendingStage].Status != model.ActivityStagePending {
 		return errors.New("activity not pending for approval")
 	}
-	return provider.RunStage(activity, activity.PendingStage)
+	ordinal := activity.PendingStage
+	activity.ActivityStages[ordinal].Status = model.ActivityStageWaiting
+	activity.PendingStage = 0
+	if activity.Status == model.ActivityPending {
+		activity.Status = model.ActivityWaiting
+	}
+	if err := provider.RunStage(activity, ordinal); err != nil {
+		return err
+	}
+	//other stages may still wait for approval
+	updatePending(activity)
+	return nil
 }
 
 func DenyActivity(activity *model.Activity) error {
 	if activity == nil {
 		return errors.New("nil activity")
 	}
-	if activity.Status != model.ActivityPending {
+	if activity.PendingStage >= len(activity.ActivityStages) ||
+		activity.ActivityStages[activity.PendingStage].Status != model.ActivityStagePending {
 		return errors.New("activity not pending for deny")
 	}
-	if activity.PendingStage < len(activity.ActivityStages) {
-		activity.ActivityStages[activity.PendingStage].Status = model.ActivityStageDenied
-		activity.Status = model.ActivityDenied
-	}
+	activity.ActivityStages[activity.PendingStage].Status = model.ActivityStageDenied
+	//running stages finish before the activity is denied
+	settleDenied(activity)
 	return nil
-
 }
 
 func StopActivity(provider model.PipelineProvider, activity *model.Activity) error {
@@ -226,16 +187,74 @@ func StopActivity(provider model.PipelineProvider, activity *model.Activity) err
 	if activity.Status != model.ActivityBuilding && activity.Status != model.ActivityWaiting {
 		return errors.New("Not a running activity for stop")
 	}
+	activity.ResumeFrom = nil
 
-	return provider.StopActivity(activity)
+	if err := provider.StopActivity(activity); err != nil {
+		return err
+	}
+	if activity.MainStatus != "" {
+		//finally stages are stopped
+		activity.FinallyStatus = activity.Status
+		activity.Status = activity.MainStatus
+	}
+	return nil
 
 }
 
+//SupersededActivities lists unfinished runs of the pipeline and branch older than the activity
+func SupersededActivities(activity *model.Activity) ([]*model.Activity, error) {
+	activities, err := ListActivities()
+	if err != nil {
+		return nil, err
+	}
+	result := []*model.Activity{}
+	branch := activityBranch(activity)
+	for _, a := range activities {
+		if a.Pipeline.Id != activity.Pipeline.Id || a.RunSequence >= activity.RunSequence ||
+			activityBranch(a) != branch {
+			continue
+		}
+		if a.MainStatus != "" {
+			//runs in finally stages are left to clean up
+			continue
+		}
+		if a.Status == model.ActivityQueued || a.Status == model.ActivityWaiting || a.Status == model.ActivityBuilding {
+			result = append(result, a)
+		}
+	}
+	return result, nil
+}
+
+func activityBranch(activity *model.Activity) string {
+	if len(activity.Pipeline.Stages) == 0 || len(activity.Pipeline.Stages[0].Steps) == 0 {
+		return ""
+	}
+	return activity.Pipeline.Stages[0].Steps[0].Branch
+}
+
+//SupersedeActivity stops the activity replaced by the newer one
+func SupersedeActivity(provider model.PipelineProvider, activity *model.Activity, newerId string) error {
+	if activity == nil {
+		return errors.New("nil activity")
+	}
+	var err error
+	if activity.Status == model.ActivityQueued {
+		err = CancelQueuedActivity(activity)
+	} else {
+		err = StopActivity(provider, activity)
+	}
+	if err != nil {
+		return err
+	}
+	activity.Status = model.ActivitySuperseded
+	activity.SupersededBy = newerId
+	return nil
+}
+
 //get updated activity from provider
 func SyncActivity(provider model.PipelineProvider, activity *model.Activity) error {
 	//its done, no need to sync
-	if activity.Status == model.ActivityFail || activity.Status == model.ActivitySuccess ||
-		activity.Status == model.ActivityDenied || activity.Status == model.ActivityAbort {
+	if IsComplete(activity) {
 		return nil
 	}
 	return provider.SyncActivity(activity)
@@ -286,13 +305,26 @@ func IsStageSuccess(stage *model.ActivityStage) bool {
 	}
 	successSteps := 0
 	for _, step := range stage.ActivitySteps {
-		if step.Status == model.ActivityStepSuccess || step.Status == model.ActivityStepSkip {
+		if step.Status == model.ActivityStepSuccess || step.Status == model.ActivityStepSkip ||
+			step.Status == model.ActivityStepFailedAllowed {
 			successSteps++
 		}
 	}
 	return successSteps == len(stage.ActivitySteps)
 }
 
+//IsActivityStarted checks if any step of the activity has run
+func IsActivityStarted(activity *model.Activity) bool {
+	for _, stage := range activity.ActivityStages {
+		for _, step := range stage.ActivitySteps {
+			if step.Status != model.ActivityStepWaiting && step.Status != model.ActivityStepSkip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func StartStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) {
 	curTime := time.Now().UnixNano() / int64(time.Millisecond)
 	stage := activity.ActivityStages[stageOrdinal]
@@ -316,6 +348,7 @@ func FailStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) {
 	stage.Duration = now - stage.StartTS
 	activity.Status = model.ActivityFail
 	activity.StopTS = now
+	activity.ResumeFrom = nil
 	activity.FailMessage = fmt.Sprintf("Execution fail in '%v' stage, step %v", stage.Name, stepOrdinal+1)
 }
 
@@ -328,50 +361,92 @@ func SuccessStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) {
 	if stage.Status == model.ActivityStageFail {
 		return
 	}
+	completeStage(activity, stageOrdinal, curTime)
+}
 
-	if IsStageSuccess(stage) {
-		stage.Status = model.ActivityStageSuccess
-		stage.Duration = curTime - stage.StartTS
-		if stageOrdinal == len(activity.ActivityStages)-1 {
-			activity.Status = model.ActivitySuccess
-			activity.StopTS = curTime
-		} else {
-			nextStage := activity.ActivityStages[stageOrdinal+1]
-			if nextStage.NeedApproval {
-				nextStage.Status = model.ActivityStagePending
-				activity.Status = model.ActivityPending
-				activity.PendingStage = stageOrdinal + 1
+//IsFailureAllowed checks if failure of the step does not fail the activity,
+//failures in finally stages do not stop the finally stages after them
+func IsFailureAllowed(activity *model.Activity, stageOrdinal int, stepOrdinal int) bool {
+	stage := activity.Pipeline.Stages[stageOrdinal]
+	return stage.AllowFailure || stage.Steps[stepOrdinal].AllowFailure || IsFinallyStage(activity, stageOrdinal)
+}
+
+//FailStepAllowed records the failure of a step allowed to fail. If only the stage is
+//allowed to fail, the stage stops and its steps not run are skipped
+func FailStepAllowed(activity *model.Activity, stageOrdinal int, stepOrdinal int) {
+	curTime := time.Now().UnixNano() / int64(time.Millisecond)
+	stage := activity.ActivityStages[stageOrdinal]
+	step := stage.ActivitySteps[stepOrdinal]
+	step.Status = model.ActivityStepFailedAllowed
+	step.Duration = curTime - step.StartTS
+	if !activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal].AllowFailure {
+		for _, s := range stage.ActivitySteps {
+			if s.Status == model.ActivityStepWaiting {
+				s.Status = model.ActivityStepSkip
 			}
 		}
 	}
+	if stage.Status == model.ActivityStageFail {
+		return
+	}
+	completeStage(activity, stageOrdinal, curTime)
+}
 
+//completeStage sets the result of the stage if all its steps are done, then sets the result
+//of the activity if all stages are done
+func completeStage(activity *model.Activity, stageOrdinal int, curTime int64) {
+	stage := activity.ActivityStages[stageOrdinal]
+	if !IsStageSuccess(stage) {
+		return
+	}
+	stage.Status = StageResult(stage)
+	stage.Duration = curTime - stage.StartTS
+	if isActivityDone(activity) {
+		finishActivity(activity, curTime)
+	}
+}
+
+//StageResult gets the status of a stage whose steps are done
+func StageResult(stage *model.ActivityStage) string {
+	for _, step := range stage.ActivitySteps {
+		if step.Status == model.ActivityStepFailedAllowed {
+			return model.ActivityStageFailedAllowed
+		}
+	}
+	return model.ActivityStageSuccess
+}
+
+//ActivityResult gets the status of an activity whose main stages are done
+func ActivityResult(activity *model.Activity) string {
+	for _, stage := range activity.ActivityStages {
+		if !stage.Finally && stage.Status == model.ActivityStageFailedAllowed {
+			return model.ActivitySuccessWithWarnings
+		}
+	}
+	return model.ActivitySuccess
 }
 
 func Triggernext(activity *model.Activity, stageOrdinal int, stepOrdinal int, provider model.PipelineProvider) {
 	logrus.Debugf("triggering next:%d,%d", stageOrdinal, stepOrdinal)
-	if activity.Status == model.ActivitySuccess ||
-		activity.Status == model.ActivityFail ||
-		activity.Status == model.ActivityPending ||
-		activity.Status == model.ActivityDenied ||
-		activity.Status == model.ActivityAbort {
+	if activity.Status == model.ActivityPending || IsComplete(activity) {
 		return
 	}
 	stage := activity.ActivityStages[stageOrdinal]
-	if IsStageSuccess(stage) && stageOrdinal+1 < len(activity.ActivityStages) {
-		nextStage := activity.ActivityStages[stageOrdinal+1]
-		if err := provider.RunStage(activity, stageOrdinal+1); err != nil {
-			logrus.Errorf("trigger next stage '%s' got error:%v", nextStage.Name, err)
+	if IsStageSuccess(stage) {
+		//run stages whose needs are done, stages needing approval wait for it
+		if err := RunReadyStages(provider, activity); err != nil {
+			logrus.Errorf("trigger stages after '%s' got error:%v", stage.Name, err)
 			//activity.Status = Error
-			activity.FailMessage = fmt.Sprintf("trigger next stage '%s' got error:%v", nextStage.Name, err)
+			activity.FailMessage = fmt.Sprintf("trigger stages after '%s' got error:%v", stage.Name, err)
 		}
+		settleDenied(activity)
 		return
 	}
 
-	if !activity.Pipeline.Stages[stageOrdinal].Parallel {
-		if err := provider.RunStep(activity, stageOrdinal, stepOrdinal+1); err != nil {
-			logrus.Errorf("trigger step #%d of '%s' got error:%v", stepOrdinal+2, stage.Name, err)
-			//activity.Status = Error
-			activity.FailMessage = fmt.Sprintf("trigger step #%d of '%s' got error:%v", stepOrdinal+2, stage.Name, err)
-		}
+	//next step of a sequential stage, or waiting steps of a matrix
+	if err := runAfterStep(provider, activity, stageOrdinal, stepOrdinal); err != nil {
+		logrus.Errorf("trigger step after #%d of '%s' got error:%v", stepOrdinal+1, stage.Name, err)
+		//activity.Status = Error
+		activity.FailMessage = fmt.Sprintf("trigger step after #%d of '%s' got error:%v", stepOrdinal+1, stage.Name, err)
 	}
 }
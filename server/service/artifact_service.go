@@ -0,0 +1,191 @@
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/model"
+)
+
+var artifactPath string
+
+//InitArtifacts sets the directory to keep artifacts of activities
+func InitArtifacts(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "fail to create artifact directory '%s'", dir)
+	}
+	artifactPath = dir
+	return nil
+}
+
+func activityArtifactDir(activityId string) string {
+	return filepath.Join(artifactPath, activityId)
+}
+
+//SaveArtifacts keeps files of the archive matching artifact globs of the step. The archive
+//is a tar stream, gzipped or not, leading path components of its files are stripped
+func SaveArtifacts(activity *model.Activity, stageOrdinal int, stepOrdinal int, archive io.Reader, strip int) error {
+	if artifactPath == "" {
+		return errors.New("artifact storage is not initialized")
+	}
+	globs := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal].Artifacts
+	if len(globs) == 0 {
+		return nil
+	}
+	tr, err := tarReader(archive)
+	if err != nil {
+		return err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "invalid tar archive")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name, ok := artifactName(hdr.Name, strip)
+		if !ok || !MatchArtifact(globs, name) {
+			continue
+		}
+		artifact, err := saveArtifact(activity.Id, name, tr)
+		if err != nil {
+			return err
+		}
+		artifact.StageOrdinal = stageOrdinal
+		artifact.StepOrdinal = stepOrdinal
+		addArtifact(activity, artifact)
+		logrus.Debugf("saved artifact '%s' of activity '%s', %d bytes", name, activity.Id, artifact.Size)
+	}
+	return nil
+}
+
+//tarReader reads the tar stream, gzipped or not. An empty stream has no file
+func tarReader(archive io.Reader) (*tar.Reader, error) {
+	r := bufio.NewReader(archive)
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid gzip archive")
+		}
+		return tar.NewReader(gz), nil
+	}
+	return tar.NewReader(r), nil
+}
+
+//artifactName gets the path of the file in the workspace, files out of the workspace are rejected
+func artifactName(name string, strip int) (string, bool) {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	parts := strings.Split(name, "/")
+	if strip >= len(parts) {
+		return "", false
+	}
+	name = strings.Join(parts[strip:], "/")
+	if name == "." || name == "" || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+//MatchArtifact checks if the file or a directory containing it matches a glob, files in the workspace
+//are matched against artifact, test report and cache path globs
+func MatchArtifact(globs []string, name string) bool {
+	for _, glob := range globs {
+		glob = path.Clean(strings.TrimPrefix(glob, "./"))
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(glob, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func saveArtifact(activityId string, name string, r io.Reader) (*model.Artifact, error) {
+	file := filepath.Join(activityArtifactDir(activityId), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".artifact")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	tmp.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to save artifact '%s'", name)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return nil, err
+	}
+	return &model.Artifact{
+		Name:     name,
+		Size:     size,
+		Checksum: "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Created:  time.Now().UnixNano() / int64(time.Millisecond),
+	}, nil
+}
+
+//addArtifact records the artifact, it replaces the one of the same name from a former step
+func addArtifact(activity *model.Activity, artifact *model.Artifact) {
+	for i, a := range activity.Artifacts {
+		if a.Name == artifact.Name {
+			activity.Artifacts[i] = artifact
+			return
+		}
+	}
+	activity.Artifacts = append(activity.Artifacts, artifact)
+}
+
+//GetArtifact gets the artifact of the activity and its local file
+func GetArtifact(activity *model.Activity, name string) (*model.Artifact, string, error) {
+	for _, a := range activity.Artifacts {
+		if a.Name == name {
+			return a, filepath.Join(activityArtifactDir(activity.Id), filepath.FromSlash(name)), nil
+		}
+	}
+	return nil, "", fmt.Errorf("artifact '%s' not found", name)
+}
+
+//dropArtifacts removes artifacts of steps to run again
+func dropArtifacts(activity *model.Activity, runAgain func(stageOrdinal int, stepOrdinal int) bool) {
+	kept := []*model.Artifact{}
+	for _, a := range activity.Artifacts {
+		if !runAgain(a.StageOrdinal, a.StepOrdinal) {
+			kept = append(kept, a)
+			continue
+		}
+		if artifactPath == "" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(activityArtifactDir(activity.Id), filepath.FromSlash(a.Name))); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("fail to remove artifact '%s' of activity '%s': %v", a.Name, activity.Id, err)
+		}
+	}
+	activity.Artifacts = kept
+}
+
+//DeleteArtifacts removes artifacts kept for the activity
+func DeleteArtifacts(activityId string) error {
+	if artifactPath == "" || activityId == "" {
+		return nil
+	}
+	return os.RemoveAll(activityArtifactDir(activityId))
+}
@@ -0,0 +1,367 @@
+package service
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/model"
+)
+
+const cacheFileExt = ".tgz"
+
+var ErrCacheNotFound = errors.New("cache not found")
+var ErrInvalidCacheKey = errors.New("cache key does not match the key template of the step")
+
+var regCacheChecksum = regexp.MustCompile(`\{\{\s*checksum\s+"([^"]*)"\s*\}\}`)
+var regCacheKeyChar = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+var cachePath string
+var cacheMaxSize int64
+var cacheMaxAge time.Duration
+
+//InitCaches sets the directory to keep caches of pipelines, caches exceeding the total size
+//or not used for the max age are evicted. Zero limits mean no limit
+func InitCaches(dir string, maxSize int64, maxAge time.Duration) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "fail to create cache directory '%s'", dir)
+	}
+	cachePath = dir
+	cacheMaxSize = maxSize
+	cacheMaxAge = maxAge
+	return nil
+}
+
+func cacheFile(pipelineId string, key string) string {
+	return filepath.Join(cachePath, pipelineId, key+cacheFileExt)
+}
+
+//GetStepCache gets the cache of a task step, the cache of the pipeline applies to
+//task steps not declaring their own
+func GetStepCache(activity *model.Activity, stageOrdinal int, stepOrdinal int) *model.StepCache {
+	step := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal]
+	if step.Type != model.StepTypeTask || step.IsService {
+		return nil
+	}
+	cache := step.Cache
+	if cache == nil {
+		cache = activity.Pipeline.Cache
+	}
+	if cache == nil || cache.Key == "" || len(cache.Paths) == 0 {
+		return nil
+	}
+	return cache
+}
+
+//CacheKey resolves the key template of the cache of the step. Env vars of the activity and the step
+//are replaced and characters not allowed in keys become '_', checksum gets the part of a workspace file
+func CacheKey(activity *model.Activity, stageOrdinal int, stepOrdinal int, checksum func(file string) (string, error)) (string, error) {
+	cache := GetStepCache(activity, stageOrdinal, stepOrdinal)
+	if cache == nil {
+		return "", errors.New("no cache for the step")
+	}
+	env := map[string]string{}
+	for k, v := range activity.EnvVars {
+		env[k] = v
+	}
+	for _, e := range activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal].Env {
+		if kv := strings.SplitN(SubstituteVar(activity, e), "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	expand := func(text string) string {
+		return SanitizeCacheKey(os.Expand(text, func(name string) string {
+			return env[name]
+		}))
+	}
+	key := ""
+	last := 0
+	for _, m := range regCacheChecksum.FindAllStringSubmatchIndex(cache.Key, -1) {
+		key += expand(cache.Key[last:m[0]])
+		sum, err := checksum(path.Clean(strings.TrimPrefix(cache.Key[m[2]:m[3]], "./")))
+		if err != nil {
+			return "", errors.Wrapf(err, "fail to get checksum of '%s'", cache.Key[m[2]:m[3]])
+		}
+		key += sum
+		last = m[1]
+	}
+	key += expand(cache.Key[last:])
+	if key == "" {
+		return "", errors.Errorf("key template '%s' resolves to an empty key", cache.Key)
+	}
+	return key, nil
+}
+
+//CheckStepCacheKey checks the key resolved by the step against its key template.
+//Env vars are resolved by the server, only checksums of workspace files are taken from the key
+func CheckStepCacheKey(activity *model.Activity, stageOrdinal int, stepOrdinal int, key string) error {
+	const mark = "\x00"
+	template, err := CacheKey(activity, stageOrdinal, stepOrdinal, func(file string) (string, error) {
+		return mark, nil
+	})
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(template, mark)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	//checksum of a missing file is empty
+	reg, err := regexp.Compile("^" + strings.Join(parts, "([0-9a-f]{64})?") + "$")
+	if err != nil {
+		return err
+	}
+	if !reg.MatchString(key) {
+		return errors.Wrapf(ErrInvalidCacheKey, "key '%s'", key)
+	}
+	return nil
+}
+
+//ExpandCacheChecksums replaces checksums in the key template by the part of their files
+func ExpandCacheChecksums(template string, checksum func(file string) string) string {
+	return regCacheChecksum.ReplaceAllStringFunc(template, func(m string) string {
+		file := regCacheChecksum.FindStringSubmatch(m)[1]
+		return checksum(path.Clean(strings.TrimPrefix(file, "./")))
+	})
+}
+
+//SanitizeCacheKey replaces characters not allowed in cache keys with '_'
+func SanitizeCacheKey(key string) string {
+	return regCacheKeyChar.ReplaceAllString(key, "_")
+}
+
+func checkCacheKey(key string) error {
+	if key == "" || len(key) > 200 || regCacheKeyChar.MatchString(key) {
+		return fmt.Errorf("invalid cache key '%s'", key)
+	}
+	return nil
+}
+
+//CacheExists checks if the key is saved for the pipeline
+func CacheExists(pipelineId string, key string) bool {
+	if cachePath == "" || checkCacheKey(key) != nil {
+		return false
+	}
+	_, err := os.Stat(cacheFile(pipelineId, key))
+	return err == nil
+}
+
+//OpenCache opens the gzipped tar archive of the cache to restore it.
+//Using the cache postpones its eviction
+func OpenCache(pipelineId string, key string) (*model.Cache, *os.File, error) {
+	if cachePath == "" {
+		return nil, nil, errors.New("cache storage is not initialized")
+	}
+	if err := checkCacheKey(key); err != nil {
+		return nil, nil, err
+	}
+	file := cacheFile(pipelineId, key)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrCacheNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(file, now, now); err != nil {
+		logrus.Warnf("fail to update last use of cache '%s': %v", key, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return toCache(pipelineId, info), f, nil
+}
+
+func toCache(pipelineId string, info os.FileInfo) *model.Cache {
+	return &model.Cache{
+		PipelineId: pipelineId,
+		Key:        strings.TrimSuffix(info.Name(), cacheFileExt),
+		Size:       info.Size(),
+		LastUsed:   info.ModTime().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+//SaveCache keeps paths of the cache of the step from the archive, a tar stream gzipped or not
+//whose leading path components are stripped. A key saved already is not replaced
+func SaveCache(activity *model.Activity, stageOrdinal int, stepOrdinal int, key string, archive io.Reader, strip int) error {
+	if cachePath == "" {
+		return errors.New("cache storage is not initialized")
+	}
+	cache := GetStepCache(activity, stageOrdinal, stepOrdinal)
+	if cache == nil {
+		return nil
+	}
+	if err := checkCacheKey(key); err != nil {
+		return err
+	}
+	if CacheExists(activity.Pipeline.Id, key) {
+		return nil
+	}
+	file := cacheFile(activity.Pipeline.Id, key)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	tr, err := tarReader(archive)
+	if err != nil {
+		return err
+	}
+	entries := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "invalid tar archive")
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink:
+		default:
+			continue
+		}
+		name, ok := artifactName(hdr.Name, strip)
+		if !ok || !MatchArtifact(cache.Paths, name) {
+			continue
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "fail to save cache '%s'", key)
+		}
+		entries++
+	}
+	if entries == 0 {
+		//no path to cache
+		return nil
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	logrus.Infof("saved cache '%s' of pipeline '%s'", key, activity.Pipeline.Id)
+	return nil
+}
+
+//ListCaches lists caches of the pipeline, or of all pipelines if the id is empty.
+//The latest used ones come first
+func ListCaches(pipelineId string) ([]*model.Cache, error) {
+	caches := []*model.Cache{}
+	if cachePath == "" {
+		return caches, nil
+	}
+	pipelineIds := []string{pipelineId}
+	if pipelineId == "" {
+		dirs, err := ioutil.ReadDir(cachePath)
+		if err != nil {
+			return nil, err
+		}
+		pipelineIds = []string{}
+		for _, dir := range dirs {
+			if dir.IsDir() {
+				pipelineIds = append(pipelineIds, dir.Name())
+			}
+		}
+	}
+	for _, id := range pipelineIds {
+		files, err := ioutil.ReadDir(filepath.Join(cachePath, id))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), cacheFileExt) && !strings.HasPrefix(f.Name(), ".") {
+				caches = append(caches, toCache(id, f))
+			}
+		}
+	}
+	sort.Slice(caches, func(i, j int) bool {
+		return caches[i].LastUsed > caches[j].LastUsed
+	})
+	return caches, nil
+}
+
+//PurgeCaches removes the cache of the pipeline, or all its caches if the key is empty
+func PurgeCaches(pipelineId string, key string) error {
+	if cachePath == "" || pipelineId == "" {
+		return nil
+	}
+	if key == "" {
+		return os.RemoveAll(filepath.Join(cachePath, pipelineId))
+	}
+	if err := checkCacheKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(cacheFile(pipelineId, key)); os.IsNotExist(err) {
+		return ErrCacheNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+//EvictCaches removes caches not used for the max age, then the least recently used
+//ones until the total size is within the max size. It gets the number of evicted caches
+func EvictCaches() (int, error) {
+	caches, err := ListCaches("")
+	if err != nil {
+		return 0, err
+	}
+	evicted := 0
+	var total int64
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	kept := []*model.Cache{}
+	for _, c := range caches {
+		if cacheMaxAge > 0 && now-c.LastUsed > int64(cacheMaxAge/time.Millisecond) {
+			if err := PurgeCaches(c.PipelineId, c.Key); err != nil && err != ErrCacheNotFound {
+				return evicted, err
+			}
+			evicted++
+			continue
+		}
+		total += c.Size
+		kept = append(kept, c)
+	}
+	//caches are ordered by last use, latest first
+	for i := len(kept) - 1; i >= 0 && cacheMaxSize > 0 && total > cacheMaxSize; i-- {
+		if err := PurgeCaches(kept[i].PipelineId, kept[i].Key); err != nil && err != ErrCacheNotFound {
+			return evicted, err
+		}
+		total -= kept[i].Size
+		evicted++
+	}
+	return evicted, nil
+}
@@ -0,0 +1,110 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+var goSum = strings.Repeat("a1", 32)
+
+//cacheActivity gets an activity of a task step with the cache in the pipeline or the step
+func cacheActivity(pipelineCache *model.StepCache, stepCache *model.StepCache) *model.Activity {
+	step := task("test", "GOOS=linux", "TAG=${CICD_GIT_BRANCH}-x")
+	step.Cache = stepCache
+	a := &model.Activity{EnvVars: map[string]string{"CICD_GIT_BRANCH": "feature/a", "GOOS": "darwin"}}
+	a.Pipeline.Cache = pipelineCache
+	a.Pipeline.Stages = []*model.Stage{stage("test", step)}
+	return a
+}
+
+//cacheChecksum gets the checksum of go.sum, other files are missing
+func cacheChecksum(file string) (string, error) {
+	if file == "go.sum" {
+		return goSum, nil
+	}
+	return "", nil
+}
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline *model.StepCache
+		step     *model.StepCache
+		//expect is empty if the step has no cache
+		expect string
+	}{
+		{
+			name:     "pipeline cache",
+			pipeline: &model.StepCache{Key: "go-${GOOS}-{{ checksum \"./go.sum\" }}", Paths: []string{"vendor"}},
+			expect:   "go-linux-" + goSum,
+		},
+		{
+			name:     "step cache",
+			pipeline: &model.StepCache{Key: "go", Paths: []string{"vendor"}},
+			step:     &model.StepCache{Key: "$TAG.{{checksum \"go.sum\"}}.{{ checksum \"none\" }}", Paths: []string{"node_modules"}},
+			expect:   "feature_a-x." + goSum + ".",
+		},
+		{
+			name:     "sanitized env vars",
+			pipeline: &model.StepCache{Key: "${CICD_GIT_BRANCH}-${MISSING}", Paths: []string{"vendor"}},
+			expect:   "feature_a-",
+		},
+		{
+			name:     "no paths",
+			pipeline: &model.StepCache{Key: "go"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := cacheActivity(tt.pipeline, tt.step)
+			key, err := service.CacheKey(a, 0, 0, cacheChecksum)
+			if tt.expect == "" {
+				if err == nil {
+					t.Errorf("got key %s of a step without cache", key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tt.expect {
+				t.Errorf("got key %s, expect %s", key, tt.expect)
+			}
+			if err := service.CheckStepCacheKey(a, 0, 0, key); err != nil {
+				t.Errorf("resolved key is not valid: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckStepCacheKey(t *testing.T) {
+	a := cacheActivity(&model.StepCache{Key: "go-${GOOS}-{{ checksum \"go.sum\" }}", Paths: []string{"vendor"}}, nil)
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{name: "checksum", key: "go-linux-" + goSum, valid: true},
+		{name: "checksum of missing file", key: "go-linux-", valid: true},
+		{name: "env var of another value", key: "go-darwin-" + goSum},
+		{name: "checksum not hex", key: "go-linux-" + strings.Repeat("z", 64)},
+		{name: "checksum too short", key: "go-linux-" + goSum[:63]},
+		{name: "suffix", key: "go-linux-" + goSum + "-x"},
+		{name: "regexp in key", key: "go-linux-.*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.CheckStepCacheKey(a, 0, 0, tt.key)
+			if tt.valid && err != nil {
+				t.Errorf("got error %v of a valid key", err)
+			}
+			if !tt.valid && errors.Cause(err) != service.ErrInvalidCacheKey {
+				t.Errorf("got error %v, expect ErrInvalidCacheKey", err)
+			}
+		})
+	}
+}
@@ -1,66 +1,114 @@
 package service
 
 import (
+	"encoding/json"
 	"fmt"
-	"net/url"
 	"strings"
 
-	"github.com/Sirupsen/logrus"
-	"github.com/rancher/go-rancher/v2"
+	"github.com/pkg/errors"
 	"github.com/rancher/pipeline/model"
 	"github.com/rancher/pipeline/scm"
-	"github.com/rancher/pipeline/util"
+	"github.com/rancher/pipeline/store"
 )
 
-func PaginateGenericObjects(kind string) ([]client.GenericObject, error) {
-	result := []client.GenericObject{}
-	limit := "1000"
-	marker := ""
-	var pageData []client.GenericObject
-	var err error
-	for {
-		pageData, marker, err = getGenericObjects(kind, limit, marker)
-		if err != nil {
-			logrus.Debugf("get genericobject err:%v", err)
-			return nil, err
-		}
-		result = append(result, pageData...)
-		if marker == "" {
-			break
-		}
+const PIPELINE_TYPE = "pipeline"
+const ACTIVITY_TYPE = "activity"
+const PIPELINE_SETTING_TYPE = "pipelineSetting"
+const SCM_SETTING_TYPE = "scmSetting"
+
+var dataStore store.Store
+
+var ErrUploadTooLarge = errors.New("upload exceeds the size limit")
+
+//InitStore sets the backend used to persist resources
+func InitStore(s store.Store) {
+	dataStore = s
+	activityIdx.reset()
+	resetStepTokenKey()
+}
+
+//conflictRetries is the number of attempts to reapply a change on version conflict
+const conflictRetries = 5
+
+//getResource unmarshals the stored resource to v and returns its version
+func getResource(kind string, key string, v interface{}) (string, error) {
+	obj, err := dataStore.Get(kind, key)
+	if err != nil {
+		return "", err
 	}
-	return result, nil
+	return obj.Version, json.Unmarshal(obj.Data, v)
 }
 
-func getGenericObjects(kind string, limit string, marker string) ([]client.GenericObject, string, error) {
-	apiClient, err := util.GetRancherClient()
+func listResources(kind string) ([]*store.Object, error) {
+	return dataStore.List(kind)
+}
+
+//createResource saves v as a new resource and returns its version
+func createResource(kind string, key string, name string, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
 	if err != nil {
-		logrus.Errorf("fail to get client:%v", err)
-		return nil, "", err
-	}
-	filters := make(map[string]interface{})
-	filters["kind"] = kind
-	filters["limit"] = limit
-	filters["marker"] = marker
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
+		return "", err
+	}
+	obj := &store.Object{
+		Kind: kind,
+		Key:  key,
+		Name: name,
+		Data: b,
+	}
+	if err := dataStore.Create(obj); err != nil {
+		return "", err
+	}
+	return obj.Version, nil
+}
+
+//updateResource overwrites the resource if its stored version matches,
+//an empty version updates unconditionally. It returns the new version
+func updateResource(kind string, key string, name string, version string, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
 	if err != nil {
-		logrus.Errorf("fail querying generic objects, error:%v", err)
-		return nil, "", err
-	}
-	//get next marker
-	nextMarker := ""
-	if goCollection.Pagination != nil && goCollection.Pagination.Next != "" {
-		r, err := url.Parse(goCollection.Pagination.Next)
-		if err != nil {
-			logrus.Errorf("fail parsing next url, error:%v", err)
-			return nil, "", err
-		}
-		nextMarker = r.Query().Get("marker")
+		return "", err
+	}
+	obj := &store.Object{
+		Kind:    kind,
+		Key:     key,
+		Name:    name,
+		Data:    b,
+		Version: version,
+	}
+	if err := dataStore.Update(obj); err != nil {
+		return "", err
+	}
+	return obj.Version, nil
+}
+
+//deleteResource removes the resource and unmarshals its last content to v
+func deleteResource(kind string, key string, v interface{}) error {
+	if _, err := getResource(kind, key, v); err != nil {
+		return err
 	}
-	return goCollection.Data, nextMarker, err
+	return dataStore.Delete(kind, key)
+}
+
+//IsBadRequest checks if the error is caused by invalid parameters of the request
+func IsBadRequest(err error) bool {
+	cause := errors.Cause(err)
+	return cause == ErrInvalidMarker || cause == ErrInvalidCacheKey
+}
+
+//IsForbidden checks if the error is caused by a callback not allowed for the step
+func IsForbidden(err error) bool {
+	cause := errors.Cause(err)
+	return cause == ErrInvalidStepToken || cause == ErrStepNotRunning
+}
+
+//IsTooLarge checks if the error is caused by an upload exceeding the size limit
+func IsTooLarge(err error) bool {
+	return errors.Cause(err) == ErrUploadTooLarge
+}
 
+//IsConflict checks if the error is caused by a resource version conflict
+func IsConflict(err error) bool {
+	return errors.Cause(err) == store.ErrConflict
 }
 
 func GetSCManager(scmType string) (model.SCManager, error) {
@@ -105,38 +153,25 @@ func GetSCManagerFromUserID(userId string) (model.SCManager, error) {
 }
 
 func Reset() error {
-	if err := cleanGO("activity"); err != nil {
-		return err
-	}
-	if err := cleanGO("pipeline"); err != nil {
-		return err
-	}
-	if err := cleanGO("pipelineSetting"); err != nil {
-		return err
-	}
-	if err := cleanGO("scmSetting"); err != nil {
-		return err
-	}
-	if err := cleanGO("gitaccount"); err != nil {
-		return err
-	}
-	if err := cleanGO("repocache"); err != nil {
-		return err
+	kinds := []string{ACTIVITY_TYPE, PIPELINE_TYPE, PIPELINE_REVISION_TYPE, PIPELINE_SETTING_TYPE, SCM_SETTING_TYPE, GIT_ACCOUNT_TYPE, REPO_CACHE_TYPE,
+		SECRET_TYPE, STEP_TOKEN_KEY_TYPE, TEST_REPORT_TYPE}
+	for _, kind := range kinds {
+		if err := cleanResources(kind); err != nil {
+			return err
+		}
 	}
+	activityIdx.reset()
+	resetStepTokenKey()
 	return nil
 }
 
-func cleanGO(kind string) error {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-	data, err := PaginateGenericObjects(kind)
+func cleanResources(kind string) error {
+	objs, err := listResources(kind)
 	if err != nil {
 		return err
 	}
-	for _, gobj := range data {
-		if err := apiClient.GenericObject.Delete(&gobj); err != nil {
+	for _, obj := range objs {
+		if err := dataStore.Delete(kind, obj.Key); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,599 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rancher/pipeline/model"
+)
+
+//Condition expressions combine comparisons of env vars of the activity, e.g.
+//
+//	CICD_GIT_BRANCH == "master" || (glob(branch(), "release/*") && changed("src/**"))
+//
+//Operands are env var names (also written $NAME or ${NAME}), quoted strings and function calls.
+//Operators are ==, !=, =~ and !~ (regular expressions), in [...], !, && and ||.
+//A string alone is true unless it is empty, "0" or "false"
+
+//ChangedFilesFile is the file in the workspace the SCM step writes files changed by the commit to
+const ChangedFilesFile = ".r_cicd_changed"
+
+type condToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+const (
+	tokIdent  = "identifier"
+	tokString = "string"
+	tokOp     = "operator"
+	tokEOF    = "end of condition"
+)
+
+//condError is an error at a byte offset of the condition, reported counting from 1
+type condError struct {
+	pos int
+	msg string
+}
+
+func (e *condError) Error() string {
+	return fmt.Sprintf("%s at byte %d", e.msg, e.pos+1)
+}
+
+var condOperators = []string{"&&", "||", "==", "!=", "=~", "!~", "!", "(", ")", "[", "]", ","}
+
+func tokenizeCondition(text string) ([]condToken, error) {
+	tokens := []condToken{}
+	i := 0
+Loop:
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '"' || c == '\'':
+			start := i
+			value := &bytes.Buffer{}
+			for i++; ; i++ {
+				if i >= len(text) {
+					return nil, &condError{start, "unterminated string"}
+				}
+				if text[i] == c {
+					i++
+					break
+				}
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+				}
+				value.WriteByte(text[i])
+			}
+			tokens = append(tokens, condToken{tokString, value.String(), start})
+			continue
+		case c == '$':
+			start := i
+			i++
+			braced := i < len(text) && text[i] == '{'
+			if braced {
+				i++
+			}
+			name := readIdent(text, i)
+			if name == "" {
+				return nil, &condError{start, "expected an env var name after '$'"}
+			}
+			i += len(name)
+			if braced {
+				if i >= len(text) || text[i] != '}' {
+					return nil, &condError{i, "expected '}'"}
+				}
+				i++
+			}
+			tokens = append(tokens, condToken{tokIdent, name, start})
+			continue
+		case isIdentStart(c):
+			name := readIdent(text, i)
+			tokens = append(tokens, condToken{tokIdent, name, i})
+			i += len(name)
+			continue
+		}
+		for _, op := range condOperators {
+			if strings.HasPrefix(text[i:], op) {
+				tokens = append(tokens, condToken{tokOp, op, i})
+				i += len(op)
+				continue Loop
+			}
+		}
+		r, _ := utf8.DecodeRuneInString(text[i:])
+		return nil, &condError{i, fmt.Sprintf("unexpected character '%c'", r)}
+	}
+	return append(tokens, condToken{tokEOF, "", len(text)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func readIdent(text string, i int) string {
+	j := i
+	for j < len(text) && (isIdentStart(text[j]) || (j > i && text[j] >= '0' && text[j] <= '9')) {
+		j++
+	}
+	return text[i:j]
+}
+
+//condEnv is what conditions of the activity are evaluated against
+type condEnv struct {
+	activity *model.Activity
+}
+
+type boolExpr interface {
+	eval(env *condEnv) bool
+}
+
+type stringExpr interface {
+	value(env *condEnv) string
+}
+
+type notExpr struct{ x boolExpr }
+
+func (e notExpr) eval(env *condEnv) bool { return !e.x.eval(env) }
+
+type andExpr struct{ x, y boolExpr }
+
+func (e andExpr) eval(env *condEnv) bool { return e.x.eval(env) && e.y.eval(env) }
+
+type orExpr struct{ x, y boolExpr }
+
+func (e orExpr) eval(env *condEnv) bool { return e.x.eval(env) || e.y.eval(env) }
+
+type literalExpr string
+
+func (e literalExpr) value(env *condEnv) string { return string(e) }
+
+type boolLiteral bool
+
+func (e boolLiteral) eval(env *condEnv) bool { return bool(e) }
+
+type varExpr string
+
+func (e varExpr) value(env *condEnv) string { return env.activity.EnvVars[string(e)] }
+
+//truthExpr converts a string to a boolean
+type truthExpr struct{ x stringExpr }
+
+func (e truthExpr) eval(env *condEnv) bool {
+	v := strings.ToLower(e.x.value(env))
+	return v != "" && v != "0" && v != "false"
+}
+
+type compareExpr struct {
+	op   string
+	x, y stringExpr
+}
+
+func (e compareExpr) eval(env *condEnv) bool {
+	if e.op == "==" {
+		return e.x.value(env) == e.y.value(env)
+	}
+	return e.x.value(env) != e.y.value(env)
+}
+
+type matchExpr struct {
+	negate bool
+	x      stringExpr
+	//set when the pattern is a literal, compiled at parse time
+	reg     *regexp.Regexp
+	pattern stringExpr
+}
+
+func (e matchExpr) eval(env *condEnv) bool {
+	reg := e.reg
+	if reg == nil {
+		var err error
+		if reg, err = regexp.Compile(e.pattern.value(env)); err != nil {
+			return false
+		}
+	}
+	return reg.MatchString(e.x.value(env)) != e.negate
+}
+
+type inExpr struct {
+	x    stringExpr
+	list []stringExpr
+}
+
+func (e inExpr) eval(env *condEnv) bool {
+	v := e.x.value(env)
+	for _, item := range e.list {
+		if item.value(env) == v {
+			return true
+		}
+	}
+	return false
+}
+
+type stringFunc func(env *condEnv, args []string) string
+
+type boolFunc func(env *condEnv, args []string) bool
+
+type callExpr struct {
+	args  []stringExpr
+	str   stringFunc
+	check boolFunc
+}
+
+func (e callExpr) values(env *condEnv) []string {
+	args := []string{}
+	for _, arg := range e.args {
+		args = append(args, arg.value(env))
+	}
+	return args
+}
+
+func (e callExpr) value(env *condEnv) string { return e.str(env, e.values(env)) }
+
+func (e callExpr) eval(env *condEnv) bool { return e.check(env, e.values(env)) }
+
+type condFunc struct {
+	//number of arguments, -1 for one or more
+	args  int
+	str   stringFunc
+	check boolFunc
+	//indexes of arguments that are glob patterns, checked at parse time if literal
+	globs func(i int) bool
+}
+
+var condFuncs = map[string]condFunc{
+	"triggerType": {args: 0, str: func(env *condEnv, args []string) string {
+		return env.activity.TriggerType
+	}},
+	"branch": {args: 0, str: func(env *condEnv, args []string) string {
+		return env.activity.EnvVars["CICD_GIT_BRANCH"]
+	}},
+	"env": {args: 1, str: func(env *condEnv, args []string) string {
+		return env.activity.EnvVars[args[0]]
+	}},
+	"glob": {args: 2, check: func(env *condEnv, args []string) bool {
+		reg, err := globRegexp(args[1])
+		return err == nil && reg.MatchString(args[0])
+	}, globs: func(i int) bool { return i == 1 }},
+	"changed": {args: -1, check: func(env *condEnv, args []string) bool {
+		return changedFiles(env.activity, args)
+	}, globs: func(i int) bool { return true }},
+}
+
+//changedFiles checks if files changed by the commit of the activity match any glob.
+//Changes are unknown before the SCM step reports them, or if it fails to, then steps run
+func changedFiles(activity *model.Activity, globs []string) bool {
+	if activity.ChangedFiles == nil {
+		return true
+	}
+	for _, glob := range globs {
+		reg, err := globRegexp(glob)
+		if err != nil {
+			continue
+		}
+		for _, file := range activity.ChangedFiles {
+			if reg.MatchString(file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//globRegexp converts a glob to a regular expression. '*' and '?' match within a path
+//segment and '**' matches across segments
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	glob = strings.TrimPrefix(glob, "./")
+	expr := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					//'**/' matches no segment too
+					i++
+					expr += "(.*/)?"
+				} else {
+					expr += ".*"
+				}
+			} else {
+				expr += "[^/]*"
+			}
+		case '?':
+			expr += "[^/]"
+		case '[':
+			j := strings.IndexByte(glob[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated '[' in glob '%s'", glob)
+			}
+			class := glob[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + class + "]"
+			i += j
+		default:
+			expr += regexp.QuoteMeta(glob[i : i+1])
+		}
+	}
+	return regexp.Compile(expr + "$")
+}
+
+type condParser struct {
+	tokens []condToken
+	pos    int
+}
+
+//parseCondition parses the condition expression, errors tell the position of the problem
+func parseCondition(text string) (boolExpr, error) {
+	tokens, err := tokenizeCondition(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &condParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.unexpected(tok)
+	}
+	return expr, nil
+}
+
+func (p *condParser) peek() condToken {
+	return p.tokens[p.pos]
+}
+
+func (p *condParser) next() condToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *condParser) isOp(op string) bool {
+	tok := p.peek()
+	return tok.kind == tokOp && tok.text == op
+}
+
+func (p *condParser) expect(op string) error {
+	if !p.isOp(op) {
+		tok := p.peek()
+		return &condError{tok.pos, fmt.Sprintf("expected '%s' but got %s", op, describeToken(tok))}
+	}
+	p.next()
+	return nil
+}
+
+func (p *condParser) unexpected(tok condToken) error {
+	return &condError{tok.pos, "unexpected " + describeToken(tok)}
+}
+
+func describeToken(tok condToken) string {
+	switch tok.kind {
+	case tokEOF:
+		return tok.kind
+	case tokString:
+		return fmt.Sprintf("string \"%s\"", tok.text)
+	}
+	return fmt.Sprintf("'%s'", tok.text)
+}
+
+func (p *condParser) parseOr() (boolExpr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = orExpr{x, y}
+	}
+	return x, nil
+}
+
+func (p *condParser) parseAnd() (boolExpr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = andExpr{x, y}
+	}
+	return x, nil
+}
+
+func (p *condParser) parseUnary() (boolExpr, error) {
+	if p.isOp("!") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{x}, nil
+	}
+	if p.isOp("(") {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *condParser) parseComparison() (boolExpr, error) {
+	start := p.peek()
+	if start.kind == tokIdent && (start.text == "true" || start.text == "false") {
+		p.next()
+		return boolLiteral(start.text == "true"), nil
+	}
+	str, check, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	isCompare := tok.kind == tokOp && (tok.text == "==" || tok.text == "!=" || tok.text == "=~" || tok.text == "!~")
+	isIn := tok.kind == tokIdent && tok.text == "in"
+	if !isCompare && !isIn {
+		if check != nil {
+			return check, nil
+		}
+		if _, ok := str.(literalExpr); ok {
+			return nil, &condError{start.pos, "expected a condition but got a string alone"}
+		}
+		return truthExpr{str}, nil
+	}
+	if str == nil {
+		return nil, &condError{tok.pos, fmt.Sprintf("'%s' needs a string on the left but got a condition", tok.text)}
+	}
+	p.next()
+	if isIn {
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return inExpr{str, list}, nil
+	}
+	right := p.peek()
+	y, err := p.parseString()
+	if err != nil {
+		return nil, err
+	}
+	switch tok.text {
+	case "=~", "!~":
+		m := matchExpr{negate: tok.text == "!~", x: str, pattern: y}
+		if lit, ok := y.(literalExpr); ok {
+			reg, err := regexp.Compile(string(lit))
+			if err != nil {
+				return nil, &condError{right.pos, fmt.Sprintf("invalid regular expression: %v", err)}
+			}
+			m.reg = reg
+		}
+		return m, nil
+	}
+	return compareExpr{tok.text, str, y}, nil
+}
+
+//parseOperand parses a string or a function call, which returns a string or a condition
+func (p *condParser) parseOperand() (stringExpr, boolExpr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return literalExpr(tok.text), nil, nil
+	case tokIdent:
+		if !p.isOp("(") {
+			if tok.text == "in" {
+				return nil, nil, p.unexpected(tok)
+			}
+			return varExpr(tok.text), nil, nil
+		}
+		return p.parseCall(tok)
+	}
+	return nil, nil, p.unexpected(tok)
+}
+
+func (p *condParser) parseCall(name condToken) (stringExpr, boolExpr, error) {
+	fn, ok := condFuncs[name.text]
+	if !ok {
+		return nil, nil, &condError{name.pos, fmt.Sprintf("unknown function '%s'", name.text)}
+	}
+	p.next()
+	args := []stringExpr{}
+	for !p.isOp(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, nil, err
+			}
+		}
+		tok := p.peek()
+		arg, err := p.parseString()
+		if err != nil {
+			return nil, nil, err
+		}
+		if lit, ok := arg.(literalExpr); ok && fn.globs != nil && fn.globs(len(args)) {
+			if _, err := globRegexp(string(lit)); err != nil {
+				return nil, nil, &condError{tok.pos, err.Error()}
+			}
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	if (fn.args >= 0 && len(args) != fn.args) || (fn.args < 0 && len(args) == 0) {
+		expected := fmt.Sprintf("%d", fn.args)
+		if fn.args < 0 {
+			expected = "at least 1"
+		}
+		return nil, nil, &condError{name.pos, fmt.Sprintf("function '%s' expects %s arguments but got %d", name.text, expected, len(args))}
+	}
+	call := callExpr{args: args, str: fn.str, check: fn.check}
+	if fn.check != nil {
+		return nil, call, nil
+	}
+	return call, nil, nil
+}
+
+//parseString parses an operand that has to be a string
+func (p *condParser) parseString() (stringExpr, error) {
+	tok := p.peek()
+	str, _, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if str == nil {
+		return nil, &condError{tok.pos, fmt.Sprintf("expected a string but '%s' is a condition", tok.text)}
+	}
+	return str, nil
+}
+
+func (p *condParser) parseList() ([]stringExpr, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	list := []stringExpr{}
+	for !p.isOp("]") {
+		if len(list) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		item, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	p.next()
+	return list, nil
+}
+
+func hasCondition(c *model.PipelineConditions) bool {
+	return c != nil && (len(c.All) > 0 || len(c.Any) > 0 || strings.TrimSpace(c.Expression) != "")
+}
+
+//EvaluateExpression evaluates the condition expression against the activity
+func EvaluateExpression(activity *model.Activity, condition string) (bool, error) {
+	expr, err := parseCondition(condition)
+	if err != nil {
+		return false, fmt.Errorf("invalid condition '%s': %v", condition, err)
+	}
+	return expr.eval(&condEnv{activity: activity}), nil
+}
@@ -0,0 +1,117 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+func conditionActivity(changedFiles []string) *model.Activity {
+	return &model.Activity{
+		TriggerType:  model.TriggerTypeWebhook,
+		ChangedFiles: changedFiles,
+		EnvVars: map[string]string{
+			"CICD_GIT_BRANCH": "feature/ñ",
+			"DEPLOY":          "true",
+			"SKIP":            "0",
+			"VERSION":         "1.2.3",
+		},
+	}
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	tests := []struct {
+		name         string
+		condition    string
+		changedFiles []string
+		expect       bool
+	}{
+		{name: "non-ASCII literal", condition: `branch() == "feature/ñ"`, expect: true},
+		{name: "escaped quote", condition: `"a\"b" == 'a"b'`, expect: true},
+		{name: "and before or", condition: `false && false || true`, expect: true},
+		{name: "and before or on the right", condition: `true || false && false`, expect: true},
+		{name: "not before and", condition: `!true && false || !false`, expect: true},
+		{name: "parentheses", condition: `false && (false || true)`, expect: false},
+		{name: "not of parentheses", condition: `!(true || false)`, expect: false},
+		{name: "env var forms", condition: `$VERSION == "1.2.3" && ${VERSION} == env("VERSION") && VERSION != "1.2"`, expect: true},
+		{name: "truth of env vars", condition: `DEPLOY && !SKIP && !MISSING`, expect: true},
+		{name: "in", condition: `branch() in ["master", "feature/ñ"]`, expect: true},
+		{name: "not in", condition: `triggerType() in ["manual", "cron"]`, expect: false},
+		{name: "regular expression", condition: `branch() =~ "^feature/.$" && VERSION !~ "^2\\."`, expect: true},
+		{name: "regular expression of env var", condition: `"feature/x" =~ CICD_GIT_BRANCH`, expect: false},
+		{name: "glob within segment", condition: `glob("src/a.go", "src/*.go") && !glob("src/pkg/a.go", "src/*.go")`, expect: true},
+		{name: "glob across segments", condition: `glob("src/pkg/a.go", "src/**/*.go") && glob("src/a.go", "src/**/*.go")`, expect: true},
+		{name: "glob of non-ASCII", condition: `glob(branch(), "feature/?") && glob(branch(), "*/ñ")`, expect: true},
+		{name: "changed", condition: `changed("docs/**", "src/**/*.go")`, changedFiles: []string{"src/pkg/a.go"}, expect: true},
+		{name: "not changed", condition: `changed("docs/**")`, changedFiles: []string{"src/pkg/a.go"}, expect: false},
+		{name: "changes unknown", condition: `changed("docs/**")`, expect: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := service.EvaluateExpression(conditionActivity(tt.changedFiles), tt.condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.expect {
+				t.Errorf("got %v, expect %v", ok, tt.expect)
+			}
+		})
+	}
+}
+
+func TestConditionErrors(t *testing.T) {
+	tests := []struct {
+		condition string
+		err       string
+	}{
+		{condition: `branch() ==`, err: "unexpected end of condition at byte 12"},
+		{condition: `"ñ" == @`, err: "unexpected character '@' at byte 9"},
+		{condition: `"ñ" == ñ`, err: "unexpected character 'ñ' at byte 9"},
+		{condition: `"abc`, err: "unterminated string at byte 1"},
+		{condition: `${VERSION`, err: "expected '}' at byte 10"},
+		{condition: `true && unknown()`, err: "unknown function 'unknown' at byte 9"},
+		{condition: `glob(branch())`, err: "function 'glob' expects 2 arguments but got 1 at byte 1"},
+		{condition: `changed("[src")`, err: "unterminated '[' in glob '[src' at byte 9"},
+		{condition: `VERSION =~ "("`, err: "invalid regular expression"},
+		{condition: `"master"`, err: "expected a condition but got a string alone at byte 1"},
+		{condition: `(true || false`, err: "expected ')' but got end of condition at byte 15"},
+		{condition: `branch() in "master"`, err: "expected '[' but got string \"master\" at byte 13"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			_, err := service.EvaluateExpression(conditionActivity(nil), tt.condition)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, expect '%s'", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEvaluateConditions(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition model.PipelineConditions
+		expect    bool
+	}{
+		{name: "all", condition: model.PipelineConditions{All: []string{"VERSION=1.2.3", "DEPLOY!=false"}}, expect: true},
+		{name: "all with one false", condition: model.PipelineConditions{All: []string{"VERSION=1.2.3", "DEPLOY=false"}}, expect: false},
+		{name: "any", condition: model.PipelineConditions{Any: []string{"VERSION=2", "DEPLOY=true"}}, expect: true},
+		{name: "any all false", condition: model.PipelineConditions{Any: []string{"VERSION=2", "DEPLOY=false"}}, expect: false},
+		{name: "expression and all", condition: model.PipelineConditions{Expression: `DEPLOY`, All: []string{"VERSION=2"}}, expect: false},
+		{name: "false expression", condition: model.PipelineConditions{Expression: `!DEPLOY`, Any: []string{"VERSION=1.2.3"}}, expect: false},
+		{name: "expression alone", condition: model.PipelineConditions{Expression: `DEPLOY`}, expect: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := service.EvaluateConditions(conditionActivity(nil), &tt.condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.expect {
+				t.Errorf("got %v, expect %v", ok, tt.expect)
+			}
+		})
+	}
+}
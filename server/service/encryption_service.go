@@ -0,0 +1,84 @@
+package service
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/encryption"
+	"github.com/rancher/pipeline/model"
+)
+
+//ReencryptSecrets encrypts plain secrets of existing accounts, scm settings and pipeline secrets,
+//and rewraps those encrypted by former master keys with the primary one.
+//It returns the number of updated records
+func ReencryptSecrets() (int, error) {
+	if !encryption.Enabled() {
+		return 0, nil
+	}
+	count := 0
+	objs, err := listResources(GIT_ACCOUNT_TYPE)
+	if err != nil {
+		return count, err
+	}
+	for _, obj := range objs {
+		account, err := GetAccount(obj.Key)
+		if err != nil {
+			logrus.Errorf("fail to get account '%s': %v", obj.Key, err)
+			continue
+		}
+		if !encryption.NeedsRotation(account.AccessToken) {
+			continue
+		}
+		if account.AccessToken, err = encryption.Rotate(account.AccessToken); err != nil {
+			logrus.Errorf("fail to reencrypt token of account '%s': %v", account.Id, err)
+			continue
+		}
+		if err := UpdateAccount(account); err != nil {
+			logrus.Errorf("fail to update account '%s': %v", account.Id, err)
+			continue
+		}
+		count++
+	}
+	for _, setting := range ListSCMSetting() {
+		if !encryption.NeedsRotation(setting.ClientSecret) {
+			continue
+		}
+		if err := reencryptSCMSetting(setting); err != nil {
+			logrus.Errorf("fail to reencrypt client secret of '%s': %v", setting.ScmType, err)
+			continue
+		}
+		count++
+	}
+	secretObjs, err := listResources(SECRET_TYPE)
+	if err != nil {
+		return count, err
+	}
+	for _, obj := range secretObjs {
+		secret, err := GetSecret(obj.Key)
+		if err != nil {
+			logrus.Errorf("fail to get secret '%s': %v", obj.Key, err)
+			continue
+		}
+		if !encryption.NeedsRotation(secret.Value) {
+			continue
+		}
+		if secret.Value, err = encryption.Rotate(secret.Value); err != nil {
+			logrus.Errorf("fail to reencrypt secret '%s': %v", secret.Id, err)
+			continue
+		}
+		if _, err := updateResource(SECRET_TYPE, secret.Id, secret.Name, secret.ResourceVersion, secret); err != nil {
+			logrus.Errorf("fail to update secret '%s': %v", secret.Id, err)
+			continue
+		}
+		count++
+	}
+	logrus.Infof("reencrypted %d records", count)
+	return count, nil
+}
+
+func reencryptSCMSetting(setting *model.SCMSetting) error {
+	secret, err := encryption.Rotate(setting.ClientSecret)
+	if err != nil {
+		return err
+	}
+	setting.ClientSecret = secret
+	return CreateOrUpdateSCMSetting(setting)
+}
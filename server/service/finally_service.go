@@ -0,0 +1,84 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+)
+
+//envActivityStatus gives finally stages the outcome of the main stages
+const envActivityStatus = "CICD_ACTIVITY_STATUS"
+
+//IsFinallyStage checks if the stage always runs after the main stages
+func IsFinallyStage(activity *model.Activity, ordinal int) bool {
+	return ordinal >= 0 && ordinal < len(activity.ActivityStages) && activity.ActivityStages[ordinal].Finally
+}
+
+//IsMainEnded checks if the stage is a main stage while finally stages run,
+//late events of its steps are ignored
+func IsMainEnded(activity *model.Activity, ordinal int) bool {
+	return activity.MainStatus != "" && !IsFinallyStage(activity, ordinal)
+}
+
+//finallyOrdinal gets the ordinal of the first finally stage, -1 if there is none
+func finallyOrdinal(activity *model.Activity) int {
+	for i, stage := range activity.ActivityStages {
+		if stage.Finally {
+			return i
+		}
+	}
+	return -1
+}
+
+//endMainStages records the outcome of the main stages for finally stages to read
+func endMainStages(activity *model.Activity, status string) {
+	activity.MainStatus = status
+	if activity.EnvVars == nil {
+		activity.EnvVars = map[string]string{}
+	}
+	activity.EnvVars[envActivityStatus] = status
+	logrus.Infof("main stages of activity '%s' end with '%s', run finally stages", activity.Id, status)
+}
+
+//RunFinally starts finally stages when the main stages stop before running through,
+//as they fail, are denied or aborted. Returns true if the activity goes on
+func RunFinally(provider model.PipelineProvider, activity *model.Activity) bool {
+	if !IsComplete(activity) || activity.MainStatus != "" {
+		return false
+	}
+	ordinal := finallyOrdinal(activity)
+	if ordinal < 0 {
+		return false
+	}
+	endMainStages(activity, activity.Status)
+	activity.Status = model.ActivityBuilding
+	activity.StopTS = 0
+	if err := provider.RunStage(activity, ordinal); err != nil {
+		logrus.Errorf("run finally stage '%s' got error:%v", activity.ActivityStages[ordinal].Name, err)
+		activity.FailMessage = fmt.Sprintf("run finally stage '%s' got error:%v", activity.ActivityStages[ordinal].Name, err)
+		activity.FinallyStatus = model.ActivityFail
+		activity.Status = activity.MainStatus
+		activity.StopTS = time.Now().UnixNano() / int64(time.Millisecond)
+		return false
+	}
+	return !IsComplete(activity)
+}
+
+//finishActivity sets the result of the activity whose stages are done. The activity
+//keeps the outcome of the main stages, finally stages are reported apart
+func finishActivity(activity *model.Activity, curTime int64) {
+	activity.StopTS = curTime
+	if activity.MainStatus == "" {
+		activity.Status = ActivityResult(activity)
+		return
+	}
+	activity.Status = activity.MainStatus
+	activity.FinallyStatus = model.ActivitySuccess
+	for _, stage := range activity.ActivityStages {
+		if stage.Finally && stage.Status == model.ActivityStageFailedAllowed {
+			activity.FinallyStatus = model.ActivityFail
+		}
+	}
+}
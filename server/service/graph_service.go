@@ -0,0 +1,139 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rancher/pipeline/model"
+)
+
+//StageNeeds gets ordinals of the stages the stage waits for. A main stage without needs
+//waits for the stage before it, and every main stage waits for the first one to check out.
+//The first finally stage waits for all main stages, finally stages run in sequence
+func StageNeeds(activity *model.Activity, ordinal int) []int {
+	if ordinal <= 0 || ordinal >= len(activity.ActivityStages) {
+		return nil
+	}
+	if IsFinallyStage(activity, ordinal) {
+		if IsFinallyStage(activity, ordinal-1) {
+			return []int{ordinal - 1}
+		}
+		needs := []int{}
+		for i := 0; i < ordinal; i++ {
+			needs = append(needs, i)
+		}
+		return needs
+	}
+	names := activity.Pipeline.Stages[ordinal].Needs
+	if len(names) == 0 {
+		return []int{ordinal - 1}
+	}
+	needs := []int{0}
+	for _, name := range names {
+		for i, stage := range activity.Pipeline.Stages {
+			if i > 0 && stage.Name == name && !IsFinallyStage(activity, i) {
+				needs = append(needs, i)
+			}
+		}
+	}
+	return needs
+}
+
+//readyStages gets waiting stages whose needs are all done. Only finally stages get ready
+//once main stages end, and no stage gets ready after a stage is denied
+func readyStages(activity *model.Activity) []int {
+	for _, stage := range activity.ActivityStages {
+		if stage.Status == model.ActivityStageDenied {
+			return nil
+		}
+	}
+	ready := []int{}
+	for i, stage := range activity.ActivityStages {
+		if stage.Status != model.ActivityStageWaiting || (activity.MainStatus != "" && !stage.Finally) {
+			continue
+		}
+		done := true
+		for _, need := range StageNeeds(activity, i) {
+			if !isStageDone(activity.ActivityStages[need]) {
+				done = false
+				break
+			}
+		}
+		if done {
+			ready = append(ready, i)
+		}
+	}
+	return ready
+}
+
+//RunReadyStages starts the stages whose needs are done, those needing approval wait for it
+func RunReadyStages(provider model.PipelineProvider, activity *model.Activity) error {
+	for _, i := range readyStages(activity) {
+		stage := activity.ActivityStages[i]
+		if stage.Status != model.ActivityStageWaiting {
+			//started on a skipped stage
+			continue
+		}
+		if stage.NeedApproval {
+			stage.Status = model.ActivityStagePending
+			continue
+		}
+		if err := provider.RunStage(activity, i); err != nil {
+			return fmt.Errorf("run stage '%s' got error:%v", stage.Name, err)
+		}
+	}
+	updatePending(activity)
+	return nil
+}
+
+//updatePending makes the activity pending when stages wait for approval and no stage runs
+func updatePending(activity *model.Activity) {
+	if IsComplete(activity) {
+		return
+	}
+	pending := -1
+	running := false
+	for i, stage := range activity.ActivityStages {
+		if stage.Status == model.ActivityStagePending && pending < 0 {
+			pending = i
+		}
+		if stage.Status == model.ActivityStageBuilding {
+			running = true
+		}
+	}
+	if pending < 0 {
+		return
+	}
+	activity.PendingStage = pending
+	if !running {
+		activity.Status = model.ActivityPending
+	}
+}
+
+//settleDenied ends the activity as denied once no stage runs after a stage is denied
+func settleDenied(activity *model.Activity) {
+	denied := false
+	for _, stage := range activity.ActivityStages {
+		if stage.Status == model.ActivityStageBuilding {
+			return
+		}
+		if stage.Status == model.ActivityStageDenied {
+			denied = true
+		}
+	}
+	if denied {
+		activity.Status = model.ActivityDenied
+		activity.StopTS = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+}
+
+//isActivityDone checks if all stages to run are done, main stages are not
+//waited for once they end
+func isActivityDone(activity *model.Activity) bool {
+	for _, stage := range activity.ActivityStages {
+		if (stage.Finally || activity.MainStatus == "") && !isStageDone(stage) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rancher/pipeline/model"
+)
+
+//ExpandMatrix gets a copy of the stage whose matrix steps are replaced by one step
+//for each combination of axis values, the values are set as env vars of the step
+func ExpandMatrix(stage *model.Stage) *model.Stage {
+	expanded := *stage
+	expanded.Steps = []*model.Step{}
+	for i, step := range stage.Steps {
+		if step.Matrix == nil || len(step.Matrix.Axes) == 0 || step.MatrixStep > 0 {
+			expanded.Steps = append(expanded.Steps, step)
+			continue
+		}
+		for _, values := range matrixCombinations(step.Matrix.Axes) {
+			child := *step
+			child.MatrixStep = i + 1
+			child.MatrixValues = values
+			child.Env = append([]string{}, step.Env...)
+			for _, name := range axisNames(step.Matrix.Axes) {
+				child.Env = append(child.Env, name+"="+values[name])
+			}
+			expanded.Steps = append(expanded.Steps, &child)
+		}
+	}
+	return &expanded
+}
+
+func axisNames(axes map[string][]string) []string {
+	names := []string{}
+	for name := range axes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//matrixCombinations gets combinations of axis values, ordered by axis names
+func matrixCombinations(axes map[string][]string) []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, name := range axisNames(axes) {
+		next := []map[string]string{}
+		for _, combination := range combinations {
+			for _, value := range axes[name] {
+				values := map[string]string{name: value}
+				for k, v := range combination {
+					values[k] = v
+				}
+				next = append(next, values)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+//IsMatrixStep checks if the step is expanded from a matrix step
+func IsMatrixStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) bool {
+	return activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].MatrixStep > 0
+}
+
+//matrixRange gets ordinals of the first step of the matrix and the step after it
+func matrixRange(activity *model.Activity, stageOrdinal int, stepOrdinal int) (int, int) {
+	steps := activity.ActivityStages[stageOrdinal].ActivitySteps
+	matrixStep := steps[stepOrdinal].MatrixStep
+	start, end := stepOrdinal, stepOrdinal+1
+	for start > 0 && steps[start-1].MatrixStep == matrixStep {
+		start--
+	}
+	for end < len(steps) && steps[end].MatrixStep == matrixStep {
+		end++
+	}
+	return start, end
+}
+
+//IsFailFast checks if failure of the step fails the activity at once. Failure of a step
+//in a matrix not failing fast waits for other steps of the matrix
+func IsFailFast(activity *model.Activity, stageOrdinal int, stepOrdinal int) bool {
+	if !IsMatrixStep(activity, stageOrdinal, stepOrdinal) {
+		return true
+	}
+	matrix := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal].Matrix
+	return matrix == nil || matrix.FailFast
+}
+
+//FailMatrixStep records the failure of a step in a matrix, the activity
+//fails when the other steps of the matrix are done
+func FailMatrixStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	step := activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+	step.Status = model.ActivityStepFail
+	step.Duration = now - step.StartTS
+}
+
+func isStepEnded(step *model.ActivityStep) bool {
+	return isStepDone(step) || step.Status == model.ActivityStepFail
+}
+
+//runMatrixSteps starts waiting steps of the matrix the step belongs to,
+//as many as the max parallel of the matrix allows
+func runMatrixSteps(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	start, end := matrixRange(activity, stageOrdinal, stepOrdinal)
+	matrix := activity.Pipeline.Stages[stageOrdinal].Steps[start].Matrix
+	steps := activity.ActivityStages[stageOrdinal].ActivitySteps
+	for j := start; j < end; j++ {
+		//a step waiting for retry is not started here
+		if steps[j].Status != model.ActivityStepWaiting || len(steps[j].Attempts) > 0 {
+			continue
+		}
+		if matrix != nil && matrix.MaxParallel > 0 && countRunning(steps[start:end]) >= matrix.MaxParallel {
+			return nil
+		}
+		if IsComplete(activity) {
+			return nil
+		}
+		//mark it started so it is not triggered again by other steps of the matrix
+		steps[j].Status = model.ActivityStepBuilding
+		if err := provider.RunStep(activity, stageOrdinal, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func countRunning(steps []*model.ActivityStep) int {
+	running := 0
+	for _, step := range steps {
+		if step.Status == model.ActivityStepBuilding ||
+			(step.Status == model.ActivityStepWaiting && len(step.Attempts) > 0) {
+			running++
+		}
+	}
+	return running
+}
+
+//runStep triggers the step, or the steps of the matrix starting from it
+func runStep(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	if IsMatrixStep(activity, stageOrdinal, stepOrdinal) {
+		return runMatrixSteps(provider, activity, stageOrdinal, stepOrdinal)
+	}
+	return provider.RunStep(activity, stageOrdinal, stepOrdinal)
+}
+
+//runAfterStep triggers what follows the ended step in a stage not done, waiting steps
+//of its matrix, or the next step of a sequential stage once the matrix is done.
+//The activity fails if a step of the ended matrix failed
+func runAfterStep(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	steps := activity.ActivityStages[stageOrdinal].ActivitySteps
+	if IsMatrixStep(activity, stageOrdinal, stepOrdinal) {
+		if err := runMatrixSteps(provider, activity, stageOrdinal, stepOrdinal); err != nil {
+			return err
+		}
+		start, end := matrixRange(activity, stageOrdinal, stepOrdinal)
+		for j := start; j < end; j++ {
+			if !isStepEnded(steps[j]) {
+				return nil
+			}
+		}
+		for j := start; j < end; j++ {
+			if steps[j].Status == model.ActivityStepFail {
+				duration := steps[j].Duration
+				FailStep(activity, stageOrdinal, j)
+				steps[j].Duration = duration
+				return nil
+			}
+		}
+		stepOrdinal = end - 1
+	}
+	if activity.Pipeline.Stages[stageOrdinal].Parallel || stepOrdinal+1 >= len(steps) {
+		return nil
+	}
+	return runStep(provider, activity, stageOrdinal, stepOrdinal+1)
+}
@@ -0,0 +1,123 @@
+package service_test
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+func matrixTask(name string, axes map[string][]string) *model.Step {
+	step := task(name, "CI=true")
+	step.Matrix = &model.StepMatrix{Axes: axes}
+	return step
+}
+
+func TestExpandMatrix(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []*model.Step
+		//expect is the matrix step followed by env of each expanded step
+		expect []string
+	}{
+		{
+			name:   "no matrix",
+			steps:  []*model.Step{task("make", "CI=true")},
+			expect: []string{"0 CI=true"},
+		},
+		{
+			name:   "one axis",
+			steps:  []*model.Step{matrixTask("test", map[string][]string{"GO": {"1.9", "1.10"}})},
+			expect: []string{"1 CI=true GO=1.9", "1 CI=true GO=1.10"},
+		},
+		{
+			name: "axes ordered by name",
+			steps: []*model.Step{
+				task("make", "CI=true"),
+				matrixTask("test", map[string][]string{"OS": {"linux", "windows"}, "ARCH": {"amd64", "arm"}}),
+			},
+			expect: []string{
+				"0 CI=true",
+				"2 CI=true ARCH=amd64 OS=linux",
+				"2 CI=true ARCH=amd64 OS=windows",
+				"2 CI=true ARCH=arm OS=linux",
+				"2 CI=true ARCH=arm OS=windows",
+			},
+		},
+		{
+			name:   "no axes",
+			steps:  []*model.Step{matrixTask("test", nil)},
+			expect: []string{"0 CI=true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := stage("build", tt.steps...)
+			expanded := service.ExpandMatrix(s)
+			got := []string{}
+			for _, step := range expanded.Steps {
+				got = append(got, strings.Join(append([]string{strconv.Itoa(step.MatrixStep)}, step.Env...), " "))
+				if len(step.MatrixValues) != len(step.Env)-1 {
+					t.Errorf("got matrix values %v of env %v", step.MatrixValues, step.Env)
+				}
+				for _, env := range step.Env[1:] {
+					kv := strings.SplitN(env, "=", 2)
+					if step.MatrixValues[kv[0]] != kv[1] {
+						t.Errorf("got matrix values %v of env %v", step.MatrixValues, step.Env)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("got steps %q, expect %q", got, tt.expect)
+			}
+			if len(s.Steps) != len(tt.steps) || len(tt.steps[len(tt.steps)-1].Env) != 1 {
+				t.Errorf("stage definition is changed")
+			}
+			//expanded steps are not expanded again
+			if again := service.ExpandMatrix(expanded); len(again.Steps) != len(expanded.Steps) {
+				t.Errorf("got %d steps on expanding again, expect %d", len(again.Steps), len(expanded.Steps))
+			}
+		})
+	}
+}
+
+func TestValidateMatrix(t *testing.T) {
+	build := &model.Step{Name: "build", Type: model.StepTypeBuild, TargetImage: "app"}
+	db := task("db")
+	db.IsService = true
+	db.Alias = "db"
+	tests := []struct {
+		name   string
+		step   *model.Step
+		matrix *model.StepMatrix
+		//err is empty if the matrix is valid
+		err string
+	}{
+		{name: "valid", step: task("test"), matrix: &model.StepMatrix{Axes: map[string][]string{"GO": {"1.9"}}, MaxParallel: 2}},
+		{name: "not a task", step: build, matrix: &model.StepMatrix{Axes: map[string][]string{"GO": {"1.9"}}}, err: "matrix is only allowed on task step"},
+		{name: "service", step: db, matrix: &model.StepMatrix{Axes: map[string][]string{"GO": {"1.9"}}}, err: "matrix is not allowed on task step run as a service"},
+		{name: "no axes", step: task("test"), matrix: &model.StepMatrix{}, err: "matrix should have axes"},
+		{name: "axis name", step: task("test"), matrix: &model.StepMatrix{Axes: map[string][]string{"GO-VERSION": {"1.9"}}}, err: "matrix axis 'GO-VERSION' is not a valid env var name"},
+		{name: "axis values", step: task("test"), matrix: &model.StepMatrix{Axes: map[string][]string{"GO": {}}}, err: "matrix axis 'GO' should have values"},
+		{name: "max parallel", step: task("test"), matrix: &model.StepMatrix{Axes: map[string][]string{"GO": {"1.9"}}, MaxParallel: -1}, err: "matrix maxParallel should not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.step.Matrix = tt.matrix
+			err := service.Validate(validationPipeline(stage("test", tt.step)))
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("got error %v of a valid matrix", err)
+				}
+				return
+			}
+			if errors.Cause(err) != service.ErrInvalidPipeline || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, expect '%s'", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+)
+
+const (
+	//env var of a task step to the file it writes KEY=VALUE lines of its outputs to
+	EnvOutputFile = "CICD_OUTPUT_FILE"
+	//outputs are set as env vars of the activity named CICD_OUTPUT_<STEP>_<KEY>
+	envOutputPrefix = "CICD_OUTPUT_"
+
+	maxStepOutputs     = 100
+	maxOutputValueSize = 4096
+)
+
+var regOutputScope = regexp.MustCompile(`[^A-Z0-9]+`)
+
+//StepOutputFile gets the path of the output file of the step relative to the workspace
+func StepOutputFile(stageOrdinal int, stepOrdinal int) string {
+	return fmt.Sprintf(".r_cicd_output_%d_%d", stageOrdinal, stepOrdinal)
+}
+
+//outputScope gets the part of env var names of outputs of the step, from the step name
+//or from the stage name and the step position if the step is not named
+func outputScope(activity *model.Activity, stageOrdinal int, stepOrdinal int) string {
+	name := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal].Name
+	if name == "" {
+		name = fmt.Sprintf("%s_%d", activity.Pipeline.Stages[stageOrdinal].Name, stepOrdinal+1)
+	}
+	return strings.Trim(regOutputScope.ReplaceAllString(strings.ToUpper(name), "_"), "_")
+}
+
+//SetStepOutputs parses KEY=VALUE lines the step wrote to its output file and sets them as env vars
+//of the activity, so that conditions and env of later stages and steps use them
+func SetStepOutputs(activity *model.Activity, stageOrdinal int, stepOrdinal int, text string) {
+	outputs := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || !regEnvName.MatchString(kv[0]) || len(kv[1]) > maxOutputValueSize {
+			logrus.Warnf("ignore invalid output line of step %d-%d of activity '%s': %s", stageOrdinal, stepOrdinal, activity.Id, line)
+			continue
+		}
+		if _, ok := outputs[kv[0]]; !ok && len(outputs) >= maxStepOutputs {
+			logrus.Warnf("ignore outputs of step %d-%d of activity '%s' beyond %d", stageOrdinal, stepOrdinal, activity.Id, maxStepOutputs)
+			break
+		}
+		outputs[kv[0]] = kv[1]
+	}
+	if len(outputs) == 0 {
+		return
+	}
+	if activity.EnvVars == nil {
+		activity.EnvVars = map[string]string{}
+	}
+	scope := outputScope(activity, stageOrdinal, stepOrdinal)
+	for k, v := range outputs {
+		activity.EnvVars[envOutputPrefix+scope+"_"+k] = v
+	}
+	activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Outputs = outputs
+}
+
+//OutputEnvVars gets env vars set by outputs of steps of the activity
+func OutputEnvVars(activity *model.Activity) map[string]string {
+	vars := map[string]string{}
+	for i, stage := range activity.ActivityStages {
+		for j, step := range stage.ActivitySteps {
+			if len(step.Outputs) == 0 {
+				continue
+			}
+			scope := outputScope(activity, i, j)
+			for k, v := range step.Outputs {
+				vars[envOutputPrefix+scope+"_"+k] = v
+			}
+		}
+	}
+	return vars
+}
+
+//dropOutputs removes outputs of steps to run again from env vars of the activity
+func dropOutputs(activity *model.Activity, runAgain func(stageOrdinal int, stepOrdinal int) bool) {
+	for i, stage := range activity.ActivityStages {
+		for j, step := range stage.ActivitySteps {
+			if len(step.Outputs) == 0 || !runAgain(i, j) {
+				continue
+			}
+			scope := outputScope(activity, i, j)
+			for k := range step.Outputs {
+				delete(activity.EnvVars, envOutputPrefix+scope+"_"+k)
+			}
+			step.Outputs = nil
+		}
+	}
+}
@@ -4,152 +4,155 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/pipeline/model"
-	"github.com/rancher/pipeline/util"
+	"github.com/rancher/pipeline/store"
 	"github.com/robfig/cron"
 )
 
 func GetPipelineById(id string) (*model.Pipeline, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return nil, err
-	}
-	filters := make(map[string]interface{})
-	filters["key"] = id
-	filters["kind"] = "pipeline"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
-		return nil, err
-	}
-	if len(goCollection.Data) == 0 {
+	ppl := &model.Pipeline{}
+	version, err := getResource(PIPELINE_TYPE, id, ppl)
+	if err == store.ErrNotFound {
 		return nil, fmt.Errorf("pipeline '%s' is not found", id)
+	} else if err != nil {
+		logrus.Errorf("Error %v getting pipeline", err)
+		return nil, err
 	}
-	data := goCollection.Data[0]
-	ppl := &model.Pipeline{}
-	json.Unmarshal([]byte(data.ResourceData["data"].(string)), ppl)
+	ppl.ResourceVersion = version
 	return ppl, nil
 }
 
-func CreatePipeline(pipeline *model.Pipeline) error {
-	b, err := json.Marshal(*pipeline)
+//CreatePipeline saves a new pipeline and its first revision
+func CreatePipeline(pipeline *model.Pipeline, author string) error {
+	pipeline.VersionSequence = "1"
+	version, err := createResource(PIPELINE_TYPE, pipeline.Id, pipeline.Name, pipeline)
 	if err != nil {
 		return err
 	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
+	pipeline.ResourceVersion = version
+	logrus.Debugf("created pipeline:%v", pipeline)
+	if _, err := CreatePipelineRevision(pipeline, author, ""); err != nil {
+		//a pipeline has the revision of each version sequence
+		if delErr := dataStore.Delete(PIPELINE_TYPE, pipeline.Id); delErr != nil {
+			logrus.Errorf("fail to delete pipeline '%s' without revision: %v", pipeline.Name, delErr)
+		}
 		return err
 	}
-	_, err = apiClient.GenericObject.Create(&client.GenericObject{
-		Name:         pipeline.Name,
-		Key:          pipeline.Id,
-		ResourceData: resourceData,
-		Kind:         "pipeline",
-	})
-	logrus.Debugf("created pipeline:%v", pipeline)
 
-	return err
+	return nil
 }
 
+//UpdatePipeline saves the pipeline, it fails with a conflict
+//if the pipeline is modified since its ResourceVersion
 func UpdatePipeline(pipeline *model.Pipeline) error {
-	apiClient, err := util.GetRancherClient()
+	prevPipeline, err := GetPipelineById(pipeline.Id)
 	if err != nil {
 		return err
 	}
+	pipeline.VersionSequence = prevPipeline.VersionSequence
+	return updatePipeline(pipeline, prevPipeline)
+}
 
-	filters := make(map[string]interface{})
-	filters["key"] = pipeline.Id
-	filters["kind"] = "pipeline"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
+//UpdatePipelineDefinition saves the pipeline and records a new revision
+//if its definition is changed
+func UpdatePipelineDefinition(pipeline *model.Pipeline, author string, message string) error {
+	prevPipeline, err := GetPipelineById(pipeline.Id)
 	if err != nil {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
 		return err
 	}
-	if len(goCollection.Data) == 0 {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
-		return err
+	changed := definitionChanged(&prevPipeline.PipelineContent, &pipeline.PipelineContent)
+	pipeline.VersionSequence = prevPipeline.VersionSequence
+	if changed {
+		seq, _ := strconv.Atoi(prevPipeline.VersionSequence)
+		pipeline.VersionSequence = strconv.Itoa(seq + 1)
 	}
-	existing := goCollection.Data[0]
-	prevPipeline := &model.Pipeline{}
-	if err := json.Unmarshal([]byte(existing.ResourceData["data"].(string)), prevPipeline); err != nil {
-		return err
+	//the revision is saved first so the version sequence of the pipeline always has one
+	if changed {
+		if _, err := CreatePipelineRevision(pipeline, author, message); err != nil {
+			return err
+		}
 	}
-	pipeline.WebHookToken = prevPipeline.WebHookToken
-
-	b, err := json.Marshal(*pipeline)
-	if err != nil {
+	if err := updatePipeline(pipeline, prevPipeline); err != nil {
+		if changed {
+			if delErr := dataStore.Delete(PIPELINE_REVISION_TYPE, revisionKey(pipeline.Id, pipeline.VersionSequence)); delErr != nil {
+				logrus.Errorf("fail to delete revision %s of pipeline '%s' not saved: %v", pipeline.VersionSequence, pipeline.Name, delErr)
+			}
+		}
 		return err
 	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
+	return nil
+}
 
-	_, err = apiClient.GenericObject.Update(&existing, &client.GenericObject{
-		Name:         pipeline.Name,
-		Key:          pipeline.Id,
-		ResourceData: resourceData,
-		Kind:         "pipeline",
-	})
+func updatePipeline(pipeline *model.Pipeline, prevPipeline *model.Pipeline) error {
+	pipeline.WebHookToken = prevPipeline.WebHookToken
+
+	version, err := updateResource(PIPELINE_TYPE, pipeline.Id, pipeline.Name, pipeline.ResourceVersion, pipeline)
 	if err != nil {
 		return err
 	}
+	pipeline.ResourceVersion = version
 	logrus.Debugf("updated pipeline")
 	return nil
 }
 
+//ModifyPipeline applies the change to the latest pipeline and saves it.
+//On a concurrent update the pipeline is reloaded and the change is applied again
+func ModifyPipeline(id string, modify func(*model.Pipeline) error) (*model.Pipeline, error) {
+	var err error
+	for i := 0; i < conflictRetries; i++ {
+		var p *model.Pipeline
+		if p, err = GetPipelineById(id); err != nil {
+			return nil, err
+		}
+		if err = modify(p); err != nil {
+			return nil, err
+		}
+		if err = UpdatePipeline(p); err == nil {
+			return p, nil
+		} else if !IsConflict(err) {
+			return nil, err
+		}
+		logrus.Debugf("pipeline '%s' is modified concurrently, retrying", id)
+	}
+	return nil, err
+}
+
 func DeletePipeline(id string) (*model.Pipeline, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
+	ppl := &model.Pipeline{}
+	if err := deleteResource(PIPELINE_TYPE, id, ppl); err == store.ErrNotFound {
+		return nil, errors.New("cannot find pipeline to delete")
+	} else if err != nil {
 		return nil, err
 	}
-	filters := make(map[string]interface{})
-	filters["key"] = id
-	filters["kind"] = "pipeline"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
-		return nil, err
+	if err := DeletePipelineRevisions(id); err != nil {
+		logrus.Errorf("fail to delete revisions of pipeline '%s': %v", id, err)
 	}
-	if len(goCollection.Data) == 0 {
-		return nil, errors.New("cannot find pipeline to delete")
+	if err := PurgeCaches(id, ""); err != nil {
+		logrus.Errorf("fail to delete caches of pipeline '%s': %v", id, err)
 	}
-	existing := goCollection.Data[0]
-	ppl := &model.Pipeline{}
-	if err = json.Unmarshal([]byte(existing.ResourceData["data"].(string)), ppl); err != nil {
-		return ppl, err
-	}
-	if err = apiClient.GenericObject.Delete(&existing); err != nil {
-		return nil, err
+	if err := deletePipelineSecrets(id); err != nil {
+		logrus.Errorf("fail to delete secrets of pipeline '%s': %v", id, err)
 	}
 
 	return ppl, nil
 }
 
-//get all pipelines from GenericObject
+//get all pipelines from store
 func ListPipelines() []*model.Pipeline {
-	geObjList, err := PaginateGenericObjects("pipeline")
+	objs, err := listResources(PIPELINE_TYPE)
 	if err != nil {
 		logrus.Errorf("fail to list pipeline,err:%v", err)
 		return nil
 	}
 	var pipelines []*model.Pipeline
-	for _, gobj := range geObjList {
-		b := []byte(gobj.ResourceData["data"].(string))
+	for _, obj := range objs {
 		a := &model.Pipeline{}
-		json.Unmarshal(b, a)
+		json.Unmarshal(obj.Data, a)
+		a.ResourceVersion = obj.Version
 		pipelines = append(pipelines, a)
 	}
 	return pipelines
@@ -161,22 +164,44 @@ func RunPipeline(provider model.PipelineProvider, id string, triggerType string)
 		return nil, fmt.Errorf("fail to get pipeline: %v", err)
 	}
 
-	activity, err := provider.RunPipeline(pp, triggerType)
+	activity, err := runOrQueue(provider, pp, triggerType)
 	if err != nil {
 		return nil, err
 	}
 
-	pp.RunCount = activity.RunSequence
-	pp.LastRunId = activity.Id
-	pp.LastRunStatus = activity.Status
-	pp.LastRunTime = activity.StartTS
-	pp.NextRunTime = GetNextRunTime(pp)
-	UpdatePipeline(pp)
+	if _, err := ModifyPipeline(id, func(pp *model.Pipeline) error {
+		pp.RunCount = activity.RunSequence
+		pp.LastRunId = activity.Id
+		pp.LastRunStatus = activity.Status
+		pp.LastRunTime = activity.StartTS
+		pp.NextRunTime = GetNextRunTime(pp)
+		return nil
+	}); err != nil {
+		logrus.Errorf("fail to update last run of pipeline '%s': %v", pp.Name, err)
+	}
 	return activity, nil
 }
 
+//runOrQueue runs the pipeline if concurrency limits allow, otherwise queues the run.
+//Runs of a pipeline having queued ones are queued to keep their order
+func runOrQueue(provider model.PipelineProvider, p *model.Pipeline, triggerType string) (*model.Activity, error) {
+	if err := activityIdx.preload(); err != nil {
+		return nil, err
+	}
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	load, err := getRunLoad()
+	if err != nil {
+		return nil, err
+	}
+	if !load.hasCapacity(p) || load.pipelineQueued[p.Id] > 0 {
+		return queueActivity(p, triggerType)
+	}
+	return provider.RunPipeline(p, triggerType)
+}
+
 func UpdatePipelineEnvKey(p *model.Pipeline) error {
-	for _, stage := range p.Stages {
+	for _, stage := range p.AllStages() {
 		for _, step := range stage.Steps {
 			if step.Accesskey != "" && step.Secretkey != "" {
 				if err := CreateOrUpdateEnvKey(step.Accesskey, step.Secretkey); err != nil {
@@ -189,11 +214,11 @@ func UpdatePipelineEnvKey(p *model.Pipeline) error {
 }
 
 func HasStepCondition(s *model.Step) bool {
-	return s.Conditions != nil && (len(s.Conditions.All) > 0 || len(s.Conditions.Any) > 0)
+	return hasCondition(s.Conditions)
 }
 
 func HasStageCondition(s *model.Stage) bool {
-	return s.Conditions != nil && (len(s.Conditions.All) > 0 || len(s.Conditions.Any) > 0)
+	return hasCondition(s.Conditions)
 }
 
 func GetNextRunTime(pipeline *model.Pipeline) int64 {
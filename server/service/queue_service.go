@@ -0,0 +1,161 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/config"
+	"github.com/rancher/pipeline/model"
+)
+
+//queueLock serializes capacity checks with starting activities
+var queueLock sync.Mutex
+
+var queueSignal = make(chan struct{}, 1)
+
+//NotifyQueue wakes up the dispatcher of queued activities without blocking
+func NotifyQueue() {
+	select {
+	case queueSignal <- struct{}{}:
+	default:
+	}
+}
+
+//QueueSignal notifies when capacity may have been freed
+func QueueSignal() <-chan struct{} {
+	return queueSignal
+}
+
+//runLoad counts running activities in all and of each pipeline, and
+//queued activities of each pipeline
+type runLoad struct {
+	running           int
+	pipelineRunning   map[string]int
+	pipelineQueued    map[string]int
+	queuedActivityIds []string
+}
+
+func isRunning(status string) bool {
+	return status == model.ActivityWaiting || status == model.ActivityBuilding
+}
+
+//getRunLoad counts runs from the activity index, which is loaded before taking queueLock
+func getRunLoad() (*runLoad, error) {
+	entries, err := activityIdx.find("")
+	if err != nil {
+		return nil, err
+	}
+	load := &runLoad{
+		pipelineRunning: map[string]int{},
+		pipelineQueued:  map[string]int{},
+	}
+	queued := []*activityEntry{}
+	for _, e := range entries {
+		if isRunning(e.Status) {
+			load.running++
+			load.pipelineRunning[e.PipelineId]++
+		} else if e.Status == model.ActivityQueued {
+			load.pipelineQueued[e.PipelineId]++
+			queued = append(queued, e)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].StartTS != queued[j].StartTS {
+			return queued[i].StartTS < queued[j].StartTS
+		}
+		return queued[i].RunSequence < queued[j].RunSequence
+	})
+	for _, e := range queued {
+		load.queuedActivityIds = append(load.queuedActivityIds, e.Id)
+	}
+	return load, nil
+}
+
+//hasCapacity checks the global limit and the limit of the pipeline
+func (l *runLoad) hasCapacity(p *model.Pipeline) bool {
+	if config.Config.MaxConcurrentRuns > 0 && l.running >= config.Config.MaxConcurrentRuns {
+		return false
+	}
+	if p.MaxConcurrentRuns > 0 && l.pipelineRunning[p.Id] >= p.MaxConcurrentRuns {
+		return false
+	}
+	return true
+}
+
+//queueActivity saves a run of the pipeline to start later
+func queueActivity(p *model.Pipeline, triggerType string) (*model.Activity, error) {
+	if len(p.Stages) == 0 {
+		return nil, errors.New("no stage in pipeline definition to run!")
+	}
+	activity := NewActivity(p, "")
+	activity.Status = model.ActivityQueued
+	activity.TriggerType = triggerType
+	if err := CreateActivity(activity); err != nil {
+		return nil, err
+	}
+	logrus.Infof("queued activity '%s' of pipeline '%s'", activity.Id, p.Name)
+	return activity, nil
+}
+
+//QueuedActivityIds lists queued activities in the order to start
+func QueuedActivityIds() ([]string, error) {
+	load, err := getRunLoad()
+	if err != nil {
+		return nil, err
+	}
+	return load.queuedActivityIds, nil
+}
+
+//StartQueuedActivity starts the queued activity if there is capacity.
+//Returns true if it is started
+func StartQueuedActivity(provider model.PipelineProvider, activity *model.Activity) (bool, error) {
+	if err := activityIdx.preload(); err != nil {
+		return false, err
+	}
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	if activity.Status != model.ActivityQueued {
+		return false, nil
+	}
+	load, err := getRunLoad()
+	if err != nil {
+		return false, err
+	}
+	//limit of the current pipeline definition applies
+	p := &activity.Pipeline
+	if latest, err := GetPipelineById(p.Id); err == nil {
+		p = latest
+	}
+	if !load.hasCapacity(p) {
+		return false, nil
+	}
+	ResetActivityStatus(activity)
+	if err := provider.RerunActivity(activity); err != nil {
+		activity.Status = model.ActivityFail
+		activity.StopTS = time.Now().UnixNano() / int64(time.Millisecond)
+		activity.FailMessage = fmt.Sprintf("fail to start queued activity: %v", err)
+		return true, err
+	}
+	logrus.Infof("started queued activity '%s'", activity.Id)
+	return true, nil
+}
+
+//CancelQueuedActivity aborts the activity before it starts
+func CancelQueuedActivity(activity *model.Activity) error {
+	if activity == nil {
+		return errors.New("nil activity")
+	}
+	if activity.Status != model.ActivityQueued {
+		return errors.New("Not a queued activity for cancel")
+	}
+	activity.Status = model.ActivityAbort
+	activity.StopTS = time.Now().UnixNano() / int64(time.Millisecond)
+	for _, stage := range activity.ActivityStages {
+		stage.Status = model.ActivityStageAbort
+	}
+	return nil
+}
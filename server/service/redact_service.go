@@ -0,0 +1,128 @@
+package service
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/encryption"
+	"github.com/rancher/pipeline/model"
+)
+
+//RedactMask replaces secret values in step logs
+const RedactMask = "****"
+
+//minRedactLen is the length of the shortest value to redact, shorter ones would mask common words
+const minRedactLen = 4
+
+//LogSecrets gets the plain values of secrets in scope for the activity: secrets of the pipeline and
+//of the environment, the git token of the SCM step and env keys of upgrade steps
+func LogSecrets(activity *model.Activity) []string {
+	values := []string{}
+	for _, pipelineId := range []string{activity.Pipeline.Id, ""} {
+		secrets, err := ListSecrets(pipelineId)
+		if err != nil {
+			logrus.Errorf("fail to list secrets for log redaction: %v", err)
+			continue
+		}
+		for _, secret := range secrets {
+			value, err := encryption.Decrypt(secret.Value)
+			if err != nil {
+				logrus.Errorf("fail to decrypt secret '%s' for log redaction: %v", secret.Id, err)
+				continue
+			}
+			values = append(values, value)
+		}
+	}
+	if len(activity.Pipeline.Stages) > 0 && len(activity.Pipeline.Stages[0].Steps) > 0 {
+		if gitUser := activity.Pipeline.Stages[0].Steps[0].GitUser; gitUser != "" {
+			if token, err := GetUserToken(gitUser); err == nil {
+				//the token is embedded in the clone url
+				values = append(values, token, url.QueryEscape(token))
+			}
+		}
+	}
+	for _, stage := range activity.Pipeline.Stages {
+		for _, step := range stage.Steps {
+			if step.Accesskey == "" {
+				continue
+			}
+			if envKey, err := GetEnvToken(step.Accesskey); err == nil {
+				values = append(values, envKey)
+			}
+		}
+	}
+	return values
+}
+
+//LogRedactor replaces secret values in a step log read in chunks, each appended since the last read
+type LogRedactor struct {
+	secrets  []string
+	replacer *strings.Replacer
+	//pending is the incomplete line held back
+	pending string
+}
+
+//NewLogRedactor creates a redactor of the values, each line of a multiline value is redacted as well
+//as log lines are read separately
+func NewLogRedactor(values []string) *LogRedactor {
+	set := map[string]bool{}
+	for _, value := range values {
+		for _, v := range append([]string{value}, strings.Split(value, "\n")...) {
+			v = strings.TrimRight(v, "\r")
+			if len(v) >= minRedactLen {
+				set[v] = true
+			}
+		}
+	}
+	r := &LogRedactor{}
+	for v := range set {
+		r.secrets = append(r.secrets, v)
+	}
+	//the longest value goes first when values overlap
+	sort.Slice(r.secrets, func(i, j int) bool {
+		if len(r.secrets[i]) != len(r.secrets[j]) {
+			return len(r.secrets[i]) > len(r.secrets[j])
+		}
+		return r.secrets[i] < r.secrets[j]
+	})
+	pairs := []string{}
+	for _, v := range r.secrets {
+		pairs = append(pairs, v, RedactMask)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+	return r
+}
+
+//NewActivityLogRedactor creates a redactor of secret values in scope for the activity
+func NewActivityLogRedactor(activity *model.Activity) *LogRedactor {
+	return NewLogRedactor(LogSecrets(activity))
+}
+
+//RedactLog replaces secret values in the complete log
+func (r *LogRedactor) RedactLog(log string) string {
+	if len(r.secrets) == 0 {
+		return log
+	}
+	return r.replacer.Replace(log)
+}
+
+//Redact replaces secret values in the chunk of log read. The incomplete last line is held back
+//until the next chunk or Flush, so a secret split across chunks is redacted
+func (r *LogRedactor) Redact(chunk string) string {
+	if len(r.secrets) == 0 {
+		return chunk
+	}
+	text := r.pending + chunk
+	cut := strings.LastIndex(text, "\n") + 1
+	r.pending = text[cut:]
+	return r.replacer.Replace(text[:cut])
+}
+
+//Flush returns the line held back when the log ends
+func (r *LogRedactor) Flush() string {
+	pending := r.pending
+	r.pending = ""
+	return r.RedactLog(pending)
+}
@@ -0,0 +1,87 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/rancher/pipeline/server/service"
+)
+
+func TestLogRedactor(t *testing.T) {
+	key := "-----BEGIN KEY-----\nMIIEpAIBAAKCAQEA\nab\n-----END KEY-----"
+	tests := []struct {
+		name   string
+		values []string
+		chunks []string
+		//expect is the log read before Flush, flushed is what Flush returns
+		expect  string
+		flushed string
+	}{
+		{
+			name:   "no secrets",
+			chunks: []string{"token s3cr", "3t-token\n"},
+			expect: "token s3cr3t-token\n",
+		},
+		{
+			name:   "secret in a chunk",
+			values: []string{"s3cr3t-token"},
+			chunks: []string{"token s3cr3t-token\n"},
+			expect: "token ****\n",
+		},
+		{
+			name:   "secret split across chunks",
+			values: []string{"s3cr3t-token"},
+			chunks: []string{"token s3cr", "3t", "-token\ndone\n"},
+			expect: "token ****\ndone\n",
+		},
+		{
+			name:   "chunk repeating former output",
+			values: []string{"s3cr3t-token"},
+			chunks: []string{"same\nsame s3cr", "same\nsame s3cr3t-token\n"},
+			expect: "same\nsame s3crsame\nsame ****\n",
+		},
+		{
+			name:   "multiline secret",
+			values: []string{key},
+			chunks: []string{"-----BEGIN KEY-----\nMIIEpAI", "BAAKCAQEA\nab\n-----END KEY-----\n"},
+			expect: "****\n****\nab\n****\n",
+		},
+		{
+			name:   "values shorter than the minimum",
+			values: []string{"abc", "abcd", ""},
+			chunks: []string{"abc abcd\n"},
+			expect: "abc ****\n",
+		},
+		{
+			name:    "flush of the last line",
+			values:  []string{"s3cr3t-token"},
+			chunks:  []string{"done\nno newline s3cr", "3t-token"},
+			expect:  "done\n",
+			flushed: "no newline ****",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := service.NewLogRedactor(tt.values)
+			log := ""
+			for _, chunk := range tt.chunks {
+				log += r.Redact(chunk)
+			}
+			if log != tt.expect {
+				t.Errorf("got log %q, expect %q", log, tt.expect)
+			}
+			if flushed := r.Flush(); flushed != tt.flushed {
+				t.Errorf("got flushed %q, expect %q", flushed, tt.flushed)
+			}
+			if r.Flush() != "" {
+				t.Errorf("line is flushed twice")
+			}
+		})
+	}
+}
+
+func TestRedactLog(t *testing.T) {
+	r := service.NewLogRedactor([]string{"s3cr3t", "s3cr3t-token"})
+	if log := r.RedactLog("a s3cr3t-token and s3cr3t"); log != "a **** and ****" {
+		t.Errorf("got log %q", log)
+	}
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+)
+
+//ResumeActivity runs the completed activity again from its first step not succeeded
+func ResumeActivity(provider model.PipelineProvider, activity *model.Activity) error {
+	stageOrdinal, stepOrdinal, ok := resumePoint(activity)
+	if !ok {
+		return errors.New("no failed step in the activity to resume from")
+	}
+	return RerunActivityFrom(provider, activity, stageOrdinal, stepOrdinal)
+}
+
+//RerunActivityFrom runs the completed activity again from the step, stages and steps
+//before it are kept along with env vars and the commit of the activity
+func RerunActivityFrom(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	if activity == nil {
+		return errors.New("nil activity")
+	}
+	if !IsComplete(activity) {
+		return errors.New("not allow to resume an activity not complete")
+	}
+	if stageOrdinal < 0 || stepOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) ||
+		stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
+		return errors.New("step index invalid")
+	}
+	stage := activity.Pipeline.Stages[stageOrdinal]
+	if stage.Parallel && stepOrdinal > 0 {
+		return fmt.Errorf("steps of parallel stage '%s' run together, rerun from its first step", stage.Name)
+	}
+	for i := 0; i < stageOrdinal; i++ {
+		if !isStageDone(activity.ActivityStages[i]) {
+			return fmt.Errorf("stage '%s' before is not successful", activity.ActivityStages[i].Name)
+		}
+	}
+	for j := 0; j < stepOrdinal; j++ {
+		if !isStepDone(activity.ActivityStages[stageOrdinal].ActivitySteps[j]) {
+			return fmt.Errorf("step %d of stage '%s' before is not successful", j+1, stage.Name)
+		}
+	}
+	resetActivityFrom(activity, stageOrdinal, stepOrdinal)
+	return provider.ResumeActivity(activity, stageOrdinal, stepOrdinal)
+}
+
+func isStageDone(stage *model.ActivityStage) bool {
+	return stage.Status == model.ActivityStageSuccess ||
+		stage.Status == model.ActivityStageSkip ||
+		stage.Status == model.ActivityStageFailedAllowed
+}
+
+func isStepDone(step *model.ActivityStep) bool {
+	return step.Status == model.ActivityStepSuccess ||
+		step.Status == model.ActivityStepSkip ||
+		step.Status == model.ActivityStepFailedAllowed
+}
+
+//resumePoint gets the first step not succeeded, steps of a parallel stage resume together
+func resumePoint(activity *model.Activity) (int, int, bool) {
+	for i, stage := range activity.ActivityStages {
+		if isStageDone(stage) {
+			continue
+		}
+		if activity.Pipeline.Stages[i].Parallel {
+			return i, 0, true
+		}
+		for j, step := range stage.ActivitySteps {
+			if !isStepDone(step) {
+				return i, j, true
+			}
+		}
+		return i, 0, true
+	}
+	return 0, 0, false
+}
+
+//resetActivityFrom resets status and timestamp of the step and those after it
+func resetActivityFrom(activity *model.Activity, stageOrdinal int, stepOrdinal int) {
+	activity.Status = model.ActivityWaiting
+	activity.PendingStage = 0
+	activity.SupersededBy = ""
+	activity.FailMessage = ""
+	activity.StopTS = 0
+	activity.ResumeFrom = nil
+	activity.MainStatus = ""
+	activity.FinallyStatus = ""
+	delete(activity.EnvVars, envActivityStatus)
+	runAgain := func(i int, j int) bool {
+		return i > stageOrdinal || (i == stageOrdinal && j >= stepOrdinal)
+	}
+	dropArtifacts(activity, runAgain)
+	dropTestReports(activity, runAgain)
+	dropOutputs(activity, runAgain)
+	if stageOrdinal == 0 && stepOrdinal == 0 {
+		activity.ChangedFiles = nil
+	}
+	for i := stageOrdinal; i < len(activity.ActivityStages); i++ {
+		stage := activity.ActivityStages[i]
+		stage.Status = model.ActivityStageWaiting
+		if i > stageOrdinal || stepOrdinal == 0 {
+			stage.Duration = 0
+			stage.StartTS = 0
+		}
+		for j, step := range stage.ActivitySteps {
+			if i == stageOrdinal && j < stepOrdinal {
+				continue
+			}
+			step.Duration = 0
+			step.StartTS = 0
+			step.Status = model.ActivityStepWaiting
+			step.Message = ""
+			step.Attempts = nil
+		}
+	}
+}
+
+//ResumeFrom runs the activity from the step. Services started by former steps run again first,
+//and so does the SCM step at the commit of the activity if the workspace needs restoring
+func ResumeFrom(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int, restoreWorkspace bool) error {
+	activity.ResumeFrom = &model.ResumePoint{
+		StageOrdinal: stageOrdinal,
+		StepOrdinal:  stepOrdinal,
+	}
+	if restoreWorkspace && (stageOrdinal > 0 || stepOrdinal > 0) {
+		logrus.Infof("restore workspace of activity '%s' to resume from step %d-%d", activity.Id, stageOrdinal, stepOrdinal)
+		return provider.RunStep(activity, 0, 0)
+	}
+	if i, j, ok := nextRestoreStep(activity, 0, 0); ok {
+		return provider.RunStep(activity, i, j)
+	}
+	activity.ResumeFrom = nil
+	return runFrom(provider, activity, stageOrdinal, stepOrdinal)
+}
+
+//IsRestoreStep checks if the step runs again to restore the activity before resuming
+func IsRestoreStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) bool {
+	point := activity.ResumeFrom
+	return point != nil && (stageOrdinal < point.StageOrdinal ||
+		(stageOrdinal == point.StageOrdinal && stepOrdinal < point.StepOrdinal))
+}
+
+//nextRestoreStep gets the next succeeded service step after the step and before the resume point
+func nextRestoreStep(activity *model.Activity, stageOrdinal int, stepOrdinal int) (int, int, bool) {
+	for i := stageOrdinal; i < len(activity.ActivityStages); i++ {
+		j := 0
+		if i == stageOrdinal {
+			j = stepOrdinal + 1
+		}
+		for ; j < len(activity.ActivityStages[i].ActivitySteps); j++ {
+			if !IsRestoreStep(activity, i, j) {
+				return 0, 0, false
+			}
+			step := activity.Pipeline.Stages[i].Steps[j]
+			if step.IsService && step.Type == model.StepTypeTask &&
+				activity.ActivityStages[i].ActivitySteps[j].Status == model.ActivityStepSuccess {
+				return i, j, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+//RestoreStep completes a step run again to restore the activity, then runs the next step
+//to restore or resumes the activity from the resume point
+func RestoreStep(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) {
+	curTime := time.Now().UnixNano() / int64(time.Millisecond)
+	stage := activity.ActivityStages[stageOrdinal]
+	step := stage.ActivitySteps[stepOrdinal]
+	step.Status = model.ActivityStepSuccess
+	step.Duration = curTime - step.StartTS
+	point := activity.ResumeFrom
+	if stageOrdinal < point.StageOrdinal && IsStageSuccess(stage) {
+		stage.Status = StageResult(stage)
+		stage.Duration = curTime - stage.StartTS
+	}
+	var err error
+	if i, j, ok := nextRestoreStep(activity, stageOrdinal, stepOrdinal); ok {
+		err = provider.RunStep(activity, i, j)
+	} else {
+		activity.ResumeFrom = nil
+		logrus.Infof("resume activity '%s' from step %d-%d", activity.Id, point.StageOrdinal, point.StepOrdinal)
+		err = runFrom(provider, activity, point.StageOrdinal, point.StepOrdinal)
+	}
+	if err != nil {
+		logrus.Errorf("resume activity '%s' got error:%v", activity.Id, err)
+		activity.FailMessage = fmt.Sprintf("resume from step %d of stage '%s' got error:%v",
+			point.StepOrdinal+1, activity.ActivityStages[point.StageOrdinal].Name, err)
+	}
+}
+
+//runFrom runs the step, or the stages ready to run from the first step of a stage.
+//A stage needing approval waits for it
+func runFrom(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	if stepOrdinal > 0 {
+		activity.ActivityStages[stageOrdinal].Status = model.ActivityStageBuilding
+		return runStep(provider, activity, stageOrdinal, stepOrdinal)
+	}
+	return RunReadyStages(provider, activity)
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+)
+
+//ExpiredActivities returns completed activities not retained by the policies.
+//The policy of a pipeline overrides the global one in pipeline setting
+func ExpiredActivities() ([]*model.Activity, error) {
+	setting, err := GetPipelineSetting()
+	if err != nil {
+		return nil, err
+	}
+	activities, err := ListActivities()
+	if err != nil {
+		return nil, err
+	}
+	policies := map[string]*model.RetentionPolicy{}
+	for _, p := range ListPipelines() {
+		if p.Retention != nil {
+			policies[p.Id] = p.Retention
+		}
+	}
+	byPipeline := map[string][]*model.Activity{}
+	for _, a := range activities {
+		byPipeline[a.Pipeline.Id] = append(byPipeline[a.Pipeline.Id], a)
+	}
+	expired := []*model.Activity{}
+	now := time.Now()
+	for pId, list := range byPipeline {
+		policy := setting.Retention
+		if p, ok := policies[pId]; ok {
+			policy = p
+		}
+		expired = append(expired, expiredByPolicy(list, policy, now)...)
+	}
+	return expired, nil
+}
+
+func expiredByPolicy(activities []*model.Activity, policy *model.RetentionPolicy, now time.Time) []*model.Activity {
+	if policy == nil || (policy.KeepLast <= 0 && policy.KeepDays <= 0) {
+		return nil
+	}
+	//latest first
+	sort.SliceStable(activities, func(i, j int) bool {
+		if activities[i].RunSequence != activities[j].RunSequence {
+			return activities[i].RunSequence > activities[j].RunSequence
+		}
+		return activities[i].StartTS > activities[j].StartTS
+	})
+	deadline := now.AddDate(0, 0, -policy.KeepDays).UnixNano() / int64(time.Millisecond)
+	lastSuccessFound := false
+	expired := []*model.Activity{}
+	for i, a := range activities {
+		keep := true
+		if policy.KeepLast > 0 && i >= policy.KeepLast {
+			keep = false
+		}
+		if policy.KeepDays > 0 && a.StartTS < deadline {
+			keep = false
+		}
+		if (a.Status == model.ActivitySuccess || a.Status == model.ActivitySuccessWithWarnings) && !lastSuccessFound {
+			lastSuccessFound = true
+			if policy.KeepLastSuccess {
+				keep = true
+			}
+		}
+		//running activities are never collected
+		if !IsComplete(a) {
+			keep = true
+		}
+		if !keep {
+			logrus.Debugf("activity '%s' of pipeline '%s' is expired", a.Id, a.Pipeline.Name)
+			expired = append(expired, a)
+		}
+	}
+	return expired
+}
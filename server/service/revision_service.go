@@ -0,0 +1,242 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/store"
+)
+
+const PIPELINE_REVISION_TYPE = "pipelineRevision"
+
+func revisionKey(pipelineId string, revision string) string {
+	return pipelineId + ":" + revision
+}
+
+//CreatePipelineRevision saves the current definition of the pipeline as a revision
+func CreatePipelineRevision(p *model.Pipeline, author string, message string) (*model.PipelineRevision, error) {
+	content, err := revisionContent(&p.PipelineContent)
+	if err != nil {
+		return nil, err
+	}
+	r := &model.PipelineRevision{
+		PipelineId: p.Id,
+		Revision:   p.VersionSequence,
+		Author:     author,
+		Created:    time.Now().UnixNano() / int64(time.Millisecond),
+		Message:    message,
+		Pipeline:   *content,
+	}
+	r.Id = revisionKey(p.Id, p.VersionSequence)
+	if _, err := createResource(PIPELINE_REVISION_TYPE, r.Id, p.Name, r); err != nil {
+		return nil, fmt.Errorf("fail to save revision %s of pipeline '%s': %v", r.Revision, p.Name, err)
+	}
+	return r, nil
+}
+
+func GetPipelineRevision(pipelineId string, revision string) (*model.PipelineRevision, error) {
+	r := &model.PipelineRevision{}
+	if _, err := getResource(PIPELINE_REVISION_TYPE, revisionKey(pipelineId, revision), r); err == store.ErrNotFound {
+		return nil, fmt.Errorf("revision '%s' of pipeline '%s' is not found", revision, pipelineId)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error %v getting pipeline revision", err)
+	}
+	return r, nil
+}
+
+//ListPipelineRevisions returns revisions of a pipeline, latest first
+func ListPipelineRevisions(pipelineId string) ([]*model.PipelineRevision, error) {
+	objs, err := listResources(PIPELINE_REVISION_TYPE)
+	if err != nil {
+		logrus.Errorf("fail to list pipeline revisions, err:%v", err)
+		return nil, err
+	}
+	revisions := []*model.PipelineRevision{}
+	for _, obj := range objs {
+		r := &model.PipelineRevision{}
+		if err := json.Unmarshal(obj.Data, r); err != nil {
+			logrus.Errorf("unmarshal revision got err:%v", err)
+			continue
+		}
+		if r.PipelineId == pipelineId {
+			revisions = append(revisions, r)
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		a, _ := strconv.Atoi(revisions[i].Revision)
+		b, _ := strconv.Atoi(revisions[j].Revision)
+		return a > b
+	})
+	return revisions, nil
+}
+
+func DeletePipelineRevisions(pipelineId string) error {
+	revisions, err := ListPipelineRevisions(pipelineId)
+	if err != nil {
+		return err
+	}
+	for _, r := range revisions {
+		if err := dataStore.Delete(PIPELINE_REVISION_TYPE, r.Id); err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+//DiffPipelineRevisions compares definitions of two revisions of a pipeline
+func DiffPipelineRevisions(pipelineId string, from string, to string) (*model.PipelineDiff, error) {
+	fromRevision, err := GetPipelineRevision(pipelineId, from)
+	if err != nil {
+		return nil, err
+	}
+	toRevision, err := GetPipelineRevision(pipelineId, to)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := diffContent(&fromRevision.Pipeline, &toRevision.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return &model.PipelineDiff{
+		PipelineId: pipelineId,
+		From:       from,
+		To:         to,
+		Changes:    changes,
+	}, nil
+}
+
+//revisionContent copies the definition part of pipeline content, dropping run states
+func revisionContent(content *model.PipelineContent) (*model.PipelineContent, error) {
+	b, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	c := &model.PipelineContent{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	c.VersionSequence = ""
+	c.IsActivate = false
+	c.Status = ""
+	c.RunCount = 0
+	c.LastRunId = ""
+	c.LastRunStatus = ""
+	c.LastRunTime = 0
+	c.NextRunTime = 0
+	c.CommitInfo = ""
+	c.WebHookId = 0
+	c.WebHookToken = ""
+	c.Templates = nil
+	return c, nil
+}
+
+//definitionChanged tells whether the pipeline definition differs, ignoring run states
+func definitionChanged(prev *model.PipelineContent, cur *model.PipelineContent) bool {
+	changes, err := diffContent(prev, cur)
+	return err != nil || len(changes) > 0
+}
+
+func diffContent(from *model.PipelineContent, to *model.PipelineContent) ([]model.DiffChange, error) {
+	fromFields, err := flattenContent(from)
+	if err != nil {
+		return nil, err
+	}
+	toFields, err := flattenContent(to)
+	if err != nil {
+		return nil, err
+	}
+	changes := []model.DiffChange{}
+	for path, v := range fromFields {
+		if nv, ok := toFields[path]; !ok {
+			changes = append(changes, model.DiffChange{Path: path, Op: model.DiffRemoved, From: v})
+		} else if !reflect.DeepEqual(v, nv) {
+			changes = append(changes, model.DiffChange{Path: path, Op: model.DiffChanged, From: v, To: nv})
+		}
+	}
+	for path, v := range toFields {
+		if _, ok := fromFields[path]; !ok {
+			changes = append(changes, model.DiffChange{Path: path, Op: model.DiffAdded, To: v})
+		}
+	}
+	//env keys of deploy steps are not shown, only that they changed
+	for i := range changes {
+		if strings.HasSuffix(changes[i].Path, ".secretkey") {
+			if changes[i].From != nil {
+				changes[i].From = RedactMask
+			}
+			if changes[i].To != nil {
+				changes[i].To = RedactMask
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+//flattenContent maps each leaf field of the definition to its value by path
+func flattenContent(content *model.PipelineContent) (map[string]interface{}, error) {
+	c, err := revisionContent(content)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	flatten("", v, fields)
+	return fields, nil
+}
+
+func flatten(prefix string, v interface{}, fields map[string]interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range t {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			flatten(path, sub, fields)
+		}
+	case []interface{}:
+		for i, sub := range t {
+			flatten(fmt.Sprintf("%s[%d]", prefix, i), sub, fields)
+		}
+	default:
+		fields[prefix] = v
+	}
+}
+
+//RestoreRevision replaces the definition of the pipeline with the revision, keeping run states
+func RestoreRevision(p *model.Pipeline, r *model.PipelineRevision) error {
+	content, err := revisionContent(&r.Pipeline)
+	if err != nil {
+		return err
+	}
+	content.VersionSequence = p.VersionSequence
+	content.IsActivate = p.IsActivate
+	content.Status = p.Status
+	content.RunCount = p.RunCount
+	content.LastRunId = p.LastRunId
+	content.LastRunStatus = p.LastRunStatus
+	content.LastRunTime = p.LastRunTime
+	content.NextRunTime = p.NextRunTime
+	content.CommitInfo = p.CommitInfo
+	content.WebHookId = p.WebHookId
+	content.WebHookToken = p.WebHookToken
+	p.PipelineContent = *content
+	return nil
+}
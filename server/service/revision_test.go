@@ -0,0 +1,152 @@
+package service_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+//revisionPipeline creates a pipeline of a task step with env and a deploy step with an env key
+func revisionPipeline(t *testing.T) *model.Pipeline {
+	deploy := &model.Step{Name: "upgrade", Type: model.StepTypeUpgradeService, Accesskey: "ak", Secretkey: "sk-old"}
+	p := createPipeline(t, []*model.Stage{stage("build", task("make", "A=1", "B=2")), stage("deploy", deploy)}, nil)
+	p, err := service.GetPipelineById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDiffPipelineRevisions(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *model.Pipeline)
+		//want is nil if no revision is recorded
+		want []model.DiffChange
+	}{
+		{
+			name:   "array items changed and added",
+			modify: func(p *model.Pipeline) { p.Stages[1].Steps[0].Env = []string{"A=1", "B=3", "C=4"} },
+			want: []model.DiffChange{
+				{Path: "stages[1].steps[0].env[1]", Op: model.DiffChanged, From: "B=2", To: "B=3"},
+				{Path: "stages[1].steps[0].env[2]", Op: model.DiffAdded, To: "C=4"},
+			},
+		},
+		{
+			name:   "array item removed",
+			modify: func(p *model.Pipeline) { p.Stages[1].Steps[0].Env = []string{"A=1"} },
+			want: []model.DiffChange{
+				{Path: "stages[1].steps[0].env[1]", Op: model.DiffRemoved, From: "B=2"},
+			},
+		},
+		{
+			name: "secret key masked",
+			modify: func(p *model.Pipeline) {
+				p.Stages[2].Steps[0].Secretkey = "sk-new"
+				p.Stages[2].Name = "release"
+			},
+			want: []model.DiffChange{
+				{Path: "stages[2].name", Op: model.DiffChanged, From: "deploy", To: "release"},
+				{Path: "stages[2].steps[0].secretkey", Op: model.DiffChanged, From: service.RedactMask, To: service.RedactMask},
+			},
+		},
+		{
+			name: "run states only",
+			modify: func(p *model.Pipeline) {
+				p.RunCount = 3
+				p.LastRunId = "a1"
+				p.LastRunStatus = model.ActivitySuccess
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := revisionPipeline(t)
+			tt.modify(p)
+			if err := service.UpdatePipelineDefinition(p, "tester", tt.name); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if p.VersionSequence != "1" {
+					t.Errorf("got version sequence %s, expect no new revision", p.VersionSequence)
+				}
+				return
+			}
+			if p.VersionSequence != "2" {
+				t.Fatalf("got version sequence %s, expect 2", p.VersionSequence)
+			}
+			diff, err := service.DiffPipelineRevisions(p.Id, "1", "2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(diff.Changes, tt.want) {
+				t.Errorf("got changes %+v, expect %+v", diff.Changes, tt.want)
+			}
+			b, err := json.Marshal(diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(b), "sk-") {
+				t.Errorf("diff shows the env key: %s", b)
+			}
+		})
+	}
+}
+
+func TestUpdatePipelineDefinitionRevisionFailure(t *testing.T) {
+	p := revisionPipeline(t)
+	//a revision of the next version sequence is saved already
+	next := *p
+	next.VersionSequence = "2"
+	if _, err := service.CreatePipelineRevision(&next, "tester", ""); err != nil {
+		t.Fatal(err)
+	}
+	p.Stages[1].Steps[0].Env = []string{"A=2"}
+	if err := service.UpdatePipelineDefinition(p, "tester", ""); err == nil {
+		t.Fatal("pipeline is updated without its revision")
+	}
+	saved, err := service.GetPipelineById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.VersionSequence != "1" || saved.Stages[1].Steps[0].Env[0] != "A=1" {
+		t.Errorf("got version sequence %s and env %v, expect the pipeline not updated", saved.VersionSequence, saved.Stages[1].Steps[0].Env)
+	}
+}
+
+func TestRestoreRevision(t *testing.T) {
+	p := revisionPipeline(t)
+	r, err := service.GetPipelineRevision(p.Id, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Stages = []*model.Stage{stage("other", task("run"))}
+	p.VersionSequence = "5"
+	p.IsActivate = true
+	p.RunCount = 7
+	p.LastRunId = "a7"
+	p.LastRunStatus = model.ActivityFail
+	p.LastRunTime = 1000
+	p.NextRunTime = 2000
+	p.CommitInfo = "0a1b2c"
+	p.WebHookId = 3
+	p.WebHookToken = "hook-token"
+	state := p.PipelineContent
+
+	if err := service.RestoreRevision(p, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Stages) != 3 || p.Stages[1].Name != "build" || p.Stages[2].Steps[0].Secretkey != "sk-old" {
+		t.Errorf("definition of the revision is not restored: %+v", p.Stages)
+	}
+	if p.VersionSequence != state.VersionSequence || p.IsActivate != state.IsActivate || p.RunCount != state.RunCount ||
+		p.LastRunId != state.LastRunId || p.LastRunStatus != state.LastRunStatus || p.LastRunTime != state.LastRunTime ||
+		p.NextRunTime != state.NextRunTime || p.CommitInfo != state.CommitInfo || p.WebHookId != state.WebHookId ||
+		p.WebHookToken != state.WebHookToken {
+		t.Errorf("run states are not kept: %+v", p.PipelineContent)
+	}
+}
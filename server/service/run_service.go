@@ -0,0 +1,354 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/util"
+	"github.com/sluu99/uuid"
+)
+
+//maxAttemptLog is the size of the log tail kept for a failed attempt
+const maxAttemptLog = 64 * 1024
+
+//NewActivity init an activity from pipeline def to run on the node
+func NewActivity(p *model.Pipeline, nodeName string) *model.Activity {
+	activity := &model.Activity{
+		Id:              uuid.Rand().Hex(),
+		Pipeline:        *p,
+		PipelineVersion: p.VersionSequence,
+		RunSequence:     p.RunCount + 1,
+		Status:          model.ActivityWaiting,
+		StartTS:         time.Now().UnixNano() / int64(time.Millisecond),
+		NodeName:        nodeName,
+	}
+	stages := []*model.Stage{}
+	for _, stage := range p.Stages {
+		stage = ExpandMatrix(stage)
+		stages = append(stages, stage)
+		activity.ActivityStages = append(activity.ActivityStages, ToActivityStage(stage))
+	}
+	//finally stages run as the last stages of the activity
+	for _, stage := range p.Finally {
+		stage = ExpandMatrix(stage)
+		stages = append(stages, stage)
+		actiStage := ToActivityStage(stage)
+		actiStage.Finally = true
+		actiStage.NeedApproval = false
+		activity.ActivityStages = append(activity.ActivityStages, actiStage)
+	}
+	activity.Pipeline.Stages = stages
+	activity.Pipeline.Finally = nil
+	return activity
+}
+
+//NodeLabels gets labels required on the node to run the pipeline,
+//steps of all stages run in the workspace on the same node
+func NodeLabels(p *model.Pipeline) []string {
+	seen := map[string]bool{}
+	labels := []string{}
+	add := func(l []string) {
+		for _, label := range l {
+			label = strings.TrimSpace(label)
+			if label == "" || seen[label] {
+				continue
+			}
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	add(p.NodeLabels)
+	for _, stage := range p.Stages {
+		add(stage.NodeLabels)
+	}
+	for _, stage := range p.Finally {
+		add(stage.NodeLabels)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func ToActivityStage(stage *model.Stage) *model.ActivityStage {
+	actiStage := model.ActivityStage{
+		Name:          stage.Name,
+		NeedApproval:  stage.NeedApprove,
+		Needs:         stage.Needs,
+		Status:        "Waiting",
+		ActivitySteps: []*model.ActivityStep{},
+	}
+	for _, step := range stage.Steps {
+		actiStep := &model.ActivityStep{
+			Name:         step.Name,
+			Status:       model.ActivityStepWaiting,
+			MatrixStep:   step.MatrixStep,
+			MatrixValues: step.MatrixValues,
+		}
+		actiStage.ActivitySteps = append(actiStage.ActivitySteps, actiStep)
+	}
+	return &actiStage
+
+}
+
+func InitActivityEnvvars(activity *model.Activity) {
+	p := activity.Pipeline
+	vars := map[string]string{}
+	vars["CICD_PIPELINE_NAME"] = p.Name
+	vars["CICD_PIPELINE_ID"] = p.Id
+	vars["CICD_NODE_NAME"] = activity.NodeName
+	vars["CICD_ACTIVITY_ID"] = activity.Id
+	vars["CICD_ACTIVITY_SEQUENCE"] = strconv.Itoa(activity.RunSequence)
+	vars["CICD_GIT_URL"] = p.Stages[0].Steps[0].Repository
+	vars["CICD_GIT_BRANCH"] = p.Stages[0].Steps[0].Branch
+	vars["CICD_GIT_COMMIT"] = activity.CommitInfo
+	vars["CICD_TRIGGER_TYPE"] = activity.TriggerType
+	//user defined env vars
+	for _, envvar := range activity.Pipeline.Parameters {
+		splits := strings.SplitN(envvar, "=", 2)
+		if len(splits) != 2 {
+			continue
+		}
+		vars[splits[0]] = splits[1]
+	}
+	activity.EnvVars = vars
+}
+
+//RunStage evaluates conditions of the stage, then triggers its steps by the provider
+func RunStage(provider model.PipelineProvider, activity *model.Activity, ordinal int) error {
+	if len(activity.ActivityStages) <= ordinal {
+		return fmt.Errorf("error run stage,stage index out of range")
+	}
+	stage := activity.Pipeline.Stages[ordinal]
+	logrus.Infof("run stage:%s", stage.Name)
+	if IsFinallyStage(activity, ordinal) && activity.MainStatus == "" {
+		//main stages run through
+		endMainStages(activity, ActivityResult(activity))
+	}
+	logrus.Debugf("paras:%v,%v,%v,%v", activity.Pipeline, activity, len(activity.Pipeline.Stages), ordinal)
+	condFlag := true
+	curTime := time.Now().UnixNano() / int64(time.Millisecond)
+	var err error
+	if HasStageCondition(stage) {
+		condFlag, err = EvaluateConditions(activity, stage.Conditions)
+		if err != nil {
+			logrus.Errorf("Evaluate condition '%v' got error:%v", stage.Conditions, err)
+			return err
+		}
+	}
+	if !condFlag {
+		activity.ActivityStages[ordinal].Status = model.ActivityStageSkip
+		if isActivityDone(activity) {
+			//skip last stage and success activity
+			finishActivity(activity, curTime)
+			provider.OnActivityCompelte(activity)
+		} else {
+			//skip the stage then run stages ready.
+			err = RunReadyStages(provider, activity)
+		}
+		return err
+	}
+
+	//mark it started so it is not triggered again by other stages
+	activity.ActivityStages[ordinal].Status = model.ActivityStageBuilding
+	activity.ActivityStages[ordinal].StartTS = curTime
+	//Trigger all step jobs in the stage.
+	if stage.Parallel {
+		for i := 0; i < len(stage.Steps); i++ {
+			if err := runStep(provider, activity, ordinal, i); err != nil {
+				logrus.Errorf("run step error:%v", err)
+				return err
+			}
+		}
+	} else {
+		//Trigger first to run sequentially
+		if err := runStep(provider, activity, ordinal, 0); err != nil {
+			logrus.Errorf("run step error:%v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//SkipStep evaluates conditions of the step, an unmet step is skipped and the
+//activity moves on. Returns true if the step is skipped.
+func SkipStep(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) (bool, error) {
+	if len(activity.ActivityStages) <= stageOrdinal ||
+		len(activity.ActivityStages[stageOrdinal].ActivitySteps) <= stepOrdinal ||
+		stageOrdinal < 0 || stepOrdinal < 0 {
+		return false, fmt.Errorf("error run stage,stage index out of range")
+	}
+	stage := activity.Pipeline.Stages[stageOrdinal]
+	step := stage.Steps[stepOrdinal]
+	if !HasStepCondition(step) {
+		return false, nil
+	}
+	condFlag, err := EvaluateConditions(activity, step.Conditions)
+	if err != nil {
+		logrus.Errorf("Evaluate condition '%v' got error:%v", step.Conditions, err)
+		return false, err
+	}
+	if condFlag {
+		return false, nil
+	}
+	activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Status = model.ActivityStepSkip
+	actiStage := activity.ActivityStages[stageOrdinal]
+	curTime := time.Now().UnixNano() / int64(time.Millisecond)
+	if IsStageSuccess(actiStage) {
+		//if skipped and stage success
+		actiStage.Status = StageResult(actiStage)
+		actiStage.Duration = curTime - actiStage.StartTS
+		if isActivityDone(activity) {
+			//last stage success and success activity
+			finishActivity(activity, curTime)
+			provider.OnActivityCompelte(activity)
+		} else {
+			//success the stage then run stages ready.
+			err = RunReadyStages(provider, activity)
+		}
+	} else {
+		//sequential, skipped current step then run next step
+		err = runAfterStep(provider, activity, stageOrdinal, stepOrdinal)
+	}
+	return true, err
+}
+
+//RetryStep records the failed attempt of the step and resets the step to run again
+//if its retry policy allows. Returns the delay before the next attempt
+func RetryStep(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) (time.Duration, bool) {
+	step := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal]
+	actiStep := activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+	if step.Retry == nil || len(actiStep.Attempts) >= step.Retry.Count ||
+		(activity.Status != model.ActivityBuilding && activity.Status != model.ActivityWaiting) {
+		return 0, false
+	}
+	prevLog := ""
+	log, err := provider.GetStepLog(activity, stageOrdinal, stepOrdinal, map[string]interface{}{"prevLog": &prevLog})
+	if err != nil {
+		logrus.Errorf("fail to get log of step %d-%d of activity '%s': %v", stageOrdinal, stepOrdinal, activity.Id, err)
+	}
+	//the archived log is served as is
+	log = NewActivityLogRedactor(activity).RedactLog(log)
+	if len(log) > maxAttemptLog {
+		log = log[len(log)-maxAttemptLog:]
+		log = log[strings.Index(log, "\n")+1:]
+	}
+	curTime := time.Now().UnixNano() / int64(time.Millisecond)
+	attempt := &model.StepAttempt{
+		Attempt:  len(actiStep.Attempts) + 1,
+		Status:   model.ActivityStepFail,
+		StartTS:  actiStep.StartTS,
+		Duration: curTime - actiStep.StartTS,
+		Log:      log,
+	}
+	actiStep.Attempts = append(actiStep.Attempts, attempt)
+	delay := retryDelay(step.Retry, attempt.Attempt)
+	actiStep.Status = model.ActivityStepWaiting
+	actiStep.StartTS = 0
+	actiStep.Duration = 0
+	actiStep.Message = fmt.Sprintf("attempt %d failed, retry in %v", attempt.Attempt, delay)
+	logrus.Infof("step %d-%d of activity '%s' failed, retry in %v", stageOrdinal, stepOrdinal, activity.Id, delay)
+	return delay, true
+}
+
+//retryDelay gets the delay before the retry after the failed attempt
+func retryDelay(retry *model.StepRetry, attempt int) time.Duration {
+	backoff := retry.Backoff
+	if backoff == 0 {
+		backoff = 1
+	}
+	return time.Duration(float64(retry.Delay)*math.Pow(backoff, float64(attempt-1))) * time.Second
+}
+
+//RunRetry runs the step again, unless the activity is stopped during the delay
+func RunRetry(provider model.PipelineProvider, activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	if activity.Status != model.ActivityBuilding && activity.Status != model.ActivityWaiting {
+		return nil
+	}
+	if activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Status != model.ActivityStepWaiting {
+		return nil
+	}
+	activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Message = ""
+	return provider.RunStep(activity, stageOrdinal, stepOrdinal)
+}
+
+//EvaluateConditions checks the condition expression, then all or any of the conditions
+func EvaluateConditions(activity *model.Activity, condition *model.PipelineConditions) (bool, error) {
+	if !hasCondition(condition) {
+		return false, fmt.Errorf("Nil condition")
+	}
+	if strings.TrimSpace(condition.Expression) != "" {
+		ok, err := EvaluateExpression(activity, condition.Expression)
+		if err != nil || !ok {
+			return false, err
+		}
+		if len(condition.All) == 0 && len(condition.Any) == 0 {
+			return true, nil
+		}
+	}
+	if len(condition.All) > 0 {
+		for _, c := range condition.All {
+			resCond, err := EvaluateCondition(activity, c)
+			if err != nil {
+				return false, err
+			}
+			if !resCond {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	for _, c := range condition.Any {
+		resCond, err := EvaluateCondition(activity, c)
+		if err != nil {
+			return false, err
+		}
+		if resCond {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//valid format:     xxx=xxx; xxx!=xxx
+func EvaluateCondition(activity *model.Activity, condition string) (bool, error) {
+	m := util.GetParams(`(?P<Key>.*?)!=(?P<Value>.*)`, condition)
+	if m["Key"] != "" && m["Value"] != "" {
+		key := SubstituteVar(activity, m["Key"])
+		val := SubstituteVar(activity, m["Value"])
+		envVal := activity.EnvVars[key]
+		if envVal != val {
+			return true, nil
+		}
+		return false, nil
+	}
+
+	m = util.GetParams(`(?P<Key>.*?)=(?P<Value>.*)`, condition)
+	if m["Key"] != "" && m["Value"] != "" {
+		key := SubstituteVar(activity, m["Key"])
+		val := SubstituteVar(activity, m["Value"])
+		envVal := activity.EnvVars[key]
+		if envVal == val {
+			return true, nil
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("cannot parse condition:%s", condition)
+}
+
+//merely substitute envvars without escaping shell
+func SubstituteVar(activity *model.Activity, text string) string {
+	for k, v := range activity.EnvVars {
+		text = strings.Replace(text, "$"+k+" ", v, -1)
+		text = strings.Replace(text, "$"+k+"\n", v, -1)
+		text = strings.Replace(text, "${"+k+"}", v, -1)
+
+	}
+	return text
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/encryption"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/store"
+)
+
+const SECRET_TYPE = "secret"
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+var regSecretName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+var regSecretRef = regexp.MustCompile(`\$\{secret:([^}]*)\}`)
+
+//SecretId gets the id of the secret, secrets of a pipeline are prefixed by its id
+func SecretId(pipelineId string, name string) string {
+	if pipelineId == "" {
+		return name
+	}
+	return pipelineId + ":" + name
+}
+
+func checkSecretName(name string) error {
+	if len(name) > 128 || !regSecretName.MatchString(name) {
+		return fmt.Errorf("invalid secret name '%s', must contain [a-zA-Z0-9_.-] characters only and start with a letter or digit", name)
+	}
+	return nil
+}
+
+//HasSecretRef checks if the text references secrets
+func HasSecretRef(text string) bool {
+	return strings.Contains(text, "${secret:")
+}
+
+func GetSecret(id string) (*model.Secret, error) {
+	secret := &model.Secret{}
+	version, err := getResource(SECRET_TYPE, id, secret)
+	if err == store.ErrNotFound {
+		return nil, ErrSecretNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	secret.ResourceVersion = version
+	return secret, nil
+}
+
+//ListSecrets lists secrets of the pipeline, or of the environment if the id is empty
+func ListSecrets(pipelineId string) ([]*model.Secret, error) {
+	objs, err := listResources(SECRET_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	secrets := []*model.Secret{}
+	for _, obj := range objs {
+		secret := &model.Secret{}
+		if err := json.Unmarshal(obj.Data, secret); err != nil {
+			logrus.Errorf("fail to parse secret '%s': %v", obj.Key, err)
+			continue
+		}
+		if secret.PipelineId != pipelineId {
+			continue
+		}
+		secret.ResourceVersion = obj.Version
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+	return secrets, nil
+}
+
+//CreateSecret saves a new secret with its value encrypted
+func CreateSecret(secret *model.Secret) error {
+	if err := checkSecretName(secret.Name); err != nil {
+		return err
+	}
+	if secret.Value == "" {
+		return errors.New("secret value should not be empty")
+	}
+	if secret.PipelineId != "" {
+		if _, err := GetPipelineById(secret.PipelineId); err != nil {
+			return err
+		}
+	}
+	secret.Id = SecretId(secret.PipelineId, secret.Name)
+	if _, err := GetSecret(secret.Id); err == nil {
+		return fmt.Errorf("secret '%s' already exists", secret.Name)
+	} else if err != ErrSecretNotFound {
+		return err
+	}
+	value, err := encryption.Encrypt(secret.Value)
+	if err != nil {
+		return errors.Wrapf(err, "fail to encrypt secret '%s'", secret.Name)
+	}
+	secret.Value = value
+	secret.Created = time.Now().UnixNano() / int64(time.Millisecond)
+	secret.Updated = secret.Created
+	version, err := createResource(SECRET_TYPE, secret.Id, secret.Name, secret)
+	if err != nil {
+		return err
+	}
+	secret.ResourceVersion = version
+	return nil
+}
+
+//UpdateSecret sets the value of the secret
+func UpdateSecret(id string, value string) (*model.Secret, error) {
+	if value == "" {
+		return nil, errors.New("secret value should not be empty")
+	}
+	secret, err := GetSecret(id)
+	if err != nil {
+		return nil, err
+	}
+	if secret.Value, err = encryption.Encrypt(value); err != nil {
+		return nil, errors.Wrapf(err, "fail to encrypt secret '%s'", secret.Name)
+	}
+	secret.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+	version, err := updateResource(SECRET_TYPE, secret.Id, secret.Name, secret.ResourceVersion, secret)
+	if err != nil {
+		return nil, err
+	}
+	secret.ResourceVersion = version
+	return secret, nil
+}
+
+func DeleteSecret(id string) (*model.Secret, error) {
+	secret := &model.Secret{}
+	if err := deleteResource(SECRET_TYPE, id, secret); err == store.ErrNotFound {
+		return nil, ErrSecretNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+//deletePipelineSecrets removes secrets of the removed pipeline
+func deletePipelineSecrets(pipelineId string) error {
+	secrets, err := ListSecrets(pipelineId)
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		if err := dataStore.Delete(SECRET_TYPE, secret.Id); err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+//secretValue gets the plain value of the secret of the pipeline, or of the environment if the pipeline has none
+func secretValue(pipelineId string, name string) (string, error) {
+	secret, err := GetSecret(SecretId(pipelineId, name))
+	if err == ErrSecretNotFound && pipelineId != "" {
+		secret, err = GetSecret(SecretId("", name))
+	}
+	if err == ErrSecretNotFound {
+		return "", fmt.Errorf("secret '%s' not found", name)
+	} else if err != nil {
+		return "", err
+	}
+	return encryption.Decrypt(secret.Value)
+}
+
+//ResolveStepEnv replaces vars of the activity and secret references in the env of a step.
+//Values of vars are not searched for secret references
+func ResolveStepEnv(activity *model.Activity, env string) (string, error) {
+	resolved := ""
+	last := 0
+	for _, m := range regSecretRef.FindAllStringSubmatchIndex(env, -1) {
+		value, err := secretValue(activity.Pipeline.Id, env[m[2]:m[3]])
+		if err != nil {
+			return "", err
+		}
+		resolved += SubstituteVar(activity, env[last:m[0]]) + value
+		last = m[1]
+	}
+	return resolved + SubstituteVar(activity, env[last:]), nil
+}
+
+//StepSecretEnv gets the value of the env var of the step referencing secrets, with vars of
+//the activity and secrets replaced. Only a running step gets it
+func StepSecretEnv(activity *model.Activity, stageOrdinal int, stepOrdinal int, name string) (string, error) {
+	if stageOrdinal < 0 || stepOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) ||
+		stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
+		return "", errors.New("step index invalid")
+	}
+	if activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Status != model.ActivityStepBuilding {
+		return "", ErrSecretNotFound
+	}
+	for _, env := range activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal].Env {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 2 && kv[0] == name && HasSecretRef(kv[1]) {
+			return ResolveStepEnv(activity, kv[1])
+		}
+	}
+	return "", ErrSecretNotFound
+}
+
+//checkSecretRefs checks names of secrets the text references
+func checkSecretRefs(text string) error {
+	for _, m := range regSecretRef.FindAllStringSubmatch(text, -1) {
+		if err := checkSecretName(m[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,34 +6,22 @@ import (
 	"fmt"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/pipeline/encryption"
 	"github.com/rancher/pipeline/model"
-	"github.com/rancher/pipeline/util"
+	"github.com/rancher/pipeline/store"
 	"github.com/sluu99/uuid"
 )
 
 func GetPipelineSetting() (*model.PipelineSetting, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return &model.PipelineSetting{}, err
-	}
-	filters := make(map[string]interface{})
-	filters["kind"] = "pipelineSetting"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		return &model.PipelineSetting{}, fmt.Errorf("Error %v filtering genericObjects by key", err)
-	}
-	if len(goCollection.Data) == 0 {
+	setting := &model.PipelineSetting{}
+	version, err := getResource(PIPELINE_SETTING_TYPE, PIPELINE_SETTING_TYPE, setting)
+	if err == store.ErrNotFound {
 		//init new settings
 		return &model.PipelineSetting{}, nil
+	} else if err != nil {
+		return &model.PipelineSetting{}, fmt.Errorf("Error %v getting pipeline setting", err)
 	}
-	data := goCollection.Data[0]
-	setting := &model.PipelineSetting{}
-	if err = json.Unmarshal([]byte(data.ResourceData["data"].(string)), &setting); err != nil {
-		return &model.PipelineSetting{}, err
-	}
+	setting.ResourceVersion = version
 
 	return setting, nil
 }
@@ -45,67 +33,35 @@ func CreateOrUpdatePipelineSetting(setting *model.PipelineSetting) error {
 	if setting.Id == "" {
 		setting.Id = uuid.Rand().Hex()
 	}
-	b, err := json.Marshal(setting)
-	if err != nil {
-		return err
-	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-
-	filters := make(map[string]interface{})
-	filters["kind"] = "pipelineSetting"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error %v filtering genericObjects by key", err)
-		return err
-	}
-	if len(goCollection.Data) == 0 {
+	version, err := updateResource(PIPELINE_SETTING_TYPE, PIPELINE_SETTING_TYPE, PIPELINE_SETTING_TYPE, setting.ResourceVersion, setting)
+	if err == store.ErrNotFound {
 		//not exist,create a setting object
-		_, err := apiClient.GenericObject.Create(&client.GenericObject{
-			Name:         "pipelineSetting",
-			Key:          "pipelineSetting",
-			ResourceData: resourceData,
-			Kind:         "pipelineSetting",
-		})
-
+		version, err = createResource(PIPELINE_SETTING_TYPE, PIPELINE_SETTING_TYPE, PIPELINE_SETTING_TYPE, setting)
 		if err != nil {
 			return fmt.Errorf("Save pipeline setting got error: %v", err)
 		}
-		return nil
+	} else if err != nil {
+		return err
 	}
-	existing := goCollection.Data[0]
-
-	_, err = apiClient.GenericObject.Update(&existing, &client.GenericObject{
-		Name:         "pipelineSetting",
-		Key:          "pipelineSetting",
-		ResourceData: resourceData,
-		Kind:         "pipelineSetting",
-	})
-	return err
+	setting.ResourceVersion = version
+	return nil
 }
 
 func ListSCMSetting() []*model.SCMSetting {
-	geObjList, err := PaginateGenericObjects("scmSetting")
+	objs, err := listResources(SCM_SETTING_TYPE)
 	if err != nil {
 		logrus.Errorf("fail to list setting,err:%v", err)
 		return nil
 	}
 
 	var settings []*model.SCMSetting
-	for _, gobj := range geObjList {
-		b := []byte(gobj.ResourceData["data"].(string))
+	for _, obj := range objs {
 		a := &model.SCMSetting{}
-		if err := json.Unmarshal(b, a); err != nil {
+		if err := json.Unmarshal(obj.Data, a); err != nil {
 			logrus.Errorf("unmarshal setting got err:%v", err)
 			continue
 		}
+		a.ResourceVersion = obj.Version
 		settings = append(settings, a)
 	}
 	return settings
@@ -113,28 +69,14 @@ func ListSCMSetting() []*model.SCMSetting {
 }
 
 func GetSCMSetting(scmType string) (*model.SCMSetting, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return nil, err
-	}
-	filters := make(map[string]interface{})
-	filters["kind"] = "scmSetting"
-	filters["key"] = scmType
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("Error %v querying setting", err)
-	}
-	if len(goCollection.Data) == 0 {
-		//init new settings
-		return nil, fmt.Errorf("Error scm setting for '%s' not found", scmType)
-	}
-	data := goCollection.Data[0]
 	setting := &model.SCMSetting{}
-	if err = json.Unmarshal([]byte(data.ResourceData["data"].(string)), &setting); err != nil {
-		return nil, err
+	version, err := getResource(SCM_SETTING_TYPE, scmType, setting)
+	if err == store.ErrNotFound {
+		return nil, fmt.Errorf("Error scm setting for '%s' not found", scmType)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error %v querying setting", err)
 	}
+	setting.ResourceVersion = version
 
 	return setting, nil
 }
@@ -146,78 +88,37 @@ func CreateOrUpdateSCMSetting(setting *model.SCMSetting) error {
 	if setting.Id == "" {
 		setting.Id = uuid.Rand().Hex()
 	}
-	b, err := json.Marshal(setting)
+	secret, err := encryption.Encrypt(setting.ClientSecret)
 	if err != nil {
-		return err
+		return fmt.Errorf("fail to encrypt client secret of '%s': %v", setting.ScmType, err)
 	}
-	resourceData := map[string]interface{}{
-		"data": string(b),
-	}
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return err
-	}
-
-	filters := make(map[string]interface{})
-	filters["kind"] = "scmSetting"
-	filters["key"] = setting.ScmType
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error %v querying setting", err)
-		return err
-	}
-	if len(goCollection.Data) == 0 {
+	setting.ClientSecret = secret
+	name := setting.ScmType + "-setting"
+	version, err := updateResource(SCM_SETTING_TYPE, setting.ScmType, name, setting.ResourceVersion, setting)
+	if err == store.ErrNotFound {
 		//not exist,create a setting object
-		_, err := apiClient.GenericObject.Create(&client.GenericObject{
-			Name:         setting.ScmType + "-setting",
-			Key:          setting.ScmType,
-			ResourceData: resourceData,
-			Kind:         "scmSetting",
-		})
-
+		version, err = createResource(SCM_SETTING_TYPE, setting.ScmType, name, setting)
 		if err != nil {
 			return fmt.Errorf("Save pipeline setting got error: %v", err)
 		}
-		return nil
+	} else if err != nil {
+		return err
 	}
-	existing := goCollection.Data[0]
+	setting.ResourceVersion = version
+	return nil
+}
 
-	_, err = apiClient.GenericObject.Update(&existing, &client.GenericObject{
-		Name:         setting.ScmType + "-setting",
-		Key:          setting.ScmType,
-		ResourceData: resourceData,
-		Kind:         "scmSetting",
-	})
-	return err
+//GetSCMClientSecret decrypts the oauth client secret of the scm setting
+func GetSCMClientSecret(setting *model.SCMSetting) (string, error) {
+	return encryption.Decrypt(setting.ClientSecret)
 }
 
 func RemoveSCMSetting(id string) (*model.SCMSetting, error) {
-	apiClient, err := util.GetRancherClient()
-	if err != nil {
-		return nil, err
-	}
-
-	filters := make(map[string]interface{})
-	filters["key"] = id
-	filters["kind"] = "scmSetting"
-	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
-		Filters: filters,
-	})
-	if err != nil {
-		logrus.Errorf("Error querying scmSetting:%v", err)
-		return nil, err
-	}
-	if len(goCollection.Data) == 0 {
-		return nil, fmt.Errorf("scmSetting '%s' not found", id)
-	}
-	existing := goCollection.Data[0]
 	setting := &model.SCMSetting{}
-	if err = json.Unmarshal([]byte(existing.ResourceData["data"].(string)), setting); err != nil {
-		return setting, err
-	}
-	if err = apiClient.GenericObject.Delete(&existing); err != nil {
+	if err := deleteResource(SCM_SETTING_TYPE, id, setting); err == store.ErrNotFound {
+		return nil, fmt.Errorf("scmSetting '%s' not found", id)
+	} else if err != nil {
+		logrus.Errorf("Error removing scmSetting:%v", err)
 		return nil, err
 	}
 
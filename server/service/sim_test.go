@@ -0,0 +1,324 @@
+package service_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/provider/sim"
+	"github.com/rancher/pipeline/server"
+	"github.com/rancher/pipeline/server/service"
+	"github.com/rancher/pipeline/store"
+)
+
+//tests drive the sim provider through the api and callbacks of the server with a local store
+var (
+	prov    *sim.SimProvider
+	apiURL  string
+	counter int32
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetLevel(logrus.WarnLevel)
+	dir, err := ioutil.TempDir("", "pipeline-service-test")
+	if err != nil {
+		panic(err)
+	}
+	st, err := store.New(store.StoreTypeLocal, dir)
+	if err != nil {
+		panic(err)
+	}
+	service.InitStore(st)
+	if err := service.InitArtifacts(filepath.Join(dir, "artifacts")); err != nil {
+		panic(err)
+	}
+	if err := service.InitCaches(filepath.Join(dir, "caches"), 0, 0); err != nil {
+		panic(err)
+	}
+	prov = sim.NewSimProvider(10 * time.Millisecond)
+	s := server.NewServer(prov)
+	server.InitAgent(s)
+	ts := httptest.NewServer(server.NewRouter(s))
+	apiURL = ts.URL
+	code := m.Run()
+	ts.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func task(name string, env ...string) *model.Step {
+	return &model.Step{Name: name, Type: model.StepTypeTask, Image: "busybox", Env: env}
+}
+
+func stage(name string, steps ...*model.Step) *model.Stage {
+	return &model.Stage{Name: name, Steps: steps}
+}
+
+//createPipeline saves a pipeline with an SCM stage before the stages
+func createPipeline(t *testing.T, stages []*model.Stage, finally []*model.Stage) *model.Pipeline {
+	p := &model.Pipeline{}
+	p.Id = fmt.Sprintf("p%d", atomic.AddInt32(&counter, 1))
+	p.Name = p.Id
+	p.Stages = append([]*model.Stage{
+		stage("scm", &model.Step{Name: "clone", Type: model.StepTypeSCM, Repository: "https://example.com/repo.git", Branch: "master"}),
+	}, stages...)
+	p.Finally = finally
+	if err := service.CreatePipeline(p, "tester"); err != nil {
+		t.Fatalf("create pipeline: %v", err)
+	}
+	return p
+}
+
+func run(t *testing.T, p *model.Pipeline) *model.Activity {
+	a, err := service.RunPipeline(prov, p.Id, model.TriggerTypeManual)
+	if err != nil {
+		t.Fatalf("run pipeline: %v", err)
+	}
+	return a
+}
+
+//waitFor polls the activity until the check passes
+func waitFor(t *testing.T, id string, what string, check func(*model.Activity) bool) *model.Activity {
+	deadline := time.Now().Add(10 * time.Second)
+	//last is the last activity read, err is the error of the last read
+	var last *model.Activity
+	for {
+		a, err := service.GetActivity(id)
+		if err == nil {
+			if check(a) {
+				return a
+			}
+			last = a
+		}
+		if time.Now().After(deadline) {
+			status := ""
+			if last != nil {
+				status = last.Status
+			}
+			t.Fatalf("activity is not %s in time, status '%s', error: %v", what, status, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+//waitSettled waits until the activity completes or waits for approval
+func waitSettled(t *testing.T, id string) *model.Activity {
+	return waitFor(t, id, "settled", func(a *model.Activity) bool {
+		return a.Status == model.ActivityPending || service.IsComplete(a)
+	})
+}
+
+//action posts the action of the activity to the api
+func action(t *testing.T, id string, name string, body string) {
+	resp, err := http.Post(apiURL+"/v1/activities/"+id+"?action="+name, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%s activity: %v", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("%s activity got %d: %s", name, resp.StatusCode, b)
+	}
+}
+
+func stageStatus(a *model.Activity) map[string]string {
+	result := map[string]string{}
+	for _, s := range a.ActivityStages {
+		result[s.Name] = s.Status
+	}
+	return result
+}
+
+func TestActivityFlow(t *testing.T) {
+	fail := "SIM_EXIT_CODE=1"
+	needApprove := func(s *model.Stage) *model.Stage {
+		s.NeedApprove = true
+		return s
+	}
+	tests := []struct {
+		name    string
+		stages  []*model.Stage
+		finally []*model.Stage
+		//act drives the settled activity, the activity settles again after it
+		act    func(t *testing.T, a *model.Activity)
+		status string
+		want   map[string]string
+	}{
+		{
+			name:   "success",
+			stages: []*model.Stage{stage("build", task("make")), stage("test", task("go-test"))},
+			status: model.ActivitySuccess,
+			want:   map[string]string{"scm": model.ActivityStageSuccess, "build": model.ActivityStageSuccess, "test": model.ActivityStageSuccess},
+		},
+		{
+			name:   "failure stops later stages",
+			stages: []*model.Stage{stage("build", task("make", fail)), stage("test", task("go-test"))},
+			status: model.ActivityFail,
+			want:   map[string]string{"build": model.ActivityStageFail, "test": model.ActivityStageWaiting},
+		},
+		{
+			name: "conditions skip stages and steps",
+			stages: []*model.Stage{
+				{Name: "release", Conditions: &model.PipelineConditions{Expression: `branch() == "release"`}, Steps: []*model.Step{task("publish")}},
+				{Name: "build", Steps: []*model.Step{
+					task("make"),
+					{Name: "lint", Type: model.StepTypeTask, Image: "busybox", Conditions: &model.PipelineConditions{All: []string{"CICD_TRIGGER_TYPE=webhook"}}},
+				}},
+				{Name: "deploy", Conditions: &model.PipelineConditions{Expression: `branch() == "master" && triggerType() == "manual"`}, Steps: []*model.Step{task("ship")}},
+			},
+			status: model.ActivitySuccess,
+			want:   map[string]string{"release": model.ActivityStageSkip, "build": model.ActivityStageSuccess, "deploy": model.ActivityStageSuccess},
+		},
+		{
+			name: "needs graph",
+			stages: []*model.Stage{
+				{Name: "unit", Needs: []string{"scm"}, Steps: []*model.Step{task("run", "SIM_DURATION=200ms")}},
+				{Name: "lint", Needs: []string{"scm"}, Steps: []*model.Step{task("run", "SIM_DURATION=200ms")}},
+				{Name: "package", Needs: []string{"unit", "lint"}, Steps: []*model.Step{task("run")}},
+			},
+			status: model.ActivitySuccess,
+			want:   map[string]string{"unit": model.ActivityStageSuccess, "lint": model.ActivityStageSuccess, "package": model.ActivityStageSuccess},
+			act: func(t *testing.T, a *model.Activity) {
+				unit, lint, pkg := a.ActivityStages[1], a.ActivityStages[2], a.ActivityStages[3]
+				if lint.StartTS >= unit.StartTS+unit.Duration || unit.StartTS >= lint.StartTS+lint.Duration {
+					t.Errorf("stages needing scm only do not run in parallel")
+				}
+				if pkg.StartTS < unit.StartTS+unit.Duration || pkg.StartTS < lint.StartTS+lint.Duration {
+					t.Errorf("stage starts before the stages it needs finish")
+				}
+			},
+		},
+		{
+			name:    "finally runs after failure",
+			stages:  []*model.Stage{stage("build", task("make", fail))},
+			finally: []*model.Stage{stage("cleanup", task("rm"))},
+			status:  model.ActivityFail,
+			want:    map[string]string{"build": model.ActivityStageFail, "cleanup": model.ActivityStageSuccess},
+		},
+		{
+			name: "allowed failure of step",
+			stages: []*model.Stage{stage("build", &model.Step{Name: "flaky", Type: model.StepTypeTask, Image: "busybox",
+				Env: []string{fail}, AllowFailure: true}, task("make"))},
+			status: model.ActivitySuccessWithWarnings,
+			want:   map[string]string{"build": model.ActivityStageFailedAllowed},
+		},
+		{
+			name: "allowed failure of stage",
+			stages: []*model.Stage{
+				{Name: "optional", AllowFailure: true, Steps: []*model.Step{task("try", fail)}},
+				stage("build", task("make")),
+			},
+			status: model.ActivitySuccessWithWarnings,
+			want:   map[string]string{"optional": model.ActivityStageFailedAllowed, "build": model.ActivityStageSuccess},
+		},
+		{
+			name: "retry keeps attempts",
+			stages: []*model.Stage{stage("build", &model.Step{Name: "flaky", Type: model.StepTypeTask, Image: "busybox",
+				Env: []string{fail}, Retry: &model.StepRetry{Count: 2}})},
+			status: model.ActivityFail,
+			want:   map[string]string{"build": model.ActivityStageFail},
+			act: func(t *testing.T, a *model.Activity) {
+				if attempts := len(a.ActivityStages[1].ActivitySteps[0].Attempts); attempts != 2 {
+					t.Errorf("got %d failed attempts, expect 2", attempts)
+				}
+			},
+		},
+		{
+			name:   "approve",
+			stages: []*model.Stage{needApprove(stage("deploy", task("ship")))},
+			act: func(t *testing.T, a *model.Activity) {
+				if a.Status != model.ActivityPending {
+					t.Fatalf("got status '%s', expect pending approval", a.Status)
+				}
+				action(t, a.Id, "approve", "")
+			},
+			status: model.ActivitySuccess,
+			want:   map[string]string{"deploy": model.ActivityStageSuccess},
+		},
+		{
+			name:    "deny runs finally",
+			stages:  []*model.Stage{needApprove(stage("deploy", task("ship")))},
+			finally: []*model.Stage{stage("notify", task("mail"))},
+			act: func(t *testing.T, a *model.Activity) {
+				if a.Status != model.ActivityPending {
+					t.Fatalf("got status '%s', expect pending approval", a.Status)
+				}
+				action(t, a.Id, "deny", "")
+			},
+			status: model.ActivityDenied,
+			want:   map[string]string{"deploy": model.ActivityStageDenied, "notify": model.ActivityStageSuccess},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := createPipeline(t, tt.stages, tt.finally)
+			a := waitSettled(t, run(t, p).Id)
+			if tt.act != nil {
+				tt.act(t, a)
+				a = waitSettled(t, a.Id)
+			}
+			if a.Status != tt.status {
+				t.Errorf("got status '%s', expect '%s'", a.Status, tt.status)
+			}
+			got := stageStatus(a)
+			for name, status := range tt.want {
+				if got[name] != status {
+					t.Errorf("got status '%s' of stage '%s', expect '%s'", got[name], name, status)
+				}
+			}
+		})
+	}
+}
+
+func TestRerunAndResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		body   string
+		//stage ordinal from which steps run again
+		from int
+	}{
+		{name: "rerun", action: "rerun", from: 0},
+		{name: "resume", action: "resume", from: 2},
+		{name: "rerun from", action: "rerunFrom", body: `{"stageOrdinal":1,"stepOrdinal":0}`, from: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//stage names are unique so scripts of the test do not apply to other pipelines
+			build, deploy := "build-"+tt.action, "deploy-"+tt.action
+			p := createPipeline(t, []*model.Stage{stage(build, task("make")), stage(deploy, task("ship"))}, nil)
+			prov.SetScript(deploy, "ship", sim.StepScript{Duration: 10 * time.Millisecond, ExitCode: 1})
+			a := waitSettled(t, run(t, p).Id)
+			if a.Status != model.ActivityFail {
+				t.Fatalf("got status '%s', expect failure", a.Status)
+			}
+			starts := []int64{}
+			for _, s := range a.ActivityStages {
+				starts = append(starts, s.ActivitySteps[0].StartTS)
+			}
+
+			prov.SetScript(deploy, "ship", sim.StepScript{Duration: 10 * time.Millisecond})
+			action(t, a.Id, tt.action, tt.body)
+			a = waitFor(t, a.Id, "run again", func(a *model.Activity) bool {
+				return service.IsComplete(a) && a.ActivityStages[2].ActivitySteps[0].StartTS != starts[2]
+			})
+			if a.Status != model.ActivitySuccess {
+				t.Errorf("got status '%s', expect success", a.Status)
+			}
+			for i, s := range a.ActivityStages {
+				if rerun := s.ActivitySteps[0].StartTS != starts[i]; rerun != (i >= tt.from) {
+					t.Errorf("stage '%s' runs again: %v, expect %v", s.Name, rerun, i >= tt.from)
+				}
+			}
+		})
+	}
+}
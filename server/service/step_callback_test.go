@@ -0,0 +1,247 @@
+package service_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rancher/pipeline/config"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+func tarArchive(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+//callStep calls the event endpoint for the step and gets the status code and the body of the response
+func callStep(t *testing.T, method string, event string, query string, token string, body []byte) (int, string) {
+	req, err := http.NewRequest(method, apiURL+"/v1/events/"+event+"?"+query, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == "stepfinish" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if token != "" {
+		req.Header.Set(service.StepTokenHeader, token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("call %s: %v", event, err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func stepToken(t *testing.T, a *model.Activity, stageOrdinal int, stepOrdinal int) string {
+	token, err := service.StepToken(a.Id, stageOrdinal, stepOrdinal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+//runningStep runs the pipeline and waits for the step of the second stage to build
+func runningStep(t *testing.T, step *model.Step) *model.Activity {
+	step.Env = append(step.Env, "SIM_DURATION=1s")
+	p := createPipeline(t, []*model.Stage{stage("build", step)}, nil)
+	return waitFor(t, run(t, p).Id, "building", func(a *model.Activity) bool {
+		return a.ActivityStages[1].ActivitySteps[0].Status == model.ActivityStepBuilding
+	})
+}
+
+func TestStepArtifactsCallback(t *testing.T) {
+	step := task("make")
+	step.Artifacts = []string{"dist/*"}
+	a := runningStep(t, step)
+	query := fmt.Sprintf("id=%s&stageOrdinal=1&stepOrdinal=0", a.Id)
+	archive := tarArchive(t, map[string]string{"dist/app": "binary"})
+
+	tests := []struct {
+		name    string
+		token   string
+		maxSize int64
+		status  int
+	}{
+		{name: "no token", status: http.StatusForbidden},
+		{name: "token of another step", token: stepToken(t, a, 0, 0), status: http.StatusForbidden},
+		{name: "too large", token: stepToken(t, a, 1, 0), maxSize: 16, status: http.StatusRequestEntityTooLarge},
+		{name: "token of the step", token: stepToken(t, a, 1, 0), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.MaxUploadSize = tt.maxSize
+			defer func() { config.Config.MaxUploadSize = 0 }()
+			if status, body := callStep(t, http.MethodPost, "artifacts", query, tt.token, archive); status != tt.status {
+				t.Errorf("got status %d, expect %d: %s", status, tt.status, body)
+			}
+		})
+	}
+	a = waitSettled(t, a.Id)
+	if len(a.Artifacts) != 1 || a.Artifacts[0].Name != "dist/app" {
+		t.Errorf("got %d artifacts, expect dist/app", len(a.Artifacts))
+	}
+	status, body := callStep(t, http.MethodPost, "artifacts", query, stepToken(t, a, 1, 0), archive)
+	if status != http.StatusForbidden || !strings.Contains(body, service.ErrStepNotRunning.Error()) {
+		t.Errorf("upload after the step finishes got status %d: %s", status, body)
+	}
+}
+
+func TestStepCacheCallback(t *testing.T) {
+	step := task("make", "TOOL=v1")
+	step.Cache = &model.StepCache{Key: `tool-${TOOL}-{{ checksum "go.sum" }}`, Paths: []string{"vendor"}}
+	a := runningStep(t, step)
+	token := stepToken(t, a, 1, 0)
+	sum := strings.Repeat("0a", 32)
+	archive := tarArchive(t, map[string]string{"vendor/lib.go": "package lib"})
+
+	tests := []struct {
+		name   string
+		method string
+		key    string
+		token  string
+		status int
+	}{
+		{name: "restore without token", method: http.MethodGet, key: "tool-v1-" + sum, status: http.StatusForbidden},
+		{name: "save without token", method: http.MethodPost, key: "tool-v1-" + sum, status: http.StatusForbidden},
+		{name: "save key of other env", method: http.MethodPost, key: "tool-v2-" + sum, token: token, status: http.StatusBadRequest},
+		{name: "save key of other template", method: http.MethodPost, key: "other-" + sum, token: token, status: http.StatusBadRequest},
+		{name: "save", method: http.MethodPost, key: "tool-v1-" + sum, token: token, status: http.StatusOK},
+		{name: "restore", method: http.MethodGet, key: "tool-v1-" + sum, token: token, status: http.StatusOK},
+		{name: "restore key of missing file", method: http.MethodGet, key: "tool-v1-", token: token, status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := fmt.Sprintf("id=%s&stageOrdinal=1&stepOrdinal=0&key=%s", a.Id, tt.key)
+			if status, body := callStep(t, tt.method, "cache", query, tt.token, archive); status != tt.status {
+				t.Errorf("got status %d, expect %d: %s", status, tt.status, body)
+			}
+		})
+	}
+	if !service.CacheExists(a.Pipeline.Id, "tool-v1-"+sum) {
+		t.Errorf("cache is not saved")
+	}
+}
+
+func TestStepTestReportsCallback(t *testing.T) {
+	step := task("test")
+	step.TestReports = []string{"reports/*.xml"}
+	a := runningStep(t, step)
+	query := fmt.Sprintf("id=%s&stageOrdinal=1&stepOrdinal=0", a.Id)
+	archive := tarArchive(t, map[string]string{"reports/unit.xml": `<testsuite name="unit" tests="1"><testcase name="ok"/></testsuite>`})
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "no token", status: http.StatusForbidden},
+		{name: "token of another step", token: stepToken(t, a, 0, 0), status: http.StatusForbidden},
+		{name: "token of the step", token: stepToken(t, a, 1, 0), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := callStep(t, http.MethodPost, "testreports", query, tt.token, archive); status != tt.status {
+				t.Errorf("got status %d, expect %d: %s", status, tt.status, body)
+			}
+		})
+	}
+	a = waitSettled(t, a.Id)
+	if tests := a.ActivityStages[1].ActivitySteps[0].Tests; tests == nil || tests.Total != 1 {
+		t.Errorf("got test summary %+v, expect 1 test", tests)
+	}
+}
+
+func TestStepSecretEnvCallback(t *testing.T) {
+	name := fmt.Sprintf("pass%d", atomic.AddInt32(&counter, 1))
+	if err := service.CreateSecret(&model.Secret{Name: name, Value: "s3cr3t-value"}); err != nil {
+		t.Fatal(err)
+	}
+	a := runningStep(t, task("deploy", "PASS=${secret:"+name+"}"))
+	query := fmt.Sprintf("id=%s&stageOrdinal=1&stepOrdinal=0&name=PASS", a.Id)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		value  string
+	}{
+		{name: "no token", status: http.StatusForbidden},
+		{name: "token of another step", token: stepToken(t, a, 0, 0), status: http.StatusForbidden},
+		{name: "token of the step", token: stepToken(t, a, 1, 0), status: http.StatusOK, value: "s3cr3t-value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := callStep(t, http.MethodGet, "secretenv", query, tt.token, nil)
+			if status != tt.status {
+				t.Errorf("got status %d, expect %d: %s", status, tt.status, body)
+			}
+			if tt.value != "" && body != tt.value {
+				t.Errorf("got value '%s', expect '%s'", body, tt.value)
+			}
+			if tt.value == "" && strings.Contains(body, "s3cr3t-value") {
+				t.Errorf("secret value is returned: %s", body)
+			}
+		})
+	}
+	a = waitSettled(t, a.Id)
+	if status, _ := callStep(t, http.MethodGet, "secretenv", query, stepToken(t, a, 1, 0), nil); status != http.StatusForbidden {
+		t.Errorf("got status %d after the step finishes, expect %d", status, http.StatusForbidden)
+	}
+}
+
+func TestStepFinishCallback(t *testing.T) {
+	a := runningStep(t, task("make"))
+	query := fmt.Sprintf("id=%s&stageOrdinal=1&stepOrdinal=0&status=SUCCESS", a.Id)
+	form := []byte("OUTPUTS=" + url.QueryEscape("VERSION=1.0\n"))
+
+	tests := []struct {
+		name   string
+		event  string
+		token  string
+		status int
+	}{
+		{name: "start without token", event: "stepstart", status: http.StatusForbidden},
+		{name: "finish without token", event: "stepfinish", status: http.StatusForbidden},
+		{name: "finish with token of another step", event: "stepfinish", token: stepToken(t, a, 0, 0), status: http.StatusForbidden},
+		{name: "finish with token of the step", event: "stepfinish", token: stepToken(t, a, 1, 0), status: http.StatusOK},
+		{name: "finish again", event: "stepfinish", token: stepToken(t, a, 1, 0), status: http.StatusForbidden},
+		{name: "start after finish", event: "stepstart", token: stepToken(t, a, 1, 0), status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := callStep(t, http.MethodPost, tt.event, query, tt.token, form); status != tt.status {
+				t.Errorf("got status %d, expect %d: %s", status, tt.status, body)
+			}
+		})
+	}
+	a = waitSettled(t, a.Id)
+	if a.Status != model.ActivitySuccess {
+		t.Errorf("got activity status '%s', expect success", a.Status)
+	}
+	if v := a.EnvVars["CICD_OUTPUT_MAKE_VERSION"]; v != "1.0" {
+		t.Errorf("got output '%s', expect the posted one", v)
+	}
+}
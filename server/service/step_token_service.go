@@ -0,0 +1,134 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/encryption"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/store"
+)
+
+const STEP_TOKEN_KEY_TYPE = "stepTokenKey"
+
+//StepTokenHeader is the header of callbacks of a running step carrying the token of the step
+const StepTokenHeader = "X-Pipeline-Step-Token"
+
+var ErrInvalidStepToken = errors.New("invalid token of the step")
+var ErrStepNotRunning = errors.New("the step is not running")
+
+//stepTokenKey signs tokens of steps. It is generated and saved on first use,
+//so tokens in jobs of running steps stay valid after the server restarts
+var stepTokenKey struct {
+	sync.Mutex
+	key []byte
+}
+
+type tokenKey struct {
+	Key string `json:"key"`
+}
+
+func getStepTokenKey() ([]byte, error) {
+	stepTokenKey.Lock()
+	defer stepTokenKey.Unlock()
+	if stepTokenKey.key != nil {
+		return stepTokenKey.key, nil
+	}
+	stored := &tokenKey{}
+	_, err := getResource(STEP_TOKEN_KEY_TYPE, "default", stored)
+	if err == store.ErrNotFound {
+		b := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, err
+		}
+		if stored.Key, err = encryption.Encrypt(hex.EncodeToString(b)); err != nil {
+			return nil, err
+		}
+		if _, err = createResource(STEP_TOKEN_KEY_TYPE, "default", "default", stored); err != nil {
+			//created by another request meanwhile
+			if _, getErr := getResource(STEP_TOKEN_KEY_TYPE, "default", stored); getErr != nil {
+				return nil, errors.Wrap(err, "fail to save key of step tokens")
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	plain, err := encryption.Decrypt(stored.Key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(plain)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed key of step tokens")
+	}
+	stepTokenKey.key = key
+	return key, nil
+}
+
+func resetStepTokenKey() {
+	stepTokenKey.Lock()
+	defer stepTokenKey.Unlock()
+	stepTokenKey.key = nil
+}
+
+//StepToken gets the token authenticating callbacks of the step to the server, it is given to the job
+//or the container of the step and never kept in the activity
+func StepToken(activityId string, stageOrdinal int, stepOrdinal int) (string, error) {
+	key, err := getStepTokenKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s/%d/%d", activityId, stageOrdinal, stepOrdinal)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+//CheckStepRunning checks that the step is building
+func CheckStepRunning(activity *model.Activity, stageOrdinal int, stepOrdinal int) error {
+	if stageOrdinal < 0 || stepOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) || stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
+		return errors.New("step index invalid")
+	}
+	if activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Status != model.ActivityStepBuilding {
+		return ErrStepNotRunning
+	}
+	return nil
+}
+
+func checkToken(activity *model.Activity, stageOrdinal int, stepOrdinal int, token string) error {
+	expect, err := StepToken(activity.Id, stageOrdinal, stepOrdinal)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(token), []byte(expect)) {
+		return ErrInvalidStepToken
+	}
+	return nil
+}
+
+//CheckStepToken checks the token of a callback of the step, which is accepted while the step is building
+func CheckStepToken(activity *model.Activity, stageOrdinal int, stepOrdinal int, token string) error {
+	if err := checkToken(activity, stageOrdinal, stepOrdinal, token); err != nil {
+		return err
+	}
+	return CheckStepRunning(activity, stageOrdinal, stepOrdinal)
+}
+
+//CheckStepStartToken checks the token of the start callback of the step, which is accepted until the step finishes
+func CheckStepStartToken(activity *model.Activity, stageOrdinal int, stepOrdinal int, token string) error {
+	if err := checkToken(activity, stageOrdinal, stepOrdinal, token); err != nil {
+		return err
+	}
+	if err := CheckStepRunning(activity, stageOrdinal, stepOrdinal); err != ErrStepNotRunning {
+		return err
+	}
+	if activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Status != model.ActivityStepWaiting {
+		return ErrStepNotRunning
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/store"
+)
+
+const TEST_REPORT_TYPE = "testReport"
+
+const (
+	//max size of a report file to parse
+	testReportSizeLimit = 32 << 20
+	//max length of the failure detail kept for a test case
+	testDetailLimit = 4096
+)
+
+func testReportKey(activityId string, stageOrdinal int, stepOrdinal int) string {
+	return fmt.Sprintf("%s:%d:%d", activityId, stageOrdinal, stepOrdinal)
+}
+
+//junitSuite is a testsuite element, or the testsuites element at the root of a report
+type junitSuite struct {
+	XMLName xml.Name
+	Name    string       `xml:"name,attr"`
+	Suites  []junitSuite `xml:"testsuite"`
+	Cases   []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string       `xml:"name,attr"`
+	ClassName string       `xml:"classname,attr"`
+	Time      string       `xml:"time,attr"`
+	Failure   *junitResult `xml:"failure"`
+	Error     *junitResult `xml:"error"`
+	Skipped   *junitResult `xml:"skipped"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+//SaveTestReports parses JUnit XML files of the archive matching test report globs of the step.
+//The summary is set on the step and test cases are kept for the tests API. The archive is a
+//tar stream, gzipped or not, leading path components of its files are stripped
+func SaveTestReports(activity *model.Activity, stageOrdinal int, stepOrdinal int, archive io.Reader, strip int) error {
+	globs := activity.Pipeline.Stages[stageOrdinal].Steps[stepOrdinal].TestReports
+	if len(globs) == 0 {
+		return nil
+	}
+	tr, err := tarReader(archive)
+	if err != nil {
+		return err
+	}
+	report := &model.TestReport{
+		ActivityId:   activity.Id,
+		StageOrdinal: stageOrdinal,
+		StepOrdinal:  stepOrdinal,
+		Cases:        []*model.TestCase{},
+	}
+	files := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "invalid tar archive")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name, ok := artifactName(hdr.Name, strip)
+		if !ok || !MatchArtifact(globs, name) {
+			continue
+		}
+		cases, err := parseJUnit(io.LimitReader(tr, testReportSizeLimit))
+		if err != nil {
+			logrus.Warnf("skip test report '%s' of activity '%s': %v", name, activity.Id, err)
+			continue
+		}
+		for _, c := range cases {
+			c.File = name
+			c.StageOrdinal = stageOrdinal
+			c.StepOrdinal = stepOrdinal
+		}
+		report.Cases = append(report.Cases, cases...)
+		files++
+	}
+	if files == 0 {
+		//no report found
+		return nil
+	}
+	report.Summary = summarizeTests(report.Cases)
+	key := testReportKey(activity.Id, stageOrdinal, stepOrdinal)
+	//a retried step replaces the report of the former attempt
+	if err := dataStore.Delete(TEST_REPORT_TYPE, key); err != nil && err != store.ErrNotFound {
+		return err
+	}
+	if _, err := createResource(TEST_REPORT_TYPE, key, activity.Id, report); err != nil {
+		return errors.Wrapf(err, "fail to save test report of step %d-%d", stageOrdinal, stepOrdinal)
+	}
+	summary := report.Summary
+	activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal].Tests = &summary
+	logrus.Debugf("saved %d test cases of %d reports for activity '%s'", len(report.Cases), files, activity.Id)
+	return nil
+}
+
+func parseJUnit(r io.Reader) ([]*model.TestCase, error) {
+	root := junitSuite{}
+	if err := xml.NewDecoder(r).Decode(&root); err != nil {
+		return nil, errors.Wrap(err, "invalid JUnit XML")
+	}
+	if root.XMLName.Local != "testsuites" && root.XMLName.Local != "testsuite" {
+		return nil, fmt.Errorf("unexpected root element '%s' of JUnit XML", root.XMLName.Local)
+	}
+	cases := []*model.TestCase{}
+	collectTestCases(&root, &cases)
+	return cases, nil
+}
+
+func collectTestCases(suite *junitSuite, cases *[]*model.TestCase) {
+	for _, c := range suite.Cases {
+		testCase := &model.TestCase{
+			Suite:     suite.Name,
+			ClassName: c.ClassName,
+			Name:      c.Name,
+			Status:    model.TestCasePassed,
+			Duration:  junitDuration(c.Time),
+		}
+		var result *junitResult
+		switch {
+		case c.Failure != nil:
+			testCase.Status = model.TestCaseFailed
+			result = c.Failure
+		case c.Error != nil:
+			testCase.Status = model.TestCaseError
+			result = c.Error
+		case c.Skipped != nil:
+			testCase.Status = model.TestCaseSkipped
+			result = c.Skipped
+		}
+		if result != nil {
+			detail := strings.TrimSpace(result.Text)
+			testCase.Message = result.Message
+			if testCase.Message == "" {
+				testCase.Message = strings.SplitN(detail, "\n", 2)[0]
+			}
+			if len(detail) > testDetailLimit {
+				detail = detail[:testDetailLimit] + "..."
+			}
+			testCase.Detail = detail
+		}
+		*cases = append(*cases, testCase)
+	}
+	for i := range suite.Suites {
+		collectTestCases(&suite.Suites[i], cases)
+	}
+}
+
+//junitDuration gets milliseconds of a time attribute in seconds
+func junitDuration(t string) int64 {
+	seconds, err := strconv.ParseFloat(strings.Replace(t, ",", "", -1), 64)
+	if err != nil {
+		return 0
+	}
+	return int64(seconds * 1000)
+}
+
+func summarizeTests(cases []*model.TestCase) model.TestSummary {
+	summary := model.TestSummary{Total: len(cases)}
+	for _, c := range cases {
+		switch c.Status {
+		case model.TestCaseFailed:
+			summary.Failures++
+		case model.TestCaseError:
+			summary.Errors++
+		case model.TestCaseSkipped:
+			summary.Skipped++
+		}
+		summary.Duration += c.Duration
+	}
+	return summary
+}
+
+//ListTestCases gets test cases of reports collected for steps of the activity
+func ListTestCases(activity *model.Activity) ([]*model.TestCase, error) {
+	cases := []*model.TestCase{}
+	for i, stage := range activity.ActivityStages {
+		for j, step := range stage.ActivitySteps {
+			if step.Tests == nil {
+				continue
+			}
+			report := &model.TestReport{}
+			if _, err := getResource(TEST_REPORT_TYPE, testReportKey(activity.Id, i, j), report); err == store.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			cases = append(cases, report.Cases...)
+		}
+	}
+	return cases, nil
+}
+
+//dropTestReports removes test reports of steps to run again
+func dropTestReports(activity *model.Activity, runAgain func(stageOrdinal int, stepOrdinal int) bool) {
+	for i, stage := range activity.ActivityStages {
+		for j, step := range stage.ActivitySteps {
+			if step.Tests == nil || !runAgain(i, j) {
+				continue
+			}
+			step.Tests = nil
+			if err := dataStore.Delete(TEST_REPORT_TYPE, testReportKey(activity.Id, i, j)); err != nil && err != store.ErrNotFound {
+				logrus.Errorf("fail to remove test report of step %d-%d of activity '%s': %v", i, j, activity.Id, err)
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"fmt"
+	"path"
 	"regexp"
 	"strings"
 
@@ -12,6 +13,9 @@ import (
 
 var ErrInvalidPipeline = errors.New("Invalid Pipeline definition")
 var regName = regexp.MustCompile(`^[\w]+[\w-_]*`)
+var regEnvName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+var regArtifact = regexp.MustCompile(`^[a-zA-Z0-9._/*?-]+$`)
+var regCacheKeyTemplate = regexp.MustCompile(`^([a-zA-Z0-9._-]|\$[a-zA-Z_][a-zA-Z0-9_]*|\$\{[a-zA-Z_][a-zA-Z0-9_]*\})*$`)
 
 func CleanPipeline(p *model.Pipeline) {
 	p.VersionSequence = ""
@@ -30,12 +34,12 @@ func CleanPipeline(p *model.Pipeline) {
 	p.WebHookToken = ""
 
 	//set condition to nil if empty, for cleaner serialization
-	for _, stage := range p.Stages {
-		if stage.Conditions != nil && len(stage.Conditions.All) == 0 && len(stage.Conditions.Any) == 0 {
+	for _, stage := range p.AllStages() {
+		if !hasCondition(stage.Conditions) {
 			stage.Conditions = nil
 		}
 		for _, step := range stage.Steps {
-			if step.Conditions != nil && len(step.Conditions.All) == 0 && len(step.Conditions.Any) == 0 {
+			if !hasCondition(step.Conditions) {
 				step.Conditions = nil
 			}
 		}
@@ -56,7 +60,8 @@ func Validate(p *model.Pipeline) error {
 		return err
 	}
 
-	if err := checkStageName(p.Stages); err != nil {
+	stages := p.AllStages()
+	if err := checkStageName(stages); err != nil {
 		return err
 	}
 
@@ -64,7 +69,7 @@ func Validate(p *model.Pipeline) error {
 		return err
 	}
 
-	for _, stage := range p.Stages {
+	for _, stage := range stages {
 		if err := checkCondition(stage.Conditions); err != nil {
 			return err
 		}
@@ -75,6 +80,148 @@ func Validate(p *model.Pipeline) error {
 		}
 	}
 
+	if err := checkFinallyStages(p.Finally); err != nil {
+		return err
+	}
+
+	if p.Cache != nil {
+		if err := checkCache(p.Cache); err != nil {
+			return err
+		}
+	}
+
+	if err := checkStageNeeds(p.Stages); err != nil {
+		return err
+	}
+
+	if err := checkSecrets(p); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//checkSecrets checks secrets are only referenced in env of task steps, which is injected
+//into the step container and not written to the workspace
+func checkSecrets(p *model.Pipeline) error {
+	for _, param := range p.Parameters {
+		if HasSecretRef(param) {
+			return errors.Wrapf(ErrInvalidPipeline, "parameter '%s' should not reference secrets, use them in env of task steps", strings.SplitN(param, "=", 2)[0])
+		}
+	}
+	for _, stage := range p.AllStages() {
+		for _, step := range stage.Steps {
+			if HasSecretRef(step.ShellScript) || HasSecretRef(step.Args) || HasSecretRef(step.Entrypoint) {
+				return errors.Wrapf(ErrInvalidPipeline, "secrets should only be referenced in env of task steps (in stage '%s')", stage.Name)
+			}
+			for _, env := range step.Env {
+				if !HasSecretRef(env) {
+					continue
+				}
+				if step.Type != model.StepTypeTask {
+					return errors.Wrapf(ErrInvalidPipeline, "secrets should only be referenced in env of task steps (in stage '%s')", stage.Name)
+				}
+				kv := strings.SplitN(env, "=", 2)
+				if len(kv) != 2 || !regEnvName.MatchString(kv[0]) {
+					return errors.Wrapf(ErrInvalidPipeline, "env '%s' referencing secrets should be in format 'NAME=VALUE' (in stage '%s')", kv[0], stage.Name)
+				}
+				if err := checkSecretRefs(kv[1]); err != nil {
+					return errors.Wrapf(ErrInvalidPipeline, "env '%s' of stage '%s': %v", kv[0], stage.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//checkStageNeeds checks stages need existing stages after the first one and do not wait
+//for each other in a cycle, a stage without needs waits for the one before it
+func checkStageNeeds(stages []*model.Stage) error {
+	index := map[string]int{}
+	for i, stage := range stages {
+		index[stage.Name] = i
+	}
+	deps := make([][]int, len(stages))
+	for i, stage := range stages {
+		if len(stage.Needs) == 0 {
+			if i > 0 {
+				deps[i] = []int{i - 1}
+			}
+			continue
+		}
+		if i == 0 {
+			return errors.Wrapf(ErrInvalidPipeline, "first stage '%s' should not need other stages", stage.Name)
+		}
+		for _, name := range stage.Needs {
+			need, ok := index[name]
+			if !ok {
+				return errors.Wrapf(ErrInvalidPipeline, "stage '%s' needs stage '%s' not found", stage.Name, name)
+			}
+			if need == i {
+				return errors.Wrapf(ErrInvalidPipeline, "stage '%s' should not need itself", stage.Name)
+			}
+			deps[i] = append(deps[i], need)
+		}
+	}
+	//0 unvisited, 1 visiting, 2 visited
+	state := make([]int, len(stages))
+	var path []int
+	var visit func(int) error
+	visit = func(i int) error {
+		state[i] = 1
+		path = append(path, i)
+		for _, need := range deps[i] {
+			if state[need] == 1 {
+				//each stage in the path needs the one after it
+				start := 0
+				for path[start] != need {
+					start++
+				}
+				names := []string{}
+				for _, k := range path[start:] {
+					names = append(names, stages[k].Name)
+				}
+				names = append(names, stages[need].Name)
+				return errors.Wrapf(ErrInvalidPipeline, "stage needs form a cycle: %s", strings.Join(names, " -> "))
+			}
+			if state[need] == 0 {
+				if err := visit(need); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = 2
+		return nil
+	}
+	for i := range stages {
+		if state[i] == 0 {
+			if err := visit(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//checkFinallyStages checks finally stages run without approval in the workspace of main stages
+func checkFinallyStages(stages []*model.Stage) error {
+	for _, stage := range stages {
+		if len(stage.Steps) == 0 {
+			return errors.Wrapf(ErrInvalidPipeline, "finally stage '%s' should have steps", stage.Name)
+		}
+		if stage.NeedApprove {
+			return errors.Wrapf(ErrInvalidPipeline, "finally stage '%s' should not need approval", stage.Name)
+		}
+		if len(stage.Needs) > 0 {
+			return errors.Wrapf(ErrInvalidPipeline, "finally stage '%s' should not need other stages", stage.Name)
+		}
+		for _, step := range stage.Steps {
+			if step.Type == model.StepTypeSCM {
+				return errors.Wrapf(ErrInvalidPipeline, "SCM step is not allowed in finally stage '%s'", stage.Name)
+			}
+		}
+	}
 	return nil
 }
 
@@ -117,6 +264,116 @@ func validateStep(step *model.Step) error {
 	if err := checkCondition(step.Conditions); err != nil {
 		return err
 	}
+	if step.Retry != nil && (step.Retry.Count < 0 || step.Retry.Delay < 0 || step.Retry.Backoff < 0) {
+		return errors.Wrap(ErrInvalidPipeline, "retry count, delay and backoff should not be negative")
+	}
+	if step.Matrix != nil {
+		if err := checkMatrix(step); err != nil {
+			return err
+		}
+	}
+	if len(step.Artifacts) > 0 {
+		if err := checkArtifacts(step); err != nil {
+			return err
+		}
+	}
+	if len(step.TestReports) > 0 {
+		if step.Type != model.StepTypeTask || step.IsService {
+			return errors.Wrap(ErrInvalidPipeline, "test reports are only allowed on task step not run as a service")
+		}
+		for _, glob := range step.TestReports {
+			if err := checkWorkspaceGlob("test report", glob); err != nil {
+				return err
+			}
+		}
+	}
+	if step.Cache != nil {
+		if step.Type != model.StepTypeTask || step.IsService {
+			return errors.Wrap(ErrInvalidPipeline, "cache is only allowed on task step not run as a service")
+		}
+		if err := checkCache(step.Cache); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//checkArtifacts checks artifact globs are in the workspace, they are expanded by shell unquoted
+func checkArtifacts(step *model.Step) error {
+	if step.Type != model.StepTypeTask || step.IsService {
+		return errors.Wrap(ErrInvalidPipeline, "artifacts are only allowed on task step not run as a service")
+	}
+	for _, glob := range step.Artifacts {
+		if err := checkWorkspaceGlob("artifact", glob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkWorkspaceGlob(kind string, glob string) error {
+	if !regArtifact.MatchString(glob) {
+		return errors.Wrapf(ErrInvalidPipeline, "%s '%s' should only contain [a-zA-Z0-9._/*?-] characters", kind, glob)
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return errors.Wrapf(ErrInvalidPipeline, "%s '%s' is not a valid glob", kind, glob)
+	}
+	if clean := path.Clean(glob); path.IsAbs(glob) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return errors.Wrapf(ErrInvalidPipeline, "%s '%s' should be relative to the workspace", kind, glob)
+	}
+	return nil
+}
+
+//checkCache checks cache paths and checksum files are in the workspace and the key
+//template is made of characters allowed in keys, env vars and checksums
+func checkCache(cache *model.StepCache) error {
+	if cache.Key == "" {
+		return errors.Wrap(ErrInvalidPipeline, "cache key should not be empty")
+	}
+	if len(cache.Paths) == 0 {
+		return errors.Wrap(ErrInvalidPipeline, "cache should have paths")
+	}
+	for _, p := range cache.Paths {
+		if err := checkWorkspaceGlob("cache path", p); err != nil {
+			return err
+		}
+	}
+	for _, m := range regCacheChecksum.FindAllStringSubmatch(cache.Key, -1) {
+		if err := checkWorkspaceGlob("cache checksum file", m[1]); err != nil {
+			return err
+		}
+		if strings.ContainsAny(m[1], "*?") {
+			return errors.Wrapf(ErrInvalidPipeline, "cache checksum file '%s' should not be a glob", m[1])
+		}
+	}
+	if literal := regCacheChecksum.ReplaceAllString(cache.Key, ""); !regCacheKeyTemplate.MatchString(literal) {
+		return errors.Wrapf(ErrInvalidPipeline, "cache key '%s' should only contain [a-zA-Z0-9._-] characters, env vars and checksums", cache.Key)
+	}
+	return nil
+}
+
+//checkMatrix checks a matrix runs a task step, not as a service, with values on each axis
+func checkMatrix(step *model.Step) error {
+	if step.Type != model.StepTypeTask {
+		return errors.Wrap(ErrInvalidPipeline, "matrix is only allowed on task step")
+	}
+	if step.IsService {
+		return errors.Wrap(ErrInvalidPipeline, "matrix is not allowed on task step run as a service")
+	}
+	if len(step.Matrix.Axes) == 0 {
+		return errors.Wrap(ErrInvalidPipeline, "matrix should have axes")
+	}
+	for name, values := range step.Matrix.Axes {
+		if !regEnvName.MatchString(name) {
+			return errors.Wrapf(ErrInvalidPipeline, "matrix axis '%s' is not a valid env var name", name)
+		}
+		if len(values) == 0 {
+			return errors.Wrapf(ErrInvalidPipeline, "matrix axis '%s' should have values", name)
+		}
+	}
+	if step.Matrix.MaxParallel < 0 {
+		return errors.Wrap(ErrInvalidPipeline, "matrix maxParallel should not be negative")
+	}
 	return nil
 }
 
@@ -172,12 +429,17 @@ func checkCondition(conditions *model.PipelineConditions) error {
 			return errors.Wrapf(ErrInvalidPipeline, "condition '%s' is not valid, expected format 'xx=xx' or 'xx!=xx'", condition)
 		}
 	}
+	if strings.TrimSpace(conditions.Expression) != "" {
+		if _, err := parseCondition(conditions.Expression); err != nil {
+			return errors.Wrapf(ErrInvalidPipeline, "condition '%s' is not valid: %v", conditions.Expression, err)
+		}
+	}
 	return nil
 }
 
 func checkServiceName(p *model.Pipeline) error {
 	names := map[string]bool{}
-	for _, stage := range p.Stages {
+	for _, stage := range p.AllStages() {
 		for _, step := range stage.Steps {
 			if step.IsService {
 				if step.Alias == "" {
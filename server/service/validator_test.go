@@ -0,0 +1,83 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/pipeline/model"
+	"github.com/rancher/pipeline/server/service"
+)
+
+//needsStage gets a stage of a task step that needs the stages
+func needsStage(name string, needs ...string) *model.Stage {
+	s := stage(name, task("make"))
+	s.Needs = needs
+	return s
+}
+
+//validationPipeline gets a pipeline of an SCM stage followed by the stages
+func validationPipeline(stages ...*model.Stage) *model.Pipeline {
+	p := &model.Pipeline{}
+	p.Name = "validation"
+	p.Stages = append([]*model.Stage{
+		stage("scm", &model.Step{Name: "clone", Type: model.StepTypeSCM, Repository: "https://example.com/repo.git", Branch: "master"}),
+	}, stages...)
+	return p
+}
+
+func TestValidateStageNeeds(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []*model.Stage
+		//err is empty if the pipeline is valid
+		err string
+	}{
+		{
+			name:   "sequence",
+			stages: []*model.Stage{needsStage("build"), needsStage("test")},
+		},
+		{
+			name:   "fan out and in",
+			stages: []*model.Stage{needsStage("build"), needsStage("unit", "build"), needsStage("lint", "build"), needsStage("deploy", "unit", "lint")},
+		},
+		{
+			name:   "need of a later stage",
+			stages: []*model.Stage{needsStage("build", "scm"), needsStage("deploy", "test"), needsStage("test", "build")},
+		},
+		{
+			name:   "missing stage",
+			stages: []*model.Stage{needsStage("build", "compile")},
+			err:    "stage 'build' needs stage 'compile' not found",
+		},
+		{
+			name:   "itself",
+			stages: []*model.Stage{needsStage("build", "build")},
+			err:    "stage 'build' should not need itself",
+		},
+		{
+			name:   "cycle of two",
+			stages: []*model.Stage{needsStage("build", "test"), needsStage("test", "build")},
+			err:    "stage needs form a cycle: build -> test -> build",
+		},
+		{
+			name:   "cycle through a stage without needs",
+			stages: []*model.Stage{needsStage("build", "deploy"), needsStage("test"), needsStage("deploy", "test")},
+			err:    "stage needs form a cycle: build -> deploy -> test -> build",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.Validate(validationPipeline(tt.stages...))
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("got error %v of a valid pipeline", err)
+				}
+				return
+			}
+			if errors.Cause(err) != service.ErrInvalidPipeline || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, expect '%s'", err, tt.err)
+			}
+		})
+	}
+}
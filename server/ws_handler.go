@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
+	"github.com/rancher/pipeline/model"
 	"github.com/rancher/pipeline/server/service"
 	"github.com/sluu99/uuid"
 )
@@ -88,13 +90,49 @@ func (s *Server) stepLogWriter(ws *websocket.Conn, activityId string, stageOrdin
 	if err != nil {
 		return
 	}
+	if stageOrdinal < 0 || stageOrdinal >= len(activity.ActivityStages) || stepOrdinal < 0 || stepOrdinal >= len(activity.ActivityStages[stageOrdinal].ActivitySteps) {
+		logrus.Errorf("error get steplog,ordinal out of range")
+		return
+	}
+	//secret values never leave the server
+	redactor := service.NewActivityLogRedactor(activity)
+	//logs of failed attempts go first
+	actiStep := activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+	for _, attempt := range actiStep.Attempts {
+		if err := writeLog(ws, activity.StartTS, redactor.RedactLog(attemptLog(activity.StartTS, attempt))); err != nil {
+			return
+		}
+	}
+	streamed := len(actiStep.Attempts)
+	//waitRetry is set when the streamed attempt finishes, retried is set when it is going to rerun
+	waitRetry := actiStep.Status == model.ActivityStepWaiting && streamed > 0
+	retried := waitRetry
 	prevLog := ""
 	for {
 		select {
 		case <-pollTicker.C:
-			var b []byte
-			var err error
+			if waitRetry {
+				if activity, err = service.GetActivity(activityId); err != nil {
+					return
+				}
+				actiStep = activity.ActivityStages[stageOrdinal].ActivitySteps[stepOrdinal]
+				if retried && actiStep.Status == model.ActivityStepBuilding {
+					//next attempt starts
+					prevLog = ""
+					redactor = service.NewActivityLogRedactor(activity)
+					waitRetry = false
+					retried = false
+				} else if len(actiStep.Attempts) > streamed {
+					streamed = len(actiStep.Attempts)
+					retried = true
+				} else if actiStep.Status != model.ActivityStepBuilding && actiStep.Status != model.ActivityStepWaiting {
+					//finish
+					return
+				}
+				continue
+			}
 
+			readLog := prevLog
 			paras := map[string]interface{}{}
 			paras["prevLog"] = &prevLog
 			stepLog, err := s.Provider.GetStepLog(activity, stageOrdinal, stepOrdinal, paras)
@@ -102,25 +140,26 @@ func (s *Server) stepLogWriter(ws *websocket.Conn, activityId string, stageOrdin
 				logrus.Errorf("error get steplog,%v", err)
 				return
 			}
+			if !strings.HasPrefix(prevLog, readLog) {
+				//the step is retried before its end is read, the held back line is dropped
+				redactor = service.NewActivityLogRedactor(activity)
+			}
 			if stepLog != "" {
-				ws.SetWriteDeadline(time.Now().Add(writeWait))
-				logData, _ := computeLogTimestamp(activity.StartTS, stepLog)
-				response := WSMsg{
-					Id:           uuid.Rand().Hex(),
-					Name:         "resource.change",
-					ResourceType: "log",
-					Time:         time.Now(),
-					Data:         logData,
+				finished := strings.HasSuffix(stepLog, "\n  Finished: SUCCESS\n") ||
+					strings.HasSuffix(stepLog, "\n  Finished: FAILURE\n") ||
+					strings.HasSuffix(stepLog, "\n  Finished: ABORTED\n")
+				redacted := redactor.Redact(stepLog)
+				if finished {
+					redacted += redactor.Flush()
 				}
-				b, err = json.Marshal(response)
-				if err := ws.WriteMessage(websocket.TextMessage, b); err != nil {
-					return
+				if redacted != "" {
+					if err := writeLog(ws, activity.StartTS, redacted); err != nil {
+						return
+					}
 				}
-				if strings.HasSuffix(stepLog, "\n  Finished: SUCCESS\n") ||
-					strings.HasSuffix(stepLog, "\n  Finished: FAILURE\n") ||
-					strings.HasSuffix(stepLog, "\n  Finished: ABORTED\n") {
-					//finish
-					return
+				if finished {
+					//finish unless the step is retried
+					waitRetry = true
 				}
 			}
 		case <-pingTicker.C:
@@ -137,6 +176,33 @@ func (s *Server) stepLogWriter(ws *websocket.Conn, activityId string, stageOrdin
 	}
 }
 
+func writeLog(ws *websocket.Conn, startTS int64, stepLog string) error {
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	logData, _ := computeLogTimestamp(startTS, stepLog)
+	response := WSMsg{
+		Id:           uuid.Rand().Hex(),
+		Name:         "resource.change",
+		ResourceType: "log",
+		Time:         time.Now(),
+		Data:         logData,
+	}
+	b, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(websocket.TextMessage, b)
+}
+
+//attemptLog is the log of a failed attempt with a heading line
+func attemptLog(startTS int64, attempt *model.StepAttempt) string {
+	elapsed := time.Duration(attempt.StartTS-startTS) * time.Millisecond
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	heading := fmt.Sprintf("%s  Attempt %d: %s\n", elapsed, attempt.Attempt, attempt.Status)
+	return heading + attempt.Log
+}
+
 func computeLogTimestamp(startTS int64, stepLog string) (string, error) {
 	lines := strings.Split(stepLog, "\n")
 	b := bytes.NewBufferString("")
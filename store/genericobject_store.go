@@ -0,0 +1,186 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/v2"
+	"github.com/rancher/pipeline/util"
+)
+
+//GenericObjectStore stores objects as Rancher GenericObjects through the Cattle API.
+//Version is kept in the resource data and checked before each update,
+//updates are serialized within the process to make the check-and-set atomic.
+//The check-and-set relies on an in-process mutex only, it is not safe across
+//several server replicas updating the same objects.
+type GenericObjectStore struct {
+	lock sync.Mutex
+}
+
+func (s *GenericObjectStore) Get(kind string, key string) (*Object, error) {
+	gobj, err := getGenericObject(kind, key)
+	if err != nil {
+		return nil, err
+	}
+	return toObject(gobj), nil
+}
+
+func (s *GenericObjectStore) List(kind string) ([]*Object, error) {
+	geObjList, err := PaginateGenericObjects(kind)
+	if err != nil {
+		return nil, err
+	}
+	objs := []*Object{}
+	for _, gobj := range geObjList {
+		objs = append(objs, toObject(&gobj))
+	}
+	return objs, nil
+}
+
+func (s *GenericObjectStore) Create(obj *Object) error {
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		return err
+	}
+	obj.Version = nextVersion("")
+	_, err = apiClient.GenericObject.Create(&client.GenericObject{
+		Name:         obj.Name,
+		Key:          obj.Key,
+		ResourceData: toResourceData(obj),
+		Kind:         obj.Kind,
+	})
+	return err
+}
+
+func (s *GenericObjectStore) Update(obj *Object) error {
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	existing, err := getGenericObject(obj.Kind, obj.Key)
+	if err != nil {
+		return err
+	}
+	current := toObject(existing).Version
+	if obj.Version != "" && obj.Version != current {
+		return ErrConflict
+	}
+	version := obj.Version
+	obj.Version = nextVersion(current)
+	_, err = apiClient.GenericObject.Update(existing, &client.GenericObject{
+		Name:         obj.Name,
+		Key:          obj.Key,
+		ResourceData: toResourceData(obj),
+		Kind:         obj.Kind,
+	})
+	if err != nil {
+		obj.Version = version
+	}
+	return err
+}
+
+func (s *GenericObjectStore) Delete(kind string, key string) error {
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		return err
+	}
+	existing, err := getGenericObject(kind, key)
+	if err != nil {
+		return err
+	}
+	return apiClient.GenericObject.Delete(existing)
+}
+
+func getGenericObject(kind string, key string) (*client.GenericObject, error) {
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		return nil, err
+	}
+	filters := make(map[string]interface{})
+	filters["kind"] = kind
+	filters["key"] = key
+	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error %v filtering genericObjects by key", err)
+	}
+	if len(goCollection.Data) == 0 {
+		return nil, ErrNotFound
+	}
+	return &goCollection.Data[0], nil
+}
+
+func toObject(gobj *client.GenericObject) *Object {
+	data, _ := gobj.ResourceData["data"].(string)
+	version, _ := gobj.ResourceData["version"].(string)
+	return &Object{
+		Kind:    gobj.Kind,
+		Key:     gobj.Key,
+		Name:    gobj.Name,
+		Data:    []byte(data),
+		Version: version,
+	}
+}
+
+func toResourceData(obj *Object) map[string]interface{} {
+	return map[string]interface{}{
+		"data":    string(obj.Data),
+		"version": obj.Version,
+	}
+}
+
+func PaginateGenericObjects(kind string) ([]client.GenericObject, error) {
+	result := []client.GenericObject{}
+	limit := "1000"
+	marker := ""
+	var pageData []client.GenericObject
+	var err error
+	for {
+		pageData, marker, err = getGenericObjects(kind, limit, marker)
+		if err != nil {
+			logrus.Debugf("get genericobject err:%v", err)
+			return nil, err
+		}
+		result = append(result, pageData...)
+		if marker == "" {
+			break
+		}
+	}
+	return result, nil
+}
+
+func getGenericObjects(kind string, limit string, marker string) ([]client.GenericObject, string, error) {
+	apiClient, err := util.GetRancherClient()
+	if err != nil {
+		logrus.Errorf("fail to get client:%v", err)
+		return nil, "", err
+	}
+	filters := make(map[string]interface{})
+	filters["kind"] = kind
+	filters["limit"] = limit
+	filters["marker"] = marker
+	goCollection, err := apiClient.GenericObject.List(&client.ListOpts{
+		Filters: filters,
+	})
+	if err != nil {
+		logrus.Errorf("fail querying generic objects, error:%v", err)
+		return nil, "", err
+	}
+	//get next marker
+	nextMarker := ""
+	if goCollection.Pagination != nil && goCollection.Pagination.Next != "" {
+		r, err := url.Parse(goCollection.Pagination.Next)
+		if err != nil {
+			logrus.Errorf("fail parsing next url, error:%v", err)
+			return nil, "", err
+		}
+		nextMarker = r.Query().Get("marker")
+	}
+	return goCollection.Data, nextMarker, err
+
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//LocalStore stores objects as json files on local disk, one directory per kind
+type LocalStore struct {
+	root string
+	lock sync.RWMutex
+}
+
+type localRecord struct {
+	Name    string `json:"name,omitempty"`
+	Created int64  `json:"created"`
+	Version string `json:"version"`
+	Data    string `json:"data"`
+}
+
+func NewLocalStore(root string) (*LocalStore, error) {
+	if root == "" {
+		return nil, fmt.Errorf("empty path for local store")
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: root}, nil
+}
+
+func (s *LocalStore) Get(kind string, key string) (*Object, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	obj, _, err := s.read(kind, key)
+	return obj, err
+}
+
+func (s *LocalStore) List(kind string) ([]*Object, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	files, err := ioutil.ReadDir(filepath.Join(s.root, kind))
+	if os.IsNotExist(err) {
+		return []*Object{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	objs := []*Object{}
+	created := map[*Object]int64{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		obj, r, err := s.read(kind, key)
+		if err != nil {
+			return nil, err
+		}
+		created[obj] = r.Created
+		objs = append(objs, obj)
+	}
+	//oldest first, as cattle lists generic objects by creation
+	sort.SliceStable(objs, func(i, j int) bool {
+		return created[objs[i]] < created[objs[j]]
+	})
+	return objs, nil
+}
+
+func (s *LocalStore) Create(obj *Object) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := os.Stat(s.path(obj.Kind, obj.Key)); err == nil {
+		return fmt.Errorf("%s '%s' already exists", obj.Kind, obj.Key)
+	}
+	obj.Version = nextVersion("")
+	return s.write(obj, time.Now().UnixNano())
+}
+
+func (s *LocalStore) Update(obj *Object) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, existing, err := s.read(obj.Kind, obj.Key)
+	if err != nil {
+		return err
+	}
+	if obj.Version != "" && obj.Version != existing.Version {
+		return ErrConflict
+	}
+	version := obj.Version
+	obj.Version = nextVersion(existing.Version)
+	if err := s.write(obj, existing.Created); err != nil {
+		obj.Version = version
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) Delete(kind string, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := os.Remove(s.path(kind, key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *LocalStore) path(kind string, key string) string {
+	return filepath.Join(s.root, kind, url.PathEscape(key)+".json")
+}
+
+func (s *LocalStore) read(kind string, key string) (*Object, *localRecord, error) {
+	b, err := ioutil.ReadFile(s.path(kind, key))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	r := &localRecord{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, nil, err
+	}
+	return &Object{
+		Kind:    kind,
+		Key:     key,
+		Name:    r.Name,
+		Data:    []byte(r.Data),
+		Version: r.Version,
+	}, r, nil
+}
+
+//write saves the object to a temp file then renames it, so readers never see partial content
+func (s *LocalStore) write(obj *Object, created int64) error {
+	dir := filepath.Join(s.root, obj.Kind)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(localRecord{Name: obj.Name, Created: created, Version: obj.Version, Data: string(obj.Data)})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(obj.Kind, obj.Key))
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	StoreTypeRancher = "rancher"
+	StoreTypeLocal   = "local"
+)
+
+var ErrNotFound = errors.New("resource not found")
+var ErrConflict = errors.New("resource version conflict, the resource has been modified")
+
+//Object is a stored resource, data is the serialized resource content
+type Object struct {
+	Kind string
+	Key  string
+	Name string
+	Data []byte
+	//Version increases on every update.
+	//An update with non-empty version succeeds only if it matches the stored one
+	Version string
+}
+
+//Store persists pipelines, activities, settings, accounts and repo caches
+//as kind/key indexed objects
+type Store interface {
+	Get(kind string, key string) (*Object, error)
+	List(kind string) ([]*Object, error)
+	Create(obj *Object) error
+	Update(obj *Object) error
+	Delete(kind string, key string) error
+}
+
+func nextVersion(version string) string {
+	v, _ := strconv.Atoi(version)
+	return strconv.Itoa(v + 1)
+}
+
+//New returns a store of the given type
+func New(storeType string, path string) (Store, error) {
+	switch storeType {
+	case StoreTypeRancher, "":
+		return &GenericObjectStore{}, nil
+	case StoreTypeLocal:
+		return NewLocalStore(path)
+	}
+	return nil, fmt.Errorf("unsupported store type '%s'", storeType)
+}
@@ -0,0 +1,251 @@
+package store_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rancher/pipeline/config"
+	"github.com/rancher/pipeline/store"
+)
+
+//fakeCattle serves the generic object api of cattle from memory
+type fakeCattle struct {
+	lock    sync.Mutex
+	nextId  int
+	objects []map[string]interface{}
+}
+
+func (c *fakeCattle) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	base := "http://" + req.Host + "/v2-beta"
+	rw.Header().Set("Content-Type", "application/json")
+	switch {
+	case req.URL.Path == "/v2-beta":
+		rw.Header().Set("X-API-Schemas", base)
+		json.NewEncoder(rw).Encode(map[string]interface{}{"data": []map[string]interface{}{{
+			"id":                "genericObject",
+			"type":              "schema",
+			"links":             map[string]string{"collection": base + "/genericobjects"},
+			"collectionMethods": []string{"GET", "POST"},
+			"resourceMethods":   []string{"GET", "PUT", "DELETE"},
+		}}})
+	case req.URL.Path == "/v2-beta/genericobjects" && req.Method == http.MethodGet:
+		data := []map[string]interface{}{}
+		for _, obj := range c.objects {
+			if match(obj, req, "kind") && match(obj, req, "key") {
+				data = append(data, obj)
+			}
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"data": data})
+	case req.URL.Path == "/v2-beta/genericobjects" && req.Method == http.MethodPost:
+		obj := map[string]interface{}{}
+		json.NewDecoder(req.Body).Decode(&obj)
+		c.nextId++
+		obj["id"] = fmt.Sprintf("1go%d", c.nextId)
+		obj["type"] = "genericObject"
+		obj["links"] = map[string]string{"self": base + "/genericobjects/" + obj["id"].(string)}
+		c.objects = append(c.objects, obj)
+		json.NewEncoder(rw).Encode(obj)
+	default:
+		id := strings.TrimPrefix(req.URL.Path, "/v2-beta/genericobjects/")
+		for i, obj := range c.objects {
+			if obj["id"] != id {
+				continue
+			}
+			switch req.Method {
+			case http.MethodPut:
+				updates := map[string]interface{}{}
+				json.NewDecoder(req.Body).Decode(&updates)
+				for k, v := range updates {
+					if k != "id" && k != "type" && k != "links" {
+						obj[k] = v
+					}
+				}
+				json.NewEncoder(rw).Encode(obj)
+			case http.MethodDelete:
+				c.objects = append(c.objects[:i], c.objects[i+1:]...)
+				json.NewEncoder(rw).Encode(obj)
+			default:
+				json.NewEncoder(rw).Encode(obj)
+			}
+			return
+		}
+		http.NotFound(rw, req)
+	}
+}
+
+func match(obj map[string]interface{}, req *http.Request, field string) bool {
+	v := req.URL.Query().Get(field)
+	return v == "" || obj[field] == v
+}
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := store.New(store.StoreTypeLocal, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cattle := httptest.NewServer(&fakeCattle{})
+	defer cattle.Close()
+	config.Config.CattleUrl = cattle.URL
+	generic, err := store.New(store.StoreTypeRancher, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := []struct {
+		name string
+		st   store.Store
+	}{
+		{name: "local", st: local},
+		{name: "genericobject", st: generic},
+	}
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			testStore(t, s.st)
+		})
+	}
+}
+
+func testStore(t *testing.T, st store.Store) {
+	if _, err := st.Get("pipeline", "p1"); err != store.ErrNotFound {
+		t.Errorf("got error %v on get of missing key, expect ErrNotFound", err)
+	}
+	if err := st.Update(&store.Object{Kind: "pipeline", Key: "p1", Data: []byte("a")}); err != store.ErrNotFound {
+		t.Errorf("got error %v on update of missing key, expect ErrNotFound", err)
+	}
+	if err := st.Delete("pipeline", "p1"); err != store.ErrNotFound {
+		t.Errorf("got error %v on delete of missing key, expect ErrNotFound", err)
+	}
+
+	obj := &store.Object{Kind: "pipeline", Key: "p1", Name: "p1", Data: []byte(`{"name":"a"}`)}
+	if err := st.Create(obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj.Version != "1" {
+		t.Errorf("got version %s on create, expect 1", obj.Version)
+	}
+	stale := *obj
+
+	tests := []struct {
+		name    string
+		version string
+		data    string
+		err     error
+		//expect is the stored version after the update
+		expect string
+	}{
+		{name: "current version", version: "1", data: `{"name":"b"}`, expect: "2"},
+		{name: "stale version", version: "1", data: `{"name":"c"}`, err: store.ErrConflict, expect: "2"},
+		{name: "empty version", version: "", data: `{"name":"d"}`, expect: "3"},
+	}
+	data := ""
+	for _, tt := range tests {
+		update := stale
+		update.Version = tt.version
+		update.Data = []byte(tt.data)
+		if err := st.Update(&update); err != tt.err {
+			t.Errorf("%s: got error %v, expect %v", tt.name, err, tt.err)
+		}
+		if tt.err == nil {
+			data = tt.data
+			if update.Version != tt.expect {
+				t.Errorf("%s: got version %s on the updated object, expect %s", tt.name, update.Version, tt.expect)
+			}
+		} else if update.Version != tt.version {
+			t.Errorf("%s: version of the object is changed by failed update", tt.name)
+		}
+		saved, err := st.Get("pipeline", "p1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Version != tt.expect || string(saved.Data) != data {
+			t.Errorf("%s: got version %s and data %s, expect %s and %s", tt.name, saved.Version, saved.Data, tt.expect, data)
+		}
+	}
+
+	objs, err := st.List("pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].Key != "p1" || objs[0].Name != "p1" {
+		t.Errorf("got objects %+v, expect p1", objs)
+	}
+	if err := st.Delete("pipeline", "p1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Get("pipeline", "p1"); err != store.ErrNotFound {
+		t.Errorf("got error %v on get of deleted key, expect ErrNotFound", err)
+	}
+}
+
+func TestLocalStoreWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := store.NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Create(&store.Object{Kind: "activity", Key: "a/1", Data: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Create(&store.Object{Kind: "activity", Key: "a/1", Data: []byte("again")}); err == nil {
+		t.Errorf("created an existing key")
+	}
+
+	//readers see the whole content of one write or the other during updates
+	data := []string{strings.Repeat("x", 1<<16), strings.Repeat("y", 1<<10)}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := st.Update(&store.Object{Kind: "activity", Key: "a/1", Data: []byte(data[i%2])}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "activity", "a%2F1.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := map[string]interface{}{}
+		if err := json.Unmarshal(b, &record); err != nil {
+			t.Fatalf("read partial content: %v", err)
+		}
+	}
+	wg.Wait()
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "activity"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("got %d files, expect no temp file left", len(files))
+	}
+	obj, err := st.Get("activity", "a/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Data) != data[1] || obj.Version != "101" {
+		t.Errorf("got version %s and %d bytes, expect version 101 and the last write", obj.Version, len(obj.Data))
+	}
+}